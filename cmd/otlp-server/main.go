@@ -1,16 +1,24 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"smelldeadfish/internal/backend"
+	"smelldeadfish/internal/config"
+	"smelldeadfish/internal/health"
 	"smelldeadfish/internal/ingest"
-	ingestduckdb "smelldeadfish/internal/ingest/duckdb"
-	ingestsqlite "smelldeadfish/internal/ingest/sqlite"
+	"smelldeadfish/internal/ingest/archive"
+	"smelldeadfish/internal/ingest/forward"
+	"smelldeadfish/internal/ingest/redact"
+	"smelldeadfish/internal/ingest/sampling"
+	"smelldeadfish/internal/metrics"
 	"smelldeadfish/internal/otlphttp"
 	"smelldeadfish/internal/queryhttp"
 	"smelldeadfish/internal/spanstore"
@@ -18,30 +26,196 @@ import (
 )
 
 func main() {
-	addr := flag.String("addr", ":4318", "listen address")
-	sinkKind := flag.String("sink", "stdout", "trace sink: stdout, sqlite, or duckdb")
-	dbPath := flag.String("db", "./smelldeadfish.sqlite", "sqlite or duckdb database path")
+	configPath := flag.String("config", "", "path to a YAML or TOML (.toml) config file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	mode := flag.String("mode", "ingest", "ingest, or query to serve an existing sqlite or duckdb database read-only")
+	addr := flag.String("addr", ":4318", "listen address (replaces the first listener)")
+	sinkKind := flag.String("sink", "stdout", "trace sink: stdout, memory, sqlite, sqlite-partitioned, duckdb, or file (archive only)")
+	dbPath := flag.String("db", "./smelldeadfish.sqlite", "sqlite or duckdb database path, or partition directory")
+	partitionInterval := flag.Duration("partition-interval", 24*time.Hour, "time range of each sqlite-partitioned database file")
+	retention := flag.Duration("retention", 0, "drop sqlite-partitioned files older than this (0 keeps everything)")
+	memoryMaxSpans := flag.Int("memory-max-spans", 100000, "max spans kept by the memory sink before evicting the oldest traces")
+	memoryMaxBytes := flag.Int64("memory-max-bytes", 0, "max encoded span bytes kept by the memory sink (0 is unbounded)")
 	queueSize := flag.Int("queue-size", 10000, "max queued trace requests for sqlite/duckdb sink before backpressure")
+	queueBatchSize := flag.Int("queue-batch-size", 1, "max queued trace requests merged into one store write")
+	importMaxBytes := flag.Int64("import-max-bytes", 1<<30, "max upload size for /api/import")
 	uiEnabled := flag.Bool("ui", true, "serve embedded UI (requires uiembed build tag)")
+	archiveDir := flag.String("archive", "", "directory to append every request to as rotating OTLP JSON files")
+	tailSampling := flag.Bool("tail-sampling", false, "hold spans received on /v1/traces and keep only error, slow, or matching traces")
+	samplePercent := flag.Float64("sample-percent", 100, "percent of traces received on /v1/traces to keep, chosen by trace ID")
+	forwardEndpoints := flag.String("forward", "", "comma-separated OTLP HTTP endpoints to re-export every request to")
+	sqlEnabled := flag.Bool("sql", false, "serve the read-only /api/sql console (sqlite or duckdb sink)")
 	flag.Parse()
 
+	cfg := config.Default()
+	if *configPath != "" {
+		loaded, err := config.Load(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg = loaded
+	}
+	envErr := cfg.ApplyEnv(os.LookupEnv)
+	// Flags given explicitly on the command line win over file and env.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mode":
+			cfg.Mode = *mode
+		case "addr":
+			if len(cfg.Listeners) == 0 {
+				cfg.Listeners = []config.Listener{{}}
+			}
+			cfg.Listeners[0].Addr = *addr
+		case "sink":
+			cfg.Sink.Kind = *sinkKind
+		case "db":
+			cfg.Sink.Path = *dbPath
+		case "partition-interval":
+			cfg.Sink.PartitionInterval = *partitionInterval
+		case "retention":
+			cfg.Sink.Retention = *retention
+		case "memory-max-spans":
+			cfg.Sink.MaxSpans = *memoryMaxSpans
+		case "memory-max-bytes":
+			cfg.Sink.MaxBytes = *memoryMaxBytes
+		case "queue-size":
+			cfg.Queue.Size = *queueSize
+		case "queue-batch-size":
+			cfg.Queue.BatchSize = *queueBatchSize
+		case "import-max-bytes":
+			cfg.Limits.ImportMaxBytes = *importMaxBytes
+		case "ui":
+			cfg.UI.Enabled = *uiEnabled
+		case "sql":
+			cfg.SQL.Enabled = *sqlEnabled
+		case "archive":
+			cfg.Archive.Dir = *archiveDir
+		case "tail-sampling":
+			cfg.Sampling.Tail.Enabled = *tailSampling
+		case "sample-percent":
+			cfg.Sampling.Percent = *samplePercent
+		case "forward":
+			cfg.Forward.Endpoints = config.SplitList(*forwardEndpoints)
+		}
+	})
+	if err := errors.Join(envErr, cfg.Validate()); err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		payload, err := cfg.Marshal()
+		if err != nil {
+			log.Fatalf("print config: %v", err)
+		}
+		_, _ = os.Stdout.Write(payload)
+		return
+	}
+
+	logger, closeLog, err := openLogger(cfg.Logging)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	log.SetOutput(logger.Writer())
+	var registry *metrics.Registry
+	if cfg.Metrics.Enabled {
+		registry = metrics.NewRegistry()
+	}
+	requestLogger := logger
+	if !cfg.Logging.RequestErrors {
+		requestLogger = nil
+	}
+
 	var sink ingest.TraceSink
 	var handlers queryHandlers
-	logger := log.Default()
-	switch strings.ToLower(strings.TrimSpace(*sinkKind)) {
-	case "stdout":
+	healthOpts := health.Options{Logger: requestLogger}
+	queryOnly := cfg.QueryOnly()
+	switch {
+	case queryOnly:
+		// The store rejects writes; it is only the sink so it gets closed.
+		store, err := backend.OpenReadOnly(cfg.Sink.Kind, cfg.Sink.Path, backend.Options{Metrics: registry, Logger: logger})
+		if err != nil {
+			log.Fatal(err)
+		}
+		sink = store
+		handlers = newQueryHandlers(store, cfg.SQL, requestLogger, registry)
+		healthOpts.Store = store
+	case strings.EqualFold(strings.TrimSpace(cfg.Sink.Kind), "stdout"):
 		sink = ingest.NewStdoutSink(os.Stdout)
+	case strings.EqualFold(strings.TrimSpace(cfg.Sink.Kind), "file"):
+		// The archive set up below is the only sink.
 	default:
-		var err error
-		normalized := strings.TrimSpace(*sinkKind)
-		normalized = strings.ToLower(normalized)
-		sink, handlers, err = setupDBSink(normalized, *dbPath, *queueSize, logger)
+		queue, store, err := setupDBSink(cfg, logger, registry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sink = queue
+		handlers = newQueryHandlers(store, cfg.SQL, requestLogger, registry)
+		healthOpts.Store = store
+		healthOpts.Queue = queue
+	}
+	healthHandler := health.NewHandler(healthOpts)
+	if len(cfg.Routing.Routes) > 0 {
+		router, err := setupRouter(cfg, sink, logger, registry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sink = router
+	}
+	if strings.TrimSpace(cfg.Archive.Dir) != "" {
+		archiver, err := archive.NewWithOptions(cfg.Archive.Dir, archive.Options{
+			Format:   cfg.Archive.Format,
+			MaxBytes: cfg.Archive.MaxBytes,
+			MaxAge:   cfg.Archive.MaxAge,
+			Compress: cfg.Archive.Compress,
+			MaxFiles: cfg.Archive.MaxFiles,
+			Logger:   logger,
+			Metrics:  registry,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sink == nil {
+			sink = archiver
+		} else {
+			sink = ingest.NewMultiSink(sink, archiver)
+		}
+	}
+	if len(cfg.Forward.Endpoints) > 0 {
+		forwarder, err := forward.NewWithOptions(cfg.Forward.Endpoints, forward.Options{
+			Headers:       cfg.Forward.Headers,
+			Compression:   cfg.Forward.Compression,
+			BatchSpans:    cfg.Forward.BatchSpans,
+			FlushInterval: cfg.Forward.FlushInterval,
+			BufferSpans:   cfg.Forward.BufferSpans,
+			Timeout:       cfg.Forward.Timeout,
+			MaxRetryTime:  cfg.Forward.MaxRetryTime,
+			Logger:        logger,
+			Metrics:       registry,
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
+		// Requests the local sink rejects are not forwarded either, so a
+		// client retry does not duplicate them upstream.
+		sink = ingest.NewMultiSink(sink, forwarder)
 	}
 
-	if closer, ok := sink.(interface{ Close() error }); ok {
+	// Only the receiver is sampled; imports are kept whole. The samplers
+	// close the sink behind them, so closing otlpSink closes everything.
+	otlpSink, err := setupSampling(cfg.Sampling, sink, logger, registry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	importSink := sink
+	if len(cfg.Redaction.Rules) > 0 {
+		if otlpSink, err = setupRedaction(cfg.Redaction, otlpSink, registry); err != nil {
+			log.Fatal(err)
+		}
+		if importSink, err = setupRedaction(cfg.Redaction, sink, registry); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if closer, ok := otlpSink.(interface{ Close() error }); ok {
 		defer func() {
 			if err := closer.Close(); err != nil {
 				log.Printf("close sink: %v", err)
@@ -49,33 +223,84 @@ func main() {
 		}()
 	}
 
-	otlpHandler := otlphttp.NewHandler(sink, otlphttp.Options{Logger: logger})
-	mux := http.NewServeMux()
-	mux.Handle("/v1/traces", otlpHandler)
-	if handlers.spans != nil {
-		mux.Handle("/api/spans", handlers.spans)
-		mux.Handle("/api/traces", handlers.traces)
-		mux.Handle("/api/traces/", handlers.traceDetail)
-	}
-	if *uiEnabled {
+	otlpHandler := otlphttp.NewHandler(otlpSink, otlphttp.Options{MaxBodyBytes: cfg.Limits.MaxBodyBytes, Logger: requestLogger, Metrics: registry})
+	importHandler := otlphttp.NewImportHandler(importSink, otlphttp.ImportOptions{MaxBodyBytes: cfg.Limits.ImportMaxBytes, Logger: requestLogger, Metrics: registry})
+	var uiHandler http.Handler
+	if cfg.UI.Enabled {
 		if uiembed.Available() {
-			uiHandler, err := uiembed.NewHandler("/ui")
+			handler, err := uiembed.NewHandler("/ui")
 			if err != nil {
 				log.Printf("ui handler unavailable: %v", err)
 			} else {
-				for _, path := range []string{"/ui/", "/ui"} {
-					mux.Handle(path, http.StripPrefix("/ui", uiHandler))
-				}
+				uiHandler = http.StripPrefix("/ui", handler)
 			}
 		} else {
 			log.Printf("ui disabled: rebuild with -tags uiembed to embed the UI")
 		}
 	}
 
-	server := &http.Server{Addr: *addr, Handler: mux}
-	log.Printf("OTLP HTTP receiver listening on %s", *addr)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("server error: %v", err)
+	errs := make(chan error, len(cfg.Listeners))
+	for _, listener := range cfg.Listeners {
+		mux := http.NewServeMux()
+		if listener.Serves(config.RouteOTLP) && !queryOnly {
+			mux.Handle("/v1/traces", otlpHandler)
+		}
+		if listener.Serves(config.RouteImport) && !queryOnly {
+			mux.Handle("/api/import", importHandler)
+		}
+		if listener.Serves(config.RouteQuery) && handlers.spans != nil {
+			mux.Handle("/api/spans", handlers.spans)
+			mux.Handle("/api/traces", handlers.traces)
+			mux.Handle("/api/traces/", handlers.traceDetail)
+			mux.Handle("/api/export", handlers.export)
+			mux.Handle("/tempo/", http.StripPrefix("/tempo", handlers.tempo))
+			if handlers.sql != nil {
+				mux.Handle("/api/sql", handlers.sql)
+			}
+		}
+		if listener.Serves(config.RouteHealth) {
+			mux.Handle("/healthz", healthHandler)
+			mux.Handle("/readyz", healthHandler)
+		}
+		if listener.Serves(config.RouteMetrics) && registry != nil {
+			mux.Handle("/metrics", registry)
+		}
+		if listener.Serves(config.RouteUI) && uiHandler != nil {
+			for _, path := range []string{"/ui/", "/ui"} {
+				mux.Handle(path, uiHandler)
+			}
+		}
+
+		server := &http.Server{Addr: listener.Addr, Handler: mux}
+		if queryOnly {
+			log.Printf("query server listening on %s", listener.Addr)
+		} else {
+			log.Printf("OTLP HTTP receiver listening on %s", listener.Addr)
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errs <- fmt.Errorf("server error on %s: %w", server.Addr, err)
+			}
+		}()
+	}
+	if err := <-errs; err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func openLogger(cfg config.LoggingConfig) (*log.Logger, func(), error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.Output)) {
+	case "", "stderr":
+		return log.Default(), func() {}, nil
+	case "stdout":
+		return log.New(os.Stdout, "", log.LstdFlags), func() {}, nil
+	default:
+		file, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open log output: %w", err)
+		}
+		return log.New(file, "", log.LstdFlags), func() { _ = file.Close() }, nil
 	}
 }
 
@@ -83,41 +308,126 @@ type queryHandlers struct {
 	spans       http.Handler
 	traces      http.Handler
 	traceDetail http.Handler
+	tempo       http.Handler
+	export      http.Handler
+	// sql is nil unless the console is enabled.
+	sql http.Handler
 }
 
-func newQueryHandlers(store spanstore.Store, logger *log.Logger) queryHandlers {
-	opts := queryhttp.Options{Logger: logger}
-	return queryHandlers{
+func newQueryHandlers(store spanstore.Store, sqlCfg config.SQLConfig, logger *log.Logger, registry *metrics.Registry) queryHandlers {
+	opts := queryhttp.Options{Logger: logger, Metrics: registry}
+	handlers := queryHandlers{
 		spans:       queryhttp.NewHandlerWithOptions(store, opts),
 		traces:      queryhttp.NewTracesHandlerWithOptions(store, opts),
 		traceDetail: queryhttp.NewTraceDetailHandlerWithOptions(store, opts),
+		tempo:       queryhttp.NewTempoHandlerWithOptions(store, opts),
+		export:      queryhttp.NewExportHandlerWithOptions(store, opts),
+	}
+	if sqlCfg.Enabled {
+		handlers.sql = queryhttp.NewSQLHandlerWithOptions(store, queryhttp.SQLOptions{
+			Timeout: sqlCfg.Timeout,
+			MaxRows: sqlCfg.MaxRows,
+			Logger:  logger,
+			Metrics: registry,
+		})
 	}
+	return handlers
 }
 
-func setupDBSink(kind, dbPath string, queueSize int, logger *log.Logger) (ingest.TraceSink, queryHandlers, error) {
-	if strings.TrimSpace(dbPath) == "" {
-		return nil, queryHandlers{}, fmt.Errorf("db path is required for %s sink", kind)
+// setupRouter opens the extra routing sinks and splits requests between them
+// and main. They are left out of metrics, which would otherwise mix their
+// queue and store series with those of main.
+func setupRouter(cfg config.Config, mainSink ingest.TraceSink, logger *log.Logger, registry *metrics.Registry) (*ingest.Router, error) {
+	sinks := map[string]ingest.TraceSink{config.MainSink: mainSink}
+	closeAll := func() {
+		for _, sink := range sinks {
+			if closer, ok := sink.(interface{ Close() error }); ok {
+				_ = closer.Close()
+			}
+		}
 	}
-
-	switch kind {
-	case "sqlite":
-		sqliteSink, err := ingestsqlite.New(dbPath)
+	for name, sinkCfg := range cfg.Routing.Sinks {
+		if strings.EqualFold(strings.TrimSpace(sinkCfg.Kind), "stdout") {
+			sinks[name] = ingest.NewStdoutSink(os.Stdout)
+			continue
+		}
+		routedCfg := cfg
+		routedCfg.Sink = sinkCfg
+		queue, _, err := setupDBSink(routedCfg, logger, nil)
 		if err != nil {
-			return nil, queryHandlers{}, fmt.Errorf("open sqlite: %w", err)
+			closeAll()
+			return nil, fmt.Errorf("routing sink %s: %w", name, err)
 		}
-		sink := ingest.NewQueueSink(sqliteSink, ingest.QueueOptions{Size: queueSize, Logger: logger})
-		return sink, newQueryHandlers(sqliteSink, logger), nil
-	case "duckdb":
-		if !ingestduckdb.Available() {
-			return nil, queryHandlers{}, fmt.Errorf("duckdb support unavailable: rebuild with CGO_ENABLED=1")
+		sinks[name] = queue
+	}
+	routes := make([]ingest.Route, 0, len(cfg.Routing.Routes))
+	for _, route := range cfg.Routing.Routes {
+		routes = append(routes, ingest.Route{Sink: route.Sink, Service: route.Service, Resource: route.Resource, Span: route.Span})
+	}
+	router, err := ingest.NewRouter(sinks, routes, ingest.RouterOptions{Default: cfg.Routing.Default, Metrics: registry})
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return router, nil
+}
+
+// setupSampling wraps sink in the tail sampler, then the head sampler, when
+// they are configured.
+func setupSampling(cfg config.SamplingConfig, sink ingest.TraceSink, logger *log.Logger, registry *metrics.Registry) (ingest.TraceSink, error) {
+	if cfg.Tail.Enabled {
+		tail, err := sampling.NewTail(sink, sampling.TailOptions{
+			DecisionWait:    cfg.Tail.DecisionWait,
+			KeepErrors:      cfg.Tail.KeepErrors,
+			MinDuration:     cfg.Tail.MinDuration,
+			Attributes:      cfg.Tail.Attributes,
+			BaselinePercent: cfg.Tail.BaselinePercent,
+			MaxSpans:        cfg.Tail.MaxSpans,
+			Logger:          logger,
+			Metrics:         registry,
+		})
+		if err != nil {
+			return nil, err
 		}
-		duckdbSink, err := ingestduckdb.New(dbPath)
+		sink = tail
+	}
+	if cfg.Percent < 100 || len(cfg.RateLimits) > 0 {
+		head, err := sampling.NewHead(sink, sampling.HeadOptions{
+			Percent:    cfg.Percent,
+			RateLimits: cfg.RateLimits,
+			Metrics:    registry,
+		})
 		if err != nil {
-			return nil, queryHandlers{}, fmt.Errorf("open duckdb: %w", err)
+			return nil, err
 		}
-		sink := ingest.NewQueueSink(duckdbSink, ingest.QueueOptions{Size: queueSize, Logger: logger})
-		return sink, newQueryHandlers(duckdbSink, logger), nil
-	default:
-		return nil, queryHandlers{}, fmt.Errorf("unknown sink: %s", kind)
+		sink = head
+	}
+	return sink, nil
+}
+
+// setupRedaction wraps sink, the samplers for received spans or the sinks
+// behind them for imports, so raw values never reach a sampler's buffer or
+// policies, a store, an archive, or an upstream.
+func setupRedaction(cfg config.RedactionConfig, sink ingest.TraceSink, registry *metrics.Registry) (ingest.TraceSink, error) {
+	rules := make([]redact.Rule, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		rules = append(rules, redact.Rule{Action: rule.Action, Keys: rule.Keys, Pattern: rule.Pattern, Replacement: rule.Replacement})
+	}
+	return redact.NewWithOptions(sink, redact.Options{Rules: rules, HashKey: cfg.HashKey, Metrics: registry})
+}
+
+func setupDBSink(cfg config.Config, logger *log.Logger, registry *metrics.Registry) (*ingest.QueueSink, backend.Store, error) {
+	store, err := backend.OpenWithOptions(cfg.Sink.Kind, cfg.Sink.Path, backend.Options{
+		Metrics:           registry,
+		Logger:            logger,
+		PartitionInterval: cfg.Sink.PartitionInterval,
+		Retention:         cfg.Sink.Retention,
+		MaxSpans:          cfg.Sink.MaxSpans,
+		MaxBytes:          cfg.Sink.MaxBytes,
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	queue := ingest.NewQueueSink(store, ingest.QueueOptions{Size: cfg.Queue.Size, BatchSize: cfg.Queue.BatchSize, Logger: logger, Metrics: registry})
+	return queue, store, nil
 }
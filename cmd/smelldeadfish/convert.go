@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"smelldeadfish/internal/backend"
+	"smelldeadfish/internal/convert"
+	"smelldeadfish/internal/spanstore"
+)
+
+func runConvert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	from := flags.String("from", "", "source store as kind:path (sqlite, sqlite-partitioned, or duckdb)")
+	to := flags.String("to", "", "destination store as kind:path (sqlite, sqlite-partitioned, or duckdb)")
+	startRaw := flags.String("start", "", "only copy spans starting at or after this time (RFC3339 or unix nanoseconds)")
+	endRaw := flags.String("end", "", "only copy spans starting at or before this time (RFC3339 or unix nanoseconds)")
+	batchSize := flags.Int("batch-size", 1000, "spans read and written per batch")
+	statePath := flags.String("state", "", "progress file used to resume an interrupted run (default <to path>.convert-state.json)")
+	restart := flags.Bool("restart", false, "ignore an existing progress file and start over")
+	quiet := flags.Bool("quiet", false, "suppress progress output")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: smelldeadfish convert -from kind:path -to kind:path [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+	srcKind, srcPath, err := parseStoreSpec("from", *from)
+	if err != nil {
+		return err
+	}
+	dstKind, dstPath, err := parseStoreSpec("to", *to)
+	if err != nil {
+		return err
+	}
+	if sameFile(srcPath, dstPath) {
+		return errors.New("source and destination must differ")
+	}
+	start, err := parseTimeFlag("start", *startRaw)
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeFlag("end", *endRaw)
+	if err != nil {
+		return err
+	}
+	if *statePath == "" {
+		*statePath = strings.TrimRight(dstPath, string(filepath.Separator)) + ".convert-state.json"
+	}
+
+	state := convertState{From: srcKind + ":" + srcPath, To: dstKind + ":" + dstPath, Start: start, End: end}
+	if !*restart {
+		saved, err := loadConvertState(*statePath)
+		if err != nil {
+			return err
+		}
+		if saved != nil {
+			if saved.From != state.From || saved.To != state.To || saved.Start != state.Start || saved.End != state.End {
+				return fmt.Errorf("progress file %s is for a different conversion; use -restart to discard it", *statePath)
+			}
+			state = *saved
+		}
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	src, err := openSource(srcKind, srcPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			logger.Printf("close source: %v", err)
+		}
+	}()
+	exporter, ok := src.(spanstore.ExportStore)
+	if !ok {
+		return fmt.Errorf("%s store does not support export", srcKind)
+	}
+	dst, err := backend.Open(dstKind, dstPath)
+	if err != nil {
+		return err
+	}
+	dstClosed := false
+	defer func() {
+		if dstClosed {
+			return
+		}
+		if err := dst.Close(); err != nil {
+			logger.Printf("close destination: %v", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if !*quiet && state.Cursor != nil {
+		fmt.Fprintf(os.Stderr, "resuming after %d spans\n", state.Spans)
+	}
+	began, last := time.Now(), time.Now()
+	resumed := state.Spans
+	progress, err := convert.Run(ctx, exporter, dst, convert.Options{
+		Start:     start,
+		End:       end,
+		BatchSize: *batchSize,
+		After:     state.Cursor,
+		Checkpoint: func(p convert.Progress) error {
+			state.Cursor = p.Cursor
+			state.Spans = resumed + p.Spans
+			if err := saveConvertState(*statePath, state); err != nil {
+				return err
+			}
+			if !*quiet && time.Since(last) >= time.Second {
+				last = time.Now()
+				fmt.Fprintf(os.Stderr, "%s: %d spans copied, at %s\n", state.To, state.Spans, formatCursorTime(p.Cursor))
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		if !*quiet && state.Cursor != nil {
+			fmt.Fprintf(os.Stderr, "stopped after %d spans; rerun the same command to resume\n", state.Spans)
+		}
+		return err
+	}
+	dstClosed = true
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("close destination: %w", err)
+	}
+	if err := os.Remove(*statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove progress file: %w", err)
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "%s: copied %d spans in %d batches in %s\n", state.To, resumed+progress.Spans, progress.Pages, time.Since(began).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// convertState is persisted after every batch so an interrupted conversion
+// can continue from the last span written.
+type convertState struct {
+	From   string                  `json:"from"`
+	To     string                  `json:"to"`
+	Start  int64                   `json:"start,omitempty"`
+	End    int64                   `json:"end,omitempty"`
+	Spans  int64                   `json:"spans"`
+	Cursor *spanstore.ExportCursor `json:"cursor,omitempty"`
+}
+
+func loadConvertState(path string) (*convertState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read progress file: %w", err)
+	}
+	var state convertState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse progress file %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+func saveConvertState(path string, state convertState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode progress: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write progress file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write progress file: %w", err)
+	}
+	return nil
+}
+
+func parseStoreSpec(name, raw string) (string, string, error) {
+	kind, path, ok := strings.Cut(strings.TrimSpace(raw), ":")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if !ok || kind == "" || strings.TrimSpace(path) == "" {
+		return "", "", fmt.Errorf("-%s must be kind:path, got %q", name, raw)
+	}
+	switch kind {
+	case "sqlite", "sqlite-partitioned", "duckdb":
+		return kind, path, nil
+	default:
+		return "", "", fmt.Errorf("-%s: unsupported store %q (want sqlite, sqlite-partitioned, or duckdb)", name, kind)
+	}
+}
+
+// openSource opens a store that is only read from. sqlite and duckdb are
+// opened read-only; the other kinds cannot be, so they must already exist
+// rather than be created empty.
+func openSource(kind, path string) (backend.Store, error) {
+	switch kind = strings.ToLower(strings.TrimSpace(kind)); kind {
+	case "sqlite", "duckdb":
+		return backend.OpenReadOnly(kind, path, backend.Options{})
+	case "memory":
+		return nil, errors.New("memory store has nothing to read")
+	default:
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("open %s: %w", kind, err)
+		}
+		return backend.Open(kind, path)
+	}
+}
+
+func parseTimeFlag(name, raw string) (int64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	if value, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return value, nil
+	}
+	value, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return 0, fmt.Errorf("-%s must be RFC3339 or unix nanoseconds, got %q", name, raw)
+	}
+	return value.UnixNano(), nil
+}
+
+func sameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return absA == absB
+}
+
+func formatCursorTime(cursor *spanstore.ExportCursor) string {
+	if cursor == nil {
+		return "start"
+	}
+	return time.Unix(0, cursor.StartTimeUnixNano).UTC().Format(time.RFC3339)
+}
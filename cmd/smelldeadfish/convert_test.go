@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/backend"
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestConvertReadsExistingSource(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.sqlite")
+	dst := filepath.Join(dir, "dst.sqlite")
+	store, err := backend.Open("sqlite", src)
+	if err != nil {
+		t.Fatalf("open source: %v", err)
+	}
+	span := &tracepb.Span{TraceId: make([]byte, 16), SpanId: []byte{0, 0, 0, 0, 0, 0, 0, 1}, Name: "op", StartTimeUnixNano: 1, EndTimeUnixNano: 2}
+	span.TraceId[15] = 1
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{span}}}}}}
+	if err := store.Consume(context.Background(), req); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close source: %v", err)
+	}
+
+	if err := runConvert([]string{"-quiet", "-from", "sqlite:" + src, "-to", "sqlite:" + dst}); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	out, err := backend.OpenReadOnly("sqlite", dst, backend.Options{})
+	if err != nil {
+		t.Fatalf("open destination: %v", err)
+	}
+	defer out.Close()
+	page, err := out.(spanstore.ExportStore).ExportSpans(context.Background(), spanstore.ExportParams{Limit: 10})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if page.Spans != 1 {
+		t.Fatalf("expected 1 span copied, got %d", page.Spans)
+	}
+}
+
+func TestConvertRejectsMissingSource(t *testing.T) {
+	for _, kind := range []string{"sqlite", "sqlite-partitioned"} {
+		dir := t.TempDir()
+		src := filepath.Join(dir, "typo.sqlite")
+		dst := filepath.Join(dir, "out.sqlite")
+		err := runConvert([]string{"-quiet", "-from", kind + ":" + src, "-to", "sqlite:" + dst})
+		if err == nil {
+			t.Fatalf("%s: expected error for a missing source", kind)
+		}
+		if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s: expected the source to stay missing, got %v", kind, err)
+		}
+	}
+}
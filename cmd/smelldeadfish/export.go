@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"smelldeadfish/internal/parquetexport"
+	"smelldeadfish/internal/spanstore"
+)
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	sinkKind := flags.String("sink", "sqlite", "database kind: sqlite, sqlite-partitioned, or duckdb")
+	dbPath := flags.String("db", "./smelldeadfish.sqlite", "sqlite or duckdb database path, or partition directory")
+	service := flags.String("service", "", "only export spans from this service")
+	startRaw := flags.String("start", "", "only export spans starting at or after this time (RFC3339 or unix nanoseconds)")
+	endRaw := flags.String("end", "", "only export spans starting at or before this time (RFC3339 or unix nanoseconds)")
+	out := flags.String("out", "", "Parquet file to write")
+	quiet := flags.Bool("quiet", false, "suppress progress output")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: smelldeadfish export -out spans.parquet [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+	if strings.TrimSpace(*out) == "" {
+		flags.Usage()
+		return errors.New("-out is required")
+	}
+	if strings.EqualFold(strings.TrimSpace(*sinkKind), "memory") {
+		return errors.New("memory sink has nothing to export")
+	}
+	start, err := parseTimeFlag("start", *startRaw)
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeFlag("end", *endRaw)
+	if err != nil {
+		return err
+	}
+	if start > 0 && end > 0 && end < start {
+		return errors.New("-end must not be before -start")
+	}
+
+	store, err := openSource(*sinkKind, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Printf("close store: %v", err)
+		}
+	}()
+	exporter, ok := store.(spanstore.ExportStore)
+	if !ok {
+		return fmt.Errorf("%s store does not support export", *sinkKind)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	began := time.Now()
+	spans, err := parquetexport.WriteFile(ctx, exporter, *out, spanstore.ExportParams{
+		Service: strings.TrimSpace(*service),
+		Start:   start,
+		End:     end,
+	})
+	if err != nil {
+		return fmt.Errorf("export %s: %w", *out, err)
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "%s: exported %d spans in %s\n", *out, spans, time.Since(began).Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportRejectsMissingDatabase(t *testing.T) {
+	for _, kind := range []string{"sqlite", "sqlite-partitioned"} {
+		dir := t.TempDir()
+		db := filepath.Join(dir, "typo.sqlite")
+		err := runExport([]string{"-quiet", "-sink", kind, "-db", db, "-out", filepath.Join(dir, "spans.parquet")})
+		if err == nil {
+			t.Fatalf("%s: expected error for a missing database", kind)
+		}
+		if _, err := os.Stat(db); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s: expected the database to stay missing, got %v", kind, err)
+		}
+	}
+}
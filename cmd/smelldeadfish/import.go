@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/backend"
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/otlpfile"
+)
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	sinkKind := flags.String("sink", "sqlite", "trace sink: stdout, sqlite, sqlite-partitioned, or duckdb")
+	dbPath := flags.String("db", "./smelldeadfish.sqlite", "sqlite or duckdb database path, or partition directory")
+	formatRaw := flags.String("format", "auto", "input format: auto, json, proto, or proto-varint")
+	rebase := flags.Bool("rebase", false, "shift timestamps so the latest span ends now")
+	queueSize := flags.Int("queue-size", 10000, "max queued trace requests before backpressure")
+	queueBatchSize := flags.Int("queue-batch-size", 64, "max queued trace requests merged into one store write")
+	quiet := flags.Bool("quiet", false, "suppress progress output")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: smelldeadfish import [flags] <file>... (use - for stdin)")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("at least one input file is required")
+	}
+	format, err := otlpfile.ParseFormat(*formatRaw)
+	if err != nil {
+		return err
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	var sink ingest.TraceSink
+	var queue *ingest.QueueSink
+	writes := &writeTracker{}
+	if strings.EqualFold(strings.TrimSpace(*sinkKind), "stdout") {
+		sink = ingest.NewStdoutSink(os.Stdout)
+	} else {
+		store, err := backend.Open(*sinkKind, *dbPath)
+		if err != nil {
+			return err
+		}
+		// The queue only logs failed writes, so the tracker records them
+		// for the exit status.
+		writes.next = store
+		queue = ingest.NewQueueSink(writes, ingest.QueueOptions{Size: *queueSize, BatchSize: *queueBatchSize, Logger: logger})
+		defer func() {
+			if err := queue.Close(); err != nil {
+				logger.Printf("close sink: %v", err)
+			}
+		}()
+		sink = queue
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var total otlpfile.Progress
+	for _, path := range flags.Args() {
+		open, cleanup, err := inputOpener(path, *rebase)
+		if err != nil {
+			return err
+		}
+		reporter := newProgressReporter(path, *quiet)
+		progress, err := otlpfile.Import(ctx, sink, open, otlpfile.ImportOptions{
+			Format:   format,
+			Rebase:   *rebase,
+			Progress: reporter.update,
+		})
+		cleanup()
+		reporter.finish(progress)
+		total.Requests += progress.Requests
+		total.Spans += progress.Spans
+		total.BytesRead += progress.BytesRead
+		if err != nil {
+			return fmt.Errorf("import %s: %w", path, err)
+		}
+	}
+	if queue != nil {
+		if err := queue.Close(); err != nil {
+			return fmt.Errorf("close sink: %w", err)
+		}
+		if failed, err := writes.failures(); failed > 0 {
+			return fmt.Errorf("%d of %d spans were not written: %w", failed, total.Spans, err)
+		}
+	}
+	if !*quiet && flags.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "total: %d requests, %d spans\n", total.Requests, total.Spans)
+	}
+	return nil
+}
+
+// writeTracker passes requests to the store and remembers how many spans it
+// rejected, along with the first error.
+type writeTracker struct {
+	next ingest.TraceSink
+
+	mu     sync.Mutex
+	failed int64
+	first  error
+}
+
+func (w *writeTracker) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	err := w.next.Consume(ctx, req)
+	if err != nil {
+		w.mu.Lock()
+		w.failed += int64(ingest.CountSpans(req.GetResourceSpans()...))
+		if w.first == nil {
+			w.first = err
+		}
+		w.mu.Unlock()
+	}
+	return err
+}
+
+func (w *writeTracker) Close() error {
+	if closer, ok := w.next.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (w *writeTracker) failures() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.failed, w.first
+}
+
+// inputOpener returns a reopenable source for path. Stdin can only be read
+// once, so it is spooled to a temporary file when rebasing needs two passes.
+func inputOpener(path string, rebase bool) (otlpfile.Opener, func(), error) {
+	if path != "-" {
+		return func() (io.ReadCloser, error) { return os.Open(path) }, func() {}, nil
+	}
+	if !rebase {
+		return func() (io.ReadCloser, error) { return io.NopCloser(os.Stdin), nil }, func() {}, nil
+	}
+	file, err := os.CreateTemp("", "smelldeadfish-import-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create spool file: %w", err)
+	}
+	cleanup := func() { _ = os.Remove(file.Name()) }
+	if _, err := io.Copy(file, os.Stdin); err != nil {
+		_ = file.Close()
+		cleanup()
+		return nil, nil, fmt.Errorf("read stdin: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("close spool file: %w", err)
+	}
+	return func() (io.ReadCloser, error) { return os.Open(file.Name()) }, cleanup, nil
+}
+
+type progressReporter struct {
+	path  string
+	quiet bool
+	start time.Time
+	last  time.Time
+}
+
+func newProgressReporter(path string, quiet bool) *progressReporter {
+	now := time.Now()
+	return &progressReporter{path: path, quiet: quiet, start: now, last: now}
+}
+
+func (p *progressReporter) update(progress otlpfile.Progress) {
+	if p.quiet || time.Since(p.last) < time.Second {
+		return
+	}
+	p.last = time.Now()
+	fmt.Fprintf(os.Stderr, "%s: %d requests, %d spans, %s read\n", p.path, progress.Requests, progress.Spans, formatBytes(progress.BytesRead))
+}
+
+func (p *progressReporter) finish(progress otlpfile.Progress) {
+	if p.quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: imported %d requests, %d spans (%s) in %s\n", p.path, progress.Requests, progress.Spans, formatBytes(progress.BytesRead), time.Since(p.start).Round(time.Millisecond))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for value := n / unit; value >= unit; value /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
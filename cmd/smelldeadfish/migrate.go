@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"smelldeadfish/internal/backend"
+	"smelldeadfish/internal/migrate"
+)
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	sinkKind := flags.String("sink", "sqlite", "database kind: sqlite, sqlite-partitioned, or duckdb")
+	dbPath := flags.String("db", "./smelldeadfish.sqlite", "sqlite or duckdb database path, or partition directory")
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: smelldeadfish migrate [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	kind, paths := *sinkKind, []string{*dbPath}
+	if strings.EqualFold(strings.TrimSpace(kind), "sqlite-partitioned") {
+		files, err := backend.PartitionFiles(*dbPath)
+		if err != nil {
+			return err
+		}
+		kind, paths = "sqlite", files
+	}
+	for _, path := range paths {
+		plan, err := backend.Migrate(context.Background(), kind, path, *dryRun)
+		if err != nil {
+			return err
+		}
+		printPlan(os.Stdout, path, plan, *dryRun)
+	}
+	return nil
+}
+
+func printPlan(w io.Writer, path string, plan migrate.Plan, dryRun bool) {
+	fmt.Fprintf(w, "%s: schema version %d, latest %d\n", path, plan.Current, plan.Latest)
+	if len(plan.Pending) == 0 {
+		fmt.Fprintln(w, "schema is up to date")
+		return
+	}
+	for _, migration := range plan.Pending {
+		fmt.Fprintf(w, "  %3d  %s\n", migration.Version, migration.Name)
+	}
+	if dryRun {
+		fmt.Fprintf(w, "dry run: %d pending migration(s) not applied\n", len(plan.Pending))
+		return
+	}
+	fmt.Fprintf(w, "applied %d migration(s)\n", len(plan.Pending))
+}
@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"smelldeadfish/internal/ingest"
+	ingestduckdb "smelldeadfish/internal/ingest/duckdb"
+	ingestmemory "smelldeadfish/internal/ingest/memory"
+	ingestsqlite "smelldeadfish/internal/ingest/sqlite"
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/migrate"
+	"smelldeadfish/internal/spanstore"
+)
+
+// Store is a persistent backend that both ingests and serves traces.
+type Store interface {
+	ingest.TraceSink
+	spanstore.Store
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+type Options struct {
+	Metrics *metrics.Registry
+	Logger  *log.Logger
+	// PartitionInterval and Retention configure the sqlite-partitioned sink.
+	PartitionInterval time.Duration
+	Retention         time.Duration
+	// MaxSpans and MaxBytes bound the memory sink.
+	MaxSpans int
+	MaxBytes int64
+}
+
+func Open(kind, path string) (Store, error) {
+	return OpenWithOptions(kind, path, Options{})
+}
+
+func OpenWithOptions(kind, path string, opts Options) (Store, error) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if kind == "memory" {
+		return ingestmemory.NewWithOptions(ingestmemory.Options{Metrics: opts.Metrics, MaxSpans: opts.MaxSpans, MaxBytes: opts.MaxBytes}), nil
+	}
+	if strings.TrimSpace(path) == "" {
+		return nil, fmt.Errorf("db path is required for %s sink", kind)
+	}
+	switch kind {
+	case "sqlite":
+		store, err := ingestsqlite.NewWithOptions(path, ingestsqlite.Options{Metrics: opts.Metrics})
+		if err != nil {
+			return nil, fmt.Errorf("open sqlite: %w", err)
+		}
+		return store, nil
+	case "sqlite-partitioned":
+		store, err := ingestsqlite.NewPartitionedWithOptions(path, ingestsqlite.PartitionOptions{
+			Metrics:   opts.Metrics,
+			Logger:    opts.Logger,
+			Interval:  opts.PartitionInterval,
+			Retention: opts.Retention,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open partitioned sqlite: %w", err)
+		}
+		return store, nil
+	case "duckdb":
+		if !ingestduckdb.Available() {
+			return nil, fmt.Errorf("duckdb support unavailable: rebuild with CGO_ENABLED=1")
+		}
+		store, err := ingestduckdb.NewWithOptions(path, ingestduckdb.Options{Metrics: opts.Metrics, Logger: opts.Logger})
+		if err != nil {
+			return nil, fmt.Errorf("open duckdb: %w", err)
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown sink: %s", kind)
+	}
+}
+
+// OpenReadOnly opens an existing sqlite or duckdb database for queries
+// only. The returned store rejects Consume.
+func OpenReadOnly(kind, path string, opts Options) (Store, error) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if strings.TrimSpace(path) == "" {
+		return nil, fmt.Errorf("db path is required for %s sink", kind)
+	}
+	switch kind {
+	case "sqlite":
+		store, err := ingestsqlite.OpenReadOnly(path, ingestsqlite.Options{Metrics: opts.Metrics})
+		if err != nil {
+			return nil, fmt.Errorf("open sqlite read-only: %w", err)
+		}
+		return store, nil
+	case "duckdb":
+		if !ingestduckdb.Available() {
+			return nil, fmt.Errorf("duckdb support unavailable: rebuild with CGO_ENABLED=1")
+		}
+		store, err := ingestduckdb.OpenReadOnly(path, ingestduckdb.Options{Metrics: opts.Metrics, Logger: opts.Logger})
+		if err != nil {
+			return nil, fmt.Errorf("open duckdb read-only: %w", err)
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("%s sink cannot be opened read-only", kind)
+	}
+}
+
+// PartitionFiles lists the database files of a sqlite-partitioned store, so
+// each can be migrated as a sqlite database.
+func PartitionFiles(dir string) ([]string, error) {
+	return ingestsqlite.PartitionFiles(dir)
+}
+
+// Migrate applies pending schema migrations to the database at path. With
+// dryRun it only reports them. Opening a store migrates automatically; this
+// is for upgrading ahead of time or inspecting a file.
+func Migrate(ctx context.Context, kind, path string, dryRun bool) (migrate.Plan, error) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if kind == "memory" {
+		return migrate.Plan{}, fmt.Errorf("memory sink has no schema to migrate")
+	}
+	if strings.TrimSpace(path) == "" {
+		return migrate.Plan{}, fmt.Errorf("db path is required for %s sink", kind)
+	}
+	switch kind {
+	case "sqlite":
+		return ingestsqlite.Migrate(ctx, path, dryRun)
+	case "duckdb":
+		if !ingestduckdb.Available() {
+			return migrate.Plan{}, fmt.Errorf("duckdb support unavailable: rebuild with CGO_ENABLED=1")
+		}
+		return ingestduckdb.Migrate(ctx, path, dryRun)
+	default:
+		return migrate.Plan{}, fmt.Errorf("unknown sink: %s", kind)
+	}
+}
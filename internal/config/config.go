@@ -0,0 +1,671 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RouteOTLP    = "otlp"
+	RouteImport  = "import"
+	RouteQuery   = "query"
+	RouteUI      = "ui"
+	RouteMetrics = "metrics"
+	RouteHealth  = "health"
+
+	EnvPrefix = "SMELLDEADFISH_"
+
+	ModeIngest = "ingest"
+	ModeQuery  = "query"
+
+	// MainSink and DropSink are the reserved route targets for the sink
+	// section and for discarding spans.
+	MainSink = "main"
+	DropSink = "drop"
+)
+
+var allRoutes = []string{RouteOTLP, RouteImport, RouteQuery, RouteUI, RouteMetrics, RouteHealth}
+
+var sinkKinds = map[string]bool{
+	"stdout":             true,
+	"memory":             true,
+	"sqlite":             true,
+	"sqlite-partitioned": true,
+	"duckdb":             true,
+	"file":               true,
+}
+
+type Config struct {
+	// Mode is ingest, or query to open an existing sqlite or duckdb database
+	// read-only and serve only the query, UI, SQL, health, and metrics routes.
+	Mode      string          `yaml:"mode"`
+	Listeners []Listener      `yaml:"listeners"`
+	Sink      SinkConfig      `yaml:"sink"`
+	Queue     QueueConfig     `yaml:"queue"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	Logging   LoggingConfig   `yaml:"logging"`
+	UI        UIConfig        `yaml:"ui"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	SQL       SQLConfig       `yaml:"sql"`
+	Forward   ForwardConfig   `yaml:"forward"`
+	Archive   ArchiveConfig   `yaml:"archive"`
+	Routing   RoutingConfig   `yaml:"routing"`
+	Sampling  SamplingConfig  `yaml:"sampling"`
+	Redaction RedactionConfig `yaml:"redaction"`
+}
+
+// Listener is one HTTP address and the route groups it serves, so ingest and
+// query traffic can be split across ports. An empty Routes serves everything.
+type Listener struct {
+	Addr   string   `yaml:"addr"`
+	Routes []string `yaml:"routes,omitempty"`
+}
+
+type SinkConfig struct {
+	Kind string `yaml:"kind"`
+	// Path is the database file, or the directory of a sqlite-partitioned
+	// sink.
+	Path string `yaml:"path"`
+	// PartitionInterval is the time range of each sqlite-partitioned file,
+	// default 24h. Retention drops partitions older than it; zero keeps
+	// everything.
+	PartitionInterval time.Duration `yaml:"partition_interval,omitempty"`
+	Retention         time.Duration `yaml:"retention,omitempty"`
+	// MaxSpans and MaxBytes bound the memory sink, which evicts the oldest
+	// traces past either. Zero is unbounded, but with both zero the store
+	// keeps 100000 spans.
+	MaxSpans int   `yaml:"max_spans,omitempty"`
+	MaxBytes int64 `yaml:"max_bytes,omitempty"`
+}
+
+type QueueConfig struct {
+	Size int `yaml:"size"`
+	// BatchSize merges up to this many queued requests into one store write.
+	BatchSize int `yaml:"batch_size"`
+}
+
+type LimitsConfig struct {
+	MaxBodyBytes   int64 `yaml:"max_body_bytes"`
+	ImportMaxBytes int64 `yaml:"import_max_bytes"`
+}
+
+type LoggingConfig struct {
+	// Output is stderr, stdout, or a file path that is appended to.
+	Output        string `yaml:"output"`
+	RequestErrors bool   `yaml:"request_errors"`
+}
+
+type UIConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// SQLConfig controls the read-only /api/sql console, which is served on the
+// query route of sqlite and duckdb sinks when enabled.
+type SQLConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"`
+	MaxRows int           `yaml:"max_rows"`
+}
+
+// ForwardConfig re-exports every ingested request to upstream OTLP HTTP
+// receivers. Forwarding is off while Endpoints is empty.
+type ForwardConfig struct {
+	// Endpoints are full traces URLs; a URL without a path gets /v1/traces.
+	Endpoints []string          `yaml:"endpoints,omitempty"`
+	Headers   map[string]string `yaml:"headers,omitempty"`
+	// Compression is gzip or none.
+	Compression   string        `yaml:"compression"`
+	BatchSpans    int           `yaml:"batch_spans"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// BufferSpans bounds the spans held per endpoint while it is slow or
+	// down; the oldest are dropped past it.
+	BufferSpans  int           `yaml:"buffer_spans"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MaxRetryTime time.Duration `yaml:"max_retry_time"`
+}
+
+// ArchiveConfig appends every ingested request to rotating files in Dir.
+// Archiving is off while Dir is empty; the file sink kind archives only.
+type ArchiveConfig struct {
+	Dir string `yaml:"dir,omitempty"`
+	// Format is json (OTLP/JSON lines) or proto (length-prefixed protobuf).
+	Format string `yaml:"format"`
+	// MaxBytes and MaxAge start a new segment; a zero MaxAge only rotates
+	// by size.
+	MaxBytes int64         `yaml:"max_bytes"`
+	MaxAge   time.Duration `yaml:"max_age,omitempty"`
+	// Compress rewrites closed segments with zstd.
+	Compress bool `yaml:"compress"`
+	// MaxFiles deletes the oldest segments past it; zero keeps everything.
+	MaxFiles int `yaml:"max_files,omitempty"`
+}
+
+// RoutingConfig splits each request between the main sink and extra named
+// sinks by rule. Routing is off while Routes is empty.
+type RoutingConfig struct {
+	// Sinks are stdout, sqlite, sqlite-partitioned, or duckdb sinks written
+	// only through routes; the sink section is named main. Queries and
+	// readiness only cover main.
+	Sinks  map[string]SinkConfig `yaml:"sinks,omitempty"`
+	Routes []RouteConfig         `yaml:"routes,omitempty"`
+	// Default receives spans no route matches: main, a name from Sinks, or
+	// drop.
+	Default string `yaml:"default"`
+}
+
+// RouteConfig sends the spans matching every condition that is set to Sink.
+// Values may use * as a wildcard.
+type RouteConfig struct {
+	Service  string            `yaml:"service,omitempty"`
+	Resource map[string]string `yaml:"resource,omitempty"`
+	Span     map[string]string `yaml:"span,omitempty"`
+	Sink     string            `yaml:"sink"`
+}
+
+// SamplingConfig drops traces received on /v1/traces before they reach any
+// sink. Imports are never sampled.
+type SamplingConfig struct {
+	// Percent of traces kept, by trace ID hash; 100 keeps everything and 0
+	// nothing.
+	Percent float64 `yaml:"percent"`
+	// RateLimits caps the traces kept per second by service.name; "*"
+	// covers services not listed.
+	RateLimits map[string]float64 `yaml:"rate_limits,omitempty"`
+	Tail       TailSamplingConfig `yaml:"tail"`
+}
+
+// TailSamplingConfig holds received spans for DecisionWait, then keeps the
+// traces matching any policy: an error span, a root span lasting at least
+// MinDuration, a span or resource attribute matching Attributes, or the
+// BaselinePercent share of the rest.
+type TailSamplingConfig struct {
+	Enabled         bool              `yaml:"enabled"`
+	DecisionWait    time.Duration     `yaml:"decision_wait"`
+	KeepErrors      bool              `yaml:"keep_errors"`
+	MinDuration     time.Duration     `yaml:"min_duration,omitempty"`
+	Attributes      map[string]string `yaml:"attributes,omitempty"`
+	BaselinePercent float64           `yaml:"baseline_percent"`
+	// MaxSpans bounds the spans held; the oldest traces are decided early
+	// past it.
+	MaxSpans int `yaml:"max_spans"`
+}
+
+// RedactionConfig rewrites sensitive attributes on every ingested span before
+// it is sampled, stored, archived, or forwarded.
+type RedactionConfig struct {
+	Rules []RedactionRule `yaml:"rules,omitempty"`
+	// HashKey turns hashed values into an HMAC so they cannot be recovered
+	// by hashing guesses.
+	HashKey string `yaml:"hash_key,omitempty"`
+}
+
+// RedactionRule drops, hashes, or masks the attributes whose key matches one
+// of Keys, which may use * as a wildcard. mask replaces matches of Pattern
+// with Replacement and applies to every attribute when Keys is empty.
+type RedactionRule struct {
+	Action      string   `yaml:"action"`
+	Keys        []string `yaml:"keys,omitempty"`
+	Pattern     string   `yaml:"pattern,omitempty"`
+	Replacement string   `yaml:"replacement,omitempty"`
+}
+
+func Default() Config {
+	return Config{
+		Mode:      ModeIngest,
+		Listeners: []Listener{{Addr: ":4318"}},
+		Sink:      SinkConfig{Kind: "stdout", Path: "./smelldeadfish.sqlite"},
+		Queue:     QueueConfig{Size: 10000, BatchSize: 1},
+		Limits:    LimitsConfig{MaxBodyBytes: 4 << 20, ImportMaxBytes: 1 << 30},
+		Logging:   LoggingConfig{Output: "stderr", RequestErrors: true},
+		UI:        UIConfig{Enabled: true},
+		Metrics:   MetricsConfig{Enabled: true},
+		SQL:       SQLConfig{Timeout: 10 * time.Second, MaxRows: 1000},
+		Forward: ForwardConfig{
+			Compression:   "gzip",
+			BatchSpans:    1000,
+			FlushInterval: time.Second,
+			BufferSpans:   100000,
+			Timeout:       10 * time.Second,
+			MaxRetryTime:  5 * time.Minute,
+		},
+		Archive: ArchiveConfig{Format: "json", MaxBytes: 100 << 20},
+		Routing: RoutingConfig{Default: MainSink},
+		Sampling: SamplingConfig{
+			Percent: 100,
+			Tail:    TailSamplingConfig{DecisionWait: 10 * time.Second, KeepErrors: true, MaxSpans: 100000},
+		},
+	}
+}
+
+// Load reads a YAML file, or a TOML one if its name ends in .toml, on top of
+// the defaults. Unknown keys are rejected so typos do not silently fall back
+// to defaults.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read config: %w", err)
+	}
+	decode := Decode
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		decode = DecodeTOML
+	}
+	if err := decode(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func Decode(data []byte, cfg *Config) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// DecodeTOML reads a TOML document with the same keys as the YAML one. It is
+// converted to YAML and decoded by Decode, so unknown keys are rejected the
+// same way, but their line numbers refer to the converted document.
+func DecodeTOML(data []byte, cfg *Config) error {
+	var doc map[string]any
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return err
+	}
+	if len(doc) == 0 {
+		return nil
+	}
+	converted, err := yaml.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("convert toml: %w", err)
+	}
+	return Decode(converted, cfg)
+}
+
+// ApplyEnv overrides settings from SMELLDEADFISH_* variables. SMELLDEADFISH_ADDR
+// replaces the address of the first listener.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, dest *string) {
+		if value, ok := lookup(EnvPrefix + name); ok {
+			*dest = strings.TrimSpace(value)
+		}
+	}
+	integer := func(name string, dest *int64) {
+		value, ok := lookup(EnvPrefix + name)
+		if !ok {
+			return
+		}
+		parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s must be an integer", EnvPrefix, name))
+			return
+		}
+		*dest = parsed
+	}
+	duration := func(name string, dest *time.Duration) {
+		value, ok := lookup(EnvPrefix + name)
+		if !ok {
+			return
+		}
+		parsed, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s must be a duration such as 24h", EnvPrefix, name))
+			return
+		}
+		*dest = parsed
+	}
+	float := func(name string, dest *float64) {
+		value, ok := lookup(EnvPrefix + name)
+		if !ok {
+			return
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s must be a number", EnvPrefix, name))
+			return
+		}
+		*dest = parsed
+	}
+	boolean := func(name string, dest *bool) {
+		value, ok := lookup(EnvPrefix + name)
+		if !ok {
+			return
+		}
+		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s must be true or false", EnvPrefix, name))
+			return
+		}
+		*dest = parsed
+	}
+
+	if value, ok := lookup(EnvPrefix + "ADDR"); ok {
+		if len(c.Listeners) == 0 {
+			c.Listeners = []Listener{{}}
+		}
+		c.Listeners[0].Addr = strings.TrimSpace(value)
+	}
+	str("MODE", &c.Mode)
+	str("SINK", &c.Sink.Kind)
+	str("DB", &c.Sink.Path)
+	duration("PARTITION_INTERVAL", &c.Sink.PartitionInterval)
+	duration("RETENTION", &c.Sink.Retention)
+	maxSpans := int64(c.Sink.MaxSpans)
+	integer("MEMORY_MAX_SPANS", &maxSpans)
+	c.Sink.MaxSpans = int(maxSpans)
+	integer("MEMORY_MAX_BYTES", &c.Sink.MaxBytes)
+	queueSize := int64(c.Queue.Size)
+	integer("QUEUE_SIZE", &queueSize)
+	c.Queue.Size = int(queueSize)
+	batchSize := int64(c.Queue.BatchSize)
+	integer("QUEUE_BATCH_SIZE", &batchSize)
+	c.Queue.BatchSize = int(batchSize)
+	integer("MAX_BODY_BYTES", &c.Limits.MaxBodyBytes)
+	integer("IMPORT_MAX_BYTES", &c.Limits.ImportMaxBytes)
+	str("LOG_OUTPUT", &c.Logging.Output)
+	boolean("LOG_REQUEST_ERRORS", &c.Logging.RequestErrors)
+	boolean("UI", &c.UI.Enabled)
+	boolean("METRICS", &c.Metrics.Enabled)
+	boolean("SQL", &c.SQL.Enabled)
+	duration("SQL_TIMEOUT", &c.SQL.Timeout)
+	sqlMaxRows := int64(c.SQL.MaxRows)
+	integer("SQL_MAX_ROWS", &sqlMaxRows)
+	c.SQL.MaxRows = int(sqlMaxRows)
+	if value, ok := lookup(EnvPrefix + "FORWARD_ENDPOINTS"); ok {
+		c.Forward.Endpoints = SplitList(value)
+	}
+	str("FORWARD_COMPRESSION", &c.Forward.Compression)
+	str("ARCHIVE_DIR", &c.Archive.Dir)
+	str("ARCHIVE_FORMAT", &c.Archive.Format)
+	integer("ARCHIVE_MAX_BYTES", &c.Archive.MaxBytes)
+	duration("ARCHIVE_MAX_AGE", &c.Archive.MaxAge)
+	boolean("ARCHIVE_COMPRESS", &c.Archive.Compress)
+	archiveMaxFiles := int64(c.Archive.MaxFiles)
+	integer("ARCHIVE_MAX_FILES", &archiveMaxFiles)
+	c.Archive.MaxFiles = int(archiveMaxFiles)
+	float("SAMPLE_PERCENT", &c.Sampling.Percent)
+	boolean("TAIL_SAMPLING", &c.Sampling.Tail.Enabled)
+	duration("TAIL_DECISION_WAIT", &c.Sampling.Tail.DecisionWait)
+	duration("TAIL_MIN_DURATION", &c.Sampling.Tail.MinDuration)
+	float("TAIL_BASELINE_PERCENT", &c.Sampling.Tail.BaselinePercent)
+	str("REDACTION_HASH_KEY", &c.Redaction.HashKey)
+	return errors.Join(errs...)
+}
+
+// Validate reports every problem in the configuration at once.
+func (c Config) Validate() error {
+	var errs []error
+	if len(c.Listeners) == 0 {
+		errs = append(errs, errors.New("listeners: at least one listener is required"))
+	}
+	addrs := map[string]bool{}
+	for i, listener := range c.Listeners {
+		addr := strings.TrimSpace(listener.Addr)
+		if addr == "" {
+			errs = append(errs, fmt.Errorf("listeners[%d].addr is required", i))
+		} else if addrs[addr] {
+			errs = append(errs, fmt.Errorf("listeners[%d].addr %q is used by another listener", i, addr))
+		}
+		addrs[addr] = true
+		for _, route := range listener.Routes {
+			if !isRoute(route) {
+				errs = append(errs, fmt.Errorf("listeners[%d].routes: unknown route %q (want %s)", i, route, strings.Join(allRoutes, ", ")))
+			}
+		}
+	}
+	kind := strings.ToLower(strings.TrimSpace(c.Sink.Kind))
+	if !sinkKinds[kind] {
+		errs = append(errs, fmt.Errorf("sink.kind: unknown sink %q", c.Sink.Kind))
+	} else if kind != "stdout" && kind != "memory" && kind != "file" && strings.TrimSpace(c.Sink.Path) == "" {
+		errs = append(errs, fmt.Errorf("sink.path is required for %s sink", kind))
+	}
+	if c.Sink.PartitionInterval < 0 {
+		errs = append(errs, errors.New("sink.partition_interval must not be negative"))
+	}
+	if c.Sink.Retention < 0 {
+		errs = append(errs, errors.New("sink.retention must not be negative"))
+	}
+	if kind != "sqlite-partitioned" && (c.Sink.PartitionInterval != 0 || c.Sink.Retention != 0) {
+		errs = append(errs, errors.New("sink.partition_interval and sink.retention require the sqlite-partitioned sink"))
+	}
+	if c.Sink.MaxSpans < 0 || c.Sink.MaxBytes < 0 {
+		errs = append(errs, errors.New("sink.max_spans and sink.max_bytes must not be negative"))
+	}
+	if kind != "memory" && (c.Sink.MaxSpans != 0 || c.Sink.MaxBytes != 0) {
+		errs = append(errs, errors.New("sink.max_spans and sink.max_bytes require the memory sink"))
+	}
+	if c.Queue.Size <= 0 {
+		errs = append(errs, errors.New("queue.size must be positive"))
+	}
+	if c.Queue.BatchSize <= 0 {
+		errs = append(errs, errors.New("queue.batch_size must be positive"))
+	}
+	if c.Limits.MaxBodyBytes <= 0 {
+		errs = append(errs, errors.New("limits.max_body_bytes must be positive"))
+	}
+	if c.Limits.ImportMaxBytes <= 0 {
+		errs = append(errs, errors.New("limits.import_max_bytes must be positive"))
+	}
+	if strings.TrimSpace(c.Logging.Output) == "" {
+		errs = append(errs, errors.New("logging.output is required"))
+	}
+	if c.SQL.Timeout <= 0 {
+		errs = append(errs, errors.New("sql.timeout must be positive"))
+	}
+	if c.SQL.MaxRows <= 0 {
+		errs = append(errs, errors.New("sql.max_rows must be positive"))
+	}
+	mode := strings.ToLower(strings.TrimSpace(c.Mode))
+	if mode != "" && mode != ModeIngest && mode != ModeQuery {
+		errs = append(errs, fmt.Errorf("mode: unknown mode %q (want %s or %s)", c.Mode, ModeIngest, ModeQuery))
+	}
+	if mode == ModeQuery && kind != "sqlite" && kind != "duckdb" {
+		errs = append(errs, errors.New("mode query requires the sqlite or duckdb sink"))
+	}
+	if c.SQL.Enabled && kind != "sqlite" && kind != "duckdb" {
+		errs = append(errs, errors.New("sql.enabled requires the sqlite or duckdb sink"))
+	}
+	for i, endpoint := range c.Forward.Endpoints {
+		parsed, err := url.Parse(strings.TrimSpace(endpoint))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("forward.endpoints[%d]: %q is not an http or https URL", i, endpoint))
+		}
+	}
+	if len(c.Forward.Endpoints) > 0 && mode == ModeQuery {
+		errs = append(errs, errors.New("forward.endpoints cannot be used in query mode"))
+	}
+	if compression := strings.ToLower(strings.TrimSpace(c.Forward.Compression)); compression != "gzip" && compression != "none" {
+		errs = append(errs, fmt.Errorf("forward.compression: unknown compression %q (want gzip or none)", c.Forward.Compression))
+	}
+	if c.Forward.BatchSpans <= 0 || c.Forward.BufferSpans <= 0 {
+		errs = append(errs, errors.New("forward.batch_spans and forward.buffer_spans must be positive"))
+	}
+	if c.Forward.FlushInterval <= 0 || c.Forward.Timeout <= 0 || c.Forward.MaxRetryTime <= 0 {
+		errs = append(errs, errors.New("forward.flush_interval, forward.timeout, and forward.max_retry_time must be positive"))
+	}
+	archiving := strings.TrimSpace(c.Archive.Dir) != ""
+	if kind == "file" && !archiving {
+		errs = append(errs, errors.New("archive.dir is required for file sink"))
+	}
+	if archiving && mode == ModeQuery {
+		errs = append(errs, errors.New("archive.dir cannot be used in query mode"))
+	}
+	if format := strings.ToLower(strings.TrimSpace(c.Archive.Format)); format != "json" && format != "proto" {
+		errs = append(errs, fmt.Errorf("archive.format: unknown format %q (want json or proto)", c.Archive.Format))
+	}
+	if c.Archive.MaxBytes <= 0 {
+		errs = append(errs, errors.New("archive.max_bytes must be positive"))
+	}
+	if c.Archive.MaxAge < 0 || c.Archive.MaxFiles < 0 {
+		errs = append(errs, errors.New("archive.max_age and archive.max_files must not be negative"))
+	}
+	errs = append(errs, c.Routing.validate(kind, mode)...)
+	if c.Sampling.Percent < 0 || c.Sampling.Percent > 100 {
+		errs = append(errs, fmt.Errorf("sampling.percent must be between 0 and 100, got %g", c.Sampling.Percent))
+	}
+	for service, limit := range c.Sampling.RateLimits {
+		if limit <= 0 {
+			errs = append(errs, fmt.Errorf("sampling.rate_limits.%s must be positive", service))
+		}
+	}
+	if tail := c.Sampling.Tail; tail.Enabled {
+		if tail.DecisionWait <= 0 || tail.MaxSpans <= 0 {
+			errs = append(errs, errors.New("sampling.tail.decision_wait and sampling.tail.max_spans must be positive"))
+		}
+		if tail.MinDuration < 0 {
+			errs = append(errs, errors.New("sampling.tail.min_duration must not be negative"))
+		}
+		if tail.BaselinePercent < 0 || tail.BaselinePercent > 100 {
+			errs = append(errs, fmt.Errorf("sampling.tail.baseline_percent must be between 0 and 100, got %g", tail.BaselinePercent))
+		}
+		if !tail.KeepErrors && tail.MinDuration == 0 && len(tail.Attributes) == 0 && tail.BaselinePercent == 0 {
+			errs = append(errs, errors.New("sampling.tail needs at least one of keep_errors, min_duration, attributes, or baseline_percent"))
+		}
+	}
+	if len(c.Redaction.Rules) > 0 && mode == ModeQuery {
+		errs = append(errs, errors.New("redaction cannot be used in query mode"))
+	}
+	for i, rule := range c.Redaction.Rules {
+		switch action := strings.ToLower(strings.TrimSpace(rule.Action)); action {
+		case "drop", "hash":
+			if len(rule.Keys) == 0 {
+				errs = append(errs, fmt.Errorf("redaction.rules[%d].keys is required for %s", i, action))
+			}
+		case "mask":
+			if rule.Pattern == "" {
+				errs = append(errs, fmt.Errorf("redaction.rules[%d].pattern is required for mask", i))
+			} else if _, err := regexp.Compile(rule.Pattern); err != nil {
+				errs = append(errs, fmt.Errorf("redaction.rules[%d].pattern: %w", i, err))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("redaction.rules[%d].action: unknown action %q (want drop, hash, or mask)", i, rule.Action))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r RoutingConfig) validate(mainKind, mode string) []error {
+	if len(r.Routes) == 0 {
+		if len(r.Sinks) > 0 {
+			return []error{errors.New("routing.sinks requires routing.routes")}
+		}
+		return nil
+	}
+	var errs []error
+	if mode == ModeQuery {
+		errs = append(errs, errors.New("routing cannot be used in query mode"))
+	}
+	if mainKind == "file" {
+		errs = append(errs, errors.New("routing requires a sink other than file"))
+	}
+	for name, sink := range r.Sinks {
+		kind := strings.ToLower(strings.TrimSpace(sink.Kind))
+		switch {
+		case name == MainSink || name == DropSink:
+			errs = append(errs, fmt.Errorf("routing.sinks: name %q is reserved", name))
+		case kind != "stdout" && kind != "sqlite" && kind != "sqlite-partitioned" && kind != "duckdb":
+			errs = append(errs, fmt.Errorf("routing.sinks.%s.kind: unknown sink %q (want stdout, sqlite, sqlite-partitioned, or duckdb)", name, sink.Kind))
+		case kind != "stdout" && strings.TrimSpace(sink.Path) == "":
+			errs = append(errs, fmt.Errorf("routing.sinks.%s.path is required for %s sink", name, kind))
+		}
+	}
+	known := func(name string) bool {
+		_, ok := r.Sinks[name]
+		return ok || name == MainSink || name == DropSink
+	}
+	for i, route := range r.Routes {
+		if !known(route.Sink) {
+			errs = append(errs, fmt.Errorf("routing.routes[%d].sink: unknown sink %q", i, route.Sink))
+		}
+	}
+	if !known(r.Default) {
+		errs = append(errs, fmt.Errorf("routing.default: unknown sink %q", r.Default))
+	}
+	return errs
+}
+
+// maskedSecret replaces secret values in Marshal output.
+const maskedSecret = "<redacted>"
+
+// Marshal encodes c as YAML for -print-config. Forward header values and the
+// redaction hash key are masked so the output is safe to share; they cannot
+// be read back from it.
+func (c Config) Marshal() ([]byte, error) {
+	if len(c.Forward.Headers) > 0 {
+		headers := make(map[string]string, len(c.Forward.Headers))
+		for name := range c.Forward.Headers {
+			headers[name] = maskedSecret
+		}
+		c.Forward.Headers = headers
+	}
+	if c.Redaction.HashKey != "" {
+		c.Redaction.HashKey = maskedSecret
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// SplitList splits a comma-separated flag or environment value, dropping
+// empty entries.
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// QueryOnly reports whether the server runs in query mode.
+func (c Config) QueryOnly() bool {
+	return strings.EqualFold(strings.TrimSpace(c.Mode), ModeQuery)
+}
+
+// Serves reports whether the listener handles the given route group.
+func (l Listener) Serves(route string) bool {
+	if len(l.Routes) == 0 {
+		return true
+	}
+	for _, candidate := range l.Routes {
+		if strings.EqualFold(strings.TrimSpace(candidate), route) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRoute(route string) bool {
+	for _, candidate := range allRoutes {
+		if strings.EqualFold(strings.TrimSpace(route), candidate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,362 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMergesFileOverDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `
+listeners:
+  - addr: ":4318"
+    routes: [otlp]
+  - addr: "127.0.0.1:8080"
+    routes: [query, ui]
+sink:
+  kind: sqlite
+  path: /var/lib/smelldeadfish.sqlite
+queue:
+  size: 500
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if len(cfg.Listeners) != 2 || !cfg.Listeners[1].Serves(RouteUI) || cfg.Listeners[1].Serves(RouteOTLP) {
+		t.Fatalf("unexpected listeners: %+v", cfg.Listeners)
+	}
+	if cfg.Sink.Kind != "sqlite" || cfg.Queue.Size != 500 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if cfg.Limits.MaxBodyBytes != Default().Limits.MaxBodyBytes || !cfg.UI.Enabled {
+		t.Fatalf("expected unset fields to keep defaults: %+v", cfg)
+	}
+}
+
+func TestLoadReadsTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := `
+[[listeners]]
+addr = ":4318"
+routes = ["otlp"]
+
+[sink]
+kind = "sqlite-partitioned"
+path = "./traces"
+partition_interval = "6h"
+
+[forward]
+endpoints = ["http://collector:4318"]
+
+[forward.headers]
+Authorization = "Bearer token"
+
+[sampling]
+percent = 25
+
+[[redaction.rules]]
+action = "drop"
+keys = ["user.email"]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if len(cfg.Listeners) != 1 || !cfg.Listeners[0].Serves(RouteOTLP) || cfg.Listeners[0].Serves(RouteQuery) {
+		t.Fatalf("unexpected listeners: %+v", cfg.Listeners)
+	}
+	if cfg.Sink.Kind != "sqlite-partitioned" || cfg.Sink.PartitionInterval != 6*time.Hour || cfg.Sampling.Percent != 25 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if cfg.Forward.Headers["Authorization"] != "Bearer token" || len(cfg.Redaction.Rules) != 1 || cfg.Redaction.Rules[0].Keys[0] != "user.email" {
+		t.Fatalf("unexpected forward or redaction config: %+v %+v", cfg.Forward, cfg.Redaction)
+	}
+	if cfg.Queue.Size != Default().Queue.Size {
+		t.Fatalf("expected unset fields to keep defaults: %+v", cfg)
+	}
+
+	if err := os.WriteFile(path, []byte("[sink]\nkynd = \"sqlite\"\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "kynd") {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("sink:\n  kynd: sqlite\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "kynd") {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"SMELLDEADFISH_ADDR":              ":9999",
+		"SMELLDEADFISH_SINK":              "duckdb",
+		"SMELLDEADFISH_QUEUE_SIZE":        "42",
+		"SMELLDEADFISH_UI":                "false",
+		"SMELLDEADFISH_SQL":               "true",
+		"SMELLDEADFISH_SQL_TIMEOUT":       "3s",
+		"SMELLDEADFISH_FORWARD_ENDPOINTS": "http://a:4318, ,https://b/v1/traces",
+		"SMELLDEADFISH_ARCHIVE_DIR":       "/var/lib/traces",
+		"SMELLDEADFISH_ARCHIVE_COMPRESS":  "true",
+		"SMELLDEADFISH_SAMPLE_PERCENT":    "12.5",
+	}
+	cfg := Default()
+	if err := cfg.ApplyEnv(func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}); err != nil {
+		t.Fatalf("apply env: %v", err)
+	}
+	if cfg.Listeners[0].Addr != ":9999" || cfg.Sink.Kind != "duckdb" || cfg.Queue.Size != 42 || cfg.UI.Enabled ||
+		!cfg.SQL.Enabled || cfg.SQL.Timeout != 3*time.Second ||
+		strings.Join(cfg.Forward.Endpoints, " ") != "http://a:4318 https://b/v1/traces" ||
+		cfg.Archive.Dir != "/var/lib/traces" || !cfg.Archive.Compress || cfg.Sampling.Percent != 12.5 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestApplyEnvReportsAllErrors(t *testing.T) {
+	env := map[string]string{
+		"SMELLDEADFISH_QUEUE_SIZE": "lots",
+		"SMELLDEADFISH_UI":         "maybe",
+		"SMELLDEADFISH_RETENTION":  "a week",
+	}
+	cfg := Default()
+	err := cfg.ApplyEnv(func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, want := range []string{"QUEUE_SIZE", "SMELLDEADFISH_UI", "RETENTION"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %s in %v", want, err)
+		}
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	cfg := Default()
+	cfg.Listeners = append(cfg.Listeners, Listener{Addr: ":4318", Routes: []string{"metrics2"}})
+	cfg.Sink = SinkConfig{Kind: "sqlite", Retention: time.Hour, MaxSpans: 10}
+	cfg.Queue.Size = 0
+	cfg.SQL = SQLConfig{Enabled: true, Timeout: time.Second}
+	cfg.Forward.Endpoints = []string{"collector:4318"}
+	cfg.Forward.Compression = "zstd"
+	cfg.Archive.Format = "avro"
+	cfg.Sampling = SamplingConfig{Percent: -1, RateLimits: map[string]float64{"api": -1}}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, want := range []string{"used by another listener", "unknown route", "sink.path", "sink.retention", "sink.max_spans", "queue.size", "sql.max_rows", "forward.endpoints[0]", "forward.compression", "archive.format", "sampling.percent", "sampling.rate_limits.api"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestValidateAllowsSamplingNothing(t *testing.T) {
+	cfg := Default()
+	cfg.Sampling.Percent = 0
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
+
+func TestValidateAllowsMemorySinkWithoutPath(t *testing.T) {
+	cfg := Default()
+	cfg.Sink = SinkConfig{Kind: "memory", MaxBytes: 64 << 20}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	cfg := Default()
+	cfg.Sink = SinkConfig{Kind: "sqlite-partitioned", Path: "./traces", PartitionInterval: 6 * time.Hour, Retention: 7 * 24 * time.Hour}
+	data, err := cfg.Marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	decoded := Config{}
+	if err := Decode(data, &decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if decoded.Sink != cfg.Sink || decoded.Listeners[0].Addr != ":4318" || decoded.Queue.Size != cfg.Queue.Size {
+		t.Fatalf("unexpected round trip: %+v", decoded)
+	}
+}
+
+func TestMarshalMasksSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Forward.Endpoints = []string{"https://collector.example.com"}
+	cfg.Forward.Headers = map[string]string{"Authorization": "Bearer s3cret-token"}
+	cfg.Redaction.HashKey = "pepper-value"
+	data, err := cfg.Marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	for _, secret := range []string{"s3cret-token", "pepper-value"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("expected %q to be masked:\n%s", secret, data)
+		}
+	}
+	decoded := Config{}
+	if err := Decode(data, &decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if decoded.Forward.Headers["Authorization"] != maskedSecret || decoded.Redaction.HashKey != maskedSecret {
+		t.Fatalf("expected masked header and hash key, got %+v %+v", decoded.Forward.Headers, decoded.Redaction)
+	}
+	if cfg.Forward.Headers["Authorization"] != "Bearer s3cret-token" || cfg.Redaction.HashKey != "pepper-value" {
+		t.Fatal("expected Marshal to leave the config unchanged")
+	}
+}
+
+func TestValidateQueryMode(t *testing.T) {
+	cfg := Default()
+	cfg.Mode = "Query"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "mode query") {
+		t.Fatalf("expected mode error for stdout sink, got %v", err)
+	}
+	cfg.Sink.Kind = "sqlite"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if !cfg.QueryOnly() {
+		t.Fatal("expected query mode")
+	}
+	cfg.Mode = "replay"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "unknown mode") {
+		t.Fatalf("expected unknown mode error, got %v", err)
+	}
+}
+
+func TestValidateRequiresSQLStore(t *testing.T) {
+	cfg := Default()
+	cfg.SQL.Enabled = true
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "sql.enabled") {
+		t.Fatalf("expected sql.enabled error for stdout sink, got %v", err)
+	}
+	cfg.Sink.Kind = "duckdb"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
+
+func TestValidateFileSink(t *testing.T) {
+	cfg := Default()
+	cfg.Sink = SinkConfig{Kind: "file"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "archive.dir") {
+		t.Fatalf("expected archive.dir error for file sink, got %v", err)
+	}
+	cfg.Archive.Dir = "./traces"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
+
+func TestValidateRouting(t *testing.T) {
+	cfg := Default()
+	cfg.Sink = SinkConfig{Kind: "sqlite", Path: "./main.sqlite"}
+	cfg.Routing = RoutingConfig{
+		Sinks: map[string]SinkConfig{
+			"team-a": {Kind: "duckdb", Path: "./team-a.duckdb"},
+			"drop":   {Kind: "stdout"},
+			"team-b": {Kind: "memory"},
+		},
+		Routes: []RouteConfig{
+			{Service: "health*", Sink: "drop"},
+			{Resource: map[string]string{"team": "a"}, Sink: "team-a"},
+			{Service: "billing", Sink: "team-c"},
+		},
+		Default: "main",
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, want := range []string{`name "drop" is reserved`, "routing.sinks.team-b.kind", "routing.routes[2].sink"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+
+	delete(cfg.Routing.Sinks, "drop")
+	cfg.Routing.Sinks["team-b"] = SinkConfig{Kind: "sqlite", Path: "./team-b.sqlite"}
+	cfg.Routing.Routes[2].Sink = "team-b"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
+
+func TestValidateTailSampling(t *testing.T) {
+	cfg := Default()
+	cfg.Sampling.Tail.Enabled = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	cfg.Sampling.Tail.KeepErrors = false
+	cfg.Sampling.Tail.DecisionWait = 0
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, want := range []string{"sampling.tail.decision_wait", "at least one of keep_errors"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestValidateRedaction(t *testing.T) {
+	cfg := Default()
+	cfg.Redaction.Rules = []RedactionRule{
+		{Action: "drop", Keys: []string{"http.request.header.authorization"}},
+		{Action: "mask", Pattern: `[\w.+-]+@[\w-]+\.[\w.]+`},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	cfg.Redaction.Rules = []RedactionRule{
+		{Action: "hash"},
+		{Action: "mask", Pattern: "("},
+		{Action: "encrypt", Keys: []string{"a"}},
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, want := range []string{"redaction.rules[0].keys", "redaction.rules[1].pattern", "redaction.rules[2].action"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+}
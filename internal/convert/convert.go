@@ -0,0 +1,91 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/spanstore"
+)
+
+const defaultBatchSize = 1000
+
+type Options struct {
+	// Start and End bound span start times in unix nanoseconds. Zero leaves
+	// the bound open.
+	Start int64
+	End   int64
+	// BatchSize is the number of spans read and written per page.
+	BatchSize int
+	// After resumes a conversion from the cursor of an earlier run.
+	After *spanstore.ExportCursor
+	// Checkpoint is called after each page is durably written. Returning an
+	// error stops the conversion.
+	Checkpoint func(Progress) error
+}
+
+type Progress struct {
+	Pages int64
+	Spans int64
+	// Cursor is the last span written; pass it as Options.After to resume.
+	Cursor *spanstore.ExportCursor
+}
+
+// flusher is implemented by sinks that buffer writes, such as duckdb.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Run copies spans from src to dst in export order. Stores deduplicate on
+// trace and span ID, so resuming from a checkpoint that trails the last
+// write is safe.
+func Run(ctx context.Context, src spanstore.ExportStore, dst ingest.TraceSink, opts Options) (Progress, error) {
+	if src == nil || dst == nil {
+		return Progress{}, errors.New("source and destination are required")
+	}
+	if opts.Start > 0 && opts.End > 0 && opts.End < opts.Start {
+		return Progress{}, fmt.Errorf("end %d is before start %d", opts.End, opts.Start)
+	}
+	limit := opts.BatchSize
+	if limit <= 0 {
+		limit = defaultBatchSize
+	}
+	progress := Progress{Cursor: opts.After}
+	for {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+		page, err := src.ExportSpans(ctx, spanstore.ExportParams{
+			Start: opts.Start,
+			End:   opts.End,
+			After: progress.Cursor,
+			Limit: limit,
+		})
+		if err != nil {
+			return progress, fmt.Errorf("read spans: %w", err)
+		}
+		if page.Spans == 0 {
+			return progress, nil
+		}
+		if err := dst.Consume(ctx, page.Request); err != nil {
+			return progress, fmt.Errorf("write spans: %w", err)
+		}
+		if f, ok := dst.(flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				return progress, fmt.Errorf("flush spans: %w", err)
+			}
+		}
+		progress.Pages++
+		progress.Spans += int64(page.Spans)
+		progress.Cursor = page.Next
+		if opts.Checkpoint != nil {
+			if err := opts.Checkpoint(progress); err != nil {
+				return progress, err
+			}
+		}
+		if page.Spans < limit {
+			return progress, nil
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	ingestmemory "smelldeadfish/internal/ingest/memory"
+	ingestsqlite "smelldeadfish/internal/ingest/sqlite"
+	"smelldeadfish/internal/spanstore"
+)
+
+func testRequest(n int) *coltracepb.ExportTraceServiceRequest {
+	spans := make([]*tracepb.Span, n)
+	for i := range spans {
+		start := uint64(1_000 + i*10)
+		spans[i] = &tracepb.Span{
+			TraceId:           []byte{1, byte(i / 4)},
+			SpanId:            []byte{2, byte(i)},
+			Name:              "op",
+			StartTimeUnixNano: start,
+			EndTimeUnixNano:   start + 5,
+			Attributes: []*commonpb.KeyValue{
+				{Key: "i", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(i)}}},
+			},
+			Events: []*tracepb.Span_Event{{Name: "tick", TimeUnixNano: start + 1}},
+			Links:  []*tracepb.Span_Link{{TraceId: []byte{9}, SpanId: []byte{9}, TraceState: "k=v"}},
+		}
+	}
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "svc"}}},
+			}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: "lib", Version: "1.0"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func newSource(t *testing.T, n int) *ingestsqlite.Sink {
+	t.Helper()
+	src, err := ingestsqlite.New(filepath.Join(t.TempDir(), "src.sqlite"))
+	if err != nil {
+		t.Fatalf("new sqlite sink: %v", err)
+	}
+	t.Cleanup(func() { _ = src.Close() })
+	if err := src.Consume(context.Background(), testRequest(n)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	return src
+}
+
+func exportAll(t *testing.T, store spanstore.ExportStore) *coltracepb.ExportTraceServiceRequest {
+	t.Helper()
+	page, err := store.ExportSpans(context.Background(), spanstore.ExportParams{Limit: 1000})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	return page.Request
+}
+
+func TestRunCopiesSpans(t *testing.T) {
+	src := newSource(t, 10)
+	dst := ingestmemory.New()
+
+	progress, err := Run(context.Background(), src, dst, Options{BatchSize: 3})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if progress.Spans != 10 || progress.Pages != 4 {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+	if want, got := exportAll(t, src), exportAll(t, dst); !proto.Equal(want, got) {
+		t.Fatalf("destination differs from source:\nwant %v\ngot  %v", want, got)
+	}
+}
+
+func TestRunFiltersByTime(t *testing.T) {
+	src := newSource(t, 10)
+	dst := ingestmemory.New()
+
+	progress, err := Run(context.Background(), src, dst, Options{Start: 1_020, End: 1_050})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if progress.Spans != 4 {
+		t.Fatalf("expected 4 spans in range got %d", progress.Spans)
+	}
+	for _, span := range exportAll(t, dst).GetResourceSpans()[0].GetScopeSpans()[0].GetSpans() {
+		if span.GetStartTimeUnixNano() < 1_020 || span.GetStartTimeUnixNano() > 1_050 {
+			t.Fatalf("span outside range: %d", span.GetStartTimeUnixNano())
+		}
+	}
+}
+
+func TestRunResumesFromCheckpoint(t *testing.T) {
+	src := newSource(t, 10)
+	dst := ingestmemory.New()
+	stop := errors.New("stop")
+
+	var saved Progress
+	_, err := Run(context.Background(), src, dst, Options{
+		BatchSize: 3,
+		Checkpoint: func(p Progress) error {
+			saved = p
+			if p.Pages == 2 {
+				return stop
+			}
+			return nil
+		},
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("expected checkpoint error got %v", err)
+	}
+	if saved.Spans != 6 || saved.Cursor == nil {
+		t.Fatalf("unexpected checkpoint: %+v", saved)
+	}
+
+	progress, err := Run(context.Background(), src, dst, Options{BatchSize: 3, After: saved.Cursor})
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if progress.Spans != 4 {
+		t.Fatalf("expected 4 remaining spans got %d", progress.Spans)
+	}
+	if want, got := exportAll(t, src), exportAll(t, dst); !proto.Equal(want, got) {
+		t.Fatalf("destination differs from source after resume:\nwant %v\ngot  %v", want, got)
+	}
+}
+
+func TestRunRejectsInvertedRange(t *testing.T) {
+	if _, err := Run(context.Background(), newSource(t, 1), ingestmemory.New(), Options{Start: 10, End: 5}); err == nil {
+		t.Fatal("expected error for end before start")
+	}
+}
@@ -0,0 +1,224 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	livePath  = "/healthz"
+	readyPath = "/readyz"
+
+	StatusOK   = "ok"
+	StatusFail = "fail"
+
+	defaultTimeout             = 2 * time.Second
+	defaultSaturationThreshold = 0.9
+	defaultFailureThreshold    = 3
+)
+
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type Queue interface {
+	Depth() int
+	Capacity() int
+	WriteFailures() (int, string)
+}
+
+// WriteReporter is implemented by stores that write in the background, such
+// as duckdb, whose failures the queue never sees.
+type WriteReporter interface {
+	WriteFailures() (int, string)
+}
+
+type Options struct {
+	// Store and Queue are optional; components that are not configured are
+	// left out of the readiness report. A Store that is also a WriteReporter
+	// has its failures counted with the queue's.
+	Store Pinger
+	Queue Queue
+	// SaturationThreshold is the queue fill ratio at which the receiver stops
+	// reporting ready. Defaults to 0.9.
+	SaturationThreshold float64
+	// FailureThreshold is the number of consecutive failed writes at which
+	// the receiver stops reporting ready. Defaults to 3.
+	FailureThreshold int
+	Timeout          time.Duration
+	Logger           *log.Logger
+}
+
+type Handler struct {
+	store               Pinger
+	queue               Queue
+	writes              []WriteReporter
+	saturationThreshold float64
+	failureThreshold    int
+	timeout             time.Duration
+	logger              *log.Logger
+}
+
+type Response struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components,omitempty"`
+}
+
+type Component struct {
+	Status              string  `json:"status"`
+	Error               string  `json:"error,omitempty"`
+	LatencyMS           *int64  `json:"latency_ms,omitempty"`
+	Depth               *int    `json:"depth,omitempty"`
+	Capacity            *int    `json:"capacity,omitempty"`
+	Saturation          float64 `json:"saturation,omitempty"`
+	ConsecutiveFailures *int    `json:"consecutive_failures,omitempty"`
+}
+
+// NewHandler serves /healthz, which reports the process is up, and /readyz,
+// which checks store connectivity, queue saturation, and recent write
+// failures and returns 503 when any of them fails.
+func NewHandler(opts Options) http.Handler {
+	h := &Handler{
+		store:               opts.Store,
+		queue:               opts.Queue,
+		saturationThreshold: opts.SaturationThreshold,
+		failureThreshold:    opts.FailureThreshold,
+		timeout:             opts.Timeout,
+		logger:              opts.Logger,
+	}
+	if h.saturationThreshold <= 0 || h.saturationThreshold > 1 {
+		h.saturationThreshold = defaultSaturationThreshold
+	}
+	if h.failureThreshold <= 0 {
+		h.failureThreshold = defaultFailureThreshold
+	}
+	if h.timeout <= 0 {
+		h.timeout = defaultTimeout
+	}
+	if h.queue != nil {
+		h.writes = append(h.writes, h.queue)
+	}
+	if reporter, ok := h.store.(WriteReporter); ok {
+		h.writes = append(h.writes, reporter)
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case livePath:
+		writeJSON(w, http.StatusOK, Response{Status: StatusOK})
+	case readyPath:
+		resp := h.Ready(r.Context())
+		status := http.StatusOK
+		if resp.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+			if h.logger != nil {
+				h.logger.Printf("msg=not_ready %s", failedComponents(resp))
+			}
+		}
+		writeJSON(w, status, resp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) Ready(ctx context.Context) Response {
+	resp := Response{Status: StatusOK, Components: map[string]Component{}}
+	if h.store != nil {
+		resp.Components["store"] = h.checkStore(ctx)
+	}
+	if h.queue != nil {
+		resp.Components["queue"] = h.checkQueue()
+	}
+	if len(h.writes) > 0 {
+		resp.Components["writes"] = h.checkWrites()
+	}
+	for _, component := range resp.Components {
+		if component.Status != StatusOK {
+			resp.Status = StatusFail
+		}
+	}
+	return resp
+}
+
+func (h *Handler) checkStore(ctx context.Context) Component {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	start := time.Now()
+	err := h.store.Ping(ctx)
+	latency := time.Since(start).Milliseconds()
+	component := Component{Status: StatusOK, LatencyMS: &latency}
+	if err != nil {
+		component.Status = StatusFail
+		component.Error = err.Error()
+	}
+	return component
+}
+
+func (h *Handler) checkQueue() Component {
+	depth := h.queue.Depth()
+	capacity := h.queue.Capacity()
+	component := Component{Status: StatusOK, Depth: &depth, Capacity: &capacity}
+	if capacity > 0 {
+		component.Saturation = float64(depth) / float64(capacity)
+		if component.Saturation >= h.saturationThreshold {
+			component.Status = StatusFail
+			component.Error = "queue saturated"
+		}
+	}
+	return component
+}
+
+// checkWrites reports the longest run of failed writes among the queue and
+// the store.
+func (h *Handler) checkWrites() Component {
+	failures, lastError := 0, ""
+	for _, reporter := range h.writes {
+		if count, err := reporter.WriteFailures(); count > failures {
+			failures, lastError = count, err
+		}
+	}
+	component := Component{Status: StatusOK, ConsecutiveFailures: &failures}
+	if failures > 0 {
+		component.Error = lastError
+	}
+	if failures >= h.failureThreshold {
+		component.Status = StatusFail
+	}
+	return component
+}
+
+func failedComponents(resp Response) string {
+	names := make([]string, 0, len(resp.Components))
+	for name, component := range resp.Components {
+		if component.Status != StatusOK {
+			names = append(names, fmt.Sprintf("%s=%q", name, component.Error))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp Response) {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(payload)
+}
@@ -0,0 +1,127 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeStore struct {
+	err error
+}
+
+func (f fakeStore) Ping(_ context.Context) error {
+	return f.err
+}
+
+type fakeQueue struct {
+	depth     int
+	capacity  int
+	failures  int
+	lastError string
+}
+
+func (f fakeQueue) Depth() int {
+	return f.depth
+}
+
+func (f fakeQueue) Capacity() int {
+	return f.capacity
+}
+
+func (f fakeQueue) WriteFailures() (int, string) {
+	return f.failures, f.lastError
+}
+
+func serve(t *testing.T, h http.Handler, path string) (int, Response) {
+	t.Helper()
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+	var decoded Response
+	if err := json.Unmarshal(resp.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode %s: %v (%s)", path, err, resp.Body.String())
+	}
+	return resp.Code, decoded
+}
+
+func TestLivenessAlwaysOK(t *testing.T) {
+	h := NewHandler(Options{Store: fakeStore{err: errors.New("locked")}})
+	code, resp := serve(t, h, livePath)
+	if code != http.StatusOK || resp.Status != StatusOK {
+		t.Fatalf("expected ok, got %d %+v", code, resp)
+	}
+}
+
+func TestReadinessReportsComponents(t *testing.T) {
+	h := NewHandler(Options{Store: fakeStore{}, Queue: fakeQueue{depth: 1, capacity: 10}})
+	code, resp := serve(t, h, readyPath)
+	if code != http.StatusOK || resp.Status != StatusOK {
+		t.Fatalf("expected ready, got %d %+v", code, resp)
+	}
+	for _, name := range []string{"store", "queue", "writes"} {
+		if resp.Components[name].Status != StatusOK {
+			t.Fatalf("expected %s ok, got %+v", name, resp.Components[name])
+		}
+	}
+	if *resp.Components["queue"].Depth != 1 || *resp.Components["queue"].Capacity != 10 {
+		t.Fatalf("unexpected queue component: %+v", resp.Components["queue"])
+	}
+}
+
+func TestReadinessFailures(t *testing.T) {
+	cases := []struct {
+		name      string
+		opts      Options
+		component string
+	}{
+		{name: "store", opts: Options{Store: fakeStore{err: errors.New("database is locked")}}, component: "store"},
+		{name: "saturated", opts: Options{Queue: fakeQueue{depth: 9, capacity: 10}}, component: "queue"},
+		{name: "writes", opts: Options{Queue: fakeQueue{capacity: 10, failures: 3, lastError: "disk full"}}, component: "writes"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, resp := serve(t, NewHandler(tc.opts), readyPath)
+			if code != http.StatusServiceUnavailable || resp.Status != StatusFail {
+				t.Fatalf("expected not ready, got %d %+v", code, resp)
+			}
+			component := resp.Components[tc.component]
+			if component.Status != StatusFail || component.Error == "" {
+				t.Fatalf("expected %s to fail with error, got %+v", tc.component, component)
+			}
+		})
+	}
+}
+
+func TestReadinessToleratesIsolatedWriteFailure(t *testing.T) {
+	h := NewHandler(Options{Queue: fakeQueue{capacity: 10, failures: 1, lastError: "busy"}})
+	code, resp := serve(t, h, readyPath)
+	if code != http.StatusOK {
+		t.Fatalf("expected ready, got %d %+v", code, resp)
+	}
+	if resp.Components["writes"].Error != "busy" {
+		t.Fatalf("expected last error reported, got %+v", resp.Components["writes"])
+	}
+}
+
+type failingWriterStore struct {
+	fakeStore
+	failures int
+}
+
+func (f failingWriterStore) WriteFailures() (int, string) {
+	return f.failures, "flush failed"
+}
+
+func TestReadinessReportsStoreWriteFailures(t *testing.T) {
+	h := NewHandler(Options{Store: failingWriterStore{failures: 3}, Queue: fakeQueue{capacity: 10}})
+	code, resp := serve(t, h, readyPath)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready, got %d %+v", code, resp)
+	}
+	if writes := resp.Components["writes"]; writes.Status != StatusFail || writes.Error != "flush failed" {
+		t.Fatalf("expected the store's flush failures reported, got %+v", writes)
+	}
+}
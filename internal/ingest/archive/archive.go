@@ -0,0 +1,442 @@
+// Package archive appends consumed requests to rotating files that
+// smelldeadfish import (or the collector's file receiver) can read back.
+package archive
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/otlpjson"
+)
+
+const (
+	FormatJSON  = "json"
+	FormatProto = "proto"
+
+	defaultMaxBytes = 100 << 20
+	segmentPrefix   = "traces-"
+	timeLayout      = "20060102T150405.000Z"
+	zstdSuffix      = ".zst"
+)
+
+var ErrClosed = errors.New("archive sink closed")
+
+type Options struct {
+	// Format is json (one OTLP/JSON request per line, the default) or proto
+	// (protobuf messages each prefixed by a 4-byte big-endian length).
+	Format string
+	// MaxBytes starts a new segment once the current one would grow past it,
+	// default 100MiB. MaxAge also starts one once the current segment is
+	// older; zero disables age-based rotation.
+	MaxBytes int64
+	MaxAge   time.Duration
+	// Compress rewrites closed segments with zstd in the background.
+	Compress bool
+	// MaxFiles deletes the oldest segments past this count, including the
+	// one being written. Zero keeps everything.
+	MaxFiles int
+	Logger   *log.Logger
+	Metrics  *metrics.Registry
+	// Now is used for segment names and ages; tests override it.
+	Now func() time.Time
+}
+
+// Sink writes every request to the current segment in dir. Segments are
+// named after the time they were opened, so names sort oldest first.
+type Sink struct {
+	dir      string
+	ext      string
+	proto    bool
+	maxBytes int64
+	maxAge   time.Duration
+	compress bool
+	maxFiles int
+	logger   *log.Logger
+	now      func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	size   int64
+	opened time.Time
+	closed bool
+	// pending holds closed segments until the worker compresses them.
+	pending []string
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	spans    *metrics.Counter
+	bytes    *metrics.Counter
+	segments *metrics.Counter
+	errors   *metrics.Counter
+}
+
+func New(dir string) (*Sink, error) {
+	return NewWithOptions(dir, Options{})
+}
+
+func NewWithOptions(dir string, opts Options) (*Sink, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, errors.New("archive directory is required")
+	}
+	format := strings.ToLower(strings.TrimSpace(opts.Format))
+	ext := ".jsonl"
+	switch format {
+	case "", FormatJSON:
+	case FormatProto:
+		ext = ".pb"
+	default:
+		return nil, fmt.Errorf("unknown archive format %q (want json or proto)", opts.Format)
+	}
+	if opts.MaxBytes < 0 || opts.MaxAge < 0 || opts.MaxFiles < 0 {
+		return nil, errors.New("archive max bytes, max age, and max files must not be negative")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create archive directory: %w", err)
+	}
+	s := &Sink{
+		dir:      dir,
+		ext:      ext,
+		proto:    format == FormatProto,
+		maxBytes: opts.MaxBytes,
+		maxAge:   opts.MaxAge,
+		compress: opts.Compress,
+		maxFiles: opts.MaxFiles,
+		logger:   opts.Logger,
+		now:      opts.Now,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		spans:    opts.Metrics.Counter("smelldeadfish_archive_spans_written_total", "Spans appended to archive segments."),
+		bytes:    opts.Metrics.Counter("smelldeadfish_archive_bytes_written_total", "Bytes appended to archive segments before compression."),
+		segments: opts.Metrics.Counter("smelldeadfish_archive_segments_total", "Archive segments opened."),
+		errors:   opts.Metrics.Counter("smelldeadfish_archive_errors_total", "Failed archive writes, rotations, compressions, and deletions.", "op"),
+	}
+	if s.maxBytes == 0 {
+		s.maxBytes = defaultMaxBytes
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	// Segments left by an earlier run are never appended to, since their
+	// last record may be cut short.
+	leftovers, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	go s.run(leftovers)
+	return s, nil
+}
+
+// Consume appends req to the current segment, rotating first when it is full
+// or too old.
+func (s *Sink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if s == nil || req == nil {
+		return nil
+	}
+	spans := ingest.CountSpans(req.GetResourceSpans()...)
+	if spans == 0 {
+		return nil
+	}
+	record, err := s.encode(req)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.file != nil && (s.size+int64(len(record)) > s.maxBytes || s.expired()) {
+		s.rotate()
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			s.errors.Inc("rotate")
+			return err
+		}
+	}
+	n, err := s.file.Write(record)
+	s.size += int64(n)
+	s.bytes.Add(float64(n))
+	if err != nil {
+		s.errors.Inc("write")
+		return fmt.Errorf("write archive segment: %w", err)
+	}
+	s.spans.Add(float64(spans))
+	return nil
+}
+
+// Close closes the current segment and waits for pending compressions.
+func (s *Sink) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.closeFile()
+	s.release()
+	s.mu.Unlock()
+	close(s.stop)
+	<-s.done
+	return err
+}
+
+func (s *Sink) encode(req *coltracepb.ExportTraceServiceRequest) ([]byte, error) {
+	if !s.proto {
+		payload, err := otlpjson.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		return append(payload, '\n'), nil
+	}
+	size := proto.Size(req)
+	record := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(record, uint32(size))
+	record, err := proto.MarshalOptions{}.MarshalAppend(record, req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal otlp protobuf: %w", err)
+	}
+	return record, nil
+}
+
+func (s *Sink) expired() bool {
+	return s.maxAge > 0 && s.now().Sub(s.opened) >= s.maxAge
+}
+
+// open creates the next segment. A name already taken, by a fast rotation
+// or a previous run, moves the timestamp forward so names keep sorting.
+func (s *Sink) open() error {
+	opened := s.now().UTC()
+	for {
+		path := filepath.Join(s.dir, segmentPrefix+opened.Format(timeLayout)+s.ext)
+		_, statErr := os.Stat(path + zstdSuffix)
+		if statErr == nil {
+			opened = opened.Add(time.Millisecond)
+			continue
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			opened = opened.Add(time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("open archive segment: %w", err)
+		}
+		s.file, s.path, s.size, s.opened = file, path, 0, s.now()
+		s.segments.Inc()
+		return nil
+	}
+}
+
+// rotate closes the current segment and hands it to the background worker.
+// The next segment is opened by the next write, so an idle sink leaves no
+// empty files behind.
+func (s *Sink) rotate() {
+	if err := s.closeFile(); err != nil {
+		s.errors.Inc("rotate")
+		s.logf("msg=archive_close_failed path=%q error=%q", s.path, err.Error())
+	}
+	s.release()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// release queues the closed current segment for the worker.
+func (s *Sink) release() {
+	if s.path != "" {
+		s.pending = append(s.pending, s.path)
+		s.path = ""
+	}
+}
+
+func (s *Sink) takePending() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
+func (s *Sink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return fmt.Errorf("close archive segment: %w", err)
+	}
+	return nil
+}
+
+// run compresses and prunes closed segments off the write path, and closes
+// segments that outlive MaxAge while no writes arrive.
+func (s *Sink) run(leftovers []string) {
+	defer close(s.done)
+	for _, path := range leftovers {
+		if !strings.HasSuffix(path, zstdSuffix) {
+			s.finish(path)
+		}
+	}
+	s.prune()
+
+	var tick <-chan time.Time
+	if s.maxAge > 0 {
+		ticker := time.NewTicker(min(s.maxAge, time.Second))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.wake:
+			for _, path := range s.takePending() {
+				s.finish(path)
+			}
+			s.prune()
+		case <-tick:
+			s.mu.Lock()
+			if !s.closed && s.file != nil && s.expired() {
+				s.rotate()
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			for _, path := range s.takePending() {
+				s.finish(path)
+			}
+			s.prune()
+			return
+		}
+	}
+}
+
+func (s *Sink) finish(path string) {
+	if !s.compress {
+		return
+	}
+	if err := compressFile(path); err != nil {
+		s.errors.Inc("compress")
+		s.logf("msg=archive_compress_failed path=%q error=%q", path, err.Error())
+	}
+}
+
+// compressFile writes path.zst next to path and removes path once the
+// compressed copy is complete.
+func compressFile(path string) (err error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open segment: %w", err)
+	}
+	defer source.Close()
+	tmp := path + zstdSuffix + ".tmp"
+	target, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("create compressed segment: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = target.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	encoder, err := zstd.NewWriter(target)
+	if err != nil {
+		return fmt.Errorf("create zstd writer: %w", err)
+	}
+	if _, err := io.Copy(encoder, source); err != nil {
+		_ = encoder.Close()
+		return fmt.Errorf("compress segment: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("compress segment: %w", err)
+	}
+	if err := target.Close(); err != nil {
+		return fmt.Errorf("close compressed segment: %w", err)
+	}
+	if err := os.Rename(tmp, path+zstdSuffix); err != nil {
+		return fmt.Errorf("rename compressed segment: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove segment: %w", err)
+	}
+	return nil
+}
+
+// prune removes the oldest segments past MaxFiles.
+func (s *Sink) prune() {
+	if s.maxFiles == 0 {
+		return
+	}
+	segments, err := s.listSegments()
+	if err != nil {
+		s.errors.Inc("prune")
+		s.logf("msg=archive_prune_failed error=%q", err.Error())
+		return
+	}
+	s.mu.Lock()
+	active := s.path
+	s.mu.Unlock()
+	if active != "" && !slices.Contains(segments, active) {
+		segments = append(segments, active)
+	}
+	for len(segments) > s.maxFiles {
+		oldest := segments[0]
+		segments = segments[1:]
+		if oldest == active {
+			continue
+		}
+		if err := os.Remove(oldest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.errors.Inc("prune")
+			s.logf("msg=archive_prune_failed path=%q error=%q", oldest, err.Error())
+		}
+	}
+}
+
+// listSegments returns the segment files in dir, oldest first.
+func (s *Sink) listSegments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("list archive directory: %w", err)
+	}
+	var segments []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		segments = append(segments, filepath.Join(s.dir, name))
+	}
+	slices.Sort(segments)
+	return segments, nil
+}
+
+func (s *Sink) logf(format string, args ...any) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,204 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/otlpfile"
+)
+
+func testRequest(spans int) *coltracepb.ExportTraceServiceRequest {
+	scope := &tracepb.ScopeSpans{}
+	for i := 0; i < spans; i++ {
+		scope.Spans = append(scope.Spans, &tracepb.Span{TraceId: []byte{1}, SpanId: []byte{byte(i + 1)}, Name: "op"})
+	}
+	return &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{scope}}}}
+}
+
+// fakeClock advances by step on every reading so each segment gets its own
+// name.
+type fakeClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func segmentNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// readSpans decodes every segment the way smelldeadfish import does.
+func readSpans(t *testing.T, dir string) int {
+	t.Helper()
+	total := 0
+	for _, name := range segmentNames(t, dir) {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		reader, err := otlpfile.NewReader(file, otlpfile.FormatAuto)
+		if err != nil {
+			t.Fatalf("reader %s: %v", name, err)
+		}
+		for {
+			req, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("decode %s: %v", name, err)
+			}
+			total += ingest.CountSpans(req.GetResourceSpans()...)
+		}
+		_ = reader.Close()
+		_ = file.Close()
+	}
+	return total
+}
+
+func TestSinkRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewWithOptions(dir, Options{MaxBytes: 200})
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := sink.Consume(context.Background(), testRequest(1)); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	names := segmentNames(t, dir)
+	if len(names) < 2 {
+		t.Fatalf("expected several segments, got %v", names)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "traces-") || !strings.HasSuffix(name, ".jsonl") {
+			t.Fatalf("unexpected segment name %q", name)
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if info.Size() > 200 {
+			t.Fatalf("segment %s is %d bytes, over the limit", name, info.Size())
+		}
+	}
+	if got := readSpans(t, dir); got != 5 {
+		t.Fatalf("expected 5 spans archived, got %d", got)
+	}
+}
+
+func TestSinkRotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{now: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), step: time.Minute}
+	sink, err := NewWithOptions(dir, Options{Format: FormatProto, MaxAge: 90 * time.Second, Now: clock.Now})
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := sink.Consume(context.Background(), testRequest(2)); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	names := segmentNames(t, dir)
+	if len(names) != 2 {
+		t.Fatalf("expected 2 segments, got %v", names)
+	}
+	if names[0] != "traces-20261018T120000.000Z.pb" {
+		t.Fatalf("unexpected first segment %q", names[0])
+	}
+	if got := readSpans(t, dir); got != 8 {
+		t.Fatalf("expected 8 spans archived, got %d", got)
+	}
+}
+
+func TestSinkCompressesAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	// A leftover segment from an earlier run is compressed, then pruned.
+	if err := os.WriteFile(filepath.Join(dir, "traces-20200101T000000.000Z.jsonl"), []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("write leftover: %v", err)
+	}
+	sink, err := NewWithOptions(dir, Options{MaxBytes: 1, Compress: true, MaxFiles: 3})
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := sink.Consume(context.Background(), testRequest(1)); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	names := segmentNames(t, dir)
+	if len(names) != 3 {
+		t.Fatalf("expected 3 segments kept, got %v", names)
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".jsonl.zst") {
+			t.Fatalf("expected compressed segments, got %v", names)
+		}
+		if strings.HasPrefix(name, "traces-2020") {
+			t.Fatalf("expected the oldest segment to be pruned, got %v", names)
+		}
+	}
+	if got := readSpans(t, dir); got != 3 {
+		t.Fatalf("expected the newest 3 spans kept, got %d", got)
+	}
+}
+
+func TestSinkRejectsAfterClose(t *testing.T) {
+	sink, err := New(t.TempDir())
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := sink.Consume(context.Background(), testRequest(1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestNewRejectsUnknownFormat(t *testing.T) {
+	if _, err := NewWithOptions(t.TempDir(), Options{Format: "csv"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,463 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	duckdb "github.com/duckdb/duckdb-go/v2"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/otlpconv"
+)
+
+const (
+	defaultFlushInterval = time.Second
+	defaultFlushSpans    = 10000
+	spanStagingTable     = "span_staging"
+)
+
+// Flushes are serialised by flushMu and the buffer drops repeated spans, so
+// the anti-join only has to look at rows committed by earlier flushes.
+const insertStagedSpans = `INSERT INTO spans
+SELECT * FROM ` + spanStagingTable + ` staged
+WHERE NOT EXISTS (SELECT 1 FROM spans existing WHERE existing.trace_id = staged.trace_id AND existing.span_id = staged.span_id)
+RETURNING id`
+
+var attributeTables = []string{"resource_attributes", "scope_attributes", "span_attributes", "span_event_attributes", "span_link_attributes"}
+
+type bufferedSpan struct {
+	row  []driver.Value
+	span *tracepb.Span
+}
+
+// writeBuffer holds consumed requests as appender rows until the next flush.
+// Span children are only materialised at flush time, once the spans that
+// survived deduplication are known.
+type writeBuffer struct {
+	reqs          []*coltracepb.ExportTraceServiceRequest
+	resources     [][]driver.Value
+	resourceAttrs map[string][]ingest.StoredAttribute
+	scopes        [][]driver.Value
+	scopeAttrs    map[string][]ingest.StoredAttribute
+	spans         []bufferedSpan
+	keys          map[string]struct{}
+	attributes    map[string][][]driver.Value
+	events        [][]driver.Value
+	links         [][]driver.Value
+	search        [][]driver.Value
+}
+
+func newWriteBuffer() *writeBuffer {
+	return &writeBuffer{
+		resourceAttrs: map[string][]ingest.StoredAttribute{},
+		scopeAttrs:    map[string][]ingest.StoredAttribute{},
+		keys:          map[string]struct{}{},
+		attributes:    map[string][][]driver.Value{},
+	}
+}
+
+func (b *writeBuffer) empty() bool {
+	return len(b.reqs) == 0
+}
+
+func (b *writeBuffer) add(req *coltracepb.ExportTraceServiceRequest) error {
+	for _, resourceSpans := range req.GetResourceSpans() {
+		serviceName := ingest.ResourceServiceName(resourceSpans.GetResource())
+		resourceID, err := b.addResource(resourceSpans.GetResource().GetAttributes(), resourceSpans.GetSchemaUrl())
+		if err != nil {
+			return err
+		}
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			scopeID, err := b.addScope(scopeSpans.GetScope(), scopeSpans.GetSchemaUrl())
+			if err != nil {
+				return err
+			}
+			for _, span := range scopeSpans.GetSpans() {
+				if span == nil {
+					continue
+				}
+				if err := b.addSpan(span, serviceName, resourceID, scopeID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	b.reqs = append(b.reqs, req)
+	return nil
+}
+
+func (b *writeBuffer) addResource(attrs []*commonpb.KeyValue, schemaURL string) (string, error) {
+	stored, err := storedAttributes(attrs)
+	if err != nil {
+		return "", err
+	}
+	resourceID := ingest.ResourceID(schemaURL, stored)
+	if _, ok := b.resourceAttrs[resourceID]; !ok {
+		b.resourceAttrs[resourceID] = stored
+		b.resources = append(b.resources, []driver.Value{resourceID, schemaURL})
+	}
+	return resourceID, nil
+}
+
+func (b *writeBuffer) addScope(scope *commonpb.InstrumentationScope, schemaURL string) (string, error) {
+	stored, err := storedAttributes(scope.GetAttributes())
+	if err != nil {
+		return "", err
+	}
+	scopeID := ingest.ScopeID(scope.GetName(), scope.GetVersion(), schemaURL, stored)
+	if _, ok := b.scopeAttrs[scopeID]; !ok {
+		b.scopeAttrs[scopeID] = stored
+		b.scopes = append(b.scopes, []driver.Value{scopeID, scope.GetName(), scope.GetVersion(), schemaURL})
+	}
+	return scopeID, nil
+}
+
+func (b *writeBuffer) addSpan(span *tracepb.Span, service, resourceID, scopeID string) error {
+	traceID := ingest.FormatTraceID(span.GetTraceId())
+	spanID := ingest.FormatSpanID(span.GetSpanId())
+	// The first copy of a span wins, both within a buffer and against rows
+	// already in the table.
+	key := traceID + "/" + spanID
+	if _, ok := b.keys[key]; ok {
+		return nil
+	}
+	b.keys[key] = struct{}{}
+	spanRowID, err := newUUIDv7()
+	if err != nil {
+		return err
+	}
+	b.spans = append(b.spans, bufferedSpan{
+		span: span,
+		row: []driver.Value{
+			spanRowID,
+			traceID,
+			spanID,
+			ingest.FormatSpanID(span.GetParentSpanId()),
+			span.GetName(),
+			ingest.SpanKind(span.GetKind()),
+			int64(span.GetStartTimeUnixNano()),
+			int64(span.GetEndTimeUnixNano()),
+			int32(span.GetStatus().GetCode()),
+			span.GetStatus().GetMessage(),
+			service,
+			int64(span.GetFlags()),
+			resourceID,
+			scopeID,
+		},
+	})
+	return nil
+}
+
+func (b *writeBuffer) addSpanChildren(spanRowID string, span *tracepb.Span) error {
+	if err := b.addAttributes("span_attributes", spanRowID, span.GetAttributes()); err != nil {
+		return err
+	}
+	doc := ingest.NewSearchDocument(span)
+	b.search = append(b.search, []driver.Value{spanRowID, doc.Name, doc.StatusMessage, doc.Attributes, doc.Events})
+	for _, event := range span.GetEvents() {
+		eventID, err := newUUIDv7()
+		if err != nil {
+			return err
+		}
+		b.events = append(b.events, []driver.Value{eventID, spanRowID, event.GetName(), int64(event.GetTimeUnixNano()), int64(event.GetDroppedAttributesCount())})
+		if err := b.addAttributes("span_event_attributes", eventID, event.GetAttributes()); err != nil {
+			return err
+		}
+	}
+	for _, link := range span.GetLinks() {
+		linkID, err := newUUIDv7()
+		if err != nil {
+			return err
+		}
+		b.links = append(b.links, []driver.Value{
+			linkID,
+			spanRowID,
+			ingest.FormatTraceID(link.GetTraceId()),
+			ingest.FormatSpanID(link.GetSpanId()),
+			link.GetTraceState(),
+			int64(link.GetDroppedAttributesCount()),
+			int64(link.GetFlags()),
+		})
+		if err := b.addAttributes("span_link_attributes", linkID, link.GetAttributes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *writeBuffer) addAttributes(table, id string, attrs []*commonpb.KeyValue) error {
+	stored, err := storedAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	b.addStoredAttributes(table, id, stored)
+	return nil
+}
+
+func (b *writeBuffer) addStoredAttributes(table, id string, attrs []ingest.StoredAttribute) {
+	for _, attr := range attrs {
+		intValue, doubleValue, boolValue := attr.Typed()
+		b.attributes[table] = append(b.attributes[table], []driver.Value{id, attr.Key, attr.Type, attr.Value, intValue, doubleValue, boolValue})
+	}
+}
+
+// newContentRows drops buffered resource or scope rows that are already
+// stored and queues attributes for the rest.
+func (b *writeBuffer) newContentRows(ctx context.Context, conn *sql.Conn, table, attrTable string, rows [][]driver.Value, attrs map[string][]ingest.StoredAttribute) ([][]driver.Value, error) {
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row[0].(string)
+	}
+	existing, err := existingIDs(ctx, conn, table, ids)
+	if err != nil {
+		return nil, err
+	}
+	fresh := rows[:0:0]
+	for _, row := range rows {
+		id := row[0].(string)
+		if _, ok := existing[id]; ok {
+			continue
+		}
+		fresh = append(fresh, row)
+		b.addStoredAttributes(attrTable, id, attrs[id])
+	}
+	return fresh, nil
+}
+
+func storedAttributes(attrs []*commonpb.KeyValue) ([]ingest.StoredAttribute, error) {
+	stored := make([]ingest.StoredAttribute, 0, len(attrs))
+	for _, attr := range attrs {
+		attrType, attrValue, err := otlpconv.StoredForm(attr.GetValue())
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, ingest.StoredAttribute{Key: attr.GetKey(), Type: attrType, Value: attrValue})
+	}
+	return stored, nil
+}
+
+func existingIDs(ctx context.Context, conn *sql.Conn, table string, ids []string) (map[string]struct{}, error) {
+	existing := map[string]struct{}{}
+	for _, chunk := range chunkIDs(ids, maxBatchSize) {
+		query, args := buildInQuery("SELECT id FROM "+table+" WHERE id IN ", chunk)
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s: %w", table, err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("lookup %s: %w", table, err)
+			}
+			existing[id] = struct{}{}
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("lookup %s: %w", table, err)
+		}
+		_ = rows.Close()
+	}
+	return existing, nil
+}
+
+// Flush writes everything buffered by Consume. Queries flush first, so
+// callers only need it when reading through DB directly. When the write
+// fails, the requests stay buffered ahead of any consumed since and the next
+// flush retries them.
+func (s *Sink) Flush(ctx context.Context) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	buf := s.buffer
+	s.buffer = newWriteBuffer()
+	s.mu.Unlock()
+	if buf.empty() {
+		return nil
+	}
+	start := time.Now()
+	err := s.withConn(ctx, func(conn *sql.Conn) error {
+		return s.writeBuffered(ctx, conn, buf)
+	})
+	for _, req := range buf.reqs {
+		s.metrics.Observe(req, start, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.flushFailures = 0
+		return nil
+	}
+	s.flushFailures++
+	s.lastFlushError = err.Error()
+	// The failed buffer was changed while writing, so it is rebuilt from
+	// its requests rather than reused.
+	retry := newWriteBuffer()
+	for _, req := range append(buf.reqs, s.buffer.reqs...) {
+		if addErr := retry.add(req); addErr != nil && s.logger != nil {
+			s.logger.Printf("msg=requeue_failed store=duckdb err=%q", addErr)
+		}
+	}
+	s.buffer = retry
+	return err
+}
+
+// WriteFailures reports how many flushes in a row have failed, along with
+// the most recent error. Spans are written in the background, so these
+// failures never reach the caller of Consume.
+func (s *Sink) WriteFailures() (int, string) {
+	if s == nil {
+		return 0, ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushFailures, s.lastFlushError
+}
+
+func (s *Sink) flushLoop(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(context.Background()); err != nil && s.logger != nil {
+				s.logger.Printf("msg=flush_failed store=duckdb err=%q", err)
+			}
+		}
+	}
+}
+
+// writeBuffered appends the buffer in one transaction. The appender has no
+// conflict handling, so spans go through a temporary staging table and an
+// anti-join drops the ones already stored. INSERT OR IGNORE does the same
+// but checks the unique index row by row and is over ten times slower.
+func (s *Sink) writeBuffered(ctx context.Context, conn *sql.Conn, buf *writeBuffer) error {
+	if _, err := conn.ExecContext(ctx, "CREATE TEMP TABLE IF NOT EXISTS "+spanStagingTable+" AS SELECT * FROM spans LIMIT 0"); err != nil {
+		return fmt.Errorf("create span staging: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN TRANSACTION"); err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	if err := s.writeBufferedTx(ctx, conn, buf); err != nil {
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK")
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *Sink) writeBufferedTx(ctx context.Context, conn *sql.Conn, buf *writeBuffer) error {
+	spanRows := make([][]driver.Value, len(buf.spans))
+	pending := make(map[string]*tracepb.Span, len(buf.spans))
+	for i, span := range buf.spans {
+		spanRows[i] = span.row
+		pending[span.row[0].(string)] = span.span
+	}
+	// Resources and scopes are content-addressed and usually already stored.
+	resources, err := buf.newContentRows(ctx, conn, "resources", "resource_attributes", buf.resources, buf.resourceAttrs)
+	if err != nil {
+		return err
+	}
+	scopes, err := buf.newContentRows(ctx, conn, "scopes", "scope_attributes", buf.scopes, buf.scopeAttrs)
+	if err != nil {
+		return err
+	}
+	if err := conn.Raw(func(driverConn any) error {
+		if err := appendRows(driverConn, "", "resources", resources); err != nil {
+			return fmt.Errorf("append resources: %w", err)
+		}
+		if err := appendRows(driverConn, "", "scopes", scopes); err != nil {
+			return fmt.Errorf("append scopes: %w", err)
+		}
+		if err := appendRows(driverConn, "temp", spanStagingTable, spanRows); err != nil {
+			return fmt.Errorf("append spans: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, insertStagedSpans)
+	if err != nil {
+		return fmt.Errorf("insert spans: %w", err)
+	}
+	inserted := make([]string, 0, len(spanRows))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("scan inserted span: %w", err)
+		}
+		inserted = append(inserted, id)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return fmt.Errorf("insert spans: %w", err)
+	}
+	_ = rows.Close()
+	if _, err := conn.ExecContext(ctx, "DELETE FROM "+spanStagingTable); err != nil {
+		return fmt.Errorf("clear span staging: %w", err)
+	}
+
+	for _, id := range inserted {
+		if err := buf.addSpanChildren(id, pending[id]); err != nil {
+			return err
+		}
+	}
+	return conn.Raw(func(driverConn any) error {
+		if err := appendRows(driverConn, "", "span_events", buf.events); err != nil {
+			return fmt.Errorf("append events: %w", err)
+		}
+		if err := appendRows(driverConn, "", "span_links", buf.links); err != nil {
+			return fmt.Errorf("append links: %w", err)
+		}
+		if err := appendRows(driverConn, "", "span_search", buf.search); err != nil {
+			return fmt.Errorf("append span_search: %w", err)
+		}
+		for _, table := range attributeTables {
+			if err := appendRows(driverConn, "", table, buf.attributes[table]); err != nil {
+				return fmt.Errorf("append %s: %w", table, err)
+			}
+		}
+		return nil
+	})
+}
+
+func appendRows(driverConn any, catalog, table string, rows [][]driver.Value) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	conn, ok := driverConn.(driver.Conn)
+	if !ok {
+		return fmt.Errorf("unexpected driver connection %T", driverConn)
+	}
+	appender, err := duckdb.NewAppender(conn, catalog, "", table)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := appender.AppendRow(row...); err != nil {
+			_ = appender.Close()
+			return err
+		}
+	}
+	return appender.Close()
+}
@@ -0,0 +1,95 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// benchmarkRequest builds a tracegen-shaped request: one resource, one scope,
+// and spansPerRequest spans with a handful of attributes, an event, and a link.
+func benchmarkRequest(seq, spansPerRequest int) *coltracepb.ExportTraceServiceRequest {
+	spans := make([]*tracepb.Span, 0, spansPerRequest)
+	for i := 0; i < spansPerRequest; i++ {
+		traceID := make([]byte, 16)
+		binary.BigEndian.PutUint64(traceID[:8], uint64(seq))
+		binary.BigEndian.PutUint64(traceID[8:], uint64(i/10))
+		spanID := make([]byte, 8)
+		binary.BigEndian.PutUint64(spanID, uint64(seq)<<20|uint64(i))
+		start := uint64(1_700_000_000_000_000_000 + seq*1_000_000 + i)
+		spans = append(spans, &tracepb.Span{
+			TraceId:           traceID,
+			SpanId:            spanID,
+			Name:              "GET /bench",
+			Kind:              tracepb.Span_SPAN_KIND_SERVER,
+			StartTimeUnixNano: start,
+			EndTimeUnixNano:   start + 1_000_000,
+			Attributes: []*commonpb.KeyValue{
+				stringAttr("http.method", "GET"),
+				stringAttr("http.route", "/bench"),
+				{Key: "http.status_code", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 200}}},
+				stringAttr("net.peer.name", "client"),
+			},
+			Events: []*tracepb.Span_Event{{
+				Name:         "bench.event",
+				TimeUnixNano: start + 10,
+				Attributes:   []*commonpb.KeyValue{stringAttr("event.attr", "value")},
+			}},
+			Links: []*tracepb.Span_Link{{TraceId: traceID, SpanId: spanID}},
+		})
+	}
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				stringAttr("service.name", "bench-service"),
+				stringAttr("host.name", "bench-host"),
+			}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: "bench", Version: "1.0.0"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+// BenchmarkDuckDBSinkConsume includes Close in the timed section so spans
+// still buffered for the appender are counted only once they are written.
+func BenchmarkDuckDBSinkConsume(b *testing.B) {
+	for _, spansPerRequest := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("spans=%d", spansPerRequest), func(b *testing.B) {
+			sink, err := New(filepath.Join(b.TempDir(), "bench.duckdb"))
+			if err != nil {
+				b.Fatalf("new sink: %v", err)
+			}
+			reqs := make([]*coltracepb.ExportTraceServiceRequest, b.N)
+			for i := range reqs {
+				reqs[i] = benchmarkRequest(i, spansPerRequest)
+			}
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := sink.Consume(ctx, reqs[i]); err != nil {
+					b.Fatalf("consume: %v", err)
+				}
+			}
+			if err := sink.Close(); err != nil {
+				b.Fatalf("close: %v", err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N*spansPerRequest)/b.Elapsed().Seconds(), "spans/s")
+		})
+	}
+}
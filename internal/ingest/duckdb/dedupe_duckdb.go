@@ -0,0 +1,194 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"smelldeadfish/internal/ingest"
+)
+
+const collapsePageSize = 500
+
+// contentTable describes a table whose rows are content-addressed.
+type contentTable struct {
+	table     string
+	columns   []string
+	attrTable string
+	idColumn  string
+	contentID func(values []string, attrs []ingest.StoredAttribute) string
+}
+
+var contentTables = []contentTable{
+	{
+		table:     "resources",
+		columns:   []string{"schema_url"},
+		attrTable: "resource_attributes",
+		idColumn:  "resource_id",
+		contentID: func(values []string, attrs []ingest.StoredAttribute) string {
+			return ingest.ResourceID(values[0], attrs)
+		},
+	},
+	{
+		table:     "scopes",
+		columns:   []string{"name", "version", "schema_url"},
+		attrTable: "scope_attributes",
+		idColumn:  "scope_id",
+		contentID: func(values []string, attrs []ingest.StoredAttribute) string {
+			return ingest.ScopeID(values[0], values[1], values[2], attrs)
+		},
+	},
+}
+
+type legacyRow struct {
+	id     string
+	values []string
+}
+
+// collapseLegacyIDs rewrites resources and scopes stored under random UUIDs
+// by earlier versions to their content-addressed IDs. Duplicates collapse
+// into one row and spans are repointed.
+func collapseLegacyIDs(ctx context.Context, tx *sql.Tx) error {
+	for _, table := range contentTables {
+		if err := collapseTable(ctx, tx, table); err != nil {
+			return fmt.Errorf("collapse %s: %w", table.table, err)
+		}
+	}
+	return nil
+}
+
+func collapseTable(ctx context.Context, tx *sql.Tx, table contentTable) error {
+	// Content IDs are plain hex, so any ID with a dash is a legacy UUID.
+	page, err := loadLegacyRows(ctx, tx, table, "")
+	if err != nil || len(page) == 0 {
+		return err
+	}
+	statements := []string{
+		"CREATE TEMP TABLE IF NOT EXISTS content_id_map (old_id TEXT PRIMARY KEY, new_id TEXT NOT NULL)",
+		"DELETE FROM content_id_map",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	for len(page) > 0 {
+		ids := make([]string, len(page))
+		for i, row := range page {
+			ids[i] = row.id
+		}
+		attrs, err := loadStoredAttributes(ctx, tx, table, ids)
+		if err != nil {
+			return err
+		}
+		for _, row := range page {
+			newID := table.contentID(row.values, attrs[row.id])
+			if _, err := tx.ExecContext(ctx, "INSERT INTO content_id_map (old_id, new_id) VALUES (?, ?)", row.id, newID); err != nil {
+				return err
+			}
+			if err := insertContentRow(ctx, tx, table, newID, row.values, attrs[row.id]); err != nil {
+				return err
+			}
+		}
+		page, err = loadLegacyRows(ctx, tx, table, page[len(page)-1].id)
+		if err != nil {
+			return err
+		}
+	}
+
+	statements = []string{
+		fmt.Sprintf("UPDATE spans SET %[1]s = (SELECT new_id FROM content_id_map WHERE old_id = spans.%[1]s) WHERE %[1]s IN (SELECT old_id FROM content_id_map)", table.idColumn),
+		fmt.Sprintf("DELETE FROM %s WHERE %s IN (SELECT old_id FROM content_id_map)", table.attrTable, table.idColumn),
+		fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT old_id FROM content_id_map)", table.table),
+		"DELETE FROM content_id_map",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadLegacyRows(ctx context.Context, tx *sql.Tx, table contentTable, after string) ([]legacyRow, error) {
+	query := fmt.Sprintf("SELECT id, %s FROM %s WHERE id LIKE '%%-%%' AND id > ? ORDER BY id LIMIT %d", coalesceColumns(table.columns), table.table, collapsePageSize)
+	rows, err := tx.QueryContext(ctx, query, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var page []legacyRow
+	for rows.Next() {
+		row := legacyRow{values: make([]string, len(table.columns))}
+		dest := make([]interface{}, 0, len(table.columns)+1)
+		dest = append(dest, &row.id)
+		for i := range row.values {
+			dest = append(dest, &row.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		page = append(page, row)
+	}
+	return page, rows.Err()
+}
+
+func loadStoredAttributes(ctx context.Context, tx *sql.Tx, table contentTable, ids []string) (map[string][]ingest.StoredAttribute, error) {
+	result := make(map[string][]ingest.StoredAttribute, len(ids))
+	for _, chunk := range chunkIDs(ids, maxBatchSize) {
+		query, args := buildInQuery(fmt.Sprintf("SELECT %s, key, type, COALESCE(value, '') FROM %s WHERE %s IN ", table.idColumn, table.attrTable, table.idColumn), chunk)
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			var attr ingest.StoredAttribute
+			if err := rows.Scan(&id, &attr.Key, &attr.Type, &attr.Value); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			result[id] = append(result[id], attr)
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		_ = rows.Close()
+	}
+	return result, nil
+}
+
+func insertContentRow(ctx context.Context, tx *sql.Tx, table contentTable, id string, values []string, attrs []ingest.StoredAttribute) error {
+	args := make([]interface{}, 0, len(values)+1)
+	args = append(args, id)
+	for _, value := range values {
+		args = append(args, value)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (id, %s) VALUES (?%s) ON CONFLICT(id) DO NOTHING RETURNING id", table.table, strings.Join(table.columns, ", "), strings.Repeat(", ?", len(values)))
+	var inserted string
+	switch err := tx.QueryRowContext(ctx, query, args...).Scan(&inserted); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+	default:
+		return err
+	}
+	for _, attr := range attrs {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s, key, type, value) VALUES (?, ?, ?, ?)", table.attrTable, table.idColumn), id, attr.Key, attr.Type, attr.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func coalesceColumns(columns []string) string {
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = fmt.Sprintf("COALESCE(%s, '')", column)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,105 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestDuckDBSinkSharesResourcesAndScopes(t *testing.T) {
+	sink, err := New(filepath.Join(t.TempDir(), "spans.duckdb"))
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	defer sink.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := sink.Consume(ctx, benchmarkRequest(i, 2)); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	want := map[string]int{"resources": 1, "resource_attributes": 2, "scopes": 1, "scope_attributes": 0, "spans": 6}
+	for table, expected := range want {
+		if got := countRows(t, sink, table); got != expected {
+			t.Fatalf("expected %d rows in %s, got %d", expected, table, got)
+		}
+	}
+}
+
+func TestDuckDBSinkCollapsesLegacyResources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.duckdb")
+	// A file as written before schema versioning: the initial tables only,
+	// with one random ID per request.
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatalf("open legacy db: %v", err)
+	}
+	legacy := []string{
+		initialSchema,
+		"INSERT INTO resources (id, schema_url) VALUES ('0190-a', ''), ('0190-b', ''), ('0190-c', '')",
+		"INSERT INTO resource_attributes (resource_id, key, type, value) VALUES ('0190-a', 'service.name', 'string', 'legacy'), ('0190-a', 'host.name', 'string', 'h1'), ('0190-b', 'host.name', 'string', 'h1'), ('0190-b', 'service.name', 'string', 'legacy'), ('0190-c', 'service.name', 'string', 'other')",
+		"INSERT INTO scopes (id, name, version, schema_url) VALUES ('0191-a', 'lib', '1.0', ''), ('0191-b', 'lib', '1.0', ''), ('0191-c', 'lib', '1.0', '')",
+		`INSERT INTO spans (id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id) VALUES
+		('s1', 't1', 'a1', '', 'one', 'server', 10, 20, 0, '', 'legacy', 0, '0190-a', '0191-a'),
+		('s2', 't1', 'a2', 'a1', 'two', 'server', 11, 19, 0, '', 'legacy', 0, '0190-b', '0191-b'),
+		('s3', 't2', 'a3', '', 'three', 'server', 12, 18, 0, '', 'other', 0, '0190-c', '0191-c')`,
+	}
+	for _, stmt := range legacy {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("seed legacy rows: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close legacy db: %v", err)
+	}
+
+	sink, err := New(path)
+	if err != nil {
+		t.Fatalf("reopen sink: %v", err)
+	}
+	defer sink.Close()
+
+	want := map[string]int{"resources": 2, "resource_attributes": 3, "scopes": 1, "spans": 3}
+	for table, expected := range want {
+		if got := countRows(t, sink, table); got != expected {
+			t.Fatalf("expected %d rows in %s, got %d", expected, table, got)
+		}
+	}
+	resourceID := ingest.ResourceID("", []ingest.StoredAttribute{
+		{Key: "service.name", Type: "string", Value: "legacy"},
+		{Key: "host.name", Type: "string", Value: "h1"},
+	})
+	scopeID := ingest.ScopeID("lib", "1.0", "", nil)
+	rows, err := sink.DB().Query("SELECT resource_id, scope_id FROM spans WHERE trace_id = 't1'")
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var gotResource, gotScope string
+		if err := rows.Scan(&gotResource, &gotScope); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		if gotResource != resourceID || gotScope != scopeID {
+			t.Fatalf("expected span to point at %s/%s, got %s/%s", resourceID, scopeID, gotResource, gotScope)
+		}
+	}
+
+	spans, err := sink.QueryTraceSpans(context.Background(), spanstore.TraceSpansQueryParams{TraceID: "t2"})
+	if err != nil {
+		t.Fatalf("query trace spans: %v", err)
+	}
+	if len(spans) != 1 || spans[0].Resource.Attributes["service.name"] != "other" || spans[0].Scope.Name != "lib" {
+		t.Fatalf("unexpected collapsed span: %+v", spans)
+	}
+}
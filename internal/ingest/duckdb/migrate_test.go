@@ -0,0 +1,106 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestDuckDBSinkBackfillsTypedAttributes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.duckdb")
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatalf("open legacy db: %v", err)
+	}
+	legacy := []string{
+		initialSchema,
+		"INSERT INTO resources (id, schema_url) VALUES ('r1', '')",
+		"INSERT INTO scopes (id, name, version, schema_url) VALUES ('c1', 'lib', '1.0', '')",
+		"INSERT INTO spans (id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id) VALUES ('s1', 't1', 'a1', '', 'one', 'server', 10, 20, 0, '', 'typed', 0, 'r1', 'c1')",
+		"INSERT INTO span_attributes (span_id, key, type, value) VALUES ('s1', 'http.status_code', 'int', '503'), ('s1', 'ratio', 'double', '0.5'), ('s1', 'cached', 'bool', 'true'), ('s1', 'nan', 'double', 'NaN'), ('s1', 'route', 'string', '7')",
+	}
+	for _, stmt := range legacy {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("seed legacy rows: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close legacy db: %v", err)
+	}
+
+	sink, err := New(path)
+	if err != nil {
+		t.Fatalf("reopen sink: %v", err)
+	}
+	defer sink.Close()
+
+	var intValue sql.NullInt64
+	var doubleValue sql.NullFloat64
+	var boolValue sql.NullBool
+	row := sink.DB().QueryRow("SELECT (SELECT int_value FROM span_attributes WHERE key = 'http.status_code'), (SELECT double_value FROM span_attributes WHERE key = 'ratio'), (SELECT bool_value FROM span_attributes WHERE key = 'cached')")
+	if err := row.Scan(&intValue, &doubleValue, &boolValue); err != nil {
+		t.Fatalf("read typed columns: %v", err)
+	}
+	if intValue.Int64 != 503 || doubleValue.Float64 != 0.5 || !boolValue.Bool {
+		t.Fatalf("unexpected backfill: %v %v %v", intValue, doubleValue, boolValue)
+	}
+	var untyped int
+	if err := sink.DB().QueryRow("SELECT COUNT(*) FROM span_attributes WHERE key = 'route' AND int_value IS NULL AND double_value IS NULL AND bool_value IS NULL").Scan(&untyped); err != nil || untyped != 1 {
+		t.Fatalf("expected string attribute to stay untyped, got %d (%v)", untyped, err)
+	}
+
+	spans, err := sink.QuerySpans(context.Background(), spanstore.QueryParams{Service: "typed", Start: 0, End: 100, Limit: 10, AttrFilters: []spanstore.AttrFilter{
+		{Key: "http.status_code", Op: spanstore.AttrOpGreaterEqual, Value: "500"},
+	}})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if len(spans) != 1 || spans[0].Attributes["http.status_code"] != int64(503) || spans[0].Attributes["cached"] != true {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	if nan, ok := spans[0].Attributes["nan"].(float64); !ok || !math.IsNaN(nan) {
+		t.Fatalf("expected NaN attribute to round-trip, got %#v", spans[0].Attributes["nan"])
+	}
+}
+
+func TestDuckDBSinkIndexesExistingSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.duckdb")
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatalf("open legacy db: %v", err)
+	}
+	legacy := []string{
+		initialSchema,
+		"INSERT INTO resources (id, schema_url) VALUES ('r1', '')",
+		"INSERT INTO scopes (id, name, version, schema_url) VALUES ('c1', 'lib', '1.0', '')",
+		"INSERT INTO spans (id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id) VALUES ('s1', 't1', 'a1', '', 'one', 'server', 10, 20, 0, '', 'shop', 0, 'r1', 'c1')",
+		"INSERT INTO span_attributes (span_id, key, type, value) VALUES ('s1', 'order.id', 'string', 'ORD-777'), ('s1', 'attempt', 'int', '777')",
+	}
+	for _, stmt := range legacy {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("seed legacy rows: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close legacy db: %v", err)
+	}
+
+	sink, err := New(path)
+	if err != nil {
+		t.Fatalf("reopen sink: %v", err)
+	}
+	defer sink.Close()
+	spans, err := sink.QuerySpans(context.Background(), spanstore.QueryParams{Service: "shop", Start: 0, End: 100, Limit: 10, Text: "777"})
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if len(spans) != 1 || spans[0].Match.Highlights["attributes"] != "ORD-<mark>777</mark>" {
+		t.Fatalf("unexpected matches: %+v", spans)
+	}
+}
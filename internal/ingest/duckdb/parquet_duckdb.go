@@ -0,0 +1,100 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+// WriteParquet writes the spans matching params to path with COPY ... TO, in
+// the layout of parquetexport.Schema. After and Limit are ignored.
+func (s *Sink) WriteParquet(ctx context.Context, params spanstore.ExportParams, path string) (int64, error) {
+	query := buildParquetQuery(params, path)
+	var spans int64
+	err := s.withReadConn(ctx, func(conn *sql.Conn) error {
+		result, err := conn.ExecContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("copy spans to parquet: %w", err)
+		}
+		spans, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return spans, nil
+}
+
+// buildParquetQuery inlines its values because COPY does not take
+// parameters. Attribute maps are sorted by key and keep one value per key.
+func buildParquetQuery(params spanstore.ExportParams, path string) string {
+	end := params.End
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	filter := fmt.Sprintf("start_time_unix_nano >= %d AND start_time_unix_nano <= %d", params.Start, end)
+	if service := strings.TrimSpace(params.Service); service != "" {
+		filter += " AND service_name = " + quoteLiteral(service)
+	}
+	return `COPY (
+WITH selected AS (
+  SELECT id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, resource_id, scope_id
+  FROM spans
+  WHERE ` + filter + `
+),
+span_maps AS (
+  SELECT owner, map_from_entries(list({'key': key, 'value': value} ORDER BY key)) AS attributes
+  FROM (
+    SELECT span_id AS owner, key, min(value) AS value FROM span_attributes
+    WHERE span_id IN (SELECT id FROM selected) GROUP BY span_id, key
+  ) GROUP BY owner
+),
+resource_maps AS (
+  SELECT owner, map_from_entries(list({'key': key, 'value': value} ORDER BY key)) AS attributes
+  FROM (
+    SELECT resource_id AS owner, key, min(value) AS value FROM resource_attributes
+    WHERE resource_id IN (SELECT resource_id FROM selected) GROUP BY resource_id, key
+  ) GROUP BY owner
+),
+scope_maps AS (
+  SELECT owner, map_from_entries(list({'key': key, 'value': value} ORDER BY key)) AS attributes
+  FROM (
+    SELECT scope_id AS owner, key, min(value) AS value FROM scope_attributes
+    WHERE scope_id IN (SELECT scope_id FROM selected) GROUP BY scope_id, key
+  ) GROUP BY owner
+)
+SELECT
+  s.trace_id,
+  s.span_id,
+  NULLIF(s.parent_span_id, '` + rootSpanParentID + `') AS parent_span_id,
+  s.name,
+  s.kind,
+  s.start_time_unix_nano,
+  s.end_time_unix_nano,
+  s.end_time_unix_nano - s.start_time_unix_nano AS duration_nano,
+  CAST(s.status_code AS INTEGER) AS status_code,
+  s.status_message,
+  s.service_name,
+  r.attributes AS resource_attributes,
+  COALESCE(sc.name, '') AS scope_name,
+  COALESCE(sc.version, '') AS scope_version,
+  scm.attributes AS scope_attributes,
+  sa.attributes AS attributes
+FROM selected s
+LEFT JOIN span_maps sa ON sa.owner = s.id
+LEFT JOIN resource_maps r ON r.owner = s.resource_id
+LEFT JOIN scopes sc ON sc.id = s.scope_id
+LEFT JOIN scope_maps scm ON scm.owner = s.scope_id
+ORDER BY s.start_time_unix_nano, s.trace_id, s.span_id
+) TO ` + quoteLiteral(path) + ` (FORMAT parquet, COMPRESSION zstd)`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
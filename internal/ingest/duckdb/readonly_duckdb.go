@@ -0,0 +1,49 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/migrate"
+)
+
+var errReadOnly = errors.New("duckdb sink is read-only")
+
+// OpenReadOnly opens an existing database in DuckDB's read-only access mode.
+// It never creates, migrates, or writes the file, and Consume fails. DuckDB
+// locks the file, so this fails while another process has it open for
+// writing.
+func OpenReadOnly(path string, opts Options) (*Sink, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("open duckdb: %w", err)
+	}
+	db, err := sql.Open("duckdb", path+"?access_mode=READ_ONLY")
+	if err != nil {
+		return nil, fmt.Errorf("open duckdb: %w", err)
+	}
+	if err := migrate.RequireCurrent(context.Background(), db, migrations); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("check schema: %w", err)
+	}
+	db.SetMaxOpenConns(4)
+	db.SetMaxIdleConns(0)
+	s := &Sink{
+		db:       db,
+		path:     path,
+		metrics:  ingest.NewWriteMetrics(opts.Metrics, "duckdb"),
+		logger:   opts.Logger,
+		readOnly: true,
+		buffer:   newWriteBuffer(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	// Nothing is ever buffered, so there is no flush loop to wait for.
+	close(s.done)
+	return s, nil
+}
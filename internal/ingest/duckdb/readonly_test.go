@@ -0,0 +1,67 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.duckdb")
+	writer, err := New(path)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	ctx := context.Background()
+	if err := writer.Consume(ctx, benchmarkRequest(1, 3)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	reader, err := OpenReadOnly(path, Options{})
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	if got := countRows(t, reader, "spans"); got != 3 {
+		t.Fatalf("expected 3 spans, got %d", got)
+	}
+	traces, err := reader.QueryTraces(ctx, spanstore.TraceQueryParams{Service: "bench-service", Start: 0, End: 1 << 62, Limit: 10})
+	if err != nil || len(traces) != 1 {
+		t.Fatalf("expected 1 trace, got %v: %v", traces, err)
+	}
+	result, err := reader.QuerySQL(ctx, spanstore.SQLQuery{Query: "SELECT COUNT(*) FROM spans"})
+	if err != nil || len(result.Rows) != 1 || result.Rows[0][0] != int64(3) {
+		t.Fatalf("expected the console to count 3 spans, got %+v: %v", result, err)
+	}
+	if err := reader.Consume(ctx, benchmarkRequest(2, 1)); err == nil {
+		t.Fatal("expected consume on read-only sink to fail")
+	}
+	if _, err := reader.DB().ExecContext(ctx, "DELETE FROM spans"); err == nil {
+		t.Fatal("expected delete on read-only handle to fail")
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("close reader: %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size() {
+		t.Fatal("expected read-only open to leave the file untouched")
+	}
+
+	if _, err := OpenReadOnly(filepath.Join(t.TempDir(), "missing.duckdb"), Options{}); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
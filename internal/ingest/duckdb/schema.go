@@ -1,6 +1,6 @@
 package duckdb
 
-const schema = `
+const initialSchema = `
 CREATE TABLE IF NOT EXISTS resources (
   id TEXT PRIMARY KEY,
   schema_url TEXT
@@ -99,3 +99,62 @@ CREATE TABLE IF NOT EXISTS span_link_attributes (
 
 CREATE INDEX IF NOT EXISTS span_link_attributes_link_idx ON span_link_attributes(link_id);
 `
+
+// typedAttributeColumns keeps int, double and bool attributes in native
+// columns next to their string form so they can be compared numerically.
+const typedAttributeColumns = `
+ALTER TABLE resource_attributes ADD COLUMN int_value BIGINT;
+ALTER TABLE resource_attributes ADD COLUMN double_value DOUBLE;
+ALTER TABLE resource_attributes ADD COLUMN bool_value BOOLEAN;
+ALTER TABLE scope_attributes ADD COLUMN int_value BIGINT;
+ALTER TABLE scope_attributes ADD COLUMN double_value DOUBLE;
+ALTER TABLE scope_attributes ADD COLUMN bool_value BOOLEAN;
+ALTER TABLE span_attributes ADD COLUMN int_value BIGINT;
+ALTER TABLE span_attributes ADD COLUMN double_value DOUBLE;
+ALTER TABLE span_attributes ADD COLUMN bool_value BOOLEAN;
+ALTER TABLE span_event_attributes ADD COLUMN int_value BIGINT;
+ALTER TABLE span_event_attributes ADD COLUMN double_value DOUBLE;
+ALTER TABLE span_event_attributes ADD COLUMN bool_value BOOLEAN;
+ALTER TABLE span_link_attributes ADD COLUMN int_value BIGINT;
+ALTER TABLE span_link_attributes ADD COLUMN double_value DOUBLE;
+ALTER TABLE span_link_attributes ADD COLUMN bool_value BOOLEAN;
+
+UPDATE resource_attributes SET int_value = TRY_CAST(value AS BIGINT) WHERE type = 'int';
+UPDATE resource_attributes SET double_value = TRY_CAST(value AS DOUBLE) WHERE type = 'double';
+UPDATE resource_attributes SET bool_value = TRY_CAST(value AS BOOLEAN) WHERE type = 'bool';
+UPDATE scope_attributes SET int_value = TRY_CAST(value AS BIGINT) WHERE type = 'int';
+UPDATE scope_attributes SET double_value = TRY_CAST(value AS DOUBLE) WHERE type = 'double';
+UPDATE scope_attributes SET bool_value = TRY_CAST(value AS BOOLEAN) WHERE type = 'bool';
+UPDATE span_attributes SET int_value = TRY_CAST(value AS BIGINT) WHERE type = 'int';
+UPDATE span_attributes SET double_value = TRY_CAST(value AS DOUBLE) WHERE type = 'double';
+UPDATE span_attributes SET bool_value = TRY_CAST(value AS BOOLEAN) WHERE type = 'bool';
+UPDATE span_event_attributes SET int_value = TRY_CAST(value AS BIGINT) WHERE type = 'int';
+UPDATE span_event_attributes SET double_value = TRY_CAST(value AS DOUBLE) WHERE type = 'double';
+UPDATE span_event_attributes SET bool_value = TRY_CAST(value AS BOOLEAN) WHERE type = 'bool';
+UPDATE span_link_attributes SET int_value = TRY_CAST(value AS BIGINT) WHERE type = 'int';
+UPDATE span_link_attributes SET double_value = TRY_CAST(value AS DOUBLE) WHERE type = 'double';
+UPDATE span_link_attributes SET bool_value = TRY_CAST(value AS BOOLEAN) WHERE type = 'bool';
+`
+
+// spanSearchSchema holds the text a span can be found by for free-text search
+// and fills it from the spans already stored. Values in attributes and events
+// are joined with ingest.SearchSeparator. The fts extension is not used
+// because its index is not updated on insert; queries scan this table
+// instead.
+const spanSearchSchema = `
+CREATE TABLE IF NOT EXISTS span_search (
+  span_id TEXT NOT NULL,
+  name TEXT NOT NULL,
+  status_message TEXT NOT NULL,
+  attributes TEXT NOT NULL,
+  events TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS span_search_span_idx ON span_search(span_id);
+
+INSERT INTO span_search (span_id, name, status_message, attributes, events)
+SELECT s.id, s.name, s.status_message,
+  COALESCE((SELECT string_agg(a.value, ' | ') FROM span_attributes a WHERE a.span_id = s.id AND a.type = 'string'), ''),
+  COALESCE((SELECT string_agg(e.name, ' | ') FROM span_events e WHERE e.span_id = s.id), '')
+FROM spans s;
+`
@@ -0,0 +1,104 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/spanstore"
+)
+
+var searchColumns = []string{"name", "status_message", "attributes", "events"}
+
+// writeSearchJoin restricts a spans query to rows matching every term of
+// text as ingest.MatchText does and exposes their rank as m.search_rank,
+// lower being better. The rank is the negated weighted occurrence count that
+// ingest.MatchText reports as the score.
+func writeSearchJoin(builder *strings.Builder, args []interface{}, text string) []interface{} {
+	terms := ingest.SearchTerms(text)
+	counts := make([]string, 0, len(terms)*len(searchColumns))
+	conditions := make([]string, 0, len(terms))
+	var conditionArgs []interface{}
+	for _, term := range terms {
+		pattern, ok := ingest.TermPattern(term)
+		if !ok {
+			conditions = append(conditions, "FALSE")
+			continue
+		}
+		contains := make([]string, len(searchColumns))
+		for i, column := range searchColumns {
+			counts = append(counts, fmt.Sprintf("%g * len(regexp_extract_all(lower(%s), ?))", ingest.SearchWeights[i], column))
+			contains[i] = fmt.Sprintf("regexp_matches(lower(%s), ?)", column)
+			args = append(args, pattern)
+			conditionArgs = append(conditionArgs, pattern)
+		}
+		conditions = append(conditions, "("+strings.Join(contains, " OR ")+")")
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "0")
+	}
+	builder.WriteString("\nJOIN (SELECT span_id AS span_row_id, -(" + strings.Join(counts, " + ") + ") AS search_rank FROM span_search WHERE " + strings.Join(conditions, " AND ") + ") m ON m.span_row_id = spans.id")
+	return append(args, conditionArgs...)
+}
+
+func (s *Sink) loadTextMatches(ctx context.Context, conn *sql.Conn, text string, spanIDs []string) (map[string]*spanstore.TextMatch, error) {
+	terms := ingest.SearchTerms(text)
+	result := make(map[string]*spanstore.TextMatch, len(spanIDs))
+	for _, batch := range chunkIDs(spanIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT span_id, '', name, status_message, attributes, events FROM span_search WHERE span_id IN ", batch)
+		err := scanTextMatches(ctx, conn, query, args, terms, func(spanRowID, _ string, match *spanstore.TextMatch) {
+			result[spanRowID] = match
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// loadTraceTextMatches returns the best-matching span of each trace.
+func (s *Sink) loadTraceTextMatches(ctx context.Context, conn *sql.Conn, text string, traceIDs []string) (map[string]*spanstore.TextMatch, error) {
+	terms := ingest.SearchTerms(text)
+	result := make(map[string]*spanstore.TextMatch, len(traceIDs))
+	for _, batch := range chunkIDs(traceIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT spans.trace_id, spans.span_id, m.name, m.status_message, m.attributes, m.events FROM span_search m JOIN spans ON spans.id = m.span_id WHERE spans.trace_id IN ", batch)
+		err := scanTextMatches(ctx, conn, query+" ORDER BY spans.start_time_unix_nano", args, terms, func(traceID, spanID string, match *spanstore.TextMatch) {
+			if best, ok := result[traceID]; !ok || match.Score > best.Score {
+				match.SpanID = spanID
+				result[traceID] = match
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// scanTextMatches reads rows of (id, span_id, search fields) and reports the
+// ones matching terms; span_id is empty for span matches.
+func scanTextMatches(ctx context.Context, conn *sql.Conn, query string, args []interface{}, terms []string, add func(id, spanID string, match *spanstore.TextMatch)) error {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("load text matches: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, spanID string
+		var doc ingest.SearchDocument
+		if err := rows.Scan(&id, &spanID, &doc.Name, &doc.StatusMessage, &doc.Attributes, &doc.Events); err != nil {
+			return fmt.Errorf("scan text match: %w", err)
+		}
+		if match, ok := ingest.MatchText(doc, terms); ok {
+			add(id, spanID, match)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate text matches: %w", err)
+	}
+	return nil
+}
@@ -5,21 +5,24 @@ package duckdb
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
-	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
-	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
-	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
 
 	_ "github.com/duckdb/duckdb-go/v2"
 	"github.com/google/uuid"
 
 	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/migrate"
+	"smelldeadfish/internal/otlpconv"
 	"smelldeadfish/internal/spanstore"
 )
 
@@ -33,41 +36,75 @@ const (
 	attrTypeKVList   = "kvlist"
 	rootSpanParentID = "0000000000000000"
 	maxBatchSize     = 200
+	// maxBufferedFlushes bounds the spans kept in memory while flushes fail,
+	// as a multiple of FlushSpans.
+	maxBufferedFlushes = 10
 )
 
+type Options struct {
+	Metrics *metrics.Registry
+	// FlushInterval bounds how long consumed spans wait in memory before
+	// they are appended. Defaults to one second.
+	FlushInterval time.Duration
+	// FlushSpans triggers a flush from Consume once this many spans are
+	// buffered. Defaults to 10000.
+	FlushSpans int
+	Logger     *log.Logger
+}
+
 type Sink struct {
-	db *sql.DB
+	db         *sql.DB
+	path       string
+	metrics    ingest.WriteMetrics
+	logger     *log.Logger
+	flushSpans int
+	readOnly   bool
+
+	mu             sync.Mutex
+	buffer         *writeBuffer
+	closed         bool
+	flushFailures  int
+	lastFlushError string
+	flushMu        sync.Mutex
+	stop           chan struct{}
+	done           chan struct{}
 }
 
 func New(path string) (*Sink, error) {
+	return NewWithOptions(path, Options{})
+}
+
+func NewWithOptions(path string, opts Options) (*Sink, error) {
 	db, err := sql.Open("duckdb", path)
 	if err != nil {
 		return nil, fmt.Errorf("open duckdb: %w", err)
 	}
-	if err := execSchema(db); err != nil {
+	if _, err := migrate.Apply(context.Background(), db, migrations); err != nil {
 		_ = db.Close()
-		return nil, err
+		return nil, fmt.Errorf("migrate schema: %w", err)
 	}
 	db.SetMaxOpenConns(4)
 	db.SetMaxIdleConns(0)
-	return &Sink{db: db}, nil
-}
-
-func execSchema(db *sql.DB) error {
-	if db == nil {
-		return fmt.Errorf("duckdb connection unavailable")
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = defaultFlushInterval
 	}
-	statements := strings.Split(schema, ";")
-	for _, stmt := range statements {
-		stmt = strings.TrimSpace(stmt)
-		if stmt == "" {
-			continue
-		}
-		if _, err := db.Exec(stmt); err != nil {
-			return fmt.Errorf("init schema: %w", err)
-		}
+	flushSpans := opts.FlushSpans
+	if flushSpans <= 0 {
+		flushSpans = defaultFlushSpans
 	}
-	return nil
+	s := &Sink{
+		db:         db,
+		path:       path,
+		metrics:    ingest.NewWriteMetrics(opts.Metrics, "duckdb"),
+		logger:     opts.Logger,
+		flushSpans: flushSpans,
+		buffer:     newWriteBuffer(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go s.flushLoop(interval)
+	return s, nil
 }
 
 func (s *Sink) withConn(ctx context.Context, fn func(*sql.Conn) error) error {
@@ -82,11 +119,35 @@ func (s *Sink) withConn(ctx context.Context, fn func(*sql.Conn) error) error {
 	return fn(conn)
 }
 
+// Close flushes buffered spans before closing the database.
 func (s *Sink) Close() error {
 	if s == nil || s.db == nil {
 		return nil
 	}
-	return s.db.Close()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	<-s.done
+	flushErr := s.Flush(context.Background())
+	return errors.Join(flushErr, s.db.Close())
+}
+
+// Ping runs a trivial read against the spans table so a locked or missing
+// database is reported rather than just an open handle.
+func (s *Sink) Ping(ctx context.Context) error {
+	return s.withConn(ctx, func(conn *sql.Conn) error {
+		var one int
+		err := conn.QueryRowContext(ctx, "SELECT 1 FROM spans LIMIT 1").Scan(&one)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("ping: %w", err)
+		}
+		return nil
+	})
 }
 
 func (s *Sink) DB() *sql.DB {
@@ -96,55 +157,60 @@ func (s *Sink) DB() *sql.DB {
 	return s.db
 }
 
+// Consume buffers the request for the next flush, which happens once
+// FlushSpans spans are pending, every FlushInterval, on Close, or before a
+// query.
 func (s *Sink) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
 	if s == nil || s.db == nil || req == nil {
 		return nil
 	}
-	return s.withConn(ctx, func(conn *sql.Conn) error {
-		tx, err := conn.BeginTx(ctx, nil)
-		if err != nil {
-			return fmt.Errorf("begin transaction: %w", err)
-		}
-		if err := s.consumeTx(ctx, tx, req); err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("commit transaction: %w", err)
+	if s.readOnly {
+		return errReadOnly
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("duckdb sink closed")
+	}
+	if s.flushFailures > 0 && len(s.buffer.spans) >= s.flushSpans*maxBufferedFlushes {
+		lastError := s.lastFlushError
+		s.mu.Unlock()
+		return fmt.Errorf("duckdb write buffer full after failed flushes: %s", lastError)
+	}
+	err := s.buffer.add(req)
+	full := len(s.buffer.spans) >= s.flushSpans
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// A failed flush keeps req buffered for the next one, so it is only
+	// logged and reported through WriteFailures.
+	if full {
+		if err := s.Flush(ctx); err != nil && s.logger != nil {
+			s.logger.Printf("msg=flush_failed store=duckdb err=%q", err)
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
-func (s *Sink) consumeTx(ctx context.Context, tx *sql.Tx, req *coltracepb.ExportTraceServiceRequest) error {
-	for _, resourceSpans := range req.GetResourceSpans() {
-		serviceName := ingest.ResourceServiceName(resourceSpans.GetResource())
-		resourceID, err := s.insertResource(ctx, tx, resourceSpans.GetResource(), resourceSpans.GetSchemaUrl())
-		if err != nil {
-			return err
-		}
-		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
-			scopeID, err := s.insertScope(ctx, tx, scopeSpans.GetScope(), scopeSpans.GetSchemaUrl())
-			if err != nil {
-				return err
-			}
-			for _, span := range scopeSpans.GetSpans() {
-				if err := s.insertSpan(ctx, tx, span, serviceName, resourceID, scopeID); err != nil {
-					return err
-				}
-			}
-		}
+// withReadConn flushes buffered spans so queries see everything consumed
+// so far. A failed flush is not the reader's error: the spans stay buffered
+// and WriteFailures reports it, so the query runs on what is stored.
+func (s *Sink) withReadConn(ctx context.Context, fn func(*sql.Conn) error) error {
+	if err := s.Flush(ctx); err != nil && s.logger != nil {
+		s.logger.Printf("msg=flush_failed store=duckdb err=%q", err)
 	}
-	return nil
+	return s.withConn(ctx, fn)
 }
 
 func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]spanstore.Span, error) {
 	if params.Limit <= 0 {
 		params.Limit = 100
 	}
+	params.Text = strings.TrimSpace(params.Text)
 	query, args := buildSpanQuery(params)
 	var spans []spanstore.Span
-	if err := s.withConn(ctx, func(conn *sql.Conn) error {
+	if err := s.withReadConn(ctx, func(conn *sql.Conn) error {
 		spans = nil
 		rows, err := conn.QueryContext(ctx, query, args...)
 		if err != nil {
@@ -217,6 +283,13 @@ func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]
 		if err != nil {
 			return err
 		}
+		var matches map[string]*spanstore.TextMatch
+		if params.Text != "" {
+			matches, err = s.loadTextMatches(ctx, conn, params.Text, spanIDs)
+			if err != nil {
+				return err
+			}
+		}
 		for i, span := range spans {
 			spanID := spanIDs[i]
 			resourceID := resourceIDs[i]
@@ -226,6 +299,7 @@ func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]
 			span.Scope = scopes[scopeID]
 			span.Events = events[spanID]
 			span.Links = links[spanID]
+			span.Match = matches[spanID]
 			spans[i] = span
 		}
 		return nil
@@ -239,12 +313,16 @@ func (s *Sink) QueryTraces(ctx context.Context, params spanstore.TraceQueryParam
 	if params.Limit <= 0 {
 		params.Limit = 100
 	}
-	if params.Order == "" {
+	params.Text = strings.TrimSpace(params.Text)
+	if params.Order == "" && params.Text != "" {
+		params.Order = spanstore.TraceOrderRelevance
+	}
+	if params.Order == "" || (params.Order == spanstore.TraceOrderRelevance && params.Text == "") {
 		params.Order = spanstore.TraceOrderStartDesc
 	}
 	query, args := buildTraceSummaryQuery(params)
 	var summaries []spanstore.TraceSummary
-	if err := s.withConn(ctx, func(conn *sql.Conn) error {
+	if err := s.withReadConn(ctx, func(conn *sql.Conn) error {
 		summaries = nil
 		rows, err := conn.QueryContext(ctx, query, args...)
 		if err != nil {
@@ -275,6 +353,20 @@ func (s *Sink) QueryTraces(ctx context.Context, params spanstore.TraceQueryParam
 		if err := rows.Err(); err != nil {
 			return fmt.Errorf("iterate traces: %w", err)
 		}
+		if params.Text == "" || len(summaries) == 0 {
+			return nil
+		}
+		traceIDs := make([]string, len(summaries))
+		for i, summary := range summaries {
+			traceIDs[i] = summary.TraceID
+		}
+		matches, err := s.loadTraceTextMatches(ctx, conn, params.Text, traceIDs)
+		if err != nil {
+			return err
+		}
+		for i := range summaries {
+			summaries[i].Match = matches[summaries[i].TraceID]
+		}
 		return nil
 	}); err != nil {
 		return nil, err
@@ -289,7 +381,7 @@ func (s *Sink) QueryTraceSpans(ctx context.Context, params spanstore.TraceSpansQ
 	}
 	query, args := buildTraceSpansQuery(traceID, params.Service, params.StatusCode)
 	var spans []spanstore.Span
-	if err := s.withConn(ctx, func(conn *sql.Conn) error {
+	if err := s.withReadConn(ctx, func(conn *sql.Conn) error {
 		spans = nil
 		rows, err := conn.QueryContext(ctx, query, args...)
 		if err != nil {
@@ -381,15 +473,19 @@ func (s *Sink) QueryTraceSpans(ctx context.Context, params spanstore.TraceSpansQ
 }
 
 func buildSpanQuery(params spanstore.QueryParams) (string, []interface{}) {
-	args := []interface{}{params.Service, params.Start, params.End}
+	args := make([]interface{}, 0, 8)
 	builder := strings.Builder{}
 	builder.WriteString(`SELECT id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id
-FROM spans
+FROM spans`)
+	if params.Text != "" {
+		args = writeSearchJoin(&builder, args, params.Text)
+	}
+	builder.WriteString(`
 WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
+	args = append(args, params.Service, params.Start, params.End)
 
 	for _, filter := range params.AttrFilters {
-		builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND sa.value = ?)`)
-		args = append(args, filter.Key, filter.Value)
+		args = writeAttrFilter(&builder, args, filter)
 	}
 
 	if params.StatusCode != nil {
@@ -397,23 +493,61 @@ WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano <=
 		args = append(args, int32(*params.StatusCode))
 	}
 
-	builder.WriteString(` ORDER BY start_time_unix_nano DESC LIMIT ?`)
+	if params.Text != "" {
+		builder.WriteString(` ORDER BY m.search_rank, start_time_unix_nano DESC LIMIT ?`)
+	} else {
+		builder.WriteString(` ORDER BY start_time_unix_nano DESC LIMIT ?`)
+	}
 	args = append(args, params.Limit)
 
 	return builder.String(), args
 }
 
+// writeAttrFilter appends an EXISTS clause for one attribute filter. Numeric
+// operators use the typed columns; a value that is not a number binds NULL
+// and matches nothing.
+func writeAttrFilter(builder *strings.Builder, args []interface{}, filter spanstore.AttrFilter) []interface{} {
+	if filter.Op.Numeric() {
+		var number interface{}
+		if parsed, err := strconv.ParseFloat(filter.Value, 64); err == nil {
+			number = parsed
+		}
+		builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND COALESCE(sa.int_value, sa.double_value) ` + string(filter.Op) + ` ?)`)
+		return append(args, filter.Key, number)
+	}
+	op := "="
+	if filter.Op == spanstore.AttrOpNotEqual {
+		op = "!="
+	}
+	builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND sa.value ` + op + ` ?)`)
+	return append(args, filter.Key, filter.Value)
+}
+
 func buildTraceSummaryQuery(params spanstore.TraceQueryParams) (string, []interface{}) {
-	args := []interface{}{params.Service, params.Start, params.End}
+	args := make([]interface{}, 0, 8)
 	builder := strings.Builder{}
-	builder.WriteString(`WITH candidate_traces AS (
+	if params.Text != "" {
+		builder.WriteString(`WITH candidate_traces AS (
+SELECT trace_id, MIN(m.search_rank) AS search_rank
+FROM spans`)
+		args = writeSearchJoin(&builder, args, params.Text)
+		builder.WriteString(`
+WHERE `)
+	} else {
+		builder.WriteString(`WITH candidate_traces AS (
 SELECT DISTINCT trace_id
 FROM spans
-WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
+WHERE `)
+	}
+	if params.Service != "" {
+		builder.WriteString(`service_name = ? AND `)
+		args = append(args, params.Service)
+	}
+	builder.WriteString(`start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
+	args = append(args, params.Start, params.End)
 
 	for _, filter := range params.AttrFilters {
-		builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND sa.value = ?)`)
-		args = append(args, filter.Key, filter.Value)
+		args = writeAttrFilter(&builder, args, filter)
 	}
 
 	if params.StatusCode != nil {
@@ -423,6 +557,10 @@ WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano <=
 	if params.HasError {
 		builder.WriteString(` AND status_code = 2`)
 	}
+	if params.Text != "" {
+		builder.WriteString(`
+GROUP BY trace_id`)
+	}
 
 	builder.WriteString(`)
 SELECT s.trace_id,
@@ -432,16 +570,38 @@ SELECT s.trace_id,
   MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano) AS duration_unix_nano,
   COUNT(*) AS span_count,
   SUM(CASE WHEN s.status_code = 2 THEN 1 ELSE 0 END) AS error_count,
-  ? AS service_name
+`)
+	args = append(args, rootSpanParentID)
+	if params.Service != "" {
+		builder.WriteString(`  ? AS service_name`)
+		args = append(args, params.Service)
+	} else {
+		builder.WriteString(`  COALESCE((SELECT service_name FROM spans root WHERE root.trace_id = s.trace_id AND root.parent_span_id = ? ORDER BY root.start_time_unix_nano ASC LIMIT 1), MIN(s.service_name)) AS service_name`)
+		args = append(args, rootSpanParentID)
+	}
+	builder.WriteString(`
 FROM spans s
 JOIN candidate_traces ct ON ct.trace_id = s.trace_id
 GROUP BY s.trace_id
 `)
 
+	if params.MinDuration > 0 || params.MaxDuration > 0 {
+		builder.WriteString(`HAVING 1 = 1`)
+		if params.MinDuration > 0 {
+			builder.WriteString(` AND MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano) >= ?`)
+			args = append(args, params.MinDuration)
+		}
+		if params.MaxDuration > 0 {
+			builder.WriteString(` AND MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano) <= ?`)
+			args = append(args, params.MaxDuration)
+		}
+		builder.WriteString("\n")
+	}
+
 	builder.WriteString(traceSummaryOrderClause(params.Order))
 	builder.WriteString(` LIMIT ?`)
 
-	args = append(args, rootSpanParentID, params.Service, params.Limit)
+	args = append(args, params.Limit)
 
 	return builder.String(), args
 }
@@ -454,6 +614,8 @@ func traceSummaryOrderClause(order spanstore.TraceOrder) string {
 		return ` ORDER BY duration_unix_nano DESC, start_time_unix_nano DESC, s.trace_id DESC`
 	case spanstore.TraceOrderDurationAsc:
 		return ` ORDER BY duration_unix_nano ASC, start_time_unix_nano DESC, s.trace_id DESC`
+	case spanstore.TraceOrderRelevance:
+		return ` ORDER BY MIN(ct.search_rank), start_time_unix_nano DESC, s.trace_id DESC`
 	default:
 		return ` ORDER BY start_time_unix_nano DESC, s.trace_id DESC`
 	}
@@ -477,156 +639,6 @@ WHERE trace_id = ?`)
 	return builder.String(), args
 }
 
-func (s *Sink) insertResource(ctx context.Context, tx *sql.Tx, resource *resourcepb.Resource, schemaURL string) (string, error) {
-	resourceID, err := newUUIDv7()
-	if err != nil {
-		return "", err
-	}
-	_, err = tx.ExecContext(ctx, "INSERT INTO resources (id, schema_url) VALUES (?, ?)", resourceID, schemaURL)
-	if err != nil {
-		return "", fmt.Errorf("insert resource: %w", err)
-	}
-	if err := s.insertAttributes(ctx, tx, "resource_attributes", "resource_id", resourceID, resource.GetAttributes()); err != nil {
-		return "", err
-	}
-	return resourceID, nil
-}
-
-func (s *Sink) insertScope(ctx context.Context, tx *sql.Tx, scope *commonpb.InstrumentationScope, schemaURL string) (string, error) {
-	if scope == nil {
-		scope = &commonpb.InstrumentationScope{}
-	}
-	scopeID, err := newUUIDv7()
-	if err != nil {
-		return "", err
-	}
-	_, err = tx.ExecContext(ctx, "INSERT INTO scopes (id, name, version, schema_url) VALUES (?, ?, ?, ?)", scopeID, scope.GetName(), scope.GetVersion(), schemaURL)
-	if err != nil {
-		return "", fmt.Errorf("insert scope: %w", err)
-	}
-	if err := s.insertAttributes(ctx, tx, "scope_attributes", "scope_id", scopeID, scope.GetAttributes()); err != nil {
-		return "", err
-	}
-	return scopeID, nil
-}
-
-func (s *Sink) insertSpan(ctx context.Context, tx *sql.Tx, span *tracepb.Span, service string, resourceID, scopeID string) error {
-	if span == nil {
-		return nil
-	}
-	traceID := ingest.FormatTraceID(span.GetTraceId())
-	spanID := ingest.FormatSpanID(span.GetSpanId())
-	parentSpanID := ingest.FormatSpanID(span.GetParentSpanId())
-	existingID, err := s.loadSpanRowID(ctx, tx, traceID, spanID)
-	if err != nil {
-		return err
-	}
-	if existingID != "" {
-		return nil
-	}
-	spanRowID, err := newUUIDv7()
-	if err != nil {
-		return err
-	}
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO spans (id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		spanRowID,
-		traceID,
-		spanID,
-		parentSpanID,
-		span.GetName(),
-		ingest.SpanKind(span.GetKind()),
-		int64(span.GetStartTimeUnixNano()),
-		int64(span.GetEndTimeUnixNano()),
-		int32(span.GetStatus().GetCode()),
-		span.GetStatus().GetMessage(),
-		service,
-		int64(span.GetFlags()),
-		resourceID,
-		scopeID,
-	)
-	if err != nil {
-		return fmt.Errorf("insert span: %w", err)
-	}
-	if err := s.insertAttributes(ctx, tx, "span_attributes", "span_id", spanRowID, span.GetAttributes()); err != nil {
-		return err
-	}
-	if err := s.insertEvents(ctx, tx, spanRowID, span.GetEvents()); err != nil {
-		return err
-	}
-	if err := s.insertLinks(ctx, tx, spanRowID, span.GetLinks()); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *Sink) loadSpanRowID(ctx context.Context, tx *sql.Tx, traceID, spanID string) (string, error) {
-	row := tx.QueryRowContext(ctx, "SELECT id FROM spans WHERE trace_id = ? AND span_id = ?", traceID, spanID)
-	var id string
-	switch err := row.Scan(&id); err {
-	case sql.ErrNoRows:
-		return "", nil
-	case nil:
-		return id, nil
-	default:
-		return "", fmt.Errorf("lookup span: %w", err)
-	}
-}
-
-func (s *Sink) insertEvents(ctx context.Context, tx *sql.Tx, spanID string, events []*tracepb.Span_Event) error {
-	for _, event := range events {
-		eventID, err := newUUIDv7()
-		if err != nil {
-			return err
-		}
-		_, err = tx.ExecContext(
-			ctx,
-			`INSERT INTO span_events (id, span_id, name, time_unix_nano, dropped_attributes_count) VALUES (?, ?, ?, ?, ?)`,
-			eventID,
-			spanID,
-			event.GetName(),
-			int64(event.GetTimeUnixNano()),
-			int64(event.GetDroppedAttributesCount()),
-		)
-		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
-		}
-		if err := s.insertAttributes(ctx, tx, "span_event_attributes", "event_id", eventID, event.GetAttributes()); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (s *Sink) insertLinks(ctx context.Context, tx *sql.Tx, spanID string, links []*tracepb.Span_Link) error {
-	for _, link := range links {
-		linkID, err := newUUIDv7()
-		if err != nil {
-			return err
-		}
-		_, err = tx.ExecContext(
-			ctx,
-			`INSERT INTO span_links (id, span_id, trace_id, linked_span_id, trace_state, dropped_attributes_count, flags) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-			linkID,
-			spanID,
-			ingest.FormatTraceID(link.GetTraceId()),
-			ingest.FormatSpanID(link.GetSpanId()),
-			link.GetTraceState(),
-			int64(link.GetDroppedAttributesCount()),
-			int64(link.GetFlags()),
-		)
-		if err != nil {
-			return fmt.Errorf("insert link: %w", err)
-		}
-		if err := s.insertAttributes(ctx, tx, "span_link_attributes", "link_id", linkID, link.GetAttributes()); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func buildInQuery(prefix string, ids []string) (string, []interface{}) {
 	builder := strings.Builder{}
 	builder.WriteString(prefix)
@@ -682,34 +694,13 @@ func sortLinks(links []spanstore.Link) {
 	})
 }
 
-func (s *Sink) insertAttributes(ctx context.Context, tx *sql.Tx, table, idColumn, id string, attrs []*commonpb.KeyValue) error {
-	for _, attr := range attrs {
-		attrType, attrValue, err := formatAttributeValue(attr.GetValue())
-		if err != nil {
-			return err
-		}
-		_, err = tx.ExecContext(
-			ctx,
-			fmt.Sprintf("INSERT INTO %s (%s, key, type, value) VALUES (?, ?, ?, ?)", table, idColumn),
-			id,
-			attr.GetKey(),
-			attrType,
-			attrValue,
-		)
-		if err != nil {
-			return fmt.Errorf("insert attribute: %w", err)
-		}
-	}
-	return nil
-}
-
 func (s *Sink) loadSpanAttributesBatch(ctx context.Context, conn *sql.Conn, spanIDs []string) (map[string]map[string]interface{}, error) {
 	result := make(map[string]map[string]interface{}, len(spanIDs))
 	if len(spanIDs) == 0 {
 		return result, nil
 	}
 	for _, batch := range chunkIDs(spanIDs, maxBatchSize) {
-		query, args := buildInQuery("SELECT span_id, key, type, value FROM span_attributes WHERE span_id IN ", batch)
+		query, args := buildInQuery("SELECT span_id, key, type, value, int_value, double_value, bool_value FROM span_attributes WHERE span_id IN ", batch)
 		rows, err := conn.QueryContext(ctx, query, args...)
 		if err != nil {
 			return nil, fmt.Errorf("load span attributes: %w", err)
@@ -719,7 +710,8 @@ func (s *Sink) loadSpanAttributesBatch(ctx context.Context, conn *sql.Conn, span
 			var key string
 			var attrType string
 			var value string
-			if err := rows.Scan(&spanID, &key, &attrType, &value); err != nil {
+			var typed typedValues
+			if err := rows.Scan(&spanID, &key, &attrType, &value, &typed.intValue, &typed.doubleValue, &typed.boolValue); err != nil {
 				_ = rows.Close()
 				return nil, fmt.Errorf("scan span attribute: %w", err)
 			}
@@ -728,7 +720,7 @@ func (s *Sink) loadSpanAttributesBatch(ctx context.Context, conn *sql.Conn, span
 				attrs = map[string]interface{}{}
 				result[spanID] = attrs
 			}
-			attrs[key] = parseAttributeValue(attrType, value)
+			attrs[key] = parseAttributeValue(attrType, value, typed)
 		}
 		if err := rows.Err(); err != nil {
 			_ = rows.Close()
@@ -823,7 +815,7 @@ func (s *Sink) loadAttributesBatch(ctx context.Context, conn *sql.Conn, table, i
 		return result, nil
 	}
 	for _, batch := range chunkIDs(ids, maxBatchSize) {
-		query, args := buildInQuery(fmt.Sprintf("SELECT %s, key, type, value FROM %s WHERE %s IN ", idColumn, table, idColumn), batch)
+		query, args := buildInQuery(fmt.Sprintf("SELECT %s, key, type, value, int_value, double_value, bool_value FROM %s WHERE %s IN ", idColumn, table, idColumn), batch)
 		rows, err := conn.QueryContext(ctx, query, args...)
 		if err != nil {
 			return nil, fmt.Errorf("load attributes: %w", err)
@@ -833,7 +825,8 @@ func (s *Sink) loadAttributesBatch(ctx context.Context, conn *sql.Conn, table, i
 			var key string
 			var attrType string
 			var value string
-			if err := rows.Scan(&id, &key, &attrType, &value); err != nil {
+			var typed typedValues
+			if err := rows.Scan(&id, &key, &attrType, &value, &typed.intValue, &typed.doubleValue, &typed.boolValue); err != nil {
 				_ = rows.Close()
 				return nil, fmt.Errorf("scan attributes: %w", err)
 			}
@@ -842,7 +835,7 @@ func (s *Sink) loadAttributesBatch(ctx context.Context, conn *sql.Conn, table, i
 				attrs = map[string]interface{}{}
 				result[id] = attrs
 			}
-			attrs[key] = parseAttributeValue(attrType, value)
+			attrs[key] = parseAttributeValue(attrType, value, typed)
 		}
 		if err := rows.Err(); err != nil {
 			_ = rows.Close()
@@ -959,53 +952,37 @@ func (s *Sink) loadLinksBatch(ctx context.Context, conn *sql.Conn, spanIDs []str
 	return result, nil
 }
 
-func formatAttributeValue(value *commonpb.AnyValue) (string, string, error) {
-	if value == nil {
-		return attrTypeString, "", nil
-	}
-	switch v := value.Value.(type) {
-	case *commonpb.AnyValue_StringValue:
-		return attrTypeString, v.StringValue, nil
-	case *commonpb.AnyValue_IntValue:
-		return attrTypeInt, fmt.Sprintf("%d", v.IntValue), nil
-	case *commonpb.AnyValue_DoubleValue:
-		return attrTypeDouble, fmt.Sprintf("%g", v.DoubleValue), nil
-	case *commonpb.AnyValue_BoolValue:
-		return attrTypeBool, fmt.Sprintf("%t", v.BoolValue), nil
-	case *commonpb.AnyValue_BytesValue:
-		return attrTypeBytes, fmt.Sprintf("%x", v.BytesValue), nil
-	case *commonpb.AnyValue_ArrayValue:
-		payload, err := json.Marshal(anyValueArray(v.ArrayValue))
-		if err != nil {
-			return "", "", fmt.Errorf("marshal array attribute: %w", err)
-		}
-		return attrTypeArray, string(payload), nil
-	case *commonpb.AnyValue_KvlistValue:
-		payload, err := json.Marshal(keyValueListToMap(v.KvlistValue))
-		if err != nil {
-			return "", "", fmt.Errorf("marshal kvlist attribute: %w", err)
-		}
-		return attrTypeKVList, string(payload), nil
-	default:
-		return attrTypeString, "", nil
-	}
+// typedValues holds the typed columns read next to an attribute's string form.
+type typedValues struct {
+	intValue    sql.NullInt64
+	doubleValue sql.NullFloat64
+	boolValue   sql.NullBool
 }
 
-func parseAttributeValue(attrType, value string) interface{} {
+func parseAttributeValue(attrType, value string, typed typedValues) interface{} {
 	switch attrType {
 	case attrTypeInt:
+		if typed.intValue.Valid {
+			return typed.intValue.Int64
+		}
 		parsed, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
 			return value
 		}
 		return parsed
 	case attrTypeDouble:
+		if typed.doubleValue.Valid {
+			return typed.doubleValue.Float64
+		}
 		parsed, err := strconv.ParseFloat(value, 64)
 		if err != nil {
 			return value
 		}
 		return parsed
 	case attrTypeBool:
+		if typed.boolValue.Valid {
+			return typed.boolValue.Bool
+		}
 		parsed, err := strconv.ParseBool(value)
 		if err != nil {
 			return value
@@ -1013,69 +990,13 @@ func parseAttributeValue(attrType, value string) interface{} {
 		return parsed
 	case attrTypeBytes:
 		return value
-	case attrTypeArray:
-		var decoded []interface{}
-		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
-			return []interface{}{value}
-		}
-		return decoded
-	case attrTypeKVList:
-		var decoded map[string]interface{}
-		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
-			return map[string]interface{}{"value": value}
-		}
-		return decoded
+	case attrTypeArray, attrTypeKVList:
+		return otlpconv.StoredInterface(attrType, value)
 	default:
 		return value
 	}
 }
 
-func anyValueArray(arr *commonpb.ArrayValue) []interface{} {
-	if arr == nil {
-		return nil
-	}
-	result := make([]interface{}, 0, len(arr.Values))
-	for _, value := range arr.Values {
-		result = append(result, anyValueToInterface(value))
-	}
-	return result
-}
-
-func anyValueToInterface(value *commonpb.AnyValue) interface{} {
-	if value == nil {
-		return nil
-	}
-	switch v := value.Value.(type) {
-	case *commonpb.AnyValue_StringValue:
-		return v.StringValue
-	case *commonpb.AnyValue_IntValue:
-		return v.IntValue
-	case *commonpb.AnyValue_DoubleValue:
-		return v.DoubleValue
-	case *commonpb.AnyValue_BoolValue:
-		return v.BoolValue
-	case *commonpb.AnyValue_BytesValue:
-		return fmt.Sprintf("%x", v.BytesValue)
-	case *commonpb.AnyValue_ArrayValue:
-		return anyValueArray(v.ArrayValue)
-	case *commonpb.AnyValue_KvlistValue:
-		return keyValueListToMap(v.KvlistValue)
-	default:
-		return nil
-	}
-}
-
-func keyValueListToMap(list *commonpb.KeyValueList) map[string]interface{} {
-	if list == nil {
-		return map[string]interface{}{}
-	}
-	result := make(map[string]interface{}, len(list.Values))
-	for _, kv := range list.Values {
-		result[kv.GetKey()] = anyValueToInterface(kv.GetValue())
-	}
-	return result
-}
-
 func newUUIDv7() (string, error) {
 	value, err := uuid.NewV7()
 	if err != nil {
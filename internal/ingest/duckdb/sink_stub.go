@@ -6,24 +6,55 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"log"
+	"time"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/migrate"
 	"smelldeadfish/internal/spanstore"
 )
 
 var errUnavailable = errors.New("duckdb sink unavailable: rebuild with CGO_ENABLED=1")
 
+type Options struct {
+	Metrics       *metrics.Registry
+	FlushInterval time.Duration
+	FlushSpans    int
+	Logger        *log.Logger
+}
+
 type Sink struct{}
 
 func New(_ string) (*Sink, error) {
 	return nil, errUnavailable
 }
 
+func NewWithOptions(_ string, _ Options) (*Sink, error) {
+	return nil, errUnavailable
+}
+
+func OpenReadOnly(_ string, _ Options) (*Sink, error) {
+	return nil, errUnavailable
+}
+
+func Migrate(_ context.Context, _ string, _ bool) (migrate.Plan, error) {
+	return migrate.Plan{}, errUnavailable
+}
+
 func (s *Sink) Close() error {
 	return nil
 }
 
+func (s *Sink) Ping(_ context.Context) error {
+	return errUnavailable
+}
+
+func (s *Sink) Flush(_ context.Context) error {
+	return errUnavailable
+}
+
 func (s *Sink) DB() *sql.DB {
 	return nil
 }
@@ -43,3 +74,27 @@ func (s *Sink) QueryTraces(_ context.Context, _ spanstore.TraceQueryParams) ([]s
 func (s *Sink) QueryTraceSpans(_ context.Context, _ spanstore.TraceSpansQueryParams) ([]spanstore.Span, error) {
 	return nil, errUnavailable
 }
+
+func (s *Sink) QueryTagNames(_ context.Context, _ spanstore.TagQueryParams) ([]string, error) {
+	return nil, errUnavailable
+}
+
+func (s *Sink) QueryTagValues(_ context.Context, _ string, _ spanstore.TagQueryParams) ([]string, error) {
+	return nil, errUnavailable
+}
+
+func (s *Sink) QueryTraceOTLP(_ context.Context, _ spanstore.TraceSpansQueryParams) (*coltracepb.ExportTraceServiceRequest, error) {
+	return nil, errUnavailable
+}
+
+func (s *Sink) ExportSpans(_ context.Context, _ spanstore.ExportParams) (spanstore.ExportPage, error) {
+	return spanstore.ExportPage{}, errUnavailable
+}
+
+func (s *Sink) WriteParquet(_ context.Context, _ spanstore.ExportParams, _ string) (int64, error) {
+	return 0, errUnavailable
+}
+
+func (s *Sink) QuerySQL(_ context.Context, _ spanstore.SQLQuery) (spanstore.SQLResult, error) {
+	return spanstore.SQLResult{}, errUnavailable
+}
@@ -4,7 +4,6 @@ package duckdb
 
 import (
 	"context"
-	"fmt"
 	"path/filepath"
 	"testing"
 	"time"
@@ -14,7 +13,7 @@ import (
 	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
 	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
 
-	"smelldeadfish/internal/spanstore"
+	"smelldeadfish/internal/spanstore/spanstoretest"
 )
 
 func TestDuckDBSinkPersistsSpan(t *testing.T) {
@@ -87,6 +86,9 @@ func TestDuckDBSinkPersistsSpan(t *testing.T) {
 	if err := sink.Consume(context.Background(), req); err != nil {
 		t.Fatalf("consume: %v", err)
 	}
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
 
 	rows, err := sink.DB().Query("SELECT trace_id, span_id, service_name, id FROM spans")
 	if err != nil {
@@ -128,354 +130,183 @@ func TestDuckDBSinkInitializesSchema(t *testing.T) {
 	}
 }
 
-func TestDuckDBSinkQueryTracesOrdersWithoutAmbiguity(t *testing.T) {
-	dir := t.TempDir()
-	path := filepath.Join(dir, "spans.duckdb")
-
-	sink, err := New(path)
+func TestDuckDBSinkPing(t *testing.T) {
+	sink, err := New(filepath.Join(t.TempDir(), "spans.duckdb"))
 	if err != nil {
 		t.Fatalf("new sink: %v", err)
 	}
-	defer func() {
-		if err := sink.Close(); err != nil {
-			t.Fatalf("close sink: %v", err)
-		}
-	}()
-
-	start := uint64(time.Now().Add(-20 * time.Millisecond).UnixNano())
-	end := uint64(time.Now().UnixNano())
-	req := &coltracepb.ExportTraceServiceRequest{
-		ResourceSpans: []*tracepb.ResourceSpans{
-			{
-				Resource: &resourcepb.Resource{
-					Attributes: []*commonpb.KeyValue{
-						{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "trace-list-service"}}},
-					},
-				},
-				ScopeSpans: []*tracepb.ScopeSpans{
-					{
-						Scope: &commonpb.InstrumentationScope{Name: "scope", Version: "v1"},
-						Spans: []*tracepb.Span{
-							{
-								TraceId:           []byte{0x02, 0x03},
-								SpanId:            []byte{0x0c, 0x0d},
-								ParentSpanId:      []byte{},
-								Name:              "root",
-								Kind:              tracepb.Span_SPAN_KIND_SERVER,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	if err := sink.Consume(context.Background(), req); err != nil {
-		t.Fatalf("consume: %v", err)
-	}
-
-	ctx := context.Background()
-	summaries, err := sink.QueryTraces(ctx, spanstore.TraceQueryParams{
-		Service: "trace-list-service",
-		Start:   int64(start) - int64(time.Millisecond),
-		End:     int64(end) + int64(time.Millisecond),
-		Limit:   10,
-		Order:   spanstore.TraceOrderDurationDesc,
-	})
-	if err != nil {
-		t.Fatalf("query traces: %v", err)
+	if err := sink.Ping(context.Background()); err != nil {
+		t.Fatalf("ping: %v", err)
 	}
-	if len(summaries) == 0 {
-		t.Fatalf("expected at least one trace summary")
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close sink: %v", err)
 	}
-	if summaries[0].TraceID == "" {
-		t.Fatalf("expected trace_id to be populated")
+	if err := sink.Ping(context.Background()); err == nil {
+		t.Fatalf("expected ping to fail after close")
 	}
 }
 
-func TestDuckDBSinkQuerySpansBatchLoadsAttributes(t *testing.T) {
-	dir := t.TempDir()
-	path := filepath.Join(dir, "spans.duckdb")
+func countRows(t *testing.T, sink *Sink, table string) int {
+	t.Helper()
+	var count int
+	if err := sink.DB().QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatalf("count %s: %v", table, err)
+	}
+	return count
+}
 
-	sink, err := New(path)
+func TestDuckDBSinkSkipsDuplicateSpans(t *testing.T) {
+	sink, err := New(filepath.Join(t.TempDir(), "spans.duckdb"))
 	if err != nil {
 		t.Fatalf("new sink: %v", err)
 	}
-	defer func() {
-		if err := sink.Close(); err != nil {
-			t.Fatalf("close sink: %v", err)
-		}
-	}()
+	defer sink.Close()
 
-	start := uint64(time.Now().Add(-30 * time.Millisecond).UnixNano())
-	end := uint64(time.Now().UnixNano())
-	req := &coltracepb.ExportTraceServiceRequest{
-		ResourceSpans: []*tracepb.ResourceSpans{
-			{
-				Resource: &resourcepb.Resource{
-					Attributes: []*commonpb.KeyValue{
-						{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "batch-service"}}},
-						{Key: "resource.attr", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "r1"}}},
-					},
-				},
-				ScopeSpans: []*tracepb.ScopeSpans{
-					{
-						Scope: &commonpb.InstrumentationScope{Name: "scope", Version: "v1"},
-						Spans: []*tracepb.Span{
-							{
-								TraceId:           []byte{0x21, 0x22},
-								SpanId:            []byte{0x31, 0x32},
-								Name:              "span-a",
-								Kind:              tracepb.Span_SPAN_KIND_SERVER,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-								Attributes: []*commonpb.KeyValue{
-									{Key: "http.method", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "POST"}}},
-								},
-								Events: []*tracepb.Span_Event{
-									{Name: "event-a", TimeUnixNano: end},
-								},
-								Links: []*tracepb.Span_Link{
-									{TraceId: []byte{0x41, 0x42}, SpanId: []byte{0x51, 0x52}, TraceState: "demo=2"},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+	ctx := context.Background()
+	// The same spans twice in one buffer, then again after a flush.
+	for i := 0; i < 2; i++ {
+		if err := sink.Consume(ctx, benchmarkRequest(1, 5)); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
 	}
-
-	if err := sink.Consume(context.Background(), req); err != nil {
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if err := sink.Consume(ctx, benchmarkRequest(1, 5)); err != nil {
 		t.Fatalf("consume: %v", err)
 	}
-
-	spans, err := sink.QuerySpans(context.Background(), spanstore.QueryParams{
-		Service: "batch-service",
-		Start:   int64(start) - int64(time.Millisecond),
-		End:     int64(end) + int64(time.Millisecond),
-		Limit:   10,
-	})
-	if err != nil {
-		t.Fatalf("query spans: %v", err)
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
 	}
-	if len(spans) != 1 {
-		t.Fatalf("expected one span, got %d", len(spans))
+
+	want := map[string]int{"spans": 5, "span_attributes": 20, "span_events": 5, "span_event_attributes": 5, "span_links": 5}
+	for table, expected := range want {
+		if got := countRows(t, sink, table); got != expected {
+			t.Fatalf("expected %d rows in %s, got %d", expected, table, got)
+		}
 	}
-	span := spans[0]
-	if span.Attributes["http.method"] != "POST" {
-		t.Fatalf("expected span attribute to load, got %+v", span.Attributes)
+}
+
+func TestDuckDBSinkFlushesWhenBufferFills(t *testing.T) {
+	sink, err := NewWithOptions(filepath.Join(t.TempDir(), "spans.duckdb"), Options{FlushSpans: 10, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
 	}
-	if span.Resource.Attributes["resource.attr"] != "r1" {
-		t.Fatalf("expected resource attribute to load, got %+v", span.Resource.Attributes)
+	defer sink.Close()
+
+	ctx := context.Background()
+	if err := sink.Consume(ctx, benchmarkRequest(1, 5)); err != nil {
+		t.Fatalf("consume: %v", err)
 	}
-	if span.Scope.Name != "scope" {
-		t.Fatalf("expected scope to load, got %+v", span.Scope)
+	if got := countRows(t, sink, "spans"); got != 0 {
+		t.Fatalf("expected spans to stay buffered, got %d rows", got)
 	}
-	if len(span.Events) != 1 || span.Events[0].Name != "event-a" {
-		t.Fatalf("expected event to load, got %+v", span.Events)
+	if err := sink.Consume(ctx, benchmarkRequest(2, 5)); err != nil {
+		t.Fatalf("consume: %v", err)
 	}
-	if len(span.Links) != 1 || span.Links[0].TraceState != "demo=2" {
-		t.Fatalf("expected link to load, got %+v", span.Links)
+	if got := countRows(t, sink, "spans"); got != 10 {
+		t.Fatalf("expected 10 spans after size-triggered flush, got %d", got)
 	}
 }
 
-func TestDuckDBSinkFiltersByStatus(t *testing.T) {
-	dir := t.TempDir()
-	path := filepath.Join(dir, "spans.duckdb")
-
-	sink, err := New(path)
+func TestDuckDBSinkFlushesOnInterval(t *testing.T) {
+	sink, err := NewWithOptions(filepath.Join(t.TempDir(), "spans.duckdb"), Options{FlushInterval: 10 * time.Millisecond})
 	if err != nil {
 		t.Fatalf("new sink: %v", err)
 	}
-	defer func() {
-		if err := sink.Close(); err != nil {
-			t.Fatalf("close sink: %v", err)
-		}
-	}()
+	defer sink.Close()
 
-	start := uint64(time.Now().Add(-15 * time.Millisecond).UnixNano())
-	end := uint64(time.Now().UnixNano())
-	traceErrorID := []byte{0x01, 0x02}
-	traceOkID := []byte{0x03, 0x04}
-	req := &coltracepb.ExportTraceServiceRequest{
-		ResourceSpans: []*tracepb.ResourceSpans{
-			{
-				Resource: &resourcepb.Resource{
-					Attributes: []*commonpb.KeyValue{
-						{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "status-service"}}},
-					},
-				},
-				ScopeSpans: []*tracepb.ScopeSpans{
-					{
-						Scope: &commonpb.InstrumentationScope{Name: "scope", Version: "v1"},
-						Spans: []*tracepb.Span{
-							{
-								TraceId:           traceErrorID,
-								SpanId:            []byte{0x0a, 0x0b},
-								ParentSpanId:      []byte{},
-								Name:              "root-error",
-								Kind:              tracepb.Span_SPAN_KIND_SERVER,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-								Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "boom"},
-							},
-							{
-								TraceId:           traceErrorID,
-								SpanId:            []byte{0x0c, 0x0d},
-								ParentSpanId:      []byte{0x0a, 0x0b},
-								Name:              "child-ok",
-								Kind:              tracepb.Span_SPAN_KIND_CLIENT,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-								Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
-							},
-							{
-								TraceId:           traceOkID,
-								SpanId:            []byte{0x0e, 0x0f},
-								ParentSpanId:      []byte{},
-								Name:              "root-ok",
-								Kind:              tracepb.Span_SPAN_KIND_SERVER,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-								Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	if err := sink.Consume(context.Background(), req); err != nil {
+	if err := sink.Consume(context.Background(), benchmarkRequest(1, 3)); err != nil {
 		t.Fatalf("consume: %v", err)
 	}
+	deadline := time.Now().Add(5 * time.Second)
+	for countRows(t, sink, "spans") != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("spans were not flushed on interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
 
-	statusError := spanstore.StatusError
-	summaries, err := sink.QueryTraces(context.Background(), spanstore.TraceQueryParams{
-		Service:    "status-service",
-		Start:      int64(start) - int64(time.Millisecond),
-		End:        int64(end) + int64(time.Millisecond),
-		Limit:      10,
-		Order:      spanstore.TraceOrderStartDesc,
-		StatusCode: &statusError,
-	})
+func TestDuckDBSinkCloseFlushesBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.duckdb")
+	sink, err := NewWithOptions(path, Options{FlushInterval: time.Hour})
 	if err != nil {
-		t.Fatalf("query traces: %v", err)
+		t.Fatalf("new sink: %v", err)
 	}
-	if len(summaries) != 1 {
-		t.Fatalf("expected one trace summary, got %d", len(summaries))
+	if err := sink.Consume(context.Background(), benchmarkRequest(1, 3)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close sink: %v", err)
 	}
-	expectedTraceID := fmt.Sprintf("%x", traceErrorID)
-	if summaries[0].TraceID != expectedTraceID {
-		t.Fatalf("unexpected trace_id: %s", summaries[0].TraceID)
+	if err := sink.Consume(context.Background(), benchmarkRequest(2, 3)); err == nil {
+		t.Fatalf("expected consume after close to fail")
 	}
 
-	spans, err := sink.QueryTraceSpans(context.Background(), spanstore.TraceSpansQueryParams{
-		TraceID:    expectedTraceID,
-		Service:    "status-service",
-		StatusCode: &statusError,
-	})
+	reopened, err := New(path)
 	if err != nil {
-		t.Fatalf("query trace spans: %v", err)
+		t.Fatalf("reopen sink: %v", err)
 	}
-	if len(spans) != 1 {
-		t.Fatalf("expected one span, got %d", len(spans))
-	}
-	if spans[0].Name != "root-error" {
-		t.Fatalf("unexpected span: %+v", spans[0])
+	defer reopened.Close()
+	if got := countRows(t, reopened, "spans"); got != 3 {
+		t.Fatalf("expected 3 spans after reopen, got %d", got)
 	}
 }
 
-func TestDuckDBSinkFiltersByHasError(t *testing.T) {
-	dir := t.TempDir()
-	path := filepath.Join(dir, "spans.duckdb")
+func TestDuckDBSinkConformance(t *testing.T) {
+	spanstoretest.Run(t, func(t *testing.T) spanstoretest.Store {
+		sink, err := New(filepath.Join(t.TempDir(), "spans.duckdb"))
+		if err != nil {
+			t.Fatalf("new sink: %v", err)
+		}
+		t.Cleanup(func() { sink.Close() })
+		return sink
+	})
+}
 
-	sink, err := New(path)
+func TestDuckDBSinkKeepsSpansWhenFlushFails(t *testing.T) {
+	sink, err := NewWithOptions(filepath.Join(t.TempDir(), "spans.duckdb"), Options{FlushInterval: time.Hour})
 	if err != nil {
 		t.Fatalf("new sink: %v", err)
 	}
-	defer func() {
-		if err := sink.Close(); err != nil {
-			t.Fatalf("close sink: %v", err)
-		}
-	}()
+	defer sink.Close()
 
-	start := uint64(time.Now().Add(-15 * time.Millisecond).UnixNano())
-	end := uint64(time.Now().UnixNano())
-	traceErrorID := []byte{0x01, 0x02}
-	traceOkID := []byte{0x03, 0x04}
-	req := &coltracepb.ExportTraceServiceRequest{
-		ResourceSpans: []*tracepb.ResourceSpans{
-			{
-				Resource: &resourcepb.Resource{
-					Attributes: []*commonpb.KeyValue{
-						{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "status-service"}}},
-					},
-				},
-				ScopeSpans: []*tracepb.ScopeSpans{
-					{
-						Scope: &commonpb.InstrumentationScope{Name: "scope", Version: "v1"},
-						Spans: []*tracepb.Span{
-							{
-								TraceId:           traceErrorID,
-								SpanId:            []byte{0x0a, 0x0b},
-								ParentSpanId:      []byte{},
-								Name:              "root-error",
-								Kind:              tracepb.Span_SPAN_KIND_SERVER,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-								Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "boom"},
-							},
-							{
-								TraceId:           traceErrorID,
-								SpanId:            []byte{0x0c, 0x0d},
-								ParentSpanId:      []byte{0x0a, 0x0b},
-								Name:              "child-ok",
-								Kind:              tracepb.Span_SPAN_KIND_CLIENT,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-								Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
-							},
-							{
-								TraceId:           traceOkID,
-								SpanId:            []byte{0x0e, 0x0f},
-								ParentSpanId:      []byte{},
-								Name:              "root-ok",
-								Kind:              tracepb.Span_SPAN_KIND_SERVER,
-								StartTimeUnixNano: start,
-								EndTimeUnixNano:   end,
-								Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
-							},
-						},
-					},
-				},
-			},
-		},
+	ctx := context.Background()
+	// Appending events fails once the spans are inserted, so the whole
+	// flush rolls back.
+	for _, statement := range []string{"DROP INDEX span_events_span_idx", "ALTER TABLE span_events RENAME TO span_events_hidden"} {
+		if _, err := sink.DB().ExecContext(ctx, statement); err != nil {
+			t.Fatalf("hide span_events: %v", err)
+		}
 	}
-
-	if err := sink.Consume(context.Background(), req); err != nil {
+	if err := sink.Consume(ctx, benchmarkRequest(1, 3)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := sink.Flush(ctx); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	if failures, lastError := sink.WriteFailures(); failures != 1 || lastError == "" {
+		t.Fatalf("expected one reported flush failure, got %d %q", failures, lastError)
+	}
+	if err := sink.Consume(ctx, benchmarkRequest(2, 2)); err != nil {
 		t.Fatalf("consume: %v", err)
 	}
 
-	summaries, err := sink.QueryTraces(context.Background(), spanstore.TraceQueryParams{
-		Service:  "status-service",
-		Start:    int64(start) - int64(time.Millisecond),
-		End:      int64(end) + int64(time.Millisecond),
-		Limit:    10,
-		Order:    spanstore.TraceOrderStartDesc,
-		HasError: true,
-	})
-	if err != nil {
-		t.Fatalf("query traces: %v", err)
+	for _, statement := range []string{"ALTER TABLE span_events_hidden RENAME TO span_events", "CREATE INDEX span_events_span_idx ON span_events(span_id)"} {
+		if _, err := sink.DB().ExecContext(ctx, statement); err != nil {
+			t.Fatalf("restore span_events: %v", err)
+		}
+	}
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("retry flush: %v", err)
 	}
-	if len(summaries) != 1 {
-		t.Fatalf("expected one trace summary, got %d", len(summaries))
+	if failures, _ := sink.WriteFailures(); failures != 0 {
+		t.Fatalf("expected failures reset after a good flush, got %d", failures)
 	}
-	expectedTraceID := fmt.Sprintf("%x", traceErrorID)
-	if summaries[0].TraceID != expectedTraceID {
-		t.Fatalf("unexpected trace_id: %s", summaries[0].TraceID)
+	for table, want := range map[string]int{"spans": 5, "span_events": 5} {
+		if got := countRows(t, sink, table); got != want {
+			t.Fatalf("expected %d rows in %s after the retry, got %d", want, table, got)
+		}
 	}
 }
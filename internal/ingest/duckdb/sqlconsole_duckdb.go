@@ -0,0 +1,106 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"smelldeadfish/internal/spanstore"
+	"smelldeadfish/internal/sqlconsole"
+)
+
+// consoleSettings lock down the console database once the store is attached:
+// no file, network, or extension access, and no way to turn it back on.
+var consoleSettings = []string{
+	"USE store",
+	"SET enable_external_access = false",
+	"SET lock_configuration = true",
+}
+
+// QuerySQL runs a single SELECT on a separate in-memory database that attaches
+// the store read-only and then disables external access. The store's own
+// handle keeps external access for parquet exports, and DuckDB refuses a
+// second handle on the file with different settings. Flushes only wait for
+// the attach, so the query sees the spans flushed before it started.
+func (s *Sink) QuerySQL(ctx context.Context, query spanstore.SQLQuery) (spanstore.SQLResult, error) {
+	if s == nil || s.db == nil {
+		return spanstore.SQLResult{}, errors.New("duckdb connection unavailable")
+	}
+	if s.path == "" || s.path == ":memory:" {
+		return spanstore.SQLResult{}, errors.New("sql console needs a duckdb database file")
+	}
+	statement, err := sqlconsole.Check(query.Query)
+	if err != nil {
+		return spanstore.SQLResult{}, err
+	}
+	if err := s.Flush(ctx); err != nil && s.logger != nil {
+		s.logger.Printf("msg=flush_failed store=duckdb err=%q", err)
+	}
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return spanstore.SQLResult{}, fmt.Errorf("open console database: %w", err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return spanstore.SQLResult{}, fmt.Errorf("open console connection: %w", err)
+	}
+	defer conn.Close()
+	if err := s.attachStore(ctx, conn); err != nil {
+		return spanstore.SQLResult{}, err
+	}
+	for _, setting := range consoleSettings {
+		if _, err := conn.ExecContext(ctx, setting); err != nil {
+			return spanstore.SQLResult{}, fmt.Errorf("lock console database: %w", err)
+		}
+	}
+	if err := checkStatement(ctx, conn, statement); err != nil {
+		return spanstore.SQLResult{}, err
+	}
+	rows, err := conn.QueryContext(ctx, statement)
+	if err != nil {
+		return spanstore.SQLResult{}, fmt.Errorf("run query: %w", err)
+	}
+	defer rows.Close()
+	return sqlconsole.Scan(rows, query.MaxRows)
+}
+
+// attachStore attaches the store to the console connection, keeping flushes
+// out while the attached copy replays the write-ahead log.
+func (s *Sink) attachStore(ctx context.Context, conn *sql.Conn) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if _, err := conn.ExecContext(ctx, "ATTACH "+quoteLiteral(s.path)+" AS store (READ_ONLY)"); err != nil {
+		return fmt.Errorf("attach store: %w", err)
+	}
+	return nil
+}
+
+// checkStatement has DuckDB parse statement and rejects anything but a single
+// SELECT, which is all json_serialize_sql accepts.
+func checkStatement(ctx context.Context, conn *sql.Conn, statement string) error {
+	var serialized string
+	if err := conn.QueryRowContext(ctx, "SELECT json_serialize_sql(?::VARCHAR)::VARCHAR", statement).Scan(&serialized); err != nil {
+		return fmt.Errorf("parse query: %w", err)
+	}
+	var parsed struct {
+		Error        bool   `json:"error"`
+		ErrorMessage string `json:"error_message"`
+		Statements   []any  `json:"statements"`
+	}
+	if err := json.Unmarshal([]byte(serialized), &parsed); err != nil {
+		return fmt.Errorf("decode parsed query: %w", err)
+	}
+	if parsed.Error {
+		return fmt.Errorf("%w: %s", spanstore.ErrSQLNotAllowed, parsed.ErrorMessage)
+	}
+	if len(parsed.Statements) != 1 {
+		return fmt.Errorf("%w: found %d statements", spanstore.ErrSQLNotAllowed, len(parsed.Statements))
+	}
+	return nil
+}
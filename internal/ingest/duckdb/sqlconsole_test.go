@@ -0,0 +1,95 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestDuckDBSinkQuerySQL(t *testing.T) {
+	sink, err := New(filepath.Join(t.TempDir(), "spans.duckdb"))
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	defer sink.Close()
+	ctx := context.Background()
+	// Buffered spans are flushed before the query runs.
+	if err := sink.Consume(ctx, benchmarkRequest(1, 5)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	result, err := sink.QuerySQL(ctx, spanstore.SQLQuery{Query: "SELECT span_id, name FROM spans ORDER BY span_id", MaxRows: 3})
+	if err != nil {
+		t.Fatalf("query sql: %v", err)
+	}
+	if len(result.Columns) != 2 || len(result.Rows) != 3 || !result.Truncated {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	result, err = sink.QuerySQL(ctx, spanstore.SQLQuery{Query: "WITH n AS (SELECT * FROM range(3)) SELECT COUNT(*) FROM n, spans"})
+	if err != nil {
+		t.Fatalf("query with cte: %v", err)
+	}
+	if len(result.Rows) != 1 || result.Rows[0][0] != int64(15) {
+		t.Fatalf("unexpected count result: %+v", result)
+	}
+}
+
+func TestDuckDBSinkQuerySQLIsReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := New(filepath.Join(dir, "spans.duckdb"))
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	defer sink.Close()
+	ctx := context.Background()
+	if err := sink.Consume(ctx, benchmarkRequest(1, 2)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	csvPath := filepath.Join(dir, "secret.csv")
+	if err := os.WriteFile(csvPath, []byte("a\n1\n"), 0o600); err != nil {
+		t.Fatalf("write csv: %v", err)
+	}
+
+	for _, query := range []string{
+		"DELETE FROM spans",
+		"SELECT 1; DELETE FROM spans",
+		"COPY spans TO '" + filepath.Join(dir, "out.csv") + "'",
+	} {
+		if _, err := sink.QuerySQL(ctx, spanstore.SQLQuery{Query: query}); !errors.Is(err, spanstore.ErrSQLNotAllowed) {
+			t.Fatalf("expected %q to be rejected, got %v", query, err)
+		}
+	}
+	// Selects that reach for files are left to DuckDB, which has external
+	// access disabled on the console database.
+	for _, query := range []string{
+		"SELECT * FROM read_csv('" + csvPath + "')",
+		"SELECT * FROM '" + csvPath + "'",
+		"SELECT * FROM (SELECT * FROM read_text('" + csvPath + "'))",
+		"SELECT * FROM glob('" + filepath.Join(dir, "*") + "')",
+		"SELECT * FROM spans, read_blob('" + csvPath + "')",
+	} {
+		if result, err := sink.QuerySQL(ctx, spanstore.SQLQuery{Query: query}); err == nil {
+			t.Fatalf("expected %q to fail, got %+v", query, result)
+		}
+	}
+	result, err := sink.QuerySQL(ctx, spanstore.SQLQuery{Query: "SELECT current_setting('enable_external_access'), current_setting('lock_configuration')"})
+	if err != nil {
+		t.Fatalf("query settings: %v", err)
+	}
+	if len(result.Rows) != 1 || result.Rows[0][0] != false || result.Rows[0][1] != true {
+		t.Fatalf("expected external access disabled and configuration locked, got %+v", result.Rows)
+	}
+	if got := countRows(t, sink, "spans"); got != 2 {
+		t.Fatalf("expected spans to be untouched, got %d", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.csv")); !os.IsNotExist(err) {
+		t.Fatalf("expected no file to be written, got %v", err)
+	}
+}
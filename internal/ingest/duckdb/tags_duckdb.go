@@ -0,0 +1,133 @@
+//go:build cgo
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+const serviceNameTag = "service.name"
+
+func (s *Sink) QueryTagNames(ctx context.Context, params spanstore.TagQueryParams) ([]string, error) {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	query, args := buildTagNamesQuery(params)
+	return s.queryStrings(ctx, "tag names", query, args)
+}
+
+func (s *Sink) QueryTagValues(ctx context.Context, tag string, params spanstore.TagQueryParams) ([]string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return nil, fmt.Errorf("tag is required")
+	}
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	query, args := buildTagValuesQuery(tag, params)
+	return s.queryStrings(ctx, "tag values", query, args)
+}
+
+func (s *Sink) queryStrings(ctx context.Context, label, query string, args []interface{}) ([]string, error) {
+	var values []string
+	err := s.withReadConn(ctx, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("query %s: %w", label, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var value sql.NullString
+			if err := rows.Scan(&value); err != nil {
+				return fmt.Errorf("scan %s: %w", label, err)
+			}
+			if value.Valid {
+				values = append(values, value.String)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("iterate %s: %w", label, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func buildTagNamesQuery(params spanstore.TagQueryParams) (string, []interface{}) {
+	args := []interface{}{serviceNameTag}
+	builder := strings.Builder{}
+	builder.WriteString(`SELECT key FROM (
+SELECT ? AS key
+UNION
+`)
+	if hasTagTimeRange(params) {
+		builder.WriteString(`SELECT sa.key FROM span_attributes sa JOIN spans ON spans.id = sa.span_id WHERE spans.start_time_unix_nano >= ? AND spans.start_time_unix_nano <= ?
+UNION
+SELECT ra.key FROM resource_attributes ra JOIN spans ON spans.resource_id = ra.resource_id WHERE spans.start_time_unix_nano >= ? AND spans.start_time_unix_nano <= ?`)
+		start, end := tagTimeRange(params)
+		args = append(args, start, end, start, end)
+	} else {
+		builder.WriteString(`SELECT key FROM span_attributes
+UNION
+SELECT key FROM resource_attributes`)
+	}
+	builder.WriteString(`
+) tags ORDER BY key LIMIT ?`)
+	args = append(args, params.Limit)
+	return builder.String(), args
+}
+
+func buildTagValuesQuery(tag string, params spanstore.TagQueryParams) (string, []interface{}) {
+	args := make([]interface{}, 0, 6)
+	builder := strings.Builder{}
+	if tag == serviceNameTag {
+		builder.WriteString(`SELECT DISTINCT service_name FROM spans`)
+		if hasTagTimeRange(params) {
+			start, end := tagTimeRange(params)
+			builder.WriteString(` WHERE start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
+			args = append(args, start, end)
+		}
+		builder.WriteString(` ORDER BY service_name LIMIT ?`)
+		args = append(args, params.Limit)
+		return builder.String(), args
+	}
+	builder.WriteString(`SELECT value FROM (
+`)
+	if hasTagTimeRange(params) {
+		start, end := tagTimeRange(params)
+		builder.WriteString(`SELECT sa.value FROM span_attributes sa JOIN spans ON spans.id = sa.span_id WHERE sa.key = ? AND spans.start_time_unix_nano >= ? AND spans.start_time_unix_nano <= ?
+UNION
+SELECT ra.value FROM resource_attributes ra JOIN spans ON spans.resource_id = ra.resource_id WHERE ra.key = ? AND spans.start_time_unix_nano >= ? AND spans.start_time_unix_nano <= ?`)
+		args = append(args, tag, start, end, tag, start, end)
+	} else {
+		builder.WriteString(`SELECT value FROM span_attributes WHERE key = ?
+UNION
+SELECT value FROM resource_attributes WHERE key = ?`)
+		args = append(args, tag, tag)
+	}
+	builder.WriteString(`
+) tag_values ORDER BY value LIMIT ?`)
+	args = append(args, params.Limit)
+	return builder.String(), args
+}
+
+func hasTagTimeRange(params spanstore.TagQueryParams) bool {
+	return params.Start > 0 || params.End > 0
+}
+
+func tagTimeRange(params spanstore.TagQueryParams) (int64, int64) {
+	end := params.End
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	return params.Start, end
+}
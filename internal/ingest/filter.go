@@ -0,0 +1,39 @@
+package ingest
+
+import (
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// FilterSpans returns a request holding the spans of req that keep accepts,
+// with their resource and scope, and the number of spans left out. Resources
+// and scopes left empty are dropped. req is returned as is when every span is
+// kept; otherwise it is not modified.
+func FilterSpans(req *coltracepb.ExportTraceServiceRequest, keep func(*resourcepb.Resource, *tracepb.Span) bool) (*coltracepb.ExportTraceServiceRequest, int) {
+	filtered := &coltracepb.ExportTraceServiceRequest{}
+	dropped := 0
+	for _, resourceSpans := range req.GetResourceSpans() {
+		resource := &tracepb.ResourceSpans{Resource: resourceSpans.GetResource(), SchemaUrl: resourceSpans.GetSchemaUrl()}
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			scope := &tracepb.ScopeSpans{Scope: scopeSpans.GetScope(), SchemaUrl: scopeSpans.GetSchemaUrl()}
+			for _, span := range scopeSpans.GetSpans() {
+				if keep(resourceSpans.GetResource(), span) {
+					scope.Spans = append(scope.Spans, span)
+				} else {
+					dropped++
+				}
+			}
+			if len(scope.Spans) > 0 {
+				resource.ScopeSpans = append(resource.ScopeSpans, scope)
+			}
+		}
+		if len(resource.ScopeSpans) > 0 {
+			filtered.ResourceSpans = append(filtered.ResourceSpans, resource)
+		}
+	}
+	if dropped == 0 {
+		return req, 0
+	}
+	return filtered, dropped
+}
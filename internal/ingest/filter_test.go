@@ -0,0 +1,33 @@
+package ingest
+
+import (
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+func TestFilterSpans(t *testing.T) {
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{
+		routedResource("api", nil, routedSpan("keep"), routedSpan("drop")),
+		routedResource("worker", nil, routedSpan("drop")),
+	}}
+	keepNamed := func(_ *resourcepb.Resource, span *tracepb.Span) bool { return span.GetName() == "keep" }
+
+	filtered, dropped := FilterSpans(req, keepNamed)
+	if dropped != 2 {
+		t.Fatalf("expected 2 dropped spans, got %d", dropped)
+	}
+	if len(filtered.GetResourceSpans()) != 1 || len(filtered.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()) != 1 {
+		t.Fatalf("expected one resource with one span, got %v", filtered)
+	}
+	if len(req.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()) != 2 {
+		t.Fatal("expected the original request to be left alone")
+	}
+
+	all, dropped := FilterSpans(req, func(*resourcepb.Resource, *tracepb.Span) bool { return true })
+	if all != req || dropped != 0 {
+		t.Fatalf("expected the original request when nothing is dropped")
+	}
+}
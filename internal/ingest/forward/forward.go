@@ -0,0 +1,471 @@
+// Package forward re-exports consumed traces to upstream OTLP HTTP
+// receivers, so this server can sit in front of a collector as a tap.
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+)
+
+const (
+	defaultBatchSpans    = 1000
+	defaultFlushInterval = time.Second
+	defaultBufferSpans   = 100000
+	defaultTimeout       = 10 * time.Second
+	defaultMaxRetryTime  = 5 * time.Minute
+	minRetryBackoff      = 500 * time.Millisecond
+	maxRetryBackoff      = 30 * time.Second
+	shutdownTimeout      = 5 * time.Second
+	maxResponseBody      = 64 << 10
+
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+var ErrClosed = errors.New("forward sink closed")
+
+type Options struct {
+	// Headers are added to every export, for example an API key.
+	Headers map[string]string
+	// Compression is gzip (the default) or none.
+	Compression string
+	// BatchSpans is the most spans merged into one export. FlushInterval
+	// bounds how long a smaller batch waits.
+	BatchSpans    int
+	FlushInterval time.Duration
+	// BufferSpans bounds the spans waiting per endpoint, including batches
+	// being retried. The oldest requests are dropped past it.
+	BufferSpans int
+	// Timeout bounds each export attempt; MaxRetryTime bounds how long a
+	// batch is retried before it is dropped.
+	Timeout      time.Duration
+	MaxRetryTime time.Duration
+	Client       *http.Client
+	Logger       *log.Logger
+	Metrics      *metrics.Registry
+}
+
+// Sink buffers consumed requests and exports them to each endpoint in the
+// background. Consume never waits on an upstream, and an unreachable
+// endpoint only drops its own backlog.
+type Sink struct {
+	exporters []*exporter
+	closeOnce sync.Once
+}
+
+func New(endpoints []string) (*Sink, error) {
+	return NewWithOptions(endpoints, Options{})
+}
+
+func NewWithOptions(endpoints []string, opts Options) (*Sink, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("at least one forward endpoint is required")
+	}
+	compression := strings.ToLower(strings.TrimSpace(opts.Compression))
+	switch compression {
+	case "":
+		compression = CompressionGzip
+	case CompressionGzip, CompressionNone:
+	default:
+		return nil, fmt.Errorf("unknown compression %q (want gzip or none)", opts.Compression)
+	}
+	cfg := settings{
+		headers:       opts.Headers,
+		gzip:          compression == CompressionGzip,
+		batchSpans:    positive(opts.BatchSpans, defaultBatchSpans),
+		flushInterval: positive(opts.FlushInterval, defaultFlushInterval),
+		bufferSpans:   positive(opts.BufferSpans, defaultBufferSpans),
+		timeout:       positive(opts.Timeout, defaultTimeout),
+		maxRetryTime:  positive(opts.MaxRetryTime, defaultMaxRetryTime),
+		client:        opts.Client,
+		logger:        opts.Logger,
+	}
+	if cfg.client == nil {
+		cfg.client = http.DefaultClient
+	}
+	exportMetrics := exporterMetrics{
+		sent:     opts.Metrics.Counter("smelldeadfish_forward_spans_sent_total", "Spans exported to an upstream OTLP endpoint.", "endpoint"),
+		dropped:  opts.Metrics.Counter("smelldeadfish_forward_spans_dropped_total", "Spans never exported to an upstream OTLP endpoint, by reason.", "endpoint", "reason"),
+		retries:  opts.Metrics.Counter("smelldeadfish_forward_retries_total", "Export attempts retried after a failure.", "endpoint"),
+		buffered: opts.Metrics.Gauge("smelldeadfish_forward_buffered_spans", "Spans waiting to be exported to an upstream OTLP endpoint.", "endpoint"),
+	}
+
+	sink := &Sink{}
+	for _, raw := range endpoints {
+		endpoint, label, err := parseEndpoint(raw)
+		if err != nil {
+			return nil, err
+		}
+		sink.exporters = append(sink.exporters, newExporter(endpoint, label, cfg, exportMetrics))
+	}
+	for _, exporter := range sink.exporters {
+		go exporter.run()
+	}
+	return sink, nil
+}
+
+// parseEndpoint accepts a full traces URL or a base URL, which gets the
+// standard /v1/traces path. The label hides any credentials.
+func parseEndpoint(raw string) (string, string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", "", fmt.Errorf("forward endpoint %q must be an http or https URL", raw)
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		parsed.Path = "/v1/traces"
+	}
+	return parsed.String(), parsed.Redacted(), nil
+}
+
+func positive[T int | time.Duration](value, fallback T) T {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Consume queues req for every endpoint. It only fails once the sink is
+// closed.
+func (s *Sink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if s == nil || req == nil {
+		return nil
+	}
+	spans := ingest.CountSpans(req.GetResourceSpans()...)
+	if spans == 0 {
+		return nil
+	}
+	for _, exporter := range s.exporters {
+		if err := exporter.enqueue(req, spans); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close exports what is buffered, giving up on retries after a few seconds.
+func (s *Sink) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.closeOnce.Do(func() {
+		for _, exporter := range s.exporters {
+			exporter.close()
+		}
+		done := make(chan struct{})
+		go func() {
+			for _, exporter := range s.exporters {
+				<-exporter.done
+			}
+			close(done)
+		}()
+		timer := time.NewTimer(shutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			for _, exporter := range s.exporters {
+				exporter.cancel()
+			}
+			<-done
+		}
+	})
+	return nil
+}
+
+type settings struct {
+	headers       map[string]string
+	gzip          bool
+	batchSpans    int
+	flushInterval time.Duration
+	bufferSpans   int
+	timeout       time.Duration
+	maxRetryTime  time.Duration
+	client        *http.Client
+	logger        *log.Logger
+}
+
+type exporterMetrics struct {
+	sent     *metrics.Counter
+	dropped  *metrics.Counter
+	retries  *metrics.Counter
+	buffered *metrics.Gauge
+}
+
+type pendingRequest struct {
+	req   *coltracepb.ExportTraceServiceRequest
+	spans int
+}
+
+type exporter struct {
+	endpoint string
+	label    string
+	settings
+	metrics exporterMetrics
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending []pendingRequest
+	// buffered counts pending spans plus the batch being exported.
+	buffered int
+	inFlight int
+	closed   bool
+}
+
+func newExporter(endpoint, label string, cfg settings, exportMetrics exporterMetrics) *exporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &exporter{
+		endpoint: endpoint,
+		label:    label,
+		settings: cfg,
+		metrics:  exportMetrics,
+		ctx:      ctx,
+		cancel:   cancel,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (e *exporter) enqueue(req *coltracepb.ExportTraceServiceRequest, spans int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	for len(e.pending) > 0 && e.buffered+spans > e.bufferSpans {
+		oldest := e.pending[0]
+		e.pending = e.pending[1:]
+		e.buffered -= oldest.spans
+		e.metrics.dropped.Add(float64(oldest.spans), e.label, "buffer_full")
+	}
+	if e.buffered+spans > e.bufferSpans {
+		// Only the batch in flight is left; the new request waits for it.
+		e.metrics.dropped.Add(float64(spans), e.label, "buffer_full")
+		return nil
+	}
+	e.pending = append(e.pending, pendingRequest{req: req, spans: spans})
+	e.buffered += spans
+	e.metrics.buffered.Set(float64(e.buffered), e.label)
+	if e.buffered-e.inFlight >= e.batchSpans {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (e *exporter) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.closed = true
+		close(e.stop)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	defer e.cancel()
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.wake:
+		case <-ticker.C:
+		case <-e.stop:
+			e.flush()
+			return
+		}
+		e.flush()
+	}
+}
+
+// flush exports batches until nothing is pending.
+func (e *exporter) flush() {
+	for {
+		req, spans := e.take()
+		if req == nil {
+			return
+		}
+		e.export(req, spans)
+		e.mu.Lock()
+		e.buffered -= spans
+		e.inFlight = 0
+		e.metrics.buffered.Set(float64(e.buffered), e.label)
+		e.mu.Unlock()
+	}
+}
+
+// take removes up to batchSpans spans worth of requests, always at least
+// one, and merges them.
+func (e *exporter) take() (*coltracepb.ExportTraceServiceRequest, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pending) == 0 {
+		return nil, 0
+	}
+	var reqs []*coltracepb.ExportTraceServiceRequest
+	spans := 0
+	count := 0
+	for _, item := range e.pending {
+		if count > 0 && spans+item.spans > e.batchSpans {
+			break
+		}
+		reqs = append(reqs, item.req)
+		spans += item.spans
+		count++
+	}
+	e.pending = e.pending[count:]
+	e.inFlight = spans
+	return ingest.MergeRequests(reqs...), spans
+}
+
+// export sends one batch, retrying transient failures with exponential
+// backoff or the server's Retry-After until maxRetryTime has passed.
+func (e *exporter) export(req *coltracepb.ExportTraceServiceRequest, spans int) {
+	body, err := e.encode(req)
+	if err != nil {
+		e.drop(spans, "encode", err)
+		return
+	}
+	deadline := time.Now().Add(e.maxRetryTime)
+	backoff := minRetryBackoff
+	for {
+		retryAfter, err := e.post(body)
+		if err == nil {
+			e.metrics.sent.Add(float64(spans), e.label)
+			return
+		}
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			e.drop(spans, "rejected", err)
+			return
+		}
+		wait := retryAfter
+		if wait <= 0 {
+			wait = backoff + time.Duration(time.Now().UnixNano()%int64(backoff/2))
+			backoff = min(backoff*2, maxRetryBackoff)
+		}
+		if time.Now().Add(wait).After(deadline) {
+			e.drop(spans, "retries_exhausted", err)
+			return
+		}
+		e.metrics.retries.Inc(e.label)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-e.ctx.Done():
+			timer.Stop()
+			e.drop(spans, "shutdown", err)
+			return
+		}
+	}
+}
+
+func (e *exporter) drop(spans int, reason string, err error) {
+	e.metrics.dropped.Add(float64(spans), e.label, reason)
+	if e.logger != nil {
+		e.logger.Printf("msg=forward_dropped endpoint=%q spans=%d reason=%s error=%q", e.label, spans, reason, err.Error())
+	}
+}
+
+func (e *exporter) encode(req *coltracepb.ExportTraceServiceRequest) ([]byte, error) {
+	payload, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	if !e.gzip {
+		return payload, nil
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, fmt.Errorf("compress request: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("compress request: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// rejectedError is a response that retrying will not fix.
+type rejectedError struct {
+	status int
+	body   string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("upstream rejected export: %d %s", e.status, e.body)
+}
+
+// post sends one attempt. It returns the server's Retry-After delay, if
+// any, with retryable errors.
+func (e *exporter) post(body []byte) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, &rejectedError{body: err.Error()}
+	}
+	for key, value := range e.headers {
+		httpReq.Header.Set(key, value)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	if e.gzip {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("post export: %w", err)
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return parseRetryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("upstream returned %d", resp.StatusCode)
+	default:
+		return 0, &rejectedError{status: resp.StatusCode, body: strings.TrimSpace(string(message))}
+	}
+}
+
+// parseRetryAfter reads delay-seconds or an HTTP date.
+func parseRetryAfter(raw string) time.Duration {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(raw); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
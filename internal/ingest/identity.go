@@ -0,0 +1,81 @@
+package ingest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strconv"
+)
+
+// StoredAttribute is an attribute in the key/type/value form the stores
+// persist. Content IDs are computed from this form so that rows already on
+// disk hash to the same ID as freshly ingested ones.
+type StoredAttribute struct {
+	Key   string
+	Type  string
+	Value string
+}
+
+// Typed returns the native value of int, double and bool attributes for the
+// stores' typed columns. Columns that do not apply, and values that fail to
+// parse, are nil so the stores write NULL.
+func (a StoredAttribute) Typed() (intValue, doubleValue, boolValue any) {
+	switch a.Type {
+	case "int":
+		if parsed, err := strconv.ParseInt(a.Value, 10, 64); err == nil {
+			return parsed, nil, nil
+		}
+	case "double":
+		if parsed, err := strconv.ParseFloat(a.Value, 64); err == nil {
+			return nil, parsed, nil
+		}
+	case "bool":
+		if parsed, err := strconv.ParseBool(a.Value); err == nil {
+			return nil, nil, parsed
+		}
+	}
+	return nil, nil, nil
+}
+
+// ResourceID returns the content-addressed ID of a resource: a hash of its
+// schema URL and attributes, independent of attribute order.
+func ResourceID(schemaURL string, attrs []StoredAttribute) string {
+	return contentID("resource", []string{schemaURL}, attrs)
+}
+
+// ScopeID returns the content-addressed ID of an instrumentation scope.
+func ScopeID(name, version, schemaURL string, attrs []StoredAttribute) string {
+	return contentID("scope", []string{name, version, schemaURL}, attrs)
+}
+
+func contentID(kind string, fields []string, attrs []StoredAttribute) string {
+	sorted := append([]StoredAttribute(nil), attrs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Key != sorted[j].Key {
+			return sorted[i].Key < sorted[j].Key
+		}
+		if sorted[i].Type != sorted[j].Type {
+			return sorted[i].Type < sorted[j].Type
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	hash := sha256.New()
+	// Every field is length-prefixed so no two inputs share an encoding.
+	write := func(value string) {
+		var size [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(size[:], uint64(len(value)))
+		hash.Write(size[:n])
+		hash.Write([]byte(value))
+	}
+	write(kind)
+	for _, field := range fields {
+		write(field)
+	}
+	for _, attr := range sorted {
+		write(attr.Key)
+		write(attr.Type)
+		write(attr.Value)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
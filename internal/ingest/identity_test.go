@@ -0,0 +1,43 @@
+package ingest
+
+import "testing"
+
+func TestContentIDsIgnoreAttributeOrder(t *testing.T) {
+	a := []StoredAttribute{{Key: "service.name", Type: "string", Value: "api"}, {Key: "host.name", Type: "string", Value: "h1"}}
+	b := []StoredAttribute{a[1], a[0]}
+	if ResourceID("", a) != ResourceID("", b) {
+		t.Fatalf("expected resource ID to ignore attribute order")
+	}
+	if ResourceID("", a) == ResourceID("https://schema", a) {
+		t.Fatalf("expected schema URL to change the resource ID")
+	}
+	changed := []StoredAttribute{a[0], {Key: "host.name", Type: "string", Value: "h2"}}
+	if ResourceID("", a) == ResourceID("", changed) {
+		t.Fatalf("expected attribute values to change the resource ID")
+	}
+	if ResourceID("", nil) == ScopeID("", "", "", nil) {
+		t.Fatalf("expected resources and scopes to hash differently")
+	}
+	if ScopeID("ab", "c", "", nil) == ScopeID("a", "bc", "", nil) {
+		t.Fatalf("expected field boundaries to be part of the scope ID")
+	}
+}
+
+func TestStoredAttributeTyped(t *testing.T) {
+	cases := []struct {
+		attr                 StoredAttribute
+		intV, doubleV, boolV any
+	}{
+		{StoredAttribute{Type: "int", Value: "-42"}, int64(-42), nil, nil},
+		{StoredAttribute{Type: "double", Value: "1.5"}, nil, 1.5, nil},
+		{StoredAttribute{Type: "bool", Value: "true"}, nil, nil, true},
+		{StoredAttribute{Type: "string", Value: "7"}, nil, nil, nil},
+		{StoredAttribute{Type: "int", Value: "seven"}, nil, nil, nil},
+	}
+	for _, tc := range cases {
+		intV, doubleV, boolV := tc.attr.Typed()
+		if intV != tc.intV || doubleV != tc.doubleV || boolV != tc.boolV {
+			t.Fatalf("%+v: got (%v, %v, %v), want (%v, %v, %v)", tc.attr, intV, doubleV, boolV, tc.intV, tc.doubleV, tc.boolV)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/otlpconv"
+	"smelldeadfish/internal/spanstore"
+)
+
+const (
+	rootSpanParentID   = "0000000000000000"
+	serviceNameTag     = "service.name"
+	defaultExportLimit = 1000
+)
+
+func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]spanstore.Span, error) {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	terms := ingest.SearchTerms(params.Text)
+	s.mu.RLock()
+	var spans []spanstore.Span
+	for _, t := range s.traces {
+		for _, stored := range t.spans {
+			if stored.span.ServiceName != params.Service || !matchesSpan(stored, params.Start, params.End, params.AttrFilters, params.StatusCode) {
+				continue
+			}
+			span := stored.span
+			if len(terms) > 0 {
+				match, ok := ingest.MatchText(stored.doc, terms)
+				if !ok {
+					continue
+				}
+				span.Match = match
+			}
+			spans = append(spans, span)
+		}
+	}
+	s.mu.RUnlock()
+	sort.SliceStable(spans, func(i, j int) bool {
+		if len(terms) > 0 && spans[i].Match.Score != spans[j].Match.Score {
+			return spans[i].Match.Score > spans[j].Match.Score
+		}
+		if spans[i].StartTimeUnixNano != spans[j].StartTimeUnixNano {
+			return spans[i].StartTimeUnixNano > spans[j].StartTimeUnixNano
+		}
+		return spans[i].SpanID > spans[j].SpanID
+	})
+	if len(spans) > params.Limit {
+		spans = spans[:params.Limit]
+	}
+	return spans, nil
+}
+
+func (s *Sink) QueryTraces(ctx context.Context, params spanstore.TraceQueryParams) ([]spanstore.TraceSummary, error) {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	params.Text = strings.TrimSpace(params.Text)
+	if params.Order == "" && params.Text != "" {
+		params.Order = spanstore.TraceOrderRelevance
+	}
+	if params.Order == "" || (params.Order == spanstore.TraceOrderRelevance && params.Text == "") {
+		params.Order = spanstore.TraceOrderStartDesc
+	}
+	terms := ingest.SearchTerms(params.Text)
+	status := params.StatusCode
+	if params.HasError {
+		code := spanstore.StatusError
+		if status != nil && *status != code {
+			return nil, nil
+		}
+		status = &code
+	}
+
+	s.mu.RLock()
+	var summaries []spanstore.TraceSummary
+	// Relevance ranks a trace by its best span among those matching the
+	// filters, while Match shows its best span overall, as in the SQL stores.
+	scores := map[string]float64{}
+	for _, t := range s.traces {
+		candidate := false
+		for _, stored := range t.spans {
+			if params.Service != "" && stored.span.ServiceName != params.Service {
+				continue
+			}
+			if !matchesSpan(stored, params.Start, params.End, params.AttrFilters, status) {
+				continue
+			}
+			if len(terms) > 0 {
+				match, ok := ingest.MatchText(stored.doc, terms)
+				if !ok {
+					continue
+				}
+				if score, seen := scores[t.id]; !seen || match.Score > score {
+					scores[t.id] = match.Score
+				}
+			}
+			candidate = true
+			if len(terms) == 0 {
+				break
+			}
+		}
+		if !candidate {
+			continue
+		}
+		summary := summarize(t, params.Service)
+		if params.MinDuration > 0 && summary.DurationUnixNano < params.MinDuration {
+			continue
+		}
+		if params.MaxDuration > 0 && summary.DurationUnixNano > params.MaxDuration {
+			continue
+		}
+		if len(terms) > 0 {
+			summary.Match = bestMatch(t, terms)
+		}
+		summaries = append(summaries, summary)
+	}
+	s.mu.RUnlock()
+
+	sortTraceSummaries(summaries, params.Order, scores)
+	if len(summaries) > params.Limit {
+		summaries = summaries[:params.Limit]
+	}
+	return summaries, nil
+}
+
+func (s *Sink) QueryTraceSpans(ctx context.Context, params spanstore.TraceSpansQueryParams) ([]spanstore.Span, error) {
+	matched, err := s.traceSpans(params)
+	if err != nil {
+		return nil, err
+	}
+	spans := make([]spanstore.Span, len(matched))
+	for i, stored := range matched {
+		spans[i] = stored.span
+	}
+	return spans, nil
+}
+
+func (s *Sink) QueryTraceOTLP(ctx context.Context, params spanstore.TraceSpansQueryParams) (*coltracepb.ExportTraceServiceRequest, error) {
+	matched, err := s.traceSpans(params)
+	if err != nil {
+		return nil, err
+	}
+	builder := otlpconv.NewBuilder()
+	for _, stored := range matched {
+		builder.Add(stored.resource.id, stored.resource.resource, stored.scope.id, stored.scope.scope, stored.proto)
+	}
+	return cloneRequest(builder.Request()), nil
+}
+
+// ExportSpans returns the next page of spans in export order.
+func (s *Sink) ExportSpans(ctx context.Context, params spanstore.ExportParams) (spanstore.ExportPage, error) {
+	if params.Limit <= 0 {
+		params.Limit = defaultExportLimit
+	}
+	end := params.End
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	type entry struct {
+		stored *storedSpan
+		cursor spanstore.ExportCursor
+	}
+	service := strings.TrimSpace(params.Service)
+	var matched []entry
+	s.mu.RLock()
+	for _, t := range s.traces {
+		for _, stored := range t.spans {
+			if service != "" && stored.span.ServiceName != service {
+				continue
+			}
+			cursor := spanstore.ExportCursor{StartTimeUnixNano: stored.span.StartTimeUnixNano, TraceID: stored.span.TraceID, SpanID: stored.span.SpanID}
+			if cursor.StartTimeUnixNano < params.Start || cursor.StartTimeUnixNano > end {
+				continue
+			}
+			if params.After != nil && !params.After.Before(cursor) {
+				continue
+			}
+			matched = append(matched, entry{stored: stored, cursor: cursor})
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].cursor.Before(matched[j].cursor)
+	})
+	if len(matched) > params.Limit {
+		matched = matched[:params.Limit]
+	}
+	builder := otlpconv.NewBuilder()
+	for _, e := range matched {
+		builder.Add(e.stored.resource.id, e.stored.resource.resource, e.stored.scope.id, e.stored.scope.scope, e.stored.proto)
+	}
+	page := spanstore.ExportPage{Request: cloneRequest(builder.Request()), Spans: len(matched)}
+	if len(matched) > 0 {
+		next := matched[len(matched)-1].cursor
+		page.Next = &next
+	}
+	return page, nil
+}
+
+// traceSpans returns the spans of one trace in start order.
+func (s *Sink) traceSpans(params spanstore.TraceSpansQueryParams) ([]*storedSpan, error) {
+	traceID := strings.TrimSpace(params.TraceID)
+	if traceID == "" {
+		return nil, fmt.Errorf("trace_id is required")
+	}
+	service := strings.TrimSpace(params.Service)
+	s.mu.RLock()
+	var matched []*storedSpan
+	if t := s.traces[traceID]; t != nil {
+		for _, stored := range t.spans {
+			if service != "" && stored.span.ServiceName != service {
+				continue
+			}
+			if params.StatusCode != nil && stored.span.StatusCode != int32(*params.StatusCode) {
+				continue
+			}
+			matched = append(matched, stored)
+		}
+	}
+	s.mu.RUnlock()
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].span.StartTimeUnixNano < matched[j].span.StartTimeUnixNano
+	})
+	return matched, nil
+}
+
+func (s *Sink) QueryTagNames(ctx context.Context, params spanstore.TagQueryParams) ([]string, error) {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	names := map[string]bool{serviceNameTag: true}
+	s.forEachSpan(params, func(stored *storedSpan) {
+		for _, attr := range stored.attrs {
+			names[attr.Key] = true
+		}
+		for _, attr := range stored.resource.attrs {
+			names[attr.Key] = true
+		}
+	})
+	return sortedLimit(names, params.Limit), nil
+}
+
+func (s *Sink) QueryTagValues(ctx context.Context, tag string, params spanstore.TagQueryParams) ([]string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return nil, fmt.Errorf("tag is required")
+	}
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	values := map[string]bool{}
+	s.forEachSpan(params, func(stored *storedSpan) {
+		if tag == serviceNameTag {
+			values[stored.span.ServiceName] = true
+			return
+		}
+		for _, attr := range stored.attrs {
+			if attr.Key == tag {
+				values[attr.Value] = true
+			}
+		}
+		for _, attr := range stored.resource.attrs {
+			if attr.Key == tag {
+				values[attr.Value] = true
+			}
+		}
+	})
+	return sortedLimit(values, params.Limit), nil
+}
+
+// forEachSpan visits the spans in the tag query's time range, or every span
+// when it has none.
+func (s *Sink) forEachSpan(params spanstore.TagQueryParams, fn func(*storedSpan)) {
+	start, end := params.Start, params.End
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.traces {
+		for _, stored := range t.spans {
+			if stored.span.StartTimeUnixNano >= start && stored.span.StartTimeUnixNano <= end {
+				fn(stored)
+			}
+		}
+	}
+}
+
+func sortedLimit(set map[string]bool, limit int) []string {
+	values := make([]string, 0, len(set))
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	if len(values) > limit {
+		values = values[:limit]
+	}
+	return values
+}
+
+func matchesSpan(stored *storedSpan, start, end int64, filters []spanstore.AttrFilter, status *spanstore.StatusCode) bool {
+	span := &stored.span
+	if span.StartTimeUnixNano < start || span.StartTimeUnixNano > end {
+		return false
+	}
+	if status != nil && span.StatusCode != int32(*status) {
+		return false
+	}
+	for _, filter := range filters {
+		if !matchesAttrFilter(stored.attrs, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAttrFilter reports whether some attribute satisfies filter, with the
+// SQL stores' semantics: equality compares the string form, and numeric
+// operators compare int and double attributes only.
+func matchesAttrFilter(attrs []ingest.StoredAttribute, filter spanstore.AttrFilter) bool {
+	var number float64
+	if filter.Op.Numeric() {
+		parsed, err := strconv.ParseFloat(filter.Value, 64)
+		if err != nil {
+			return false
+		}
+		number = parsed
+	}
+	for _, attr := range attrs {
+		if attr.Key != filter.Key {
+			continue
+		}
+		switch filter.Op {
+		case "", spanstore.AttrOpEqual:
+			if attr.Value == filter.Value {
+				return true
+			}
+		case spanstore.AttrOpNotEqual:
+			if attr.Value != filter.Value {
+				return true
+			}
+		default:
+			value, ok := numericValue(attr)
+			if ok && compareNumbers(value, filter.Op, number) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericValue(attr ingest.StoredAttribute) (float64, bool) {
+	intValue, doubleValue, _ := attr.Typed()
+	if v, ok := intValue.(int64); ok {
+		return float64(v), true
+	}
+	v, ok := doubleValue.(float64)
+	return v, ok
+}
+
+func compareNumbers(value float64, op spanstore.AttrOp, number float64) bool {
+	switch op {
+	case spanstore.AttrOpGreater:
+		return value > number
+	case spanstore.AttrOpGreaterEqual:
+		return value >= number
+	case spanstore.AttrOpLess:
+		return value < number
+	case spanstore.AttrOpLessEqual:
+		return value <= number
+	}
+	return false
+}
+
+// summarize aggregates every span of the trace. The earliest root span names
+// it; without one, the service is the lowest service name.
+func summarize(t *trace, service string) spanstore.TraceSummary {
+	summary := spanstore.TraceSummary{TraceID: t.id}
+	var root *spanstore.Span
+	for i, stored := range t.spans {
+		span := &stored.span
+		if i == 0 || span.StartTimeUnixNano < summary.StartTimeUnixNano {
+			summary.StartTimeUnixNano = span.StartTimeUnixNano
+		}
+		if i == 0 || span.EndTimeUnixNano > summary.EndTimeUnixNano {
+			summary.EndTimeUnixNano = span.EndTimeUnixNano
+		}
+		if i == 0 || span.ServiceName < summary.ServiceName {
+			summary.ServiceName = span.ServiceName
+		}
+		summary.SpanCount++
+		if span.StatusCode == int32(spanstore.StatusError) {
+			summary.ErrorCount++
+		}
+		if span.ParentSpanID == rootSpanParentID && (root == nil || span.StartTimeUnixNano < root.StartTimeUnixNano) {
+			root = span
+		}
+	}
+	summary.DurationUnixNano = summary.EndTimeUnixNano - summary.StartTimeUnixNano
+	if root != nil {
+		summary.RootName = root.Name
+		summary.ServiceName = root.ServiceName
+	}
+	if service != "" {
+		summary.ServiceName = service
+	}
+	return summary
+}
+
+// bestMatch returns the trace's best-matching span, the earliest on ties.
+func bestMatch(t *trace, terms []string) *spanstore.TextMatch {
+	spans := append([]*storedSpan(nil), t.spans...)
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].span.StartTimeUnixNano < spans[j].span.StartTimeUnixNano
+	})
+	var best *spanstore.TextMatch
+	for _, stored := range spans {
+		if match, ok := ingest.MatchText(stored.doc, terms); ok && (best == nil || match.Score > best.Score) {
+			match.SpanID = stored.span.SpanID
+			best = match
+		}
+	}
+	return best
+}
+
+func sortTraceSummaries(summaries []spanstore.TraceSummary, order spanstore.TraceOrder, scores map[string]float64) {
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		switch order {
+		case spanstore.TraceOrderStartAsc:
+			if a.StartTimeUnixNano != b.StartTimeUnixNano {
+				return a.StartTimeUnixNano < b.StartTimeUnixNano
+			}
+			return a.TraceID > b.TraceID
+		case spanstore.TraceOrderDurationDesc:
+			if a.DurationUnixNano != b.DurationUnixNano {
+				return a.DurationUnixNano > b.DurationUnixNano
+			}
+		case spanstore.TraceOrderDurationAsc:
+			if a.DurationUnixNano != b.DurationUnixNano {
+				return a.DurationUnixNano < b.DurationUnixNano
+			}
+		case spanstore.TraceOrderRelevance:
+			if scores[a.TraceID] != scores[b.TraceID] {
+				return scores[a.TraceID] > scores[b.TraceID]
+			}
+		}
+		if a.StartTimeUnixNano != b.StartTimeUnixNano {
+			return a.StartTimeUnixNano > b.StartTimeUnixNano
+		}
+		return a.TraceID > b.TraceID
+	})
+}
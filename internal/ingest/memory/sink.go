@@ -0,0 +1,299 @@
+package memory
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/otlpconv"
+	"smelldeadfish/internal/spanstore"
+)
+
+const defaultMaxSpans = 100000
+
+type Options struct {
+	Metrics *metrics.Registry
+	// MaxSpans and MaxBytes bound the store. Bytes are the encoded OTLP size
+	// of the spans, which understates the memory they use: each span is also
+	// kept decoded, as a query view, and as search text, several times its
+	// encoded size. Zero disables a bound; with both zero MaxSpans is 100000.
+	MaxSpans int
+	MaxBytes int64
+}
+
+// Sink keeps spans in memory for tests, demos, and short-lived environments.
+// When a bound is exceeded, the traces first written longest ago are evicted
+// whole, even if more of their spans arrived since. Queries follow the SQL
+// stores, free text included.
+type Sink struct {
+	maxSpans int
+	maxBytes int64
+	metrics  ingest.WriteMetrics
+	evicted  *metrics.Counter
+
+	mu     sync.RWMutex
+	traces map[string]*trace
+	order  *list.List // of *trace, first written first
+	spans  int
+	bytes  int64
+}
+
+type trace struct {
+	id    string
+	spans []*storedSpan
+	ids   map[string]bool
+	bytes int64
+}
+
+type storedSpan struct {
+	span     spanstore.Span
+	attrs    []ingest.StoredAttribute
+	doc      ingest.SearchDocument
+	proto    *tracepb.Span
+	resource *storedGroup
+	scope    *storedGroup
+}
+
+// storedGroup is a resource or scope shared by the spans of one request,
+// with the content ID the SQL stores would give it. attrs holds resource
+// attributes in stored form for tag queries.
+type storedGroup struct {
+	id       string
+	resource otlpconv.StoredResource
+	scope    otlpconv.StoredScope
+	attrs    []ingest.StoredAttribute
+}
+
+func New() *Sink {
+	return NewWithOptions(Options{})
+}
+
+func NewWithOptions(opts Options) *Sink {
+	if opts.MaxSpans <= 0 && opts.MaxBytes <= 0 {
+		opts.MaxSpans = defaultMaxSpans
+	}
+	s := &Sink{
+		maxSpans: opts.MaxSpans,
+		maxBytes: opts.MaxBytes,
+		metrics:  ingest.NewWriteMetrics(opts.Metrics, "memory"),
+		evicted:  opts.Metrics.Counter("smelldeadfish_memory_evicted_traces_total", "Traces evicted from the memory store to stay within its bounds."),
+		traces:   map[string]*trace{},
+		order:    list.New(),
+	}
+	opts.Metrics.GaugeFunc("smelldeadfish_memory_spans", "Spans held by the memory store.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(s.spans)
+	})
+	opts.Metrics.GaugeFunc("smelldeadfish_memory_bytes", "Encoded size of the spans held by the memory store.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(s.bytes)
+	})
+	return s
+}
+
+func (s *Sink) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *Sink) Close() error {
+	return nil
+}
+
+// Consume stores the spans of req. As in the SQL stores, a span whose trace
+// and span ID are already stored is skipped.
+func (s *Sink) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if s == nil || req == nil {
+		return nil
+	}
+	start := time.Now()
+	// The caller keeps ownership of req, so store a copy it cannot change.
+	spans, err := convertRequest(proto.Clone(req).(*coltracepb.ExportTraceServiceRequest))
+	if err == nil {
+		s.add(spans)
+	}
+	s.metrics.Observe(req, start, err)
+	return err
+}
+
+func (s *Sink) add(spans []*storedSpan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range spans {
+		t := s.traces[stored.span.TraceID]
+		if t == nil {
+			t = &trace{id: stored.span.TraceID, ids: map[string]bool{}}
+			s.order.PushBack(t)
+			s.traces[t.id] = t
+		}
+		if t.ids[stored.span.SpanID] {
+			continue
+		}
+		size := int64(proto.Size(stored.proto))
+		t.ids[stored.span.SpanID] = true
+		t.spans = append(t.spans, stored)
+		t.bytes += size
+		s.spans++
+		s.bytes += size
+	}
+	for s.order.Len() > 0 && ((s.maxSpans > 0 && s.spans > s.maxSpans) || (s.maxBytes > 0 && s.bytes > s.maxBytes)) {
+		oldest := s.order.Remove(s.order.Front()).(*trace)
+		delete(s.traces, oldest.id)
+		s.spans -= len(oldest.spans)
+		s.bytes -= oldest.bytes
+		s.evicted.Inc()
+	}
+}
+
+func convertRequest(req *coltracepb.ExportTraceServiceRequest) ([]*storedSpan, error) {
+	var result []*storedSpan
+	for _, resourceSpans := range req.GetResourceSpans() {
+		resourceAttrs, err := storedAttributes(resourceSpans.GetResource().GetAttributes())
+		if err != nil {
+			return nil, err
+		}
+		resource := &storedGroup{
+			id:       ingest.ResourceID(resourceSpans.GetSchemaUrl(), resourceAttrs),
+			resource: otlpconv.StoredResource{SchemaURL: resourceSpans.GetSchemaUrl(), Attributes: resourceSpans.GetResource().GetAttributes()},
+			attrs:    resourceAttrs,
+		}
+		resourceView := spanstore.Resource{SchemaURL: resourceSpans.GetSchemaUrl(), Attributes: attributeMap(resourceSpans.GetResource().GetAttributes())}
+		serviceName := ingest.ResourceServiceName(resourceSpans.GetResource())
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			instrumentation := scopeSpans.GetScope()
+			scopeAttrs, err := storedAttributes(instrumentation.GetAttributes())
+			if err != nil {
+				return nil, err
+			}
+			scope := &storedGroup{
+				id: ingest.ScopeID(instrumentation.GetName(), instrumentation.GetVersion(), scopeSpans.GetSchemaUrl(), scopeAttrs),
+				scope: otlpconv.StoredScope{
+					Name:       instrumentation.GetName(),
+					Version:    instrumentation.GetVersion(),
+					SchemaURL:  scopeSpans.GetSchemaUrl(),
+					Attributes: instrumentation.GetAttributes(),
+				},
+			}
+			scopeView := spanstore.Scope{
+				Name:       instrumentation.GetName(),
+				Version:    instrumentation.GetVersion(),
+				SchemaURL:  scopeSpans.GetSchemaUrl(),
+				Attributes: attributeMap(instrumentation.GetAttributes()),
+			}
+			for _, span := range scopeSpans.GetSpans() {
+				if span == nil {
+					continue
+				}
+				attrs, err := storedAttributes(span.GetAttributes())
+				if err != nil {
+					return nil, err
+				}
+				view := spanView(span)
+				view.ServiceName = serviceName
+				view.Resource = resourceView
+				view.Scope = scopeView
+				result = append(result, &storedSpan{
+					span:     view,
+					attrs:    attrs,
+					doc:      ingest.NewSearchDocument(span),
+					proto:    span,
+					resource: resource,
+					scope:    scope,
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+// cloneRequest copies a request built from stored spans so callers cannot
+// change the store through it.
+func cloneRequest(req *coltracepb.ExportTraceServiceRequest) *coltracepb.ExportTraceServiceRequest {
+	return proto.Clone(req).(*coltracepb.ExportTraceServiceRequest)
+}
+
+// spanView converts span the way the SQL stores read it back.
+func spanView(span *tracepb.Span) spanstore.Span {
+	view := spanstore.Span{
+		TraceID:           ingest.FormatTraceID(span.GetTraceId()),
+		SpanID:            ingest.FormatSpanID(span.GetSpanId()),
+		ParentSpanID:      ingest.FormatSpanID(span.GetParentSpanId()),
+		Name:              span.GetName(),
+		Kind:              ingest.SpanKind(span.GetKind()),
+		StartTimeUnixNano: int64(span.GetStartTimeUnixNano()),
+		EndTimeUnixNano:   int64(span.GetEndTimeUnixNano()),
+		StatusCode:        int32(span.GetStatus().GetCode()),
+		StatusMessage:     span.GetStatus().GetMessage(),
+		Flags:             span.GetFlags(),
+	}
+	if len(span.GetAttributes()) > 0 {
+		view.Attributes = attributeMap(span.GetAttributes())
+	}
+	for _, event := range span.GetEvents() {
+		view.Events = append(view.Events, spanstore.Event{
+			Name:                   event.GetName(),
+			TimeUnixNano:           int64(event.GetTimeUnixNano()),
+			DroppedAttributesCount: event.GetDroppedAttributesCount(),
+			Attributes:             attributeMap(event.GetAttributes()),
+		})
+	}
+	sort.SliceStable(view.Events, func(i, j int) bool {
+		if view.Events[i].TimeUnixNano == view.Events[j].TimeUnixNano {
+			return view.Events[i].Name < view.Events[j].Name
+		}
+		return view.Events[i].TimeUnixNano < view.Events[j].TimeUnixNano
+	})
+	for _, link := range span.GetLinks() {
+		view.Links = append(view.Links, spanstore.Link{
+			TraceID:                ingest.FormatTraceID(link.GetTraceId()),
+			SpanID:                 ingest.FormatSpanID(link.GetSpanId()),
+			TraceState:             link.GetTraceState(),
+			DroppedAttributesCount: link.GetDroppedAttributesCount(),
+			Flags:                  link.GetFlags(),
+			Attributes:             attributeMap(link.GetAttributes()),
+		})
+	}
+	sort.SliceStable(view.Links, func(i, j int) bool {
+		if view.Links[i].TraceID == view.Links[j].TraceID {
+			return view.Links[i].SpanID < view.Links[j].SpanID
+		}
+		return view.Links[i].TraceID < view.Links[j].TraceID
+	})
+	return view
+}
+
+func storedAttributes(attrs []*commonpb.KeyValue) ([]ingest.StoredAttribute, error) {
+	stored := make([]ingest.StoredAttribute, 0, len(attrs))
+	for _, attr := range attrs {
+		attrType, attrValue, err := otlpconv.StoredForm(attr.GetValue())
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, ingest.StoredAttribute{Key: attr.GetKey(), Type: attrType, Value: attrValue})
+	}
+	return stored, nil
+}
+
+// attributeMap decodes attributes as the SQL stores read them back from their
+// stored form.
+func attributeMap(attrs []*commonpb.KeyValue) map[string]any {
+	result := make(map[string]any, len(attrs))
+	for _, attr := range attrs {
+		attrType, attrValue, err := otlpconv.StoredForm(attr.GetValue())
+		if err != nil {
+			continue
+		}
+		result[attr.GetKey()] = otlpconv.StoredInterface(attrType, attrValue)
+	}
+	return result
+}
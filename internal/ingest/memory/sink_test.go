@@ -0,0 +1,283 @@
+package memory
+
+import (
+	"context"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/spanstore"
+	"smelldeadfish/internal/spanstore/spanstoretest"
+)
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intAttr(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
+
+func request(service string, spans ...*tracepb.Span) *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", service), stringAttr("host.name", "web-1")}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: "scope", Version: "v1"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func shopRequest() *coltracepb.ExportTraceServiceRequest {
+	return request("shop",
+		&tracepb.Span{
+			TraceId: []byte{1}, SpanId: []byte{1}, Name: "POST /checkout", Kind: tracepb.Span_SPAN_KIND_SERVER, StartTimeUnixNano: 100, EndTimeUnixNano: 400,
+			Attributes: []*commonpb.KeyValue{stringAttr("http.method", "POST"), intAttr("http.status_code", 502)},
+			Events:     []*tracepb.Span_Event{{Name: "retry", TimeUnixNano: 300}, {Name: "accepted", TimeUnixNano: 150}},
+			Links:      []*tracepb.Span_Link{{TraceId: []byte{9}, SpanId: []byte{9}, Attributes: []*commonpb.KeyValue{stringAttr("link.kind", "follows")}}},
+		},
+		&tracepb.Span{
+			TraceId: []byte{1}, SpanId: []byte{2}, ParentSpanId: []byte{1}, Name: "charge card", StartTimeUnixNano: 120, EndTimeUnixNano: 380,
+			Status:     &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "payment declined"},
+			Attributes: []*commonpb.KeyValue{intAttr("http.status_code", 402)},
+		},
+		&tracepb.Span{
+			TraceId: []byte{2}, SpanId: []byte{3}, Name: "GET /cart", StartTimeUnixNano: 500, EndTimeUnixNano: 520,
+			Attributes: []*commonpb.KeyValue{stringAttr("http.method", "GET"), intAttr("http.status_code", 200)},
+		},
+	)
+}
+
+func TestMemorySinkQueriesSpans(t *testing.T) {
+	sink := New()
+	ctx := context.Background()
+	if err := sink.Consume(ctx, shopRequest()); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	// Duplicates are skipped as in the SQL stores.
+	if err := sink.Consume(ctx, shopRequest()); err != nil {
+		t.Fatalf("consume duplicate: %v", err)
+	}
+
+	spans, err := sink.QuerySpans(ctx, spanstore.QueryParams{Service: "shop", Start: 0, End: 1000})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if len(spans) != 3 || spans[0].Name != "GET /cart" || spans[2].Name != "POST /checkout" {
+		t.Fatalf("expected 3 spans newest first, got %+v", spans)
+	}
+	checkout := spans[2]
+	if checkout.TraceID != "01" || checkout.ParentSpanID != rootSpanParentID || checkout.Kind != "SPAN_KIND_SERVER" || checkout.Attributes["http.status_code"] != int64(502) {
+		t.Fatalf("unexpected span: %+v", checkout)
+	}
+	if checkout.Resource.Attributes["host.name"] != "web-1" || checkout.Scope.Name != "scope" {
+		t.Fatalf("unexpected resource or scope: %+v %+v", checkout.Resource, checkout.Scope)
+	}
+	if len(checkout.Events) != 2 || checkout.Events[0].Name != "accepted" || len(checkout.Links) != 1 || checkout.Links[0].Attributes["link.kind"] != "follows" {
+		t.Fatalf("unexpected events or links: %+v %+v", checkout.Events, checkout.Links)
+	}
+
+	cases := []struct {
+		name   string
+		params spanstore.QueryParams
+		want   []string
+	}{
+		{"equal", spanstore.QueryParams{AttrFilters: []spanstore.AttrFilter{{Key: "http.method", Value: "GET"}}}, []string{"GET /cart"}},
+		{"not equal", spanstore.QueryParams{AttrFilters: []spanstore.AttrFilter{{Key: "http.method", Op: spanstore.AttrOpNotEqual, Value: "GET"}}}, []string{"POST /checkout"}},
+		{"numeric", spanstore.QueryParams{AttrFilters: []spanstore.AttrFilter{{Key: "http.status_code", Op: spanstore.AttrOpGreaterEqual, Value: "400"}}}, []string{"charge card", "POST /checkout"}},
+		{"numeric on string", spanstore.QueryParams{AttrFilters: []spanstore.AttrFilter{{Key: "http.method", Op: spanstore.AttrOpGreater, Value: "0"}}}, nil},
+		{"status", spanstore.QueryParams{StatusCode: statusPtr(spanstore.StatusError)}, []string{"charge card"}},
+		{"time range", spanstore.QueryParams{Start: 110, End: 500}, []string{"GET /cart", "charge card"}},
+		{"text", spanstore.QueryParams{Text: "DECLINED"}, []string{"charge card"}},
+		{"limit", spanstore.QueryParams{Limit: 1}, []string{"GET /cart"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := tc.params
+			params.Service = "shop"
+			if params.End == 0 {
+				params.End = 1000
+			}
+			spans, err := sink.QuerySpans(ctx, params)
+			if err != nil {
+				t.Fatalf("query spans: %v", err)
+			}
+			if len(spans) != len(tc.want) {
+				t.Fatalf("expected %v, got %+v", tc.want, spans)
+			}
+			for i, name := range tc.want {
+				if spans[i].Name != name {
+					t.Fatalf("expected %v, got %+v", tc.want, spans)
+				}
+			}
+		})
+	}
+}
+
+func statusPtr(code spanstore.StatusCode) *spanstore.StatusCode {
+	return &code
+}
+
+func TestMemorySinkQueriesTraces(t *testing.T) {
+	sink := New()
+	ctx := context.Background()
+	if err := sink.Consume(ctx, shopRequest()); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	traces, err := sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: 0, End: 1000})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(traces) != 2 || traces[0].TraceID != "02" || traces[1].TraceID != "01" {
+		t.Fatalf("expected traces newest first, got %+v", traces)
+	}
+	checkout := traces[1]
+	if checkout.RootName != "POST /checkout" || checkout.SpanCount != 2 || checkout.ErrorCount != 1 || checkout.DurationUnixNano != 300 || checkout.ServiceName != "shop" {
+		t.Fatalf("unexpected summary: %+v", checkout)
+	}
+
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: 0, End: 1000, Order: spanstore.TraceOrderDurationAsc})
+	if err != nil {
+		t.Fatalf("query traces by duration: %v", err)
+	}
+	if len(traces) != 2 || traces[0].TraceID != "02" {
+		t.Fatalf("expected shortest trace first, got %+v", traces)
+	}
+
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: 0, End: 1000, HasError: true})
+	if err != nil {
+		t.Fatalf("query error traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].TraceID != "01" || traces[0].SpanCount != 2 {
+		t.Fatalf("expected whole error trace, got %+v", traces)
+	}
+
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: 0, End: 1000, MinDuration: 100})
+	if err != nil {
+		t.Fatalf("query long traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].TraceID != "01" {
+		t.Fatalf("expected only the long trace, got %+v", traces)
+	}
+
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: 0, End: 1000, Text: "card"})
+	if err != nil {
+		t.Fatalf("search traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].Match == nil || traces[0].Match.SpanID != "02" || traces[0].Match.Highlights["name"] != "charge <mark>card</mark>" {
+		t.Fatalf("expected text match on the charge span, got %+v", traces)
+	}
+
+	spans, err := sink.QueryTraceSpans(ctx, spanstore.TraceSpansQueryParams{TraceID: "01"})
+	if err != nil {
+		t.Fatalf("query trace spans: %v", err)
+	}
+	if len(spans) != 2 || spans[0].Name != "POST /checkout" || spans[1].Name != "charge card" {
+		t.Fatalf("expected trace spans in start order, got %+v", spans)
+	}
+
+	req, err := sink.QueryTraceOTLP(ctx, spanstore.TraceSpansQueryParams{TraceID: "01"})
+	if err != nil {
+		t.Fatalf("query trace otlp: %v", err)
+	}
+	if len(req.GetResourceSpans()) != 1 || len(req.GetResourceSpans()[0].GetScopeSpans()) != 1 || len(req.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()) != 2 {
+		t.Fatalf("expected spans grouped under one resource and scope, got %v", req)
+	}
+
+	values, err := sink.QueryTagValues(ctx, "http.method", spanstore.TagQueryParams{})
+	if err != nil {
+		t.Fatalf("query tag values: %v", err)
+	}
+	if len(values) != 2 || values[0] != "GET" || values[1] != "POST" {
+		t.Fatalf("unexpected tag values: %v", values)
+	}
+	names, err := sink.QueryTagNames(ctx, spanstore.TagQueryParams{Start: 500, End: 600})
+	if err != nil {
+		t.Fatalf("query tag names: %v", err)
+	}
+	if len(names) != 4 || names[0] != "host.name" || names[3] != "service.name" {
+		t.Fatalf("unexpected tag names: %v", names)
+	}
+}
+
+func TestMemorySinkEvictsOldestTraces(t *testing.T) {
+	sink := NewWithOptions(Options{MaxSpans: 3})
+	ctx := context.Background()
+	span := func(trace, id byte) *tracepb.Span {
+		return &tracepb.Span{TraceId: []byte{trace}, SpanId: []byte{id}, Name: "op", StartTimeUnixNano: uint64(id), EndTimeUnixNano: uint64(id) + 1}
+	}
+	if err := sink.Consume(ctx, request("svc", span(1, 1), span(1, 2))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := sink.Consume(ctx, request("svc", span(2, 3))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	// A late span for trace 1 does not keep it: traces leave in the order
+	// they arrived.
+	if err := sink.Consume(ctx, request("svc", span(1, 4))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	traces, err := sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: 0, End: 100})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].TraceID != "02" || traces[0].SpanCount != 1 {
+		t.Fatalf("expected trace 1 evicted whole, got %+v", traces)
+	}
+
+	sink = NewWithOptions(Options{MaxBytes: 1})
+	if err := sink.Consume(ctx, request("svc", span(1, 1))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if spans, _ := sink.QueryTraceSpans(ctx, spanstore.TraceSpansQueryParams{TraceID: "01"}); len(spans) != 0 {
+		t.Fatalf("expected a trace larger than the byte bound to be evicted, got %+v", spans)
+	}
+}
+
+func TestMemorySinkCopiesSpans(t *testing.T) {
+	sink := New()
+	ctx := context.Background()
+	req := shopRequest()
+	if err := sink.Consume(ctx, req); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	// Changes the caller makes to the request after Consume, or to a query
+	// result, must not reach the store.
+	req.ResourceSpans[0].Resource.Attributes[0].Value = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "changed"}}
+	req.ResourceSpans[0].ScopeSpans[0].Spans[0].Name = "changed"
+	first, err := sink.QueryTraceOTLP(ctx, spanstore.TraceSpansQueryParams{TraceID: "01"})
+	if err != nil {
+		t.Fatalf("query trace otlp: %v", err)
+	}
+	first.ResourceSpans[0].ScopeSpans[0].Spans[0].Attributes = nil
+	page, err := sink.ExportSpans(ctx, spanstore.ExportParams{Limit: 10})
+	if err != nil {
+		t.Fatalf("export spans: %v", err)
+	}
+	page.Request.ResourceSpans[0].Resource.Attributes = nil
+
+	got, err := sink.QueryTraceOTLP(ctx, spanstore.TraceSpansQueryParams{TraceID: "01"})
+	if err != nil {
+		t.Fatalf("query trace otlp: %v", err)
+	}
+	resourceSpans := got.GetResourceSpans()[0]
+	if service := resourceSpans.GetResource().GetAttributes()[0].GetValue().GetStringValue(); service != "shop" {
+		t.Fatalf("expected the stored resource to be unchanged, got service %q", service)
+	}
+	span := resourceSpans.GetScopeSpans()[0].GetSpans()[0]
+	if span.GetName() != "POST /checkout" || len(span.GetAttributes()) != 2 {
+		t.Fatalf("expected the stored span to be unchanged, got %v", span)
+	}
+}
+
+func TestMemorySinkConformance(t *testing.T) {
+	spanstoretest.Run(t, func(t *testing.T) spanstoretest.Store {
+		return New()
+	})
+}
@@ -0,0 +1,43 @@
+package ingest
+
+import (
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/metrics"
+)
+
+// WriteMetrics records how a persistent store handles each request. A zero
+// value or one built from a nil registry records nothing.
+type WriteMetrics struct {
+	store    string
+	duration *metrics.Histogram
+	errors   *metrics.Counter
+	spans    *metrics.Counter
+}
+
+func NewWriteMetrics(registry *metrics.Registry, store string) WriteMetrics {
+	return WriteMetrics{
+		store:    store,
+		duration: registry.Histogram("smelldeadfish_store_write_duration_seconds", "Time to write one trace request to the store.", nil, "store"),
+		errors:   registry.Counter("smelldeadfish_store_write_errors_total", "Trace requests the store failed to write.", "store"),
+		spans:    registry.Counter("smelldeadfish_store_spans_written_total", "Spans written to the store, by service.", "store", "service"),
+	}
+}
+
+func (m WriteMetrics) Observe(req *coltracepb.ExportTraceServiceRequest, start time.Time, err error) {
+	if m.duration == nil {
+		return
+	}
+	m.duration.Observe(time.Since(start).Seconds(), m.store)
+	if err != nil {
+		m.errors.Inc(m.store)
+		return
+	}
+	for _, resourceSpans := range req.GetResourceSpans() {
+		if count := CountSpans(resourceSpans); count > 0 {
+			m.spans.Add(float64(count), m.store, ResourceServiceName(resourceSpans.GetResource()))
+		}
+	}
+}
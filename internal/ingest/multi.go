@@ -2,6 +2,7 @@ package ingest
 
 import (
 	"context"
+	"errors"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 )
@@ -28,3 +29,14 @@ func (m *MultiSink) Consume(ctx context.Context, req *coltracepb.ExportTraceServ
 	}
 	return nil
 }
+
+// Close closes every sink that has a Close method, in order.
+func (m *MultiSink) Close() error {
+	var errs []error
+	for _, sink := range m.sinks {
+		if closer, ok := sink.(interface{ Close() error }); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
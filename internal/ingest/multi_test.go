@@ -46,3 +46,16 @@ func TestMultiSinkReturnsError(t *testing.T) {
 		t.Fatalf("expected to stop on first error")
 	}
 }
+
+func TestMultiSinkClosesSinks(t *testing.T) {
+	first := &countingSink{}
+	second := &recordSink{}
+
+	sink := NewMultiSink(first, second)
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if !first.Closed() {
+		t.Fatalf("expected closable sink to be closed")
+	}
+}
@@ -5,24 +5,48 @@ import (
 	"errors"
 	"log"
 	"sync"
+	"time"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/metrics"
 )
 
 var ErrQueueClosed = errors.New("trace queue closed")
 
 type QueueOptions struct {
-	Size   int
-	Logger *log.Logger
+	Size int
+	// BatchSize merges up to this many already-queued requests into a single
+	// Consume call on the downstream sink, so stores can write them in one
+	// transaction. It never waits for more requests to arrive. Values below 2
+	// disable batching.
+	BatchSize int
+	Logger    *log.Logger
+	Metrics   *metrics.Registry
 }
 
 type QueueSink struct {
 	sink      TraceSink
-	queue     chan *coltracepb.ExportTraceServiceRequest
+	queue     chan queuedRequest
 	closed    chan struct{}
 	closeOnce sync.Once
 	wg        sync.WaitGroup
 	logger    *log.Logger
+	batchSize int
+
+	enqueued      *metrics.Counter
+	rejected      *metrics.Counter
+	consumeErrors *metrics.Counter
+	latency       *metrics.Histogram
+
+	statsMu             sync.Mutex
+	consecutiveFailures int
+	lastError           string
+}
+
+type queuedRequest struct {
+	req      *coltracepb.ExportTraceServiceRequest
+	enqueued time.Time
 }
 
 func NewQueueSink(sink TraceSink, opts QueueOptions) *QueueSink {
@@ -35,10 +59,18 @@ func NewQueueSink(sink TraceSink, opts QueueOptions) *QueueSink {
 	}
 	queue := &QueueSink{
 		sink:   sink,
-		queue:  make(chan *coltracepb.ExportTraceServiceRequest, size),
+		queue:  make(chan queuedRequest, size),
 		closed: make(chan struct{}),
 		logger: opts.Logger,
+
+		batchSize:     max(opts.BatchSize, 1),
+		enqueued:      opts.Metrics.Counter("smelldeadfish_queue_enqueued_total", "Trace requests accepted into the ingest queue."),
+		rejected:      opts.Metrics.Counter("smelldeadfish_queue_rejected_total", "Trace requests dropped before reaching the queue, by reason.", "reason"),
+		consumeErrors: opts.Metrics.Counter("smelldeadfish_queue_consume_errors_total", "Queued trace requests the downstream sink failed to store."),
+		latency:       opts.Metrics.Histogram("smelldeadfish_ingest_latency_seconds", "Time from enqueue until the downstream sink finished storing a request.", nil),
 	}
+	opts.Metrics.GaugeFunc("smelldeadfish_queue_depth", "Trace requests waiting in the ingest queue.", func() float64 { return float64(len(queue.queue)) })
+	opts.Metrics.GaugeFunc("smelldeadfish_queue_capacity", "Maximum trace requests the ingest queue holds before applying backpressure.", func() float64 { return float64(cap(queue.queue)) })
 	queue.wg.Add(1)
 	go queue.run()
 	return queue
@@ -50,15 +82,19 @@ func (q *QueueSink) Consume(ctx context.Context, req *coltracepb.ExportTraceServ
 	}
 	select {
 	case <-q.closed:
+		q.rejected.Inc("closed")
 		return ErrQueueClosed
 	default:
 	}
 	select {
-	case q.queue <- req:
+	case q.queue <- queuedRequest{req: req, enqueued: time.Now()}:
+		q.enqueued.Inc()
 		return nil
 	case <-q.closed:
+		q.rejected.Inc("closed")
 		return ErrQueueClosed
 	case <-ctx.Done():
+		q.rejected.Inc("canceled")
 		return ctx.Err()
 	}
 }
@@ -85,13 +121,13 @@ func (q *QueueSink) run() {
 	defer q.wg.Done()
 	for {
 		select {
-		case req := <-q.queue:
-			q.consume(req)
+		case item := <-q.queue:
+			q.consume(q.fillBatch(item))
 		case <-q.closed:
 			for {
 				select {
-				case req := <-q.queue:
-					q.consume(req)
+				case item := <-q.queue:
+					q.consume(q.fillBatch(item))
 				default:
 					return
 				}
@@ -100,11 +136,91 @@ func (q *QueueSink) run() {
 	}
 }
 
-func (q *QueueSink) consume(req *coltracepb.ExportTraceServiceRequest) {
-	if req == nil || q.sink == nil {
+func (q *QueueSink) fillBatch(first queuedRequest) []queuedRequest {
+	batch := []queuedRequest{first}
+	for len(batch) < q.batchSize {
+		select {
+		case item := <-q.queue:
+			batch = append(batch, item)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (q *QueueSink) consume(batch []queuedRequest) {
+	if q.sink == nil {
+		return
+	}
+	reqs := make([]*coltracepb.ExportTraceServiceRequest, 0, len(batch))
+	for _, item := range batch {
+		if item.req != nil {
+			reqs = append(reqs, item.req)
+		}
+	}
+	if len(reqs) == 0 {
 		return
 	}
-	if err := q.sink.Consume(context.Background(), req); err != nil && q.logger != nil {
-		q.logger.Printf("msg=queue_sink_consume_error error=%q", err.Error())
+	err := q.sink.Consume(context.Background(), MergeRequests(reqs...))
+	for _, item := range batch {
+		q.latency.Observe(time.Since(item.enqueued).Seconds())
+	}
+	q.recordResult(err)
+	if err != nil {
+		q.consumeErrors.Add(float64(len(reqs)))
+		if q.logger != nil {
+			q.logger.Printf("msg=queue_sink_consume_error error=%q", err.Error())
+		}
+	}
+}
+
+func (q *QueueSink) recordResult(err error) {
+	q.statsMu.Lock()
+	defer q.statsMu.Unlock()
+	if err == nil {
+		q.consecutiveFailures = 0
+		return
+	}
+	q.consecutiveFailures++
+	q.lastError = err.Error()
+}
+
+// Depth is the number of requests waiting to be written.
+func (q *QueueSink) Depth() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.queue)
+}
+
+func (q *QueueSink) Capacity() int {
+	if q == nil {
+		return 0
+	}
+	return cap(q.queue)
+}
+
+// WriteFailures reports how many writes in a row the downstream sink has
+// rejected, along with the most recent error.
+func (q *QueueSink) WriteFailures() (int, string) {
+	if q == nil {
+		return 0, ""
+	}
+	q.statsMu.Lock()
+	defer q.statsMu.Unlock()
+	return q.consecutiveFailures, q.lastError
+}
+
+// MergeRequests combines requests into one by concatenating their resource
+// spans. A single request is returned as is.
+func MergeRequests(reqs ...*coltracepb.ExportTraceServiceRequest) *coltracepb.ExportTraceServiceRequest {
+	if len(reqs) == 1 {
+		return reqs[0]
+	}
+	merged := &coltracepb.ExportTraceServiceRequest{}
+	for _, req := range reqs {
+		merged.ResourceSpans = append(merged.ResourceSpans, req.GetResourceSpans()...)
 	}
+	return merged
 }
@@ -1,13 +1,18 @@
 package ingest
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/metrics"
 )
 
 type countingSink struct {
@@ -100,3 +105,159 @@ func TestQueueSinkBackpressure(t *testing.T) {
 		t.Fatalf("close: %v", err)
 	}
 }
+
+func TestQueueSinkRecordsMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	sink := &countingSink{}
+	queue := NewQueueSink(sink, QueueOptions{Size: 4, Metrics: registry})
+	req := &coltracepb.ExportTraceServiceRequest{}
+	for i := 0; i < 2; i++ {
+		if err := queue.Consume(context.Background(), req); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if err := queue.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := queue.Consume(context.Background(), req); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+
+	var buffer bytes.Buffer
+	if err := registry.WriteText(&buffer); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	body := buffer.String()
+	for _, want := range []string{
+		"smelldeadfish_queue_enqueued_total 2\n",
+		`smelldeadfish_queue_rejected_total{reason="closed"} 1` + "\n",
+		"smelldeadfish_queue_capacity 4\n",
+		"smelldeadfish_ingest_latency_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in\n%s", want, body)
+		}
+	}
+}
+
+type failingSink struct {
+	mu   sync.Mutex
+	fail bool
+}
+
+func (f *failingSink) Consume(_ context.Context, _ *coltracepb.ExportTraceServiceRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return errors.New("database is locked")
+	}
+	return nil
+}
+
+func (f *failingSink) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func TestQueueSinkTracksConsecutiveWriteFailures(t *testing.T) {
+	sink := &failingSink{fail: true}
+	queue := NewQueueSink(sink, QueueOptions{Size: 4})
+	req := &coltracepb.ExportTraceServiceRequest{}
+	waitFailures := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			got, _ := queue.WriteFailures()
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d failures, got %d", want, got)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := queue.Consume(context.Background(), req); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	waitFailures(2)
+	if _, lastError := queue.WriteFailures(); lastError != "database is locked" {
+		t.Fatalf("unexpected last error %q", lastError)
+	}
+
+	sink.setFail(false)
+	if err := queue.Consume(context.Background(), req); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	waitFailures(0)
+	if queue.Capacity() != 4 {
+		t.Fatalf("expected capacity 4, got %d", queue.Capacity())
+	}
+	if err := queue.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+type mergeSink struct {
+	mu      sync.Mutex
+	calls   int
+	batches []int
+	release chan struct{}
+}
+
+func (m *mergeSink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	<-m.release
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	m.batches = append(m.batches, len(req.GetResourceSpans()))
+	return nil
+}
+
+func TestQueueSinkBatchesQueuedRequests(t *testing.T) {
+	sink := &mergeSink{release: make(chan struct{})}
+	queue := NewQueueSink(sink, QueueOptions{Size: 8, BatchSize: 3})
+	for i := 0; i < 5; i++ {
+		req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{}}}
+		if err := queue.Consume(context.Background(), req); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	close(sink.release)
+	if err := queue.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	total := 0
+	for _, size := range sink.batches {
+		if size > 3 {
+			t.Fatalf("batch exceeded limit: %v", sink.batches)
+		}
+		total += size
+	}
+	if total != 5 {
+		t.Fatalf("expected 5 resource spans consumed, got %d (%v)", total, sink.batches)
+	}
+	if sink.calls >= 5 {
+		t.Fatalf("expected requests to be merged, got %d calls", sink.calls)
+	}
+}
+
+func TestMergeRequests(t *testing.T) {
+	first := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{SchemaUrl: "a"}}}
+	second := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{SchemaUrl: "b"}, {SchemaUrl: "c"}}}
+	if MergeRequests(first) != first {
+		t.Fatalf("expected single request returned unchanged")
+	}
+	merged := MergeRequests(first, second)
+	if len(merged.GetResourceSpans()) != 3 || merged.GetResourceSpans()[2].GetSchemaUrl() != "c" {
+		t.Fatalf("unexpected merge: %v", merged)
+	}
+	if len(first.GetResourceSpans()) != 1 {
+		t.Fatalf("expected inputs untouched")
+	}
+}
@@ -0,0 +1,242 @@
+// Package redact rewrites sensitive attributes before requests reach a sink.
+package redact
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+)
+
+const (
+	ActionDrop = "drop"
+	ActionHash = "hash"
+	ActionMask = "mask"
+
+	DefaultReplacement = "[REDACTED]"
+)
+
+// Rule changes the attributes whose key matches one of Keys, which may use *
+// as a wildcard. drop removes them and hash replaces their value with a hex
+// digest. mask replaces every match of Pattern in their string values, and
+// nested ones, with Replacement; a mask rule without Keys applies to every
+// attribute.
+type Rule struct {
+	Action      string
+	Keys        []string
+	Pattern     string
+	Replacement string
+}
+
+type Options struct {
+	Rules []Rule
+	// HashKey makes hashed values an HMAC, so short values such as emails
+	// cannot be recovered by hashing guesses. Without it they are SHA-256.
+	HashKey string
+	Metrics *metrics.Registry
+}
+
+// Sink applies the rules, in order, to the resource, span, event, and link
+// attributes of every request, then passes it on. Requests are rewritten in
+// place.
+type Sink struct {
+	next     ingest.TraceSink
+	rules    []rule
+	hashKey  []byte
+	redacted *metrics.Counter
+}
+
+type rule struct {
+	action      string
+	keys        []string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func New(next ingest.TraceSink, rules ...Rule) (*Sink, error) {
+	return NewWithOptions(next, Options{Rules: rules})
+}
+
+func NewWithOptions(next ingest.TraceSink, opts Options) (*Sink, error) {
+	if next == nil {
+		return nil, errors.New("redaction requires a sink")
+	}
+	s := &Sink{
+		next:     next,
+		redacted: opts.Metrics.Counter("smelldeadfish_redacted_attributes_total", "Attributes changed by redaction rules, by action.", "action"),
+	}
+	if opts.HashKey != "" {
+		s.hashKey = []byte(opts.HashKey)
+	}
+	for i, raw := range opts.Rules {
+		compiled, err := compileRule(raw)
+		if err != nil {
+			return nil, fmt.Errorf("redaction rule %d: %w", i, err)
+		}
+		s.rules = append(s.rules, compiled)
+	}
+	return s, nil
+}
+
+func compileRule(raw Rule) (rule, error) {
+	compiled := rule{action: strings.ToLower(strings.TrimSpace(raw.Action)), keys: raw.Keys}
+	switch compiled.action {
+	case ActionDrop, ActionHash:
+		if len(raw.Keys) == 0 {
+			return rule{}, fmt.Errorf("%s needs keys", compiled.action)
+		}
+	case ActionMask:
+		if raw.Pattern == "" {
+			return rule{}, errors.New("mask needs a pattern")
+		}
+		pattern, err := regexp.Compile(raw.Pattern)
+		if err != nil {
+			return rule{}, fmt.Errorf("compile pattern: %w", err)
+		}
+		compiled.pattern = pattern
+		compiled.replacement = raw.Replacement
+		if compiled.replacement == "" {
+			compiled.replacement = DefaultReplacement
+		}
+	default:
+		return rule{}, fmt.Errorf("unknown action %q (want drop, hash, or mask)", raw.Action)
+	}
+	return compiled, nil
+}
+
+func (s *Sink) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if req == nil {
+		return nil
+	}
+	if len(s.rules) > 0 {
+		s.Apply(req)
+	}
+	return s.next.Consume(ctx, req)
+}
+
+// Close closes the wrapped sink.
+func (s *Sink) Close() error {
+	if closer, ok := s.next.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Apply redacts req in place.
+func (s *Sink) Apply(req *coltracepb.ExportTraceServiceRequest) {
+	for _, resourceSpans := range req.GetResourceSpans() {
+		if resource := resourceSpans.GetResource(); resource != nil {
+			resource.Attributes = s.redact(resource.Attributes)
+		}
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			for _, span := range scopeSpans.GetSpans() {
+				span.Attributes = s.redact(span.Attributes)
+				for _, event := range span.GetEvents() {
+					event.Attributes = s.redact(event.Attributes)
+				}
+				for _, link := range span.GetLinks() {
+					link.Attributes = s.redact(link.Attributes)
+				}
+			}
+		}
+	}
+}
+
+func (s *Sink) redact(attrs []*commonpb.KeyValue) []*commonpb.KeyValue {
+	return slices.DeleteFunc(attrs, func(attr *commonpb.KeyValue) bool {
+		for _, rule := range s.rules {
+			if len(rule.keys) > 0 && !matchKey(rule.keys, attr.GetKey()) {
+				continue
+			}
+			switch rule.action {
+			case ActionDrop:
+				s.redacted.Inc(ActionDrop)
+				return true
+			case ActionHash:
+				attr.Value = stringValue(s.hash(valueText(attr.GetValue())))
+				s.redacted.Inc(ActionHash)
+			case ActionMask:
+				if mask(attr.GetValue(), rule) {
+					s.redacted.Inc(ActionMask)
+				}
+			}
+		}
+		return false
+	})
+}
+
+func (s *Sink) hash(value string) string {
+	if s.hashKey == nil {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, s.hashKey)
+	_, _ = mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// valueText is the text hashed for value: the value itself for scalars, and
+// its deterministic protobuf encoding for arrays and key-value lists.
+func valueText(value *commonpb.AnyValue) string {
+	switch value.GetValue().(type) {
+	case *commonpb.AnyValue_ArrayValue, *commonpb.AnyValue_KvlistValue, *commonpb.AnyValue_BytesValue:
+		encoded, _ := proto.MarshalOptions{Deterministic: true}.Marshal(value)
+		return string(encoded)
+	default:
+		return ingest.ValueString(value)
+	}
+}
+
+// mask rewrites the string values in value, descending into arrays and
+// key-value lists, and reports whether anything changed.
+func mask(value *commonpb.AnyValue, rule rule) bool {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		masked := rule.pattern.ReplaceAllLiteralString(v.StringValue, rule.replacement)
+		if masked == v.StringValue {
+			return false
+		}
+		v.StringValue = masked
+		return true
+	case *commonpb.AnyValue_ArrayValue:
+		changed := false
+		for _, item := range v.ArrayValue.GetValues() {
+			changed = mask(item, rule) || changed
+		}
+		return changed
+	case *commonpb.AnyValue_KvlistValue:
+		changed := false
+		for _, item := range v.KvlistValue.GetValues() {
+			changed = mask(item.GetValue(), rule) || changed
+		}
+		return changed
+	default:
+		return false
+	}
+}
+
+func matchKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ingest.MatchWildcard(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringValue(value string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+}
@@ -0,0 +1,156 @@
+package redact
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/metrics"
+)
+
+type captureSink struct {
+	req *coltracepb.ExportTraceServiceRequest
+}
+
+func (c *captureSink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	c.req = req
+	return nil
+}
+
+func attr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: stringValue(value)}
+}
+
+func attrMap(attrs []*commonpb.KeyValue) map[string]string {
+	values := map[string]string{}
+	for _, kv := range attrs {
+		values[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	return values
+}
+
+func TestSinkRedactsEverywhere(t *testing.T) {
+	registry := metrics.NewRegistry()
+	sink := &captureSink{}
+	redactor, err := NewWithOptions(sink, Options{
+		Rules: []Rule{
+			{Action: ActionDrop, Keys: []string{"http.request.header.authorization", "*.password"}},
+			{Action: ActionHash, Keys: []string{"user.email"}},
+			{Action: ActionMask, Pattern: `[\w.+-]+@[\w-]+\.[\w.]+`, Replacement: "<email>"},
+			{Action: ActionMask, Keys: []string{"db.statement"}, Pattern: `\b\d{4}(?:[ -]?\d{4}){3}\b`},
+		},
+		Metrics: registry,
+	})
+	if err != nil {
+		t.Fatalf("new redactor: %v", err)
+	}
+	span := &tracepb.Span{
+		Name: "checkout",
+		Attributes: []*commonpb.KeyValue{
+			attr("http.request.header.authorization", "Bearer secret"),
+			attr("http.url", "https://shop.example.com/orders?email=jane@example.com"),
+			attr("db.statement", "UPDATE cards SET number = '4111 1111 1111 1111'"),
+			attr("user.email", "jane@example.com"),
+			attr("http.route", "/orders"),
+		},
+		Events: []*tracepb.Span_Event{{Name: "login", Attributes: []*commonpb.KeyValue{attr("db.password", "hunter2"), attr("message", "sent to jane@example.com")}}},
+		Links:  []*tracepb.Span_Link{{Attributes: []*commonpb.KeyValue{attr("user.email", "bob@example.com")}}},
+	}
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		Resource:   &resourcepb.Resource{Attributes: []*commonpb.KeyValue{attr("service.name", "shop"), attr("owner", "ops@example.com")}},
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{span}}},
+	}}}
+	if err := redactor.Consume(context.Background(), req); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	got := sink.req.GetResourceSpans()[0]
+	if resource := attrMap(got.GetResource().GetAttributes()); resource["owner"] != "<email>" || resource["service.name"] != "shop" {
+		t.Fatalf("unexpected resource attributes: %v", resource)
+	}
+	spanAttrs := attrMap(got.GetScopeSpans()[0].GetSpans()[0].GetAttributes())
+	sum := sha256.Sum256([]byte("jane@example.com"))
+	for key, want := range map[string]string{
+		"http.url":     "https://shop.example.com/orders?email=<email>",
+		"db.statement": "UPDATE cards SET number = '[REDACTED]'",
+		"user.email":   hex.EncodeToString(sum[:]),
+		"http.route":   "/orders",
+	} {
+		if spanAttrs[key] != want {
+			t.Fatalf("%s = %q, want %q", key, spanAttrs[key], want)
+		}
+	}
+	if _, ok := spanAttrs["http.request.header.authorization"]; ok {
+		t.Fatal("expected the authorization header to be dropped")
+	}
+	eventAttrs := attrMap(span.GetEvents()[0].GetAttributes())
+	if _, ok := eventAttrs["db.password"]; ok || eventAttrs["message"] != "sent to <email>" {
+		t.Fatalf("unexpected event attributes: %v", eventAttrs)
+	}
+	if linkAttrs := attrMap(span.GetLinks()[0].GetAttributes()); strings.Contains(linkAttrs["user.email"], "@") {
+		t.Fatalf("expected the link email to be hashed, got %v", linkAttrs)
+	}
+
+	var buffer bytes.Buffer
+	if err := registry.WriteText(&buffer); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	for _, want := range []string{
+		`smelldeadfish_redacted_attributes_total{action="drop"} 2` + "\n",
+		`smelldeadfish_redacted_attributes_total{action="hash"} 2` + "\n",
+		`smelldeadfish_redacted_attributes_total{action="mask"} 4` + "\n",
+	} {
+		if !strings.Contains(buffer.String(), want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, buffer.String())
+		}
+	}
+}
+
+func TestSinkHashKeyAndNestedValues(t *testing.T) {
+	sink := &captureSink{}
+	redactor, err := NewWithOptions(sink, Options{
+		Rules: []Rule{
+			{Action: ActionHash, Keys: []string{"user.id"}},
+			{Action: ActionMask, Keys: []string{"tags"}, Pattern: `secret`},
+		},
+		HashKey: "pepper",
+	})
+	if err != nil {
+		t.Fatalf("new redactor: %v", err)
+	}
+	tags := &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{stringValue("ok"), stringValue("top secret")}}}}
+	span := &tracepb.Span{Attributes: []*commonpb.KeyValue{attr("user.id", "42"), {Key: "tags", Value: tags}}}
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{span}}}}}}
+	if err := redactor.Consume(context.Background(), req); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("42"))
+	if hashed := span.GetAttributes()[0].GetValue().GetStringValue(); hashed == hex.EncodeToString(sum[:]) || len(hashed) != 64 {
+		t.Fatalf("expected a keyed 64-character digest, got %q", hashed)
+	}
+	if masked := tags.GetArrayValue().GetValues()[1].GetStringValue(); masked != "top [REDACTED]" {
+		t.Fatalf("expected the nested value to be masked, got %q", masked)
+	}
+}
+
+func TestNewRejectsBadRules(t *testing.T) {
+	for _, rule := range []Rule{
+		{Action: "encrypt", Keys: []string{"a"}},
+		{Action: ActionDrop},
+		{Action: ActionMask},
+		{Action: ActionMask, Pattern: "("},
+	} {
+		if _, err := New(&captureSink{}, rule); err == nil {
+			t.Fatalf("expected error for %+v", rule)
+		}
+	}
+}
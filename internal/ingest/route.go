@@ -0,0 +1,228 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/metrics"
+)
+
+// DropRoute is the route target that discards spans.
+const DropRoute = "drop"
+
+// Route sends the spans it matches to the sink named Sink, or discards them
+// when Sink is DropRoute. Every condition that is set must hold: Service is
+// compared with service.name, and Resource and Span map attribute keys to
+// values. Values may use * as a wildcard.
+type Route struct {
+	Sink     string
+	Service  string
+	Resource map[string]string
+	Span     map[string]string
+}
+
+type RouterOptions struct {
+	// Default receives spans no route matches: a sink name or DropRoute.
+	Default string
+	Metrics *metrics.Registry
+}
+
+// Router splits each request between named sinks. Routes are tried in order
+// and the first match wins. Each sink receives one request holding only its
+// spans, with their resource and scope.
+type Router struct {
+	sinks  map[string]TraceSink
+	names  []string
+	routes []Route
+	def    string
+	spans  *metrics.Counter
+}
+
+func NewRouter(sinks map[string]TraceSink, routes []Route, opts RouterOptions) (*Router, error) {
+	known := func(name string) bool {
+		_, ok := sinks[name]
+		return ok || name == DropRoute
+	}
+	if _, ok := sinks[DropRoute]; ok {
+		return nil, fmt.Errorf("sink name %q is reserved", DropRoute)
+	}
+	if opts.Default == "" {
+		return nil, errors.New("default route is required")
+	}
+	if !known(opts.Default) {
+		return nil, fmt.Errorf("default route: unknown sink %q", opts.Default)
+	}
+	for i, route := range routes {
+		if !known(route.Sink) {
+			return nil, fmt.Errorf("route %d: unknown sink %q", i, route.Sink)
+		}
+	}
+	router := &Router{
+		sinks:  sinks,
+		routes: routes,
+		def:    opts.Default,
+		spans:  opts.Metrics.Counter("smelldeadfish_routed_spans_total", "Spans split off by the router, by target sink.", "sink"),
+	}
+	for name := range sinks {
+		router.names = append(router.names, name)
+	}
+	sort.Strings(router.names)
+	return router, nil
+}
+
+// Consume hands every sink its share of req. A failing sink does not stop
+// the others; their errors are joined.
+func (r *Router) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if req == nil {
+		return nil
+	}
+	split := map[string]*coltracepb.ExportTraceServiceRequest{}
+	counts := map[string]int{}
+	add := func(target string, resourceSpans *tracepb.ResourceSpans) {
+		part := split[target]
+		if part == nil {
+			part = &coltracepb.ExportTraceServiceRequest{}
+			split[target] = part
+		}
+		part.ResourceSpans = append(part.ResourceSpans, resourceSpans)
+	}
+
+	for _, resourceSpans := range req.GetResourceSpans() {
+		candidates := r.resourceRoutes(resourceSpans.GetResource())
+		if target, ok := r.wholeResource(candidates); ok {
+			add(target, resourceSpans)
+			counts[target] += CountSpans(resourceSpans)
+			continue
+		}
+		resources := map[string]*tracepb.ResourceSpans{}
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			scopes := map[string]*tracepb.ScopeSpans{}
+			for _, span := range scopeSpans.GetSpans() {
+				target := r.def
+				for _, route := range candidates {
+					if matchAttributes(route.Span, span.GetAttributes()) {
+						target = route.Sink
+						break
+					}
+				}
+				counts[target]++
+				scope := scopes[target]
+				if scope == nil {
+					scope = &tracepb.ScopeSpans{Scope: scopeSpans.GetScope(), SchemaUrl: scopeSpans.GetSchemaUrl()}
+					scopes[target] = scope
+					resource := resources[target]
+					if resource == nil {
+						resource = &tracepb.ResourceSpans{Resource: resourceSpans.GetResource(), SchemaUrl: resourceSpans.GetSchemaUrl()}
+						resources[target] = resource
+						add(target, resource)
+					}
+					resource.ScopeSpans = append(resource.ScopeSpans, scope)
+				}
+				scope.Spans = append(scope.Spans, span)
+			}
+		}
+	}
+
+	if count := counts[DropRoute]; count > 0 {
+		r.spans.Add(float64(count), DropRoute)
+	}
+	var errs []error
+	for _, name := range r.names {
+		part := split[name]
+		if part == nil {
+			continue
+		}
+		if err := r.sinks[name].Consume(ctx, part); err != nil {
+			errs = append(errs, fmt.Errorf("route to %s: %w", name, err))
+			continue
+		}
+		r.spans.Add(float64(counts[name]), name)
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink that has a Close method.
+func (r *Router) Close() error {
+	var errs []error
+	for _, name := range r.names {
+		if closer, ok := r.sinks[name].(interface{ Close() error }); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resourceRoutes returns the routes whose service and resource conditions
+// hold for resource, in order.
+func (r *Router) resourceRoutes(resource *resourcepb.Resource) []Route {
+	var candidates []Route
+	service := ResourceServiceName(resource)
+	for _, route := range r.routes {
+		if route.Service != "" && !MatchWildcard(route.Service, service) {
+			continue
+		}
+		if !matchAttributes(route.Resource, resource.GetAttributes()) {
+			continue
+		}
+		candidates = append(candidates, route)
+	}
+	return candidates
+}
+
+// wholeResource reports the target of every span of a resource when no span
+// conditions are left to check, so the resource is passed on as is.
+func (r *Router) wholeResource(candidates []Route) (string, bool) {
+	if len(candidates) == 0 {
+		return r.def, true
+	}
+	if len(candidates[0].Span) == 0 {
+		return candidates[0].Sink, true
+	}
+	return "", false
+}
+
+func matchAttributes(want map[string]string, attrs []*commonpb.KeyValue) bool {
+	for key, pattern := range want {
+		found := false
+		for _, attr := range attrs {
+			if attr.GetKey() == key {
+				found = MatchWildcard(pattern, ValueString(attr.GetValue()))
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchWildcard matches value against pattern, where * matches any run of
+// characters.
+func MatchWildcard(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
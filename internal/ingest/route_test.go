@@ -0,0 +1,186 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/metrics"
+)
+
+type captureSink struct {
+	reqs []*coltracepb.ExportTraceServiceRequest
+	err  error
+}
+
+func (c *captureSink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	c.reqs = append(c.reqs, req)
+	return c.err
+}
+
+func (c *captureSink) spanNames() []string {
+	var names []string
+	for _, req := range c.reqs {
+		for _, resourceSpans := range req.GetResourceSpans() {
+			for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+				for _, span := range scopeSpans.GetSpans() {
+					names = append(names, ResourceServiceName(resourceSpans.GetResource())+"/"+span.GetName())
+				}
+			}
+		}
+	}
+	return names
+}
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func routedResource(service string, attrs []*commonpb.KeyValue, spans ...*tracepb.Span) *tracepb.ResourceSpans {
+	return &tracepb.ResourceSpans{
+		Resource:   &resourcepb.Resource{Attributes: append([]*commonpb.KeyValue{stringAttr("service.name", service)}, attrs...)},
+		ScopeSpans: []*tracepb.ScopeSpans{{Scope: &commonpb.InstrumentationScope{Name: "lib"}, Spans: spans}},
+	}
+}
+
+func routedSpan(name string, attrs ...*commonpb.KeyValue) *tracepb.Span {
+	return &tracepb.Span{Name: name, Attributes: attrs}
+}
+
+func TestRouterSplitsRequest(t *testing.T) {
+	teamA := &captureSink{}
+	teamB := &captureSink{}
+	main := &captureSink{}
+	registry := metrics.NewRegistry()
+	router, err := NewRouter(map[string]TraceSink{"team-a": teamA, "team-b": teamB, "main": main}, []Route{
+		{Service: "healthcheck*", Sink: DropRoute},
+		{Span: map[string]string{"http.route": "/healthz"}, Sink: DropRoute},
+		{Resource: map[string]string{"team": "a"}, Sink: "team-a"},
+		{Service: "billing", Sink: "team-b"},
+	}, RouterOptions{Default: "main", Metrics: registry})
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{
+		routedResource("healthcheck-probe", nil, routedSpan("ping")),
+		routedResource("checkout", []*commonpb.KeyValue{stringAttr("team", "a")},
+			routedSpan("GET /healthz", stringAttr("http.route", "/healthz")),
+			routedSpan("POST /cart", stringAttr("http.route", "/cart")),
+		),
+		routedResource("billing", nil, routedSpan("charge")),
+		routedResource("search", nil, routedSpan("query")),
+	}}
+	if err := router.Consume(context.Background(), req); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		sink *captureSink
+		want []string
+	}{
+		{"team-a", teamA, []string{"checkout/POST /cart"}},
+		{"team-b", teamB, []string{"billing/charge"}},
+		{"main", main, []string{"search/query"}},
+	} {
+		if len(tc.sink.reqs) != 1 {
+			t.Fatalf("%s: expected one request, got %d", tc.name, len(tc.sink.reqs))
+		}
+		got := tc.sink.spanNames()
+		if len(got) != len(tc.want) || got[0] != tc.want[0] {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+	scope := teamA.reqs[0].GetResourceSpans()[0].GetScopeSpans()[0].GetScope()
+	if scope.GetName() != "lib" {
+		t.Fatalf("expected scope to be kept, got %v", scope)
+	}
+	var buffer bytes.Buffer
+	if err := registry.WriteText(&buffer); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	for _, want := range []string{
+		`smelldeadfish_routed_spans_total{sink="drop"} 2` + "\n",
+		`smelldeadfish_routed_spans_total{sink="team-a"} 1` + "\n",
+	} {
+		if !strings.Contains(buffer.String(), want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, buffer.String())
+		}
+	}
+}
+
+func TestRouterDefaultDrop(t *testing.T) {
+	kept := &captureSink{}
+	router, err := NewRouter(map[string]TraceSink{"kept": kept}, []Route{{Service: "api", Sink: "kept"}}, RouterOptions{Default: DropRoute})
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{routedResource("worker", nil, routedSpan("job"))}}
+	if err := router.Consume(context.Background(), req); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if len(kept.reqs) != 0 {
+		t.Fatalf("expected unmatched spans to be dropped, got %v", kept.spanNames())
+	}
+}
+
+func TestRouterJoinsSinkErrors(t *testing.T) {
+	failing := &captureSink{err: errors.New("disk full")}
+	healthy := &captureSink{}
+	router, err := NewRouter(map[string]TraceSink{"a": failing, "b": healthy}, []Route{{Service: "api", Sink: "a"}}, RouterOptions{Default: "b"})
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{
+		routedResource("api", nil, routedSpan("one")),
+		routedResource("web", nil, routedSpan("two")),
+	}}
+	if err := router.Consume(context.Background(), req); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(healthy.reqs) != 1 {
+		t.Fatal("expected the healthy sink to still receive its spans")
+	}
+}
+
+func TestNewRouterRejectsUnknownSinks(t *testing.T) {
+	sinks := map[string]TraceSink{"a": &captureSink{}}
+	if _, err := NewRouter(sinks, []Route{{Sink: "b"}}, RouterOptions{Default: "a"}); err == nil {
+		t.Fatal("expected unknown route sink error")
+	}
+	if _, err := NewRouter(sinks, nil, RouterOptions{Default: "c"}); err == nil {
+		t.Fatal("expected unknown default error")
+	}
+	if _, err := NewRouter(map[string]TraceSink{DropRoute: &captureSink{}}, nil, RouterOptions{Default: DropRoute}); err == nil {
+		t.Fatal("expected reserved name error")
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"api", "api", true},
+		{"api", "api-v2", false},
+		{"health*", "healthcheck", true},
+		{"*-canary", "checkout-canary", true},
+		{"*-canary", "canary", false},
+		{"a*b*c", "a-b-c", true},
+		{"a*b*c", "a-c-b", false},
+		{"ab*ba", "aba", false},
+		{"*", "", true},
+	} {
+		if got := MatchWildcard(tc.pattern, tc.value); got != tc.want {
+			t.Fatalf("MatchWildcard(%q, %q) = %v, want %v", tc.pattern, tc.value, got, tc.want)
+		}
+	}
+}
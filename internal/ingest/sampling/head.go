@@ -0,0 +1,237 @@
+// Package sampling keeps a subset of traces in front of a sink.
+package sampling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+)
+
+const (
+	// AnyService is the rate limit key for services without their own.
+	AnyService = "*"
+
+	ReasonProbability = "probability"
+	ReasonRateLimit   = "rate_limit"
+
+	defaultMaxDecisions = 100000
+)
+
+type HeadOptions struct {
+	// Percent of traces kept, chosen by a hash of the trace ID so every span
+	// of a trace gets the same decision in every request. Zero keeps none and
+	// 100 keeps every trace.
+	Percent float64
+	// RateLimits caps the traces kept per second for each service.name, with
+	// AnyService covering services not listed. A trace is limited by the
+	// service it is first seen from, and the decision is remembered for its
+	// later spans.
+	RateLimits map[string]float64
+	// MaxDecisions bounds the remembered rate limit decisions, default
+	// 100000. The oldest are forgotten first.
+	MaxDecisions int
+	Metrics      *metrics.Registry
+	// Now drives the rate limits; tests override it.
+	Now func() time.Time
+}
+
+// Head decides on each span as it arrives and passes the kept spans on.
+type Head struct {
+	next      ingest.TraceSink
+	keepAll   bool
+	threshold uint64
+	limits    map[string]float64
+	now       func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	decisions *decisions
+
+	kept    *metrics.Counter
+	dropped *metrics.Counter
+}
+
+func NewHead(next ingest.TraceSink, opts HeadOptions) (*Head, error) {
+	if next == nil {
+		return nil, errors.New("head sampling requires a sink")
+	}
+	if opts.Percent < 0 || opts.Percent > 100 {
+		return nil, fmt.Errorf("sampling percent must be between 0 and 100, got %g", opts.Percent)
+	}
+	for service, limit := range opts.RateLimits {
+		if limit <= 0 {
+			return nil, fmt.Errorf("rate limit for %q must be positive", service)
+		}
+	}
+	maxDecisions := opts.MaxDecisions
+	if maxDecisions <= 0 {
+		maxDecisions = defaultMaxDecisions
+	}
+	h := &Head{
+		next:      next,
+		keepAll:   opts.Percent == 100,
+		threshold: percentThreshold(opts.Percent),
+		limits:    opts.RateLimits,
+		now:       opts.Now,
+		buckets:   map[string]*bucket{},
+		decisions: newDecisions(maxDecisions),
+		kept:      opts.Metrics.Counter("smelldeadfish_head_sampling_kept_spans_total", "Spans kept by head sampling."),
+		dropped:   opts.Metrics.Counter("smelldeadfish_head_sampling_dropped_spans_total", "Spans dropped by head sampling, by service and reason.", "service", "reason"),
+	}
+	if h.now == nil {
+		h.now = time.Now
+	}
+	return h, nil
+}
+
+// Consume passes on the sampled spans of req, if any.
+func (h *Head) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if req == nil {
+		return nil
+	}
+	var (
+		lastResource *resourcepb.Resource
+		service      string
+		kept         int
+	)
+	h.mu.Lock()
+	now := h.now()
+	filtered, _ := ingest.FilterSpans(req, func(resource *resourcepb.Resource, span *tracepb.Span) bool {
+		if resource != lastResource || service == "" {
+			lastResource, service = resource, ingest.ResourceServiceName(resource)
+		}
+		if reason := h.decide(service, span.GetTraceId(), now); reason != "" {
+			h.dropped.Inc(service, reason)
+			return false
+		}
+		kept++
+		return true
+	})
+	h.mu.Unlock()
+	if kept == 0 {
+		return nil
+	}
+	h.kept.Add(float64(kept))
+	return h.next.Consume(ctx, filtered)
+}
+
+// Close closes the wrapped sink.
+func (h *Head) Close() error {
+	if closer, ok := h.next.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// decide returns why the span is dropped, or "" to keep it.
+func (h *Head) decide(service string, traceID []byte, now time.Time) string {
+	if !h.keepAll && traceHash(traceID) >= h.threshold {
+		return ReasonProbability
+	}
+	if len(h.limits) == 0 {
+		return ""
+	}
+	key := string(traceID)
+	kept, seen := h.decisions.get(key)
+	if !seen {
+		limit, limited := h.limits[service]
+		if !limited {
+			limit, limited = h.limits[AnyService]
+		}
+		kept = !limited || h.bucket(service, limit).take(now)
+		h.decisions.put(key, kept)
+	}
+	if !kept {
+		return ReasonRateLimit
+	}
+	return ""
+}
+
+func (h *Head) bucket(service string, limit float64) *bucket {
+	b := h.buckets[service]
+	if b == nil {
+		burst := max(limit, 1)
+		b = &bucket{rate: limit, burst: burst, tokens: burst, last: h.now()}
+		h.buckets[service] = b
+	}
+	return b
+}
+
+func traceHash(traceID []byte) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write(traceID)
+	return hash.Sum64()
+}
+
+// percentThreshold is the traceHash below which a trace falls within
+// percent.
+func percentThreshold(percent float64) uint64 {
+	if percent >= 100 {
+		return math.MaxUint64
+	}
+	return uint64(math.Ldexp(percent/100, 64))
+}
+
+// decisions remembers whether recent traces were kept, forgetting the
+// oldest past its capacity.
+type decisions struct {
+	kept   map[string]bool
+	order  []string
+	oldest int
+}
+
+func newDecisions(capacity int) *decisions {
+	return &decisions{kept: map[string]bool{}, order: make([]string, 0, capacity)}
+}
+
+func (d *decisions) get(traceID string) (kept, ok bool) {
+	kept, ok = d.kept[traceID]
+	return kept, ok
+}
+
+func (d *decisions) put(traceID string, kept bool) {
+	if _, ok := d.kept[traceID]; ok {
+		d.kept[traceID] = kept
+		return
+	}
+	if len(d.order) < cap(d.order) {
+		d.order = append(d.order, traceID)
+	} else {
+		delete(d.kept, d.order[d.oldest])
+		d.order[d.oldest] = traceID
+		d.oldest = (d.oldest + 1) % len(d.order)
+	}
+	d.kept[traceID] = kept
+}
+
+// bucket is a token bucket holding up to burst traces, refilled at rate per
+// second.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,194 @@
+package sampling
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/metrics"
+)
+
+type captureSink struct {
+	spans []*tracepb.Span
+}
+
+func (c *captureSink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			c.spans = append(c.spans, scopeSpans.GetSpans()...)
+		}
+	}
+	return nil
+}
+
+func (c *captureSink) has(traceID []byte) bool {
+	for _, span := range c.spans {
+		if bytes.Equal(span.GetTraceId(), traceID) {
+			return true
+		}
+	}
+	return false
+}
+
+func traceID(n uint64) []byte {
+	id := make([]byte, 16)
+	binary.BigEndian.PutUint64(id[8:], n)
+	return id
+}
+
+func serviceRequest(service string, spans ...*tracepb.Span) *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{{
+			Key:   "service.name",
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: service}},
+		}}},
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: spans}},
+	}}}
+}
+
+func TestHeadKeepsConsistentPercent(t *testing.T) {
+	sink := &captureSink{}
+	head, err := NewHead(sink, HeadOptions{Percent: 25})
+	if err != nil {
+		t.Fatalf("new head: %v", err)
+	}
+	ids := make([][]byte, 10000)
+	for i := range ids {
+		ids[i] = make([]byte, 16)
+		binary.BigEndian.PutUint64(ids[i], rand.Uint64())
+		binary.BigEndian.PutUint64(ids[i][8:], rand.Uint64())
+		if err := head.Consume(context.Background(), serviceRequest("api", &tracepb.Span{TraceId: ids[i], Name: "root"})); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	kept := len(sink.spans)
+	if kept < 2200 || kept > 2800 {
+		t.Fatalf("expected about 2500 traces kept, got %d", kept)
+	}
+
+	// A second request for the same traces gets the same decisions.
+	for _, id := range ids[:200] {
+		wasKept := sink.has(id)
+		before := len(sink.spans)
+		if err := head.Consume(context.Background(), serviceRequest("web", &tracepb.Span{TraceId: id, Name: "child"})); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+		if (len(sink.spans) > before) != wasKept {
+			t.Fatalf("trace %x got a different decision for its second span", id)
+		}
+	}
+}
+
+func TestHeadZeroPercentKeepsNothing(t *testing.T) {
+	registry := metrics.NewRegistry()
+	sink := &captureSink{}
+	head, err := NewHead(sink, HeadOptions{Percent: 0, Metrics: registry})
+	if err != nil {
+		t.Fatalf("new head: %v", err)
+	}
+	for id := uint64(0); id < 100; id++ {
+		if err := head.Consume(context.Background(), serviceRequest("api", &tracepb.Span{TraceId: traceID(id)})); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if len(sink.spans) != 0 {
+		t.Fatalf("expected every trace dropped, got %d spans", len(sink.spans))
+	}
+	var buffer bytes.Buffer
+	if err := registry.WriteText(&buffer); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	if want := `smelldeadfish_head_sampling_dropped_spans_total{service="api",reason="probability"} 100` + "\n"; !strings.Contains(buffer.String(), want) {
+		t.Fatalf("expected %q in metrics:\n%s", want, buffer.String())
+	}
+}
+
+func TestHeadRateLimitsPerService(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	registry := metrics.NewRegistry()
+	sink := &captureSink{}
+	head, err := NewHead(sink, HeadOptions{
+		Percent:    100,
+		RateLimits: map[string]float64{"chatty": 2},
+		Metrics:    registry,
+		Now:        func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatalf("new head: %v", err)
+	}
+	consume := func(service string, id uint64) {
+		t.Helper()
+		if err := head.Consume(context.Background(), serviceRequest(service, &tracepb.Span{TraceId: traceID(id)})); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+
+	for id := uint64(1); id <= 5; id++ {
+		consume("chatty", id)
+	}
+	consume("quiet", 6)
+	// Later spans follow the decision made for their trace.
+	consume("quiet", 1)
+	consume("quiet", 5)
+	now = now.Add(time.Second)
+	consume("chatty", 7)
+
+	for id, want := range map[uint64]bool{1: true, 2: true, 3: false, 5: false, 6: true, 7: true} {
+		if got := sink.has(traceID(id)); got != want {
+			t.Fatalf("trace %d kept=%v, want %v", id, got, want)
+		}
+	}
+	if len(sink.spans) != 5 {
+		t.Fatalf("expected 5 spans kept, got %d", len(sink.spans))
+	}
+
+	var buffer bytes.Buffer
+	if err := registry.WriteText(&buffer); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	for _, want := range []string{
+		"smelldeadfish_head_sampling_kept_spans_total 5\n",
+		`smelldeadfish_head_sampling_dropped_spans_total{service="chatty",reason="rate_limit"} 3` + "\n",
+		`smelldeadfish_head_sampling_dropped_spans_total{service="quiet",reason="rate_limit"} 1` + "\n",
+	} {
+		if !strings.Contains(buffer.String(), want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, buffer.String())
+		}
+	}
+}
+
+func TestHeadForgetsOldestDecisions(t *testing.T) {
+	head, err := NewHead(&captureSink{}, HeadOptions{Percent: 100, RateLimits: map[string]float64{AnyService: 100}, MaxDecisions: 2})
+	if err != nil {
+		t.Fatalf("new head: %v", err)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		if err := head.Consume(context.Background(), serviceRequest("api", &tracepb.Span{TraceId: traceID(id)})); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if len(head.decisions.kept) != 2 {
+		t.Fatalf("expected 2 remembered decisions, got %d", len(head.decisions.kept))
+	}
+	if _, ok := head.decisions.get(string(traceID(1))); ok {
+		t.Fatal("expected the oldest decision to be forgotten")
+	}
+}
+
+func TestNewHeadValidatesOptions(t *testing.T) {
+	if _, err := NewHead(&captureSink{}, HeadOptions{Percent: 120}); err == nil {
+		t.Fatal("expected percent error")
+	}
+	if _, err := NewHead(&captureSink{}, HeadOptions{RateLimits: map[string]float64{"api": 0}}); err == nil {
+		t.Fatal("expected rate limit error")
+	}
+}
@@ -0,0 +1,366 @@
+package sampling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+)
+
+const (
+	PolicyError     = "error"
+	PolicyDuration  = "duration"
+	PolicyAttribute = "attribute"
+	PolicyBaseline  = "baseline"
+
+	defaultDecisionWait = 10 * time.Second
+	defaultMaxSpans     = 100000
+)
+
+var ErrClosed = errors.New("tail sampling sink closed")
+
+type TailOptions struct {
+	// DecisionWait is how long spans are held after the first span of their
+	// trace arrives, default 10s.
+	DecisionWait time.Duration
+	// A trace is kept when any policy matches: KeepErrors keeps traces with
+	// an error span, MinDuration those whose root span (or, without one, the
+	// spans seen) lasted at least that long, and Attributes those with a span
+	// or resource attribute matching one of the values, which may use * as a
+	// wildcard. BaselinePercent keeps that share of the remaining traces.
+	KeepErrors      bool
+	MinDuration     time.Duration
+	Attributes      map[string]string
+	BaselinePercent float64
+	// MaxSpans bounds the spans held. Past it the oldest traces are decided
+	// early on the spans seen so far. Default 100000.
+	MaxSpans int
+	// MaxDecisions bounds the decisions remembered for spans that arrive
+	// after their trace was decided, default 100000.
+	MaxDecisions int
+	Logger       *log.Logger
+	Metrics      *metrics.Registry
+	// Now drives the decision wait; tests override it.
+	Now func() time.Time
+}
+
+// Tail buffers spans by trace ID and passes on whole traces once they are
+// decided. Spans of a decided trace follow its decision as they arrive.
+type Tail struct {
+	next         ingest.TraceSink
+	wait         time.Duration
+	keepErrors   bool
+	minDuration  time.Duration
+	attributes   map[string]string
+	baseline     uint64
+	keepBaseline bool
+	maxSpans     int
+	logger       *log.Logger
+	now          func() time.Time
+
+	mu        sync.Mutex
+	traces    map[string]*pendingTrace
+	queue     []*pendingTrace
+	spans     int
+	decisions *decisions
+	closed    bool
+	stop      chan struct{}
+	done      chan struct{}
+
+	traceCount *metrics.Counter
+	evicted    *metrics.Counter
+	late       *metrics.Counter
+	buffered   *metrics.Gauge
+	errors     *metrics.Counter
+}
+
+type pendingTrace struct {
+	id      string
+	arrived time.Time
+	spans   []heldSpan
+}
+
+// heldSpan keeps the resource and scope a span arrived with, so kept traces
+// are passed on with them.
+type heldSpan struct {
+	resource *tracepb.ResourceSpans
+	scope    *tracepb.ScopeSpans
+	span     *tracepb.Span
+}
+
+func NewTail(next ingest.TraceSink, opts TailOptions) (*Tail, error) {
+	if next == nil {
+		return nil, errors.New("tail sampling requires a sink")
+	}
+	if opts.BaselinePercent < 0 || opts.BaselinePercent > 100 {
+		return nil, fmt.Errorf("baseline percent must be between 0 and 100, got %g", opts.BaselinePercent)
+	}
+	if !opts.KeepErrors && opts.MinDuration == 0 && len(opts.Attributes) == 0 && opts.BaselinePercent == 0 {
+		return nil, errors.New("tail sampling needs at least one policy")
+	}
+	if opts.DecisionWait < 0 || opts.MinDuration < 0 {
+		return nil, errors.New("decision wait and min duration must not be negative")
+	}
+	t := &Tail{
+		next:         next,
+		wait:         opts.DecisionWait,
+		keepErrors:   opts.KeepErrors,
+		minDuration:  opts.MinDuration,
+		attributes:   opts.Attributes,
+		baseline:     percentThreshold(opts.BaselinePercent),
+		keepBaseline: opts.BaselinePercent > 0,
+		maxSpans:     opts.MaxSpans,
+		logger:       opts.Logger,
+		now:          opts.Now,
+		traces:       map[string]*pendingTrace{},
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		traceCount:   opts.Metrics.Counter("smelldeadfish_tail_sampling_traces_total", "Traces decided by tail sampling, by decision and the policy that kept them.", "decision", "policy"),
+		evicted:      opts.Metrics.Counter("smelldeadfish_tail_sampling_evicted_traces_total", "Traces decided before their decision wait because the buffer was full."),
+		late:         opts.Metrics.Counter("smelldeadfish_tail_sampling_late_spans_total", "Spans that arrived after their trace was decided, by decision.", "decision"),
+		buffered:     opts.Metrics.Gauge("smelldeadfish_tail_sampling_buffered_spans", "Spans waiting for a tail sampling decision."),
+		errors:       opts.Metrics.Counter("smelldeadfish_tail_sampling_forward_errors_total", "Kept traces the wrapped sink failed to consume."),
+	}
+	if t.wait == 0 {
+		t.wait = defaultDecisionWait
+	}
+	if t.maxSpans <= 0 {
+		t.maxSpans = defaultMaxSpans
+	}
+	maxDecisions := opts.MaxDecisions
+	if maxDecisions <= 0 {
+		maxDecisions = defaultMaxDecisions
+	}
+	t.decisions = newDecisions(maxDecisions)
+	if t.now == nil {
+		t.now = time.Now
+	}
+	go t.run()
+	return t, nil
+}
+
+// Consume holds the spans of undecided traces and passes on late spans of
+// kept ones right away, along with any traces decided early to make room.
+func (t *Tail) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if req == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+	now := t.now()
+	var ready []heldSpan
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			for _, span := range scopeSpans.GetSpans() {
+				held := heldSpan{resource: resourceSpans, scope: scopeSpans, span: span}
+				id := string(span.GetTraceId())
+				if kept, ok := t.decisions.get(id); ok {
+					if kept {
+						ready = append(ready, held)
+						t.late.Inc("kept")
+					} else {
+						t.late.Inc("dropped")
+					}
+					continue
+				}
+				trace := t.traces[id]
+				if trace == nil {
+					trace = &pendingTrace{id: id, arrived: now}
+					t.traces[id] = trace
+					t.queue = append(t.queue, trace)
+				}
+				trace.spans = append(trace.spans, held)
+				t.spans++
+			}
+		}
+	}
+	for t.spans > t.maxSpans && len(t.queue) > 0 {
+		t.evicted.Inc()
+		ready = append(ready, t.decideOldest()...)
+	}
+	t.buffered.Set(float64(t.spans))
+	t.mu.Unlock()
+	if len(ready) == 0 {
+		return nil
+	}
+	return t.next.Consume(ctx, assemble(ready))
+}
+
+// Close decides every held trace, passes on the kept ones, and closes the
+// wrapped sink.
+func (t *Tail) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.mu.Unlock()
+	close(t.stop)
+	<-t.done
+
+	t.mu.Lock()
+	var ready []heldSpan
+	for len(t.queue) > 0 {
+		ready = append(ready, t.decideOldest()...)
+	}
+	t.buffered.Set(0)
+	t.mu.Unlock()
+	var errs []error
+	if len(ready) > 0 {
+		errs = append(errs, t.next.Consume(context.Background(), assemble(ready)))
+	}
+	if closer, ok := t.next.(interface{ Close() error }); ok {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Tail) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(max(t.wait/10, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.decideDue()
+		}
+	}
+}
+
+// decideDue decides the traces whose wait is over and passes on the kept
+// ones.
+func (t *Tail) decideDue() {
+	t.mu.Lock()
+	now := t.now()
+	var ready []heldSpan
+	for len(t.queue) > 0 && now.Sub(t.queue[0].arrived) >= t.wait {
+		ready = append(ready, t.decideOldest()...)
+	}
+	t.buffered.Set(float64(t.spans))
+	t.mu.Unlock()
+	if len(ready) == 0 {
+		return
+	}
+	if err := t.next.Consume(context.Background(), assemble(ready)); err != nil {
+		t.errors.Inc()
+		if t.logger != nil {
+			t.logger.Printf("msg=tail_sampling_forward_failed spans=%d error=%q", len(ready), err.Error())
+		}
+	}
+}
+
+// decideOldest removes the oldest held trace and returns its spans if it is
+// kept. The caller holds mu.
+func (t *Tail) decideOldest() []heldSpan {
+	trace := t.queue[0]
+	t.queue[0] = nil
+	t.queue = t.queue[1:]
+	delete(t.traces, trace.id)
+	t.spans -= len(trace.spans)
+
+	policy := t.policy(trace)
+	t.decisions.put(trace.id, policy != "")
+	if policy == "" {
+		t.traceCount.Inc("dropped", "none")
+		return nil
+	}
+	t.traceCount.Inc("kept", policy)
+	return trace.spans
+}
+
+// policy returns the first policy that keeps the trace, or "".
+func (t *Tail) policy(trace *pendingTrace) string {
+	if t.keepErrors {
+		for _, held := range trace.spans {
+			if held.span.GetStatus().GetCode() == tracepb.Status_STATUS_CODE_ERROR {
+				return PolicyError
+			}
+		}
+	}
+	if t.minDuration > 0 && traceDuration(trace.spans) >= t.minDuration {
+		return PolicyDuration
+	}
+	if len(t.attributes) > 0 {
+		for _, held := range trace.spans {
+			if t.matchAny(held.span.GetAttributes()) || t.matchAny(held.resource.GetResource().GetAttributes()) {
+				return PolicyAttribute
+			}
+		}
+	}
+	if t.keepBaseline && traceHash([]byte(trace.id)) < t.baseline {
+		return PolicyBaseline
+	}
+	return ""
+}
+
+func (t *Tail) matchAny(attrs []*commonpb.KeyValue) bool {
+	for _, attr := range attrs {
+		if pattern, ok := t.attributes[attr.GetKey()]; ok && ingest.MatchWildcard(pattern, ingest.ValueString(attr.GetValue())) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceDuration is the duration of the root span, or the range covered by
+// the spans when the root has not arrived.
+func traceDuration(spans []heldSpan) time.Duration {
+	var start, end uint64
+	for i, held := range spans {
+		span := held.span
+		if len(span.GetParentSpanId()) == 0 {
+			return spanDuration(span.GetStartTimeUnixNano(), span.GetEndTimeUnixNano())
+		}
+		if i == 0 || span.GetStartTimeUnixNano() < start {
+			start = span.GetStartTimeUnixNano()
+		}
+		end = max(end, span.GetEndTimeUnixNano())
+	}
+	return spanDuration(start, end)
+}
+
+func spanDuration(start, end uint64) time.Duration {
+	if end <= start {
+		return 0
+	}
+	return time.Duration(end - start)
+}
+
+// assemble builds one request from held spans, grouping spans that arrived
+// with the same resource and scope.
+func assemble(spans []heldSpan) *coltracepb.ExportTraceServiceRequest {
+	req := &coltracepb.ExportTraceServiceRequest{}
+	resources := map[*tracepb.ResourceSpans]*tracepb.ResourceSpans{}
+	scopes := map[*tracepb.ScopeSpans]*tracepb.ScopeSpans{}
+	for _, held := range spans {
+		scope := scopes[held.scope]
+		if scope == nil {
+			resource := resources[held.resource]
+			if resource == nil {
+				resource = &tracepb.ResourceSpans{Resource: held.resource.GetResource(), SchemaUrl: held.resource.GetSchemaUrl()}
+				resources[held.resource] = resource
+				req.ResourceSpans = append(req.ResourceSpans, resource)
+			}
+			scope = &tracepb.ScopeSpans{Scope: held.scope.GetScope(), SchemaUrl: held.scope.GetSchemaUrl()}
+			scopes[held.scope] = scope
+			resource.ScopeSpans = append(resource.ScopeSpans, scope)
+		}
+		scope.Spans = append(scope.Spans, held.span)
+	}
+	return req
+}
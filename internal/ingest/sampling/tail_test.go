@@ -0,0 +1,219 @@
+package sampling
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/metrics"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func testSpan(trace uint64, span byte, root bool, duration time.Duration) *tracepb.Span {
+	s := &tracepb.Span{TraceId: traceID(trace), SpanId: []byte{span}, StartTimeUnixNano: 1000, EndTimeUnixNano: 1000 + uint64(duration)}
+	if !root {
+		s.ParentSpanId = []byte{1}
+	}
+	return s
+}
+
+// newTestTail returns a tail sampler whose decisions only happen when the
+// test calls decideDue, since its ticker is far slower than the test.
+func newTestTail(t *testing.T, sink *captureSink, opts TailOptions) (*Tail, *testClock) {
+	t.Helper()
+	clock := &testClock{now: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)}
+	opts.DecisionWait = time.Minute
+	opts.Now = clock.Now
+	tail, err := NewTail(sink, opts)
+	if err != nil {
+		t.Fatalf("new tail: %v", err)
+	}
+	return tail, clock
+}
+
+func TestTailKeepsMatchingTraces(t *testing.T) {
+	registry := metrics.NewRegistry()
+	sink := &captureSink{}
+	tail, clock := newTestTail(t, sink, TailOptions{
+		KeepErrors:  true,
+		MinDuration: time.Second,
+		Attributes:  map[string]string{"customer.tier": "gold*"},
+		Metrics:     registry,
+	})
+	errorSpan := testSpan(1, 2, false, time.Millisecond)
+	errorSpan.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}
+	goldSpan := testSpan(3, 1, true, time.Millisecond)
+	goldSpan.Attributes = []*commonpb.KeyValue{{Key: "customer.tier", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "gold-plus"}}}}
+
+	ctx := context.Background()
+	for _, span := range []*tracepb.Span{
+		testSpan(1, 1, true, time.Millisecond), errorSpan,
+		testSpan(2, 1, true, 2*time.Second),
+		goldSpan,
+		testSpan(4, 1, true, time.Millisecond), testSpan(4, 2, false, time.Millisecond),
+	} {
+		if err := tail.Consume(ctx, serviceRequest("api", span)); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+	}
+	if len(sink.spans) != 0 {
+		t.Fatalf("expected spans to be held until the decision, got %d", len(sink.spans))
+	}
+	tail.decideDue()
+	if len(sink.spans) != 0 {
+		t.Fatal("expected no decision before the wait is over")
+	}
+
+	clock.Advance(time.Minute)
+	tail.decideDue()
+	for id, want := range map[uint64]bool{1: true, 2: true, 3: true, 4: false} {
+		if got := sink.has(traceID(id)); got != want {
+			t.Fatalf("trace %d kept=%v, want %v", id, got, want)
+		}
+	}
+	if len(sink.spans) != 4 {
+		t.Fatalf("expected both spans of the error trace kept, got %d spans", len(sink.spans))
+	}
+
+	// Late spans follow their trace's decision.
+	if err := tail.Consume(ctx, serviceRequest("web", testSpan(1, 3, false, 0), testSpan(4, 3, false, 0))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if len(sink.spans) != 5 {
+		t.Fatalf("expected the late span of the kept trace to pass, got %d spans", len(sink.spans))
+	}
+	if err := tail.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	if err := registry.WriteText(&buffer); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	for _, want := range []string{
+		`smelldeadfish_tail_sampling_traces_total{decision="kept",policy="error"} 1` + "\n",
+		`smelldeadfish_tail_sampling_traces_total{decision="kept",policy="duration"} 1` + "\n",
+		`smelldeadfish_tail_sampling_traces_total{decision="kept",policy="attribute"} 1` + "\n",
+		`smelldeadfish_tail_sampling_traces_total{decision="dropped",policy="none"} 1` + "\n",
+		`smelldeadfish_tail_sampling_late_spans_total{decision="dropped"} 1` + "\n",
+	} {
+		if !strings.Contains(buffer.String(), want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, buffer.String())
+		}
+	}
+}
+
+func TestTailEvictsOldestWhenFull(t *testing.T) {
+	registry := metrics.NewRegistry()
+	sink := &captureSink{}
+	tail, _ := newTestTail(t, sink, TailOptions{MinDuration: time.Second, MaxSpans: 2, Metrics: registry})
+	ctx := context.Background()
+	if err := tail.Consume(ctx, serviceRequest("api", testSpan(1, 1, true, 2*time.Second))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := tail.Consume(ctx, serviceRequest("api", testSpan(2, 1, true, 0), testSpan(2, 2, false, 0))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if !sink.has(traceID(1)) {
+		t.Fatal("expected the oldest trace to be decided early and kept")
+	}
+	if tail.spans != 2 {
+		t.Fatalf("expected 2 spans still held, got %d", tail.spans)
+	}
+	if err := tail.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	var buffer bytes.Buffer
+	_ = registry.WriteText(&buffer)
+	if !strings.Contains(buffer.String(), "smelldeadfish_tail_sampling_evicted_traces_total 1\n") {
+		t.Fatalf("expected an eviction in metrics:\n%s", buffer.String())
+	}
+}
+
+func TestTailCloseDecidesHeldTraces(t *testing.T) {
+	sink := &captureSink{}
+	tail, _ := newTestTail(t, sink, TailOptions{BaselinePercent: 100})
+	if err := tail.Consume(context.Background(), serviceRequest("api", testSpan(1, 1, true, 0))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := tail.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if !sink.has(traceID(1)) {
+		t.Fatal("expected held traces to be passed on at close")
+	}
+	if err := tail.Consume(context.Background(), serviceRequest("api", testSpan(2, 1, true, 0))); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestTailDecidesAfterWait(t *testing.T) {
+	sink := &lockedSink{}
+	tail, err := NewTail(sink, TailOptions{DecisionWait: 20 * time.Millisecond, KeepErrors: true, BaselinePercent: 100})
+	if err != nil {
+		t.Fatalf("new tail: %v", err)
+	}
+	defer tail.Close()
+	if err := tail.Consume(context.Background(), serviceRequest("api", testSpan(1, 1, true, 0))); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for sink.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the trace to be passed on after the decision wait")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewTailRequiresPolicy(t *testing.T) {
+	if _, err := NewTail(&captureSink{}, TailOptions{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// lockedSink counts spans passed on from the sampler's own goroutine.
+type lockedSink struct {
+	mu    sync.Mutex
+	spans int
+}
+
+func (l *lockedSink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			l.spans += len(scopeSpans.GetSpans())
+		}
+	}
+	return nil
+}
+
+func (l *lockedSink) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.spans
+}
@@ -0,0 +1,246 @@
+package ingest
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+const (
+	// HighlightStart and HighlightEnd wrap matched terms in highlights,
+	// which are HTML: the text around them is escaped.
+	HighlightStart = "<mark>"
+	HighlightEnd   = "</mark>"
+	// SearchSeparator joins attribute values and event names in a
+	// SearchDocument.
+	SearchSeparator = " | "
+
+	snippetContext = 48
+)
+
+// SearchFields names the search document fields as they appear in
+// spanstore.TextMatch highlights, and SearchWeights gives their weight in
+// ranking. Stores that rank in SQL use the same weights.
+var (
+	SearchFields  = [4]string{"name", "status_message", "attributes", "events"}
+	SearchWeights = [4]float64{4, 2, 1, 1}
+)
+
+// SearchDocument is the text a span can be found by in a free-text search:
+// its name, status message, string attribute values, and event names.
+type SearchDocument struct {
+	Name          string
+	StatusMessage string
+	Attributes    string
+	Events        string
+}
+
+func NewSearchDocument(span *tracepb.Span) SearchDocument {
+	values := make([]string, 0, len(span.GetAttributes()))
+	for _, attr := range span.GetAttributes() {
+		if value, ok := attr.GetValue().GetValue().(*commonpb.AnyValue_StringValue); ok {
+			values = append(values, value.StringValue)
+		}
+	}
+	events := make([]string, 0, len(span.GetEvents()))
+	for _, event := range span.GetEvents() {
+		events = append(events, event.GetName())
+	}
+	return SearchDocument{
+		Name:          span.GetName(),
+		StatusMessage: span.GetStatus().GetMessage(),
+		Attributes:    strings.Join(values, SearchSeparator),
+		Events:        strings.Join(events, SearchSeparator),
+	}
+}
+
+// Fields returns the document fields in SearchFields order.
+func (d SearchDocument) Fields() [4]string {
+	return [4]string{d.Name, d.StatusMessage, d.Attributes, d.Events}
+}
+
+// SearchTerms splits a free-text query into lower-case terms. Every term
+// must appear for a span to match.
+func SearchTerms(text string) []string {
+	return strings.Fields(strings.ToLower(text))
+}
+
+// textToken is a token of a field, with its byte offsets in the field.
+type textToken struct {
+	text       string
+	start, end int
+}
+
+func isTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Co, r)
+}
+
+// tokenize splits text into lower-case tokens at every character that is not
+// a letter or number, as SQLite's FTS5 unicode61 tokenizer does without
+// diacritic folding. A term matches a run of tokens equal to its own, except
+// that the last only has to start with the term's last token, so every store
+// finds the same spans: "pay" finds "payment" and "ord-123" finds
+// "ORD-12345", but "ment" finds nothing.
+func tokenize(text string) []textToken {
+	var tokens []textToken
+	start := -1
+	for i, r := range text {
+		switch {
+		case isTokenRune(r) && start < 0:
+			start = i
+		case !isTokenRune(r) && start >= 0:
+			tokens = append(tokens, textToken{text: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, textToken{text: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// termTokens returns the tokens a term matches; a term without any, such as
+// "-", matches nothing.
+func termTokens(term string) []string {
+	tokens := tokenize(term)
+	words := make([]string, len(tokens))
+	for i, token := range tokens {
+		words[i] = token.text
+	}
+	return words
+}
+
+type textHit struct{ start, end int }
+
+// findTerm returns the non-overlapping occurrences of a term's tokens.
+func findTerm(tokens []textToken, words []string) []textHit {
+	var hits []textHit
+	if len(words) == 0 {
+		return nil
+	}
+	last := len(words) - 1
+	for i := 0; i+last < len(tokens); {
+		matched := strings.HasPrefix(tokens[i+last].text, words[last])
+		for j := 0; matched && j < last; j++ {
+			matched = tokens[i+j].text == words[j]
+		}
+		if !matched {
+			i++
+			continue
+		}
+		hits = append(hits, textHit{tokens[i].start, tokens[i+last].end})
+		i += len(words)
+	}
+	return hits
+}
+
+// TermPattern returns an RE2 pattern matching the occurrences of term in
+// lower-cased text, for stores that search in SQL. It reports false when
+// the term matches nothing.
+func TermPattern(term string) (string, bool) {
+	words := termTokens(term)
+	if len(words) == 0 {
+		return "", false
+	}
+	const separator = `[^\pL\pN\p{Co}]`
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	return "(^|" + separator + ")" + strings.Join(words, separator+"+"), true
+}
+
+// MatchText is the matcher used by stores without a full-text index. A span
+// matches when every term occurs in some field; the score is the weighted
+// number of occurrences.
+func MatchText(doc SearchDocument, terms []string) (*spanstore.TextMatch, bool) {
+	if len(terms) == 0 {
+		return nil, false
+	}
+	fields := doc.Fields()
+	var tokens [4][]textToken
+	for i, field := range fields {
+		tokens[i] = tokenize(field)
+	}
+	match := &spanstore.TextMatch{Highlights: map[string]string{}}
+	for _, term := range terms {
+		words := termTokens(term)
+		found := false
+		for i := range fields {
+			if count := len(findTerm(tokens[i], words)); count > 0 {
+				match.Score += SearchWeights[i] * float64(count)
+				found = true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	for i, field := range fields {
+		if highlighted, ok := Highlight(field, terms); ok {
+			match.Highlights[SearchFields[i]] = highlighted
+		}
+	}
+	return match, true
+}
+
+// Highlight HTML-escapes text and wraps the occurrences of terms in
+// HighlightStart and HighlightEnd, trimming long text to the context around
+// the first match. It reports false when no term occurs.
+func Highlight(text string, terms []string) (string, bool) {
+	tokens := tokenize(text)
+	var hits []textHit
+	for _, term := range terms {
+		hits = append(hits, findTerm(tokens, termTokens(term))...)
+	}
+	if len(hits) == 0 {
+		return "", false
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].start < hits[j].start })
+	merged := hits[:1]
+	for _, h := range hits[1:] {
+		if last := &merged[len(merged)-1]; h.start <= last.end {
+			last.end = max(last.end, h.end)
+		} else {
+			merged = append(merged, h)
+		}
+	}
+	hits = merged
+	from, to := 0, len(text)
+	prefix, suffix := "", ""
+	if from < hits[0].start-snippetContext {
+		from = runeStart(text, hits[0].start-snippetContext)
+		prefix = "…"
+	}
+	if last := hits[len(hits)-1].end; to > last+2*snippetContext {
+		to = runeStart(text, last+2*snippetContext)
+		suffix = "…"
+	}
+	var builder strings.Builder
+	builder.WriteString(prefix)
+	pos := from
+	for _, h := range hits {
+		builder.WriteString(html.EscapeString(text[pos:h.start]))
+		builder.WriteString(HighlightStart)
+		builder.WriteString(html.EscapeString(text[h.start:h.end]))
+		builder.WriteString(HighlightEnd)
+		pos = h.end
+	}
+	builder.WriteString(html.EscapeString(text[pos:to]))
+	builder.WriteString(suffix)
+	return builder.String(), true
+}
+
+func runeStart(text string, i int) int {
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	return i
+}
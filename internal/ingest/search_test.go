@@ -0,0 +1,63 @@
+package ingest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchTextRequiresEveryTerm(t *testing.T) {
+	doc := SearchDocument{Name: "POST /checkout", StatusMessage: "Payment declined", Attributes: "ORD-12345 | checkout"}
+	match, ok := MatchText(doc, SearchTerms("checkout DECLINED"))
+	if !ok {
+		t.Fatalf("expected match")
+	}
+	if match.Score != 4+1+2 {
+		t.Fatalf("unexpected score %v", match.Score)
+	}
+	want := map[string]string{
+		"name":           "POST /<mark>checkout</mark>",
+		"status_message": "Payment <mark>declined</mark>",
+		"attributes":     "ORD-12345 | <mark>checkout</mark>",
+	}
+	for field, highlighted := range want {
+		if match.Highlights[field] != highlighted {
+			t.Fatalf("%s: expected %q, got %q", field, highlighted, match.Highlights[field])
+		}
+	}
+	if _, ok := MatchText(doc, SearchTerms("checkout refund")); ok {
+		t.Fatalf("expected missing term to prevent a match")
+	}
+}
+
+func TestHighlightTrimsLongText(t *testing.T) {
+	text := strings.Repeat("a", 200) + " needle " + strings.Repeat("é", 200)
+	got, ok := Highlight(text, []string{"needle"})
+	if !ok {
+		t.Fatalf("expected a hit")
+	}
+	if !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") || !strings.Contains(got, "<mark>needle</mark>") {
+		t.Fatalf("unexpected snippet %q", got)
+	}
+	if len(got) > 2*len(text)/3 {
+		t.Fatalf("expected snippet to be trimmed, got %d bytes", len(got))
+	}
+}
+
+func TestMatchTextMatchesTokenPrefixes(t *testing.T) {
+	doc := SearchDocument{Name: "payment declined", Attributes: "ORD-12345 | card"}
+	match, ok := MatchText(doc, SearchTerms("pay ord-123"))
+	if !ok {
+		t.Fatalf("expected token prefixes to match")
+	}
+	if got := match.Highlights["name"]; got != "<mark>payment</mark> declined" {
+		t.Fatalf("expected the whole token highlighted, got %q", got)
+	}
+	if got := match.Highlights["attributes"]; got != "<mark>ORD-12345</mark> | card" {
+		t.Fatalf("expected the whole phrase highlighted, got %q", got)
+	}
+	for _, text := range []string{"ment", "ard", "-", "12345-ord"} {
+		if _, ok := MatchText(doc, SearchTerms(text)); ok {
+			t.Fatalf("expected %q not to match", text)
+		}
+	}
+}
@@ -4,8 +4,21 @@ import (
 	"context"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
 )
 
 type TraceSink interface {
 	Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error
 }
+
+// CountSpans returns the number of spans under resourceSpans; pass
+// req.GetResourceSpans()... to count a whole request.
+func CountSpans(resourceSpans ...*tracepb.ResourceSpans) int {
+	count := 0
+	for _, resource := range resourceSpans {
+		for _, scopeSpans := range resource.GetScopeSpans() {
+			count += len(scopeSpans.GetSpans())
+		}
+	}
+	return count
+}
@@ -0,0 +1,44 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"smelldeadfish/internal/migrate"
+)
+
+// migrations are applied in order on open. Released entries must never be
+// edited; schema changes go in a new migration.
+var migrations = []migrate.Migration{
+	{Version: 1, Name: "initial schema", SQL: initialSchema},
+	{Version: 2, Name: "content-addressed resources and scopes", Func: collapseLegacyIDs},
+	{Version: 3, Name: "typed attribute columns", SQL: typedAttributeColumns},
+	{Version: 4, Name: "span full-text index", SQL: spanSearchSchema},
+	{Version: 5, Name: "span export order index", SQL: exportOrderIndex},
+	{Version: 6, Name: "span full-text index without diacritic folding", SQL: spanSearchExactDiacritics},
+}
+
+// Migrate brings the database at path to the latest schema version. With
+// dryRun it only reports the pending migrations and never creates the file.
+func Migrate(ctx context.Context, path string, dryRun bool) (migrate.Plan, error) {
+	if dryRun {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return migrate.PlanFor(0, migrations)
+		}
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return migrate.Plan{}, fmt.Errorf("open sqlite: %w", err)
+	}
+	defer db.Close()
+	if dryRun {
+		return migrate.Inspect(ctx, db, migrations)
+	}
+	if _, err := db.ExecContext(ctx, pragmas); err != nil {
+		return migrate.Plan{}, fmt.Errorf("init schema: %w", err)
+	}
+	return migrate.Apply(ctx, db, migrations)
+}
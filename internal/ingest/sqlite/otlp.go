@@ -0,0 +1,401 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/otlpconv"
+	"smelldeadfish/internal/spanstore"
+)
+
+const defaultExportLimit = 1000
+
+type otlpSpanRow struct {
+	id         string
+	resourceID string
+	scopeID    string
+	span       *tracepb.Span
+	cursor     spanstore.ExportCursor
+}
+
+func (s *Sink) QueryTraceOTLP(ctx context.Context, params spanstore.TraceSpansQueryParams) (*coltracepb.ExportTraceServiceRequest, error) {
+	traceID := strings.TrimSpace(params.TraceID)
+	if traceID == "" {
+		return nil, fmt.Errorf("trace_id is required")
+	}
+	query, args := buildTraceSpansQuery(traceID, params.Service, params.StatusCode)
+	var req *coltracepb.ExportTraceServiceRequest
+	err := withRetry(ctx, defaultRetryTimeout, func(ctx context.Context) error {
+		return s.withConn(ctx, func(conn *sql.Conn) error {
+			var err error
+			req, _, err = s.queryOTLP(ctx, conn, query, args)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ExportSpans returns the next page of spans in export order.
+func (s *Sink) ExportSpans(ctx context.Context, params spanstore.ExportParams) (spanstore.ExportPage, error) {
+	if params.Limit <= 0 {
+		params.Limit = defaultExportLimit
+	}
+	query, args := buildExportQuery(params)
+	var page spanstore.ExportPage
+	err := withRetry(ctx, defaultRetryTimeout, func(ctx context.Context) error {
+		return s.withConn(ctx, func(conn *sql.Conn) error {
+			req, rows, err := s.queryOTLP(ctx, conn, query, args)
+			if err != nil {
+				return err
+			}
+			page = exportPage(req, rows)
+			return nil
+		})
+	})
+	if err != nil {
+		return spanstore.ExportPage{}, err
+	}
+	return page, nil
+}
+
+func buildExportQuery(params spanstore.ExportParams) (string, []interface{}) {
+	end := params.End
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	args := []interface{}{params.Start, end}
+	builder := strings.Builder{}
+	builder.WriteString(`SELECT id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id
+FROM spans
+WHERE start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
+	if service := strings.TrimSpace(params.Service); service != "" {
+		builder.WriteString(` AND service_name = ?`)
+		args = append(args, service)
+	}
+	if after := params.After; after != nil {
+		builder.WriteString(` AND (start_time_unix_nano > ? OR (start_time_unix_nano = ? AND (trace_id > ? OR (trace_id = ? AND span_id > ?))))`)
+		args = append(args, after.StartTimeUnixNano, after.StartTimeUnixNano, after.TraceID, after.TraceID, after.SpanID)
+	}
+	builder.WriteString(` ORDER BY start_time_unix_nano, trace_id, span_id LIMIT ?`)
+	args = append(args, params.Limit)
+	return builder.String(), args
+}
+
+func exportPage(req *coltracepb.ExportTraceServiceRequest, rows []otlpSpanRow) spanstore.ExportPage {
+	page := spanstore.ExportPage{Request: req, Spans: len(rows)}
+	if len(rows) > 0 {
+		next := rows[len(rows)-1].cursor
+		page.Next = &next
+	}
+	return page
+}
+
+// queryOTLP rebuilds the spans selected by query, which must return the
+// spans columns in the order buildTraceSpansQuery does. It also returns the
+// span rows in query order.
+func (s *Sink) queryOTLP(ctx context.Context, conn *sql.Conn, query string, args []interface{}) (*coltracepb.ExportTraceServiceRequest, []otlpSpanRow, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query otlp spans: %w", err)
+	}
+	spanRows := make([]otlpSpanRow, 0, 16)
+	for rows.Next() {
+		var (
+			row           otlpSpanRow
+			traceID       string
+			spanID        string
+			parentSpanID  string
+			name          string
+			kind          string
+			startTime     int64
+			endTime       int64
+			statusCode    int32
+			statusMessage string
+			serviceName   string
+			flags         uint32
+		)
+		if err := rows.Scan(
+			&row.id,
+			&traceID,
+			&spanID,
+			&parentSpanID,
+			&name,
+			&kind,
+			&startTime,
+			&endTime,
+			&statusCode,
+			&statusMessage,
+			&serviceName,
+			&flags,
+			&row.resourceID,
+			&row.scopeID,
+		); err != nil {
+			_ = rows.Close()
+			return nil, nil, fmt.Errorf("scan otlp span: %w", err)
+		}
+		row.span = &tracepb.Span{
+			TraceId:           otlpconv.DecodeID(traceID),
+			SpanId:            otlpconv.DecodeID(spanID),
+			ParentSpanId:      otlpconv.DecodeParentID(parentSpanID),
+			Name:              name,
+			Kind:              otlpconv.SpanKind(kind),
+			StartTimeUnixNano: uint64(startTime),
+			EndTimeUnixNano:   uint64(endTime),
+			Flags:             flags,
+		}
+		row.cursor = spanstore.ExportCursor{StartTimeUnixNano: startTime, TraceID: traceID, SpanID: spanID}
+		if statusCode != 0 || statusMessage != "" {
+			row.span.Status = &tracepb.Status{Code: tracepb.Status_StatusCode(statusCode), Message: statusMessage}
+		}
+		spanRows = append(spanRows, row)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, nil, fmt.Errorf("iterate otlp spans: %w", err)
+	}
+	_ = rows.Close()
+
+	builder := otlpconv.NewBuilder()
+	if len(spanRows) == 0 {
+		return builder.Request(), nil, nil
+	}
+	spanIDs := make([]string, 0, len(spanRows))
+	resourceIDs := make([]string, 0, len(spanRows))
+	scopeIDs := make([]string, 0, len(spanRows))
+	for _, row := range spanRows {
+		spanIDs = append(spanIDs, row.id)
+		resourceIDs = append(resourceIDs, row.resourceID)
+		scopeIDs = append(scopeIDs, row.scopeID)
+	}
+	spanAttrs, err := s.loadRawAttributesBatch(ctx, conn, "span_attributes", "span_id", spanIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	resources, err := s.loadRawResourcesBatch(ctx, conn, uniqueIDs(resourceIDs))
+	if err != nil {
+		return nil, nil, err
+	}
+	scopes, err := s.loadRawScopesBatch(ctx, conn, uniqueIDs(scopeIDs))
+	if err != nil {
+		return nil, nil, err
+	}
+	events, err := s.loadRawEventsBatch(ctx, conn, spanIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	links, err := s.loadRawLinksBatch(ctx, conn, spanIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, row := range spanRows {
+		row.span.Attributes = spanAttrs[row.id]
+		row.span.Events = events[row.id]
+		row.span.Links = links[row.id]
+		builder.Add(row.resourceID, resources[row.resourceID], row.scopeID, scopes[row.scopeID], row.span)
+	}
+	return builder.Request(), spanRows, nil
+}
+
+func (s *Sink) loadRawAttributesBatch(ctx context.Context, conn *sql.Conn, table, idColumn string, ids []string) (map[string][]*commonpb.KeyValue, error) {
+	result := make(map[string][]*commonpb.KeyValue, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	for _, batch := range chunkIDs(ids, maxBatchSize) {
+		query, args := buildInQuery(fmt.Sprintf("SELECT %s, key, type, value FROM %s WHERE %s IN ", idColumn, table, idColumn), batch)
+		rows, err := conn.QueryContext(ctx, query+" ORDER BY rowid", args...)
+		if err != nil {
+			return nil, fmt.Errorf("load raw attributes: %w", err)
+		}
+		for rows.Next() {
+			var id string
+			var key string
+			var attrType string
+			var value string
+			if err := rows.Scan(&id, &key, &attrType, &value); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("scan raw attributes: %w", err)
+			}
+			result[id] = append(result[id], &commonpb.KeyValue{Key: key, Value: otlpconv.StoredValue(attrType, value)})
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("iterate raw attributes: %w", err)
+		}
+		_ = rows.Close()
+	}
+	return result, nil
+}
+
+func (s *Sink) loadRawResourcesBatch(ctx context.Context, conn *sql.Conn, resourceIDs []string) (map[string]otlpconv.StoredResource, error) {
+	result := make(map[string]otlpconv.StoredResource, len(resourceIDs))
+	for _, batch := range chunkIDs(resourceIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT id, schema_url FROM resources WHERE id IN ", batch)
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("load raw resources: %w", err)
+		}
+		for rows.Next() {
+			var id string
+			var schemaURL sql.NullString
+			if err := rows.Scan(&id, &schemaURL); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("scan raw resource: %w", err)
+			}
+			result[id] = otlpconv.StoredResource{SchemaURL: schemaURL.String}
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("iterate raw resources: %w", err)
+		}
+		_ = rows.Close()
+	}
+	attrs, err := s.loadRawAttributesBatch(ctx, conn, "resource_attributes", "resource_id", resourceIDs)
+	if err != nil {
+		return nil, err
+	}
+	for id, resource := range result {
+		resource.Attributes = attrs[id]
+		result[id] = resource
+	}
+	return result, nil
+}
+
+func (s *Sink) loadRawScopesBatch(ctx context.Context, conn *sql.Conn, scopeIDs []string) (map[string]otlpconv.StoredScope, error) {
+	result := make(map[string]otlpconv.StoredScope, len(scopeIDs))
+	for _, batch := range chunkIDs(scopeIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT id, name, version, schema_url FROM scopes WHERE id IN ", batch)
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("load raw scopes: %w", err)
+		}
+		for rows.Next() {
+			var id string
+			var name, version, schemaURL sql.NullString
+			if err := rows.Scan(&id, &name, &version, &schemaURL); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("scan raw scope: %w", err)
+			}
+			result[id] = otlpconv.StoredScope{Name: name.String, Version: version.String, SchemaURL: schemaURL.String}
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("iterate raw scopes: %w", err)
+		}
+		_ = rows.Close()
+	}
+	attrs, err := s.loadRawAttributesBatch(ctx, conn, "scope_attributes", "scope_id", scopeIDs)
+	if err != nil {
+		return nil, err
+	}
+	for id, scope := range result {
+		scope.Attributes = attrs[id]
+		result[id] = scope
+	}
+	return result, nil
+}
+
+func (s *Sink) loadRawEventsBatch(ctx context.Context, conn *sql.Conn, spanIDs []string) (map[string][]*tracepb.Span_Event, error) {
+	result := make(map[string][]*tracepb.Span_Event, len(spanIDs))
+	eventIDs := make([]string, 0)
+	eventByID := make(map[string]*tracepb.Span_Event)
+	for _, batch := range chunkIDs(spanIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT id, span_id, name, time_unix_nano, dropped_attributes_count FROM span_events WHERE span_id IN ", batch)
+		rows, err := conn.QueryContext(ctx, query+" ORDER BY rowid", args...)
+		if err != nil {
+			return nil, fmt.Errorf("load raw events: %w", err)
+		}
+		for rows.Next() {
+			var eventID string
+			var spanID string
+			var timeUnixNano int64
+			event := &tracepb.Span_Event{}
+			if err := rows.Scan(&eventID, &spanID, &event.Name, &timeUnixNano, &event.DroppedAttributesCount); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("scan raw event: %w", err)
+			}
+			event.TimeUnixNano = uint64(timeUnixNano)
+			eventIDs = append(eventIDs, eventID)
+			eventByID[eventID] = event
+			result[spanID] = append(result[spanID], event)
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("iterate raw events: %w", err)
+		}
+		_ = rows.Close()
+	}
+	attrs, err := s.loadRawAttributesBatch(ctx, conn, "span_event_attributes", "event_id", eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	for eventID, event := range eventByID {
+		event.Attributes = attrs[eventID]
+	}
+	return result, nil
+}
+
+func (s *Sink) loadRawLinksBatch(ctx context.Context, conn *sql.Conn, spanIDs []string) (map[string][]*tracepb.Span_Link, error) {
+	result := make(map[string][]*tracepb.Span_Link, len(spanIDs))
+	linkIDs := make([]string, 0)
+	linkByID := make(map[string]*tracepb.Span_Link)
+	for _, batch := range chunkIDs(spanIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT id, span_id, trace_id, linked_span_id, trace_state, dropped_attributes_count, flags FROM span_links WHERE span_id IN ", batch)
+		rows, err := conn.QueryContext(ctx, query+" ORDER BY rowid", args...)
+		if err != nil {
+			return nil, fmt.Errorf("load raw links: %w", err)
+		}
+		for rows.Next() {
+			var linkID string
+			var spanID string
+			var traceID string
+			var linkedSpanID string
+			link := &tracepb.Span_Link{}
+			if err := rows.Scan(&linkID, &spanID, &traceID, &linkedSpanID, &link.TraceState, &link.DroppedAttributesCount, &link.Flags); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("scan raw link: %w", err)
+			}
+			link.TraceId = otlpconv.DecodeID(traceID)
+			link.SpanId = otlpconv.DecodeParentID(linkedSpanID)
+			linkIDs = append(linkIDs, linkID)
+			linkByID[linkID] = link
+			result[spanID] = append(result[spanID], link)
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("iterate raw links: %w", err)
+		}
+		_ = rows.Close()
+	}
+	attrs, err := s.loadRawAttributesBatch(ctx, conn, "span_link_attributes", "link_id", linkIDs)
+	if err != nil {
+		return nil, err
+	}
+	for linkID, link := range linkByID {
+		link.Attributes = attrs[linkID]
+	}
+	return result, nil
+}
+
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]struct{}, len(ids))
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		result = append(result, id)
+	}
+	return result
+}
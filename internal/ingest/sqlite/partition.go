@@ -0,0 +1,876 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/spanstore"
+)
+
+const (
+	defaultPartitionInterval = 24 * time.Hour
+	retentionCheckInterval   = time.Minute
+	partitionPrefix          = "spans-"
+	partitionSuffix          = ".sqlite"
+	partitionTimeLayout      = "20060102T150405Z"
+	defaultTraceSpread       = time.Hour
+	// traceOverfetch scales the trace limit pushed down to each partition,
+	// leaving room for traces whose rank changes once their spans in other
+	// partitions are counted.
+	traceOverfetch = 2
+)
+
+type PartitionOptions struct {
+	Metrics *metrics.Registry
+	Logger  *log.Logger
+	// Interval is the span start time range each database file covers,
+	// aligned to UTC. Defaults to one day.
+	Interval time.Duration
+	// Retention drops partitions that ended longer ago than this, and spans
+	// that would land in them are discarded. Zero keeps everything.
+	Retention time.Duration
+	// TraceSpread bounds how far apart the spans of one trace start. Trace
+	// queries only read partitions within it of the spans they found, so
+	// spans further away are missed. Defaults to one hour.
+	TraceSpread time.Duration
+}
+
+// PartitionedSink keeps spans in one SQLite database per time interval under
+// a directory, routed by span start time. Queries fan out to the partitions
+// overlapping the requested window and merge the results, and retention
+// deletes whole files instead of rows.
+//
+// A trace crossing a partition boundary is summarized from all of its spans
+// that start within TraceSpread of each other. Each partition returns only a
+// margin over the trace limit, so a trace ranked far lower in its own
+// partitions than overall can be missed. Relevance scores come from each partition's own index, so they are only
+// roughly comparable across partitions.
+type PartitionedSink struct {
+	dir       string
+	interval  time.Duration
+	retention time.Duration
+	spread    time.Duration
+	logger    *log.Logger
+	metrics   ingest.WriteMetrics
+
+	mu         sync.RWMutex
+	partitions []*partition // sorted by start
+	closed     bool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// partition is one database file covering span start times in [start, end).
+// The file is opened on first use. Users hold mu for reading while they use
+// the sink so that drop waits for them.
+type partition struct {
+	start int64
+	end   int64
+	path  string
+
+	mu      sync.RWMutex
+	sink    *Sink
+	dropped bool
+}
+
+func NewPartitioned(dir string) (*PartitionedSink, error) {
+	return NewPartitionedWithOptions(dir, PartitionOptions{})
+}
+
+func NewPartitionedWithOptions(dir string, opts PartitionOptions) (*PartitionedSink, error) {
+	if opts.Interval < 0 || opts.Retention < 0 || opts.TraceSpread < 0 {
+		return nil, fmt.Errorf("partition interval, retention, and trace spread must not be negative")
+	}
+	if opts.Interval == 0 {
+		opts.Interval = defaultPartitionInterval
+	}
+	if opts.TraceSpread == 0 {
+		opts.TraceSpread = defaultTraceSpread
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create partition dir: %w", err)
+	}
+	partitions, err := loadPartitions(dir)
+	if err != nil {
+		return nil, err
+	}
+	p := &PartitionedSink{
+		dir:        dir,
+		interval:   opts.Interval,
+		retention:  opts.Retention,
+		spread:     opts.TraceSpread,
+		logger:     opts.Logger,
+		metrics:    ingest.NewWriteMetrics(opts.Metrics, "sqlite"),
+		partitions: partitions,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	opts.Metrics.GaugeFunc("smelldeadfish_store_partitions", "Database files in the partitioned store.", func() float64 {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return float64(len(p.partitions))
+	})
+	if p.retention > 0 {
+		if _, err := p.DropBefore(time.Now().Add(-p.retention)); err != nil {
+			return nil, err
+		}
+		go p.retentionLoop()
+	} else {
+		close(p.done)
+	}
+	return p, nil
+}
+
+// PartitionFiles lists the partition databases in dir, oldest first.
+func PartitionFiles(dir string) ([]string, error) {
+	partitions, err := loadPartitions(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(partitions))
+	for i, part := range partitions {
+		paths[i] = part.path
+	}
+	return paths, nil
+}
+
+func loadPartitions(dir string) ([]*partition, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read partition dir: %w", err)
+	}
+	var partitions []*partition
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		start, end, ok := parsePartitionName(entry.Name())
+		if !ok {
+			continue
+		}
+		partitions = append(partitions, &partition{start: start, end: end, path: filepath.Join(dir, entry.Name())})
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].start != partitions[j].start {
+			return partitions[i].start < partitions[j].start
+		}
+		return partitions[i].end < partitions[j].end
+	})
+	return partitions, nil
+}
+
+func partitionName(start, end int64) string {
+	return partitionPrefix + time.Unix(0, start).UTC().Format(partitionTimeLayout) + "-" + time.Unix(0, end).UTC().Format(partitionTimeLayout) + partitionSuffix
+}
+
+func parsePartitionName(name string) (int64, int64, bool) {
+	if !strings.HasPrefix(name, partitionPrefix) || !strings.HasSuffix(name, partitionSuffix) {
+		return 0, 0, false
+	}
+	startText, endText, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, partitionPrefix), partitionSuffix), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := time.Parse(partitionTimeLayout, startText)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := time.Parse(partitionTimeLayout, endText)
+	if err != nil || !end.After(start) {
+		return 0, 0, false
+	}
+	return start.UnixNano(), end.UnixNano(), true
+}
+
+// use runs fn with the partition's sink, opening the file if needed. A
+// dropped partition is skipped.
+func (part *partition) use(fn func(*Sink) error) error {
+	for {
+		part.mu.RLock()
+		if part.dropped {
+			part.mu.RUnlock()
+			return nil
+		}
+		if part.sink != nil {
+			defer part.mu.RUnlock()
+			return fn(part.sink)
+		}
+		part.mu.RUnlock()
+
+		part.mu.Lock()
+		if part.sink == nil && !part.dropped {
+			sink, err := NewWithOptions(part.path, Options{})
+			if err != nil {
+				part.mu.Unlock()
+				return fmt.Errorf("open partition %s: %w", filepath.Base(part.path), err)
+			}
+			part.sink = sink
+		}
+		part.mu.Unlock()
+	}
+}
+
+// drop closes the partition once in-flight users finish and removes its
+// files.
+func (part *partition) drop() error {
+	part.mu.Lock()
+	defer part.mu.Unlock()
+	part.dropped = true
+	var errs []error
+	if part.sink != nil {
+		errs = append(errs, part.sink.Close())
+		part.sink = nil
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(part.path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("remove partition: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (part *partition) close() error {
+	part.mu.Lock()
+	defer part.mu.Unlock()
+	part.dropped = true
+	if part.sink == nil {
+		return nil
+	}
+	err := part.sink.Close()
+	part.sink = nil
+	return err
+}
+
+func (part *partition) overlaps(start, end int64) bool {
+	return part.start <= end && part.end > start
+}
+
+// DropBefore deletes the partitions that ended at or before cutoff and
+// reports how many were removed.
+func (p *PartitionedSink) DropBefore(cutoff time.Time) (int, error) {
+	limit := cutoff.UnixNano()
+	p.mu.Lock()
+	var expired []*partition
+	kept := p.partitions[:0:0]
+	for _, part := range p.partitions {
+		if part.end <= limit {
+			expired = append(expired, part)
+		} else {
+			kept = append(kept, part)
+		}
+	}
+	p.partitions = kept
+	p.mu.Unlock()
+
+	var errs []error
+	for _, part := range expired {
+		if err := part.drop(); err != nil {
+			errs = append(errs, err)
+		} else if p.logger != nil {
+			p.logger.Printf("msg=partition_dropped store=sqlite path=%q", part.path)
+		}
+	}
+	return len(expired), errors.Join(errs...)
+}
+
+func (p *PartitionedSink) retentionLoop() {
+	defer close(p.done)
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if _, err := p.DropBefore(time.Now().Add(-p.retention)); err != nil && p.logger != nil {
+				p.logger.Printf("msg=retention_failed store=sqlite err=%q", err)
+			}
+		}
+	}
+}
+
+func (p *PartitionedSink) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	partitions := p.partitions
+	p.mu.Unlock()
+	close(p.stop)
+	<-p.done
+	var errs []error
+	for _, part := range partitions {
+		errs = append(errs, part.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Ping checks the newest partition, or the directory when there is none yet.
+func (p *PartitionedSink) Ping(ctx context.Context) error {
+	p.mu.RLock()
+	var newest *partition
+	if len(p.partitions) > 0 {
+		newest = p.partitions[len(p.partitions)-1]
+	}
+	p.mu.RUnlock()
+	if newest == nil {
+		if _, err := os.Stat(p.dir); err != nil {
+			return fmt.Errorf("ping: %w", err)
+		}
+		return nil
+	}
+	return newest.use(func(sink *Sink) error {
+		return sink.Ping(ctx)
+	})
+}
+
+func (p *PartitionedSink) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if p == nil || req == nil {
+		return nil
+	}
+	start := time.Now()
+	routed, err := p.route(req)
+	if err == nil {
+		for _, part := range routed.order {
+			if err = part.use(func(sink *Sink) error {
+				return sink.Consume(ctx, routed.requests[part])
+			}); err != nil {
+				break
+			}
+		}
+	}
+	p.metrics.Observe(req, start, err)
+	return err
+}
+
+type routedRequest struct {
+	order    []*partition
+	requests map[*partition]*coltracepb.ExportTraceServiceRequest
+}
+
+// route splits req by the partition of each span's start time, keeping the
+// resource and scope of every span. Spans older than the retention window
+// are dropped.
+func (p *PartitionedSink) route(req *coltracepb.ExportTraceServiceRequest) (routedRequest, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return routedRequest{}, fmt.Errorf("partitioned store closed")
+	}
+	cutoff := int64(0)
+	if p.retention > 0 {
+		cutoff = time.Now().Add(-p.retention).UnixNano()
+	}
+	routed := routedRequest{requests: map[*partition]*coltracepb.ExportTraceServiceRequest{}}
+	for _, resourceSpans := range req.GetResourceSpans() {
+		resources := map[*partition]*tracepb.ResourceSpans{}
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			scopes := map[*partition]*tracepb.ScopeSpans{}
+			for _, span := range scopeSpans.GetSpans() {
+				part := p.partitionForLocked(int64(span.GetStartTimeUnixNano()), cutoff)
+				if part == nil {
+					continue
+				}
+				scope := scopes[part]
+				if scope == nil {
+					resource := resources[part]
+					if resource == nil {
+						out := routed.requests[part]
+						if out == nil {
+							out = &coltracepb.ExportTraceServiceRequest{}
+							routed.requests[part] = out
+							routed.order = append(routed.order, part)
+						}
+						resource = &tracepb.ResourceSpans{Resource: resourceSpans.GetResource(), SchemaUrl: resourceSpans.GetSchemaUrl()}
+						out.ResourceSpans = append(out.ResourceSpans, resource)
+						resources[part] = resource
+					}
+					scope = &tracepb.ScopeSpans{Scope: scopeSpans.GetScope(), SchemaUrl: scopeSpans.GetSchemaUrl()}
+					resource.ScopeSpans = append(resource.ScopeSpans, scope)
+					scopes[part] = scope
+				}
+				scope.Spans = append(scope.Spans, span)
+			}
+		}
+	}
+	return routed, nil
+}
+
+// partitionForLocked finds the partition covering ts, registering a new one
+// aligned to the interval when none does. Existing files win over the
+// current interval so changing it does not split their range. It returns nil
+// for partitions that ended at or before cutoff.
+func (p *PartitionedSink) partitionForLocked(ts, cutoff int64) *partition {
+	for i := len(p.partitions) - 1; i >= 0; i-- {
+		if part := p.partitions[i]; part.start <= ts && ts < part.end {
+			if part.end <= cutoff {
+				return nil
+			}
+			return part
+		}
+	}
+	start := time.Unix(0, ts).UTC().Truncate(p.interval)
+	part := &partition{start: start.UnixNano(), end: start.Add(p.interval).UnixNano()}
+	if part.end <= cutoff {
+		return nil
+	}
+	part.path = filepath.Join(p.dir, partitionName(part.start, part.end))
+	i := sort.Search(len(p.partitions), func(i int) bool {
+		return p.partitions[i].start > part.start
+	})
+	p.partitions = append(p.partitions, nil)
+	copy(p.partitions[i+1:], p.partitions[i:])
+	p.partitions[i] = part
+	return part
+}
+
+// overlapping returns the partitions that may hold spans starting in
+// [start, end], newest first. A non-positive end is unbounded.
+func (p *PartitionedSink) overlapping(start, end int64) []*partition {
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var result []*partition
+	for i := len(p.partitions) - 1; i >= 0; i-- {
+		if part := p.partitions[i]; part.overlaps(start, end) {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+func (p *PartitionedSink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]spanstore.Span, error) {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	params.Text = strings.TrimSpace(params.Text)
+	var spans []spanstore.Span
+	for _, part := range p.overlapping(params.Start, params.End) {
+		// Without text, results are newest first, so once the limit is met
+		// older partitions cannot contribute.
+		if params.Text == "" && len(spans) >= params.Limit && spans[params.Limit-1].StartTimeUnixNano >= part.end {
+			continue
+		}
+		err := part.use(func(sink *Sink) error {
+			found, err := sink.QuerySpans(ctx, params)
+			spans = append(spans, found...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		sortSpans(spans, params.Text != "")
+	}
+	if len(spans) > params.Limit {
+		spans = spans[:params.Limit]
+	}
+	return spans, nil
+}
+
+func sortSpans(spans []spanstore.Span, byScore bool) {
+	sort.SliceStable(spans, func(i, j int) bool {
+		if byScore {
+			if left, right := matchScore(spans[i].Match), matchScore(spans[j].Match); left != right {
+				return left > right
+			}
+		}
+		return spans[i].StartTimeUnixNano > spans[j].StartTimeUnixNano
+	})
+}
+
+func matchScore(match *spanstore.TextMatch) float64 {
+	if match == nil {
+		return 0
+	}
+	return match.Score
+}
+
+// QueryTraces finds candidate traces in the partitions overlapping the
+// window, each limited and ordered by its own spans, then summarizes the best
+// candidates from the partitions within the trace spread of them, so
+// duration bounds, order, and limit see whole traces.
+func (p *PartitionedSink) QueryTraces(ctx context.Context, params spanstore.TraceQueryParams) ([]spanstore.TraceSummary, error) {
+	params = normalizeTraceParams(params)
+	spread := p.spread.Nanoseconds()
+	candidates := map[string]spanstore.TraceSummary{}
+	for _, part := range p.overlapping(params.Start, params.End) {
+		bounds := fragmentBounds{from: part.start + spread, to: part.end - spread}
+		err := part.use(func(sink *Sink) error {
+			found, err := sink.traceCandidates(ctx, params, bounds)
+			for _, summary := range found {
+				if existing, ok := candidates[summary.TraceID]; ok {
+					match := existing.Match
+					if matchScore(summary.Match) > matchScore(match) {
+						match = summary.Match
+					}
+					summary = mergeTraceSummaries(existing, summary)
+					summary.Match = match
+				}
+				candidates[summary.TraceID] = summary
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	best := make([]spanstore.TraceSummary, 0, len(candidates))
+	for _, summary := range candidates {
+		best = append(best, summary)
+	}
+	sortTraceSummaries(best, params.Order)
+	if len(best) > params.Limit*traceOverfetch {
+		best = best[:params.Limit*traceOverfetch]
+	}
+	traceIDs := make([]string, len(best))
+	first, last := best[0].StartTimeUnixNano, best[0].EndTimeUnixNano
+	for i, summary := range best {
+		traceIDs[i] = summary.TraceID
+		first = min(first, summary.StartTimeUnixNano)
+		last = max(last, summary.EndTimeUnixNano)
+	}
+
+	// A trace's spans may also sit in partitions outside the window.
+	merged := map[string]spanstore.TraceSummary{}
+	for _, part := range p.overlapping(first-spread, last+spread) {
+		err := part.use(func(sink *Sink) error {
+			found, err := sink.summarizeTraces(ctx, traceIDs)
+			for _, summary := range found {
+				if existing, ok := merged[summary.TraceID]; ok {
+					summary = mergeTraceSummaries(existing, summary)
+				}
+				merged[summary.TraceID] = summary
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	summaries := make([]spanstore.TraceSummary, 0, len(merged))
+	for traceID, summary := range merged {
+		if params.MinDuration > 0 && summary.DurationUnixNano < params.MinDuration {
+			continue
+		}
+		if params.MaxDuration > 0 && summary.DurationUnixNano > params.MaxDuration {
+			continue
+		}
+		if params.Service != "" {
+			summary.ServiceName = params.Service
+		}
+		summary.Match = candidates[traceID].Match
+		summaries = append(summaries, summary)
+	}
+	sortTraceSummaries(summaries, params.Order)
+	if len(summaries) > params.Limit {
+		summaries = summaries[:params.Limit]
+	}
+	return summaries, nil
+}
+
+// mergeTraceSummaries combines the parts of one trace found in different
+// partitions. The root span, when either part has it, names the trace;
+// otherwise the lowest service name does, as in a single database.
+func mergeTraceSummaries(a, b spanstore.TraceSummary) spanstore.TraceSummary {
+	if a.RootName == "" && (b.RootName != "" || b.ServiceName < a.ServiceName) {
+		a.RootName = b.RootName
+		a.ServiceName = b.ServiceName
+	}
+	if b.StartTimeUnixNano < a.StartTimeUnixNano {
+		a.StartTimeUnixNano = b.StartTimeUnixNano
+	}
+	if b.EndTimeUnixNano > a.EndTimeUnixNano {
+		a.EndTimeUnixNano = b.EndTimeUnixNano
+	}
+	a.DurationUnixNano = a.EndTimeUnixNano - a.StartTimeUnixNano
+	a.SpanCount += b.SpanCount
+	a.ErrorCount += b.ErrorCount
+	return a
+}
+
+// sortTraceSummaries mirrors traceSummaryOrderClause.
+func sortTraceSummaries(summaries []spanstore.TraceSummary, order spanstore.TraceOrder) {
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		switch order {
+		case spanstore.TraceOrderStartAsc:
+			if a.StartTimeUnixNano != b.StartTimeUnixNano {
+				return a.StartTimeUnixNano < b.StartTimeUnixNano
+			}
+			return a.TraceID > b.TraceID
+		case spanstore.TraceOrderDurationDesc:
+			if a.DurationUnixNano != b.DurationUnixNano {
+				return a.DurationUnixNano > b.DurationUnixNano
+			}
+		case spanstore.TraceOrderDurationAsc:
+			if a.DurationUnixNano != b.DurationUnixNano {
+				return a.DurationUnixNano < b.DurationUnixNano
+			}
+		case spanstore.TraceOrderRelevance:
+			if left, right := matchScore(a.Match), matchScore(b.Match); left != right {
+				return left > right
+			}
+		}
+		if a.StartTimeUnixNano != b.StartTimeUnixNano {
+			return a.StartTimeUnixNano > b.StartTimeUnixNano
+		}
+		return a.TraceID > b.TraceID
+	})
+}
+
+// searchTrace runs fn on the partitions that may hold one trace, newest
+// first. A trace ID carries no time, so partitions are searched until one
+// holds the trace, and from then on only those within the trace spread of
+// its earliest span; a missing trace reads every partition. fn returns the
+// earliest span start it found, or zero.
+func (p *PartitionedSink) searchTrace(fn func(*Sink) (int64, error)) error {
+	var earliest int64
+	for _, part := range p.overlapping(0, 0) {
+		if earliest > 0 && part.end <= earliest-p.spread.Nanoseconds() {
+			continue
+		}
+		err := part.use(func(sink *Sink) error {
+			start, err := fn(sink)
+			if start > 0 && (earliest == 0 || start < earliest) {
+				earliest = start
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PartitionedSink) QueryTraceSpans(ctx context.Context, params spanstore.TraceSpansQueryParams) ([]spanstore.Span, error) {
+	if strings.TrimSpace(params.TraceID) == "" {
+		return nil, fmt.Errorf("trace_id is required")
+	}
+	var spans []spanstore.Span
+	err := p.searchTrace(func(sink *Sink) (int64, error) {
+		found, err := sink.QueryTraceSpans(ctx, params)
+		spans = append(spans, found...)
+		var earliest int64
+		for _, span := range found {
+			if earliest == 0 || span.StartTimeUnixNano < earliest {
+				earliest = span.StartTimeUnixNano
+			}
+		}
+		return earliest, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].StartTimeUnixNano < spans[j].StartTimeUnixNano
+	})
+	return spans, nil
+}
+
+// QueryTraceOTLP returns the trace's spans grouped by partition, oldest
+// first.
+func (p *PartitionedSink) QueryTraceOTLP(ctx context.Context, params spanstore.TraceSpansQueryParams) (*coltracepb.ExportTraceServiceRequest, error) {
+	if strings.TrimSpace(params.TraceID) == "" {
+		return nil, fmt.Errorf("trace_id is required")
+	}
+	var parts [][]*tracepb.ResourceSpans
+	err := p.searchTrace(func(sink *Sink) (int64, error) {
+		found, err := sink.QueryTraceOTLP(ctx, params)
+		if len(found.GetResourceSpans()) > 0 {
+			parts = append(parts, found.GetResourceSpans())
+		}
+		return earliestSpanStart(found), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &coltracepb.ExportTraceServiceRequest{}
+	for i := len(parts) - 1; i >= 0; i-- {
+		result.ResourceSpans = append(result.ResourceSpans, parts[i]...)
+	}
+	return result, nil
+}
+
+func earliestSpanStart(req *coltracepb.ExportTraceServiceRequest) int64 {
+	var earliest int64
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			for _, span := range scopeSpans.GetSpans() {
+				if start := int64(span.GetStartTimeUnixNano()); earliest == 0 || start < earliest {
+					earliest = start
+				}
+			}
+		}
+	}
+	return earliest
+}
+
+// ExportSpans pages through the partitions oldest first. Partitions only
+// overlap when the interval changed between runs, so a page merges every
+// partition that may hold spans before its last one.
+func (p *PartitionedSink) ExportSpans(ctx context.Context, params spanstore.ExportParams) (spanstore.ExportPage, error) {
+	if params.Limit <= 0 {
+		params.Limit = defaultExportLimit
+	}
+	from := params.Start
+	if params.After != nil && params.After.StartTimeUnixNano > from {
+		from = params.After.StartTimeUnixNano
+	}
+	partitions := p.overlapping(from, params.End)
+	var entries []exportEntry
+	for i := len(partitions) - 1; i >= 0; i-- {
+		part := partitions[i]
+		if len(entries) == params.Limit && part.start > entries[len(entries)-1].cursor.StartTimeUnixNano {
+			break
+		}
+		err := part.use(func(sink *Sink) error {
+			page, err := sink.ExportSpans(ctx, params)
+			entries = appendExportEntries(entries, page.Request)
+			return err
+		})
+		if err != nil {
+			return spanstore.ExportPage{}, err
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].cursor.Before(entries[j].cursor)
+		})
+		if len(entries) > params.Limit {
+			entries = entries[:params.Limit]
+		}
+	}
+	return mergeExportPage(entries), nil
+}
+
+// exportEntry is one exported span with the resource and scope groups it
+// was exported under.
+type exportEntry struct {
+	resource *tracepb.ResourceSpans
+	scope    *tracepb.ScopeSpans
+	span     *tracepb.Span
+	cursor   spanstore.ExportCursor
+}
+
+func appendExportEntries(entries []exportEntry, req *coltracepb.ExportTraceServiceRequest) []exportEntry {
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			for _, span := range scopeSpans.GetSpans() {
+				entries = append(entries, exportEntry{
+					resource: resourceSpans,
+					scope:    scopeSpans,
+					span:     span,
+					cursor: spanstore.ExportCursor{
+						StartTimeUnixNano: int64(span.GetStartTimeUnixNano()),
+						TraceID:           ingest.FormatTraceID(span.GetTraceId()),
+						SpanID:            ingest.FormatSpanID(span.GetSpanId()),
+					},
+				})
+			}
+		}
+	}
+	return entries
+}
+
+// mergeExportPage regroups entries under their original resource and scope
+// groups, in entry order.
+func mergeExportPage(entries []exportEntry) spanstore.ExportPage {
+	req := &coltracepb.ExportTraceServiceRequest{}
+	resources := map[*tracepb.ResourceSpans]*tracepb.ResourceSpans{}
+	scopes := map[*tracepb.ScopeSpans]*tracepb.ScopeSpans{}
+	for _, entry := range entries {
+		scope := scopes[entry.scope]
+		if scope == nil {
+			resource := resources[entry.resource]
+			if resource == nil {
+				resource = &tracepb.ResourceSpans{Resource: entry.resource.GetResource(), SchemaUrl: entry.resource.GetSchemaUrl()}
+				req.ResourceSpans = append(req.ResourceSpans, resource)
+				resources[entry.resource] = resource
+			}
+			scope = &tracepb.ScopeSpans{Scope: entry.scope.GetScope(), SchemaUrl: entry.scope.GetSchemaUrl()}
+			resource.ScopeSpans = append(resource.ScopeSpans, scope)
+			scopes[entry.scope] = scope
+		}
+		scope.Spans = append(scope.Spans, entry.span)
+	}
+	page := spanstore.ExportPage{Request: req, Spans: len(entries)}
+	if len(entries) > 0 {
+		next := entries[len(entries)-1].cursor
+		page.Next = &next
+	}
+	return page
+}
+
+func (p *PartitionedSink) QueryTagNames(ctx context.Context, params spanstore.TagQueryParams) ([]string, error) {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	return p.queryTags(params, []string{serviceNameTag}, func(sink *Sink) ([]string, error) {
+		return sink.QueryTagNames(ctx, params)
+	})
+}
+
+func (p *PartitionedSink) QueryTagValues(ctx context.Context, tag string, params spanstore.TagQueryParams) ([]string, error) {
+	if strings.TrimSpace(tag) == "" {
+		return nil, fmt.Errorf("tag is required")
+	}
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	return p.queryTags(params, nil, func(sink *Sink) ([]string, error) {
+		return sink.QueryTagValues(ctx, tag, params)
+	})
+}
+
+// queryTags unions seed and each partition's sorted, limited values and
+// keeps the first Limit overall.
+func (p *PartitionedSink) queryTags(params spanstore.TagQueryParams, seed []string, query func(*Sink) ([]string, error)) ([]string, error) {
+	seen := map[string]bool{}
+	values := append([]string(nil), seed...)
+	for _, value := range seed {
+		seen[value] = true
+	}
+	for _, part := range p.overlapping(params.Start, params.End) {
+		err := part.use(func(sink *Sink) error {
+			found, err := query(sink)
+			for _, value := range found {
+				if !seen[value] {
+					seen[value] = true
+					values = append(values, value)
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(values)
+	if len(values) > params.Limit {
+		values = values[:params.Limit]
+	}
+	return values, nil
+}
@@ -0,0 +1,388 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/spanstore"
+	"smelldeadfish/internal/spanstore/spanstoretest"
+)
+
+func partitionedRequest(spans ...*tracepb.Span) *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource:   &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", "shop")}},
+			ScopeSpans: []*tracepb.ScopeSpans{{Spans: spans}},
+		}},
+	}
+}
+
+func partitionFileNames(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := PartitionFiles(dir)
+	if err != nil {
+		t.Fatalf("partition files: %v", err)
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = filepath.Base(file)
+	}
+	return names
+}
+
+func TestPartitionedSinkRoutesAndMergesQueries(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewPartitionedWithOptions(dir, PartitionOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("new partitioned sink: %v", err)
+	}
+	defer sink.Close()
+
+	base := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) uint64 {
+		return uint64(base.Add(time.Duration(minutes) * time.Minute).UnixNano())
+	}
+	ctx := context.Background()
+	// Trace 1 crosses from the first hour into the second.
+	err = sink.Consume(ctx, partitionedRequest(
+		&tracepb.Span{TraceId: []byte{1}, SpanId: []byte{1}, Name: "checkout", StartTimeUnixNano: at(30), EndTimeUnixNano: at(100)},
+		&tracepb.Span{TraceId: []byte{1}, SpanId: []byte{2}, ParentSpanId: []byte{1}, Name: "charge", StartTimeUnixNano: at(90), EndTimeUnixNano: at(95),
+			Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}},
+		&tracepb.Span{TraceId: []byte{2}, SpanId: []byte{3}, Name: "refund", StartTimeUnixNano: at(150), EndTimeUnixNano: at(151)},
+		&tracepb.Span{TraceId: []byte{3}, SpanId: []byte{4}, Name: "browse", StartTimeUnixNano: at(10), EndTimeUnixNano: at(12)},
+	))
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	want := []string{
+		"spans-20261018T000000Z-20261018T010000Z.sqlite",
+		"spans-20261018T010000Z-20261018T020000Z.sqlite",
+		"spans-20261018T020000Z-20261018T030000Z.sqlite",
+	}
+	if got := partitionFileNames(t, dir); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("expected partitions %v, got %v", want, got)
+	}
+
+	spans, err := sink.QuerySpans(ctx, spanstore.QueryParams{Service: "shop", Start: int64(at(0)), End: int64(at(180)), Limit: 2})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if len(spans) != 2 || spans[0].Name != "refund" || spans[1].Name != "charge" {
+		t.Fatalf("expected newest spans across partitions, got %+v", spans)
+	}
+
+	traces, err := sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: int64(at(0)), End: int64(at(180))})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(traces) != 3 || traces[0].RootName != "refund" || traces[1].RootName != "checkout" || traces[2].RootName != "browse" {
+		t.Fatalf("unexpected trace order: %+v", traces)
+	}
+	if merged := traces[1]; merged.SpanCount != 2 || merged.ErrorCount != 1 || merged.DurationUnixNano != int64(70*time.Minute) {
+		t.Fatalf("expected trace merged across partitions, got %+v", merged)
+	}
+
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: int64(at(0)), End: int64(at(180)), Order: spanstore.TraceOrderDurationDesc, Limit: 2})
+	if err != nil {
+		t.Fatalf("query traces by duration: %v", err)
+	}
+	if len(traces) != 2 || traces[0].RootName != "checkout" || traces[1].RootName != "browse" {
+		t.Fatalf("unexpected duration order: %+v", traces)
+	}
+
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: int64(at(140)), End: int64(at(180))})
+	if err != nil {
+		t.Fatalf("query traces in window: %v", err)
+	}
+	if len(traces) != 1 || traces[0].RootName != "refund" {
+		t.Fatalf("expected only the last partition, got %+v", traces)
+	}
+
+	traceSpans, err := sink.QueryTraceSpans(ctx, spanstore.TraceSpansQueryParams{TraceID: "01"})
+	if err != nil {
+		t.Fatalf("query trace spans: %v", err)
+	}
+	if len(traceSpans) != 2 || traceSpans[0].Name != "checkout" || traceSpans[1].Name != "charge" {
+		t.Fatalf("expected both trace spans in start order, got %+v", traceSpans)
+	}
+
+	req, err := sink.QueryTraceOTLP(ctx, spanstore.TraceSpansQueryParams{TraceID: "01"})
+	if err != nil {
+		t.Fatalf("query trace otlp: %v", err)
+	}
+	count := 0
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			count += len(scopeSpans.GetSpans())
+		}
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 otlp spans, got %d", count)
+	}
+
+	values, err := sink.QueryTagValues(ctx, "service.name", spanstore.TagQueryParams{})
+	if err != nil {
+		t.Fatalf("query tag values: %v", err)
+	}
+	if len(values) != 1 || values[0] != "shop" {
+		t.Fatalf("expected one service across partitions, got %v", values)
+	}
+}
+
+func TestPartitionedSinkSummarizesTracesAcrossPartitions(t *testing.T) {
+	sink, err := NewPartitionedWithOptions(t.TempDir(), PartitionOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("new partitioned sink: %v", err)
+	}
+	defer sink.Close()
+
+	base := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) uint64 {
+		return uint64(base.Add(time.Duration(minutes) * time.Minute).UnixNano())
+	}
+	ctx := context.Background()
+	// Each piece of trace 1 lasts 5 minutes; together they cover 25.
+	err = sink.Consume(ctx, partitionedRequest(
+		&tracepb.Span{TraceId: []byte{1}, SpanId: []byte{1}, Name: "checkout", StartTimeUnixNano: at(50), EndTimeUnixNano: at(55)},
+		&tracepb.Span{TraceId: []byte{1}, SpanId: []byte{2}, ParentSpanId: []byte{1}, Name: "charge", StartTimeUnixNano: at(70), EndTimeUnixNano: at(75),
+			Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}},
+		&tracepb.Span{TraceId: []byte{2}, SpanId: []byte{3}, Name: "browse", StartTimeUnixNano: at(10), EndTimeUnixNano: at(20)},
+	))
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	traces, err := sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: int64(at(0)), End: int64(at(120)), MinDuration: int64(20 * time.Minute)})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].RootName != "checkout" || traces[0].DurationUnixNano != int64(25*time.Minute) {
+		t.Fatalf("expected the crossing trace to meet the minimum duration, got %+v", traces)
+	}
+
+	// Only the second piece matches, but the summary covers the whole trace.
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: int64(at(60)), End: int64(at(120)), HasError: true})
+	if err != nil {
+		t.Fatalf("query error traces: %v", err)
+	}
+	if len(traces) != 1 {
+		t.Fatalf("expected one error trace, got %+v", traces)
+	}
+	if got := traces[0]; got.RootName != "checkout" || got.SpanCount != 2 || got.ErrorCount != 1 || got.StartTimeUnixNano != int64(at(50)) {
+		t.Fatalf("expected a summary of both pieces, got %+v", got)
+	}
+
+	traces, err = sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: int64(at(0)), End: int64(at(120)), Order: spanstore.TraceOrderDurationDesc, Limit: 1})
+	if err != nil {
+		t.Fatalf("query traces by duration: %v", err)
+	}
+	if len(traces) != 1 || traces[0].RootName != "checkout" {
+		t.Fatalf("expected the merged trace to sort first, got %+v", traces)
+	}
+}
+
+func TestPartitionedSinkLeavesDistantPartitionsClosed(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) uint64 {
+		return uint64(base.Add(time.Duration(hours) * time.Hour).UnixNano())
+	}
+	opts := PartitionOptions{Interval: time.Hour, TraceSpread: 30 * time.Minute}
+	sink, err := NewPartitionedWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("new partitioned sink: %v", err)
+	}
+	ctx := context.Background()
+	err = sink.Consume(ctx, partitionedRequest(
+		&tracepb.Span{TraceId: []byte{1}, SpanId: []byte{1}, Name: "old", StartTimeUnixNano: at(0), EndTimeUnixNano: at(0) + 1},
+		&tracepb.Span{TraceId: []byte{2}, SpanId: []byte{2}, Name: "middle", StartTimeUnixNano: at(5), EndTimeUnixNano: at(5) + 1},
+		&tracepb.Span{TraceId: []byte{3}, SpanId: []byte{3}, Name: "recent", StartTimeUnixNano: at(10), EndTimeUnixNano: at(10) + 1},
+	))
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	sink, err = NewPartitionedWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen partitioned sink: %v", err)
+	}
+	defer sink.Close()
+	opened := func() []string {
+		var names []string
+		for _, part := range sink.partitions {
+			if part.sink != nil {
+				names = append(names, filepath.Base(part.path))
+			}
+		}
+		return names
+	}
+
+	traces, err := sink.QueryTraces(ctx, spanstore.TraceQueryParams{Start: int64(at(10)), End: int64(at(11))})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].RootName != "recent" {
+		t.Fatalf("expected the recent trace, got %+v", traces)
+	}
+	if got := opened(); len(got) != 1 {
+		t.Fatalf("expected only the queried partition to be opened, got %v", got)
+	}
+
+	spans, err := sink.QueryTraceSpans(ctx, spanstore.TraceSpansQueryParams{TraceID: ingest.FormatTraceID([]byte{2})})
+	if err != nil {
+		t.Fatalf("query trace spans: %v", err)
+	}
+	if len(spans) != 1 || spans[0].Name != "middle" {
+		t.Fatalf("expected the middle trace's span, got %+v", spans)
+	}
+	if got := opened(); len(got) != 2 {
+		t.Fatalf("expected the search to stop before the oldest partition, got %v", got)
+	}
+}
+
+func TestPartitionedSinkDropsExpiredPartitions(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	now := time.Now()
+	old := uint64(now.Add(-5 * 24 * time.Hour).UnixNano())
+	recent := uint64(now.UnixNano())
+
+	sink, err := NewPartitioned(dir)
+	if err != nil {
+		t.Fatalf("new partitioned sink: %v", err)
+	}
+	err = sink.Consume(ctx, partitionedRequest(
+		&tracepb.Span{TraceId: []byte{1}, SpanId: []byte{1}, Name: "old", StartTimeUnixNano: old, EndTimeUnixNano: old + 1},
+		&tracepb.Span{TraceId: []byte{2}, SpanId: []byte{2}, Name: "recent", StartTimeUnixNano: recent, EndTimeUnixNano: recent + 1},
+	))
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := partitionFileNames(t, dir); len(got) != 2 {
+		t.Fatalf("expected 2 partitions, got %v", got)
+	}
+
+	sink, err = NewPartitionedWithOptions(dir, PartitionOptions{Retention: 48 * time.Hour})
+	if err != nil {
+		t.Fatalf("reopen with retention: %v", err)
+	}
+	defer sink.Close()
+	kept := partitionFileNames(t, dir)
+	if len(kept) != 1 {
+		t.Fatalf("expected the old partition to be dropped, got %v", kept)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), kept[0]) {
+			t.Fatalf("expected files of the old partition removed, found %s", entry.Name())
+		}
+	}
+
+	err = sink.Consume(ctx, partitionedRequest(
+		&tracepb.Span{TraceId: []byte{3}, SpanId: []byte{3}, Name: "late", StartTimeUnixNano: old, EndTimeUnixNano: old + 1},
+	))
+	if err != nil {
+		t.Fatalf("consume expired span: %v", err)
+	}
+	if got := partitionFileNames(t, dir); len(got) != 1 {
+		t.Fatalf("expected expired spans to be discarded, got %v", got)
+	}
+	spans, err := sink.QuerySpans(ctx, spanstore.QueryParams{Service: "shop", Start: 0, End: int64(recent), Limit: 10})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if len(spans) != 1 || spans[0].Name != "recent" {
+		t.Fatalf("expected only the recent span, got %+v", spans)
+	}
+}
+
+func TestPartitionedSinkConformance(t *testing.T) {
+	spanstoretest.Run(t, func(t *testing.T) spanstoretest.Store {
+		sink, err := NewPartitioned(t.TempDir())
+		if err != nil {
+			t.Fatalf("new partitioned sink: %v", err)
+		}
+		t.Cleanup(func() { sink.Close() })
+		return sink
+	})
+}
+
+func TestPartitionedSinkExportsOverlappingPartitionsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	base := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	span := func(id byte, minutes int) *tracepb.Span {
+		ts := uint64(base.Add(time.Duration(minutes) * time.Minute).UnixNano())
+		return &tracepb.Span{TraceId: []byte{id}, SpanId: []byte{id}, Name: "op", StartTimeUnixNano: ts, EndTimeUnixNano: ts + 1}
+	}
+
+	hourly, err := NewPartitionedWithOptions(dir, PartitionOptions{Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("new hourly sink: %v", err)
+	}
+	if err := hourly.Consume(ctx, partitionedRequest(span(1, 10), span(3, 30))); err != nil {
+		t.Fatalf("consume hourly: %v", err)
+	}
+	if err := hourly.Close(); err != nil {
+		t.Fatalf("close hourly sink: %v", err)
+	}
+	// The daily partition created for 05:00 overlaps the hourly file and
+	// takes later spans from its hour.
+	sink, err := NewPartitioned(dir)
+	if err != nil {
+		t.Fatalf("new daily sink: %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Consume(ctx, partitionedRequest(span(4, 300))); err != nil {
+		t.Fatalf("consume daily: %v", err)
+	}
+	if err := sink.Consume(ctx, partitionedRequest(span(2, 20))); err != nil {
+		t.Fatalf("consume overlap: %v", err)
+	}
+	if got := partitionFileNames(t, dir); len(got) != 2 {
+		t.Fatalf("expected overlapping partitions, got %v", got)
+	}
+
+	var names []string
+	var after *spanstore.ExportCursor
+	for {
+		page, err := sink.ExportSpans(ctx, spanstore.ExportParams{After: after, Limit: 2})
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		if page.Spans == 0 {
+			break
+		}
+		for _, resourceSpans := range page.Request.GetResourceSpans() {
+			for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+				for _, span := range scopeSpans.GetSpans() {
+					names = append(names, fmt.Sprintf("%x", span.GetSpanId()))
+				}
+			}
+		}
+		after = page.Next
+	}
+	if got := strings.Join(names, ","); got != "01,02,03,04" {
+		t.Fatalf("expected spans in start order across partitions, got %s", got)
+	}
+}
@@ -0,0 +1,63 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/migrate"
+)
+
+var errReadOnly = errors.New("sqlite sink is read-only")
+
+// OpenReadOnly opens an existing database for queries only. It never
+// creates, migrates, or writes the file, and reads alongside a process that
+// is still ingesting into it. Consume fails.
+func OpenReadOnly(path string, opts Options) (*Sink, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	dsn, err := readOnlyDSN(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	if err := migrate.RequireCurrent(context.Background(), db, migrations); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("check schema: %w", err)
+	}
+	return &Sink{
+		db:       db,
+		metrics:  ingest.NewWriteMetrics(opts.Metrics, "sqlite"),
+		stmts:    newStmtCache(db),
+		path:     path,
+		readOnly: true,
+	}, nil
+}
+
+// readOnlyDSN builds a mode=ro URI with query_only set on every connection.
+func readOnlyDSN(path string) (string, error) {
+	if path == "" || path == ":memory:" || strings.HasPrefix(path, "file:") {
+		return "", fmt.Errorf("read-only sqlite needs a plain database file path, got %q", path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("resolve database path: %w", err)
+	}
+	location := url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+	query := url.Values{}
+	query.Set("mode", "ro")
+	query.Add("_pragma", "query_only(1)")
+	query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", defaultBusyTimeout.Milliseconds()))
+	location.RawQuery = query.Encode()
+	return location.String(), nil
+}
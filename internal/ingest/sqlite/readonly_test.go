@@ -0,0 +1,119 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"smelldeadfish/internal/migrate"
+	"smelldeadfish/internal/spanstore"
+)
+
+func countSpans(t *testing.T, sink *Sink) int {
+	t.Helper()
+	spans, err := sink.QuerySpans(context.Background(), spanstore.QueryParams{Service: "bench-service", Start: 0, End: 1 << 62, Limit: 1000})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	return len(spans)
+}
+
+func TestOpenReadOnlyReadsAlongsideWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.sqlite")
+	writer, err := New(path)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	defer writer.Close()
+	ctx := context.Background()
+	if err := writer.Consume(ctx, benchmarkRequest(1, 3)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	reader, err := OpenReadOnly(path, Options{})
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	defer reader.Close()
+	if got := countSpans(t, reader); got != 3 {
+		t.Fatalf("expected 3 spans, got %d", got)
+	}
+	if err := writer.Consume(ctx, benchmarkRequest(2, 2)); err != nil {
+		t.Fatalf("consume while reader is open: %v", err)
+	}
+	if got := countSpans(t, reader); got != 5 {
+		t.Fatalf("expected reader to see 5 spans, got %d", got)
+	}
+
+	if err := reader.Consume(ctx, benchmarkRequest(3, 1)); err == nil {
+		t.Fatal("expected consume on read-only sink to fail")
+	}
+	if _, err := reader.DB().ExecContext(ctx, "DELETE FROM spans"); err == nil {
+		t.Fatal("expected delete on read-only handle to fail")
+	}
+	if err := reader.Ping(ctx); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+}
+
+func TestOpenReadOnlyReadsCopiedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "spans.sqlite")
+	writer, err := New(path)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	if err := writer.Consume(context.Background(), benchmarkRequest(1, 4)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	copied := filepath.Join(t.TempDir(), "ci.sqlite")
+	if err := os.WriteFile(copied, data, 0o444); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+
+	reader, err := OpenReadOnly(copied, Options{})
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	defer reader.Close()
+	if got := countSpans(t, reader); got != 4 {
+		t.Fatalf("expected 4 spans, got %d", got)
+	}
+	result, err := reader.QuerySQL(context.Background(), spanstore.SQLQuery{Query: "SELECT COUNT(*) FROM spans"})
+	if err != nil || result.Rows[0][0] != int64(4) {
+		t.Fatalf("unexpected sql result %+v: %v", result, err)
+	}
+}
+
+func TestOpenReadOnlyRejectsMissingAndOutdatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := OpenReadOnly(filepath.Join(dir, "missing.sqlite"), Options{}); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.sqlite")); !os.IsNotExist(err) {
+		t.Fatalf("expected missing file not to be created, got %v", err)
+	}
+
+	path := filepath.Join(dir, "old.sqlite")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := migrate.Apply(context.Background(), db, migrations[:2]); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	_ = db.Close()
+	if _, err := OpenReadOnly(path, Options{}); !errors.Is(err, migrate.ErrOlderSchema) {
+		t.Fatalf("expected ErrOlderSchema, got %v", err)
+	}
+}
@@ -1,10 +1,14 @@
 package sqlite
 
-const schema = `
+// pragmas are connection and file settings applied on every open; they are
+// not versioned and journal_mode cannot change inside a transaction.
+const pragmas = `
 PRAGMA foreign_keys = ON;
 PRAGMA journal_mode = WAL;
 PRAGMA synchronous = NORMAL;
+`
 
+const initialSchema = `
 CREATE TABLE IF NOT EXISTS resources (
   id TEXT PRIMARY KEY,
   schema_url TEXT
@@ -110,3 +114,89 @@ CREATE TABLE IF NOT EXISTS span_link_attributes (
 );
 CREATE INDEX IF NOT EXISTS span_link_attributes_link_idx ON span_link_attributes(link_id);
 `
+
+// typedAttributeColumns keeps int, double and bool attributes in native
+// columns next to their string form so they can be compared numerically.
+// NaN and infinities stay NULL; readers fall back to the string form.
+const typedAttributeColumns = `
+ALTER TABLE resource_attributes ADD COLUMN int_value INTEGER;
+ALTER TABLE resource_attributes ADD COLUMN double_value REAL;
+ALTER TABLE resource_attributes ADD COLUMN bool_value INTEGER;
+ALTER TABLE scope_attributes ADD COLUMN int_value INTEGER;
+ALTER TABLE scope_attributes ADD COLUMN double_value REAL;
+ALTER TABLE scope_attributes ADD COLUMN bool_value INTEGER;
+ALTER TABLE span_attributes ADD COLUMN int_value INTEGER;
+ALTER TABLE span_attributes ADD COLUMN double_value REAL;
+ALTER TABLE span_attributes ADD COLUMN bool_value INTEGER;
+ALTER TABLE span_event_attributes ADD COLUMN int_value INTEGER;
+ALTER TABLE span_event_attributes ADD COLUMN double_value REAL;
+ALTER TABLE span_event_attributes ADD COLUMN bool_value INTEGER;
+ALTER TABLE span_link_attributes ADD COLUMN int_value INTEGER;
+ALTER TABLE span_link_attributes ADD COLUMN double_value REAL;
+ALTER TABLE span_link_attributes ADD COLUMN bool_value INTEGER;
+
+UPDATE resource_attributes SET int_value = CAST(value AS INTEGER) WHERE type = 'int';
+UPDATE resource_attributes SET double_value = CAST(value AS REAL) WHERE type = 'double' AND value NOT IN ('NaN', '+Inf', '-Inf');
+UPDATE resource_attributes SET bool_value = (value = 'true') WHERE type = 'bool';
+UPDATE scope_attributes SET int_value = CAST(value AS INTEGER) WHERE type = 'int';
+UPDATE scope_attributes SET double_value = CAST(value AS REAL) WHERE type = 'double' AND value NOT IN ('NaN', '+Inf', '-Inf');
+UPDATE scope_attributes SET bool_value = (value = 'true') WHERE type = 'bool';
+UPDATE span_attributes SET int_value = CAST(value AS INTEGER) WHERE type = 'int';
+UPDATE span_attributes SET double_value = CAST(value AS REAL) WHERE type = 'double' AND value NOT IN ('NaN', '+Inf', '-Inf');
+UPDATE span_attributes SET bool_value = (value = 'true') WHERE type = 'bool';
+UPDATE span_event_attributes SET int_value = CAST(value AS INTEGER) WHERE type = 'int';
+UPDATE span_event_attributes SET double_value = CAST(value AS REAL) WHERE type = 'double' AND value NOT IN ('NaN', '+Inf', '-Inf');
+UPDATE span_event_attributes SET bool_value = (value = 'true') WHERE type = 'bool';
+UPDATE span_link_attributes SET int_value = CAST(value AS INTEGER) WHERE type = 'int';
+UPDATE span_link_attributes SET double_value = CAST(value AS REAL) WHERE type = 'double' AND value NOT IN ('NaN', '+Inf', '-Inf');
+UPDATE span_link_attributes SET bool_value = (value = 'true') WHERE type = 'bool';
+`
+
+// spanSearchSchema indexes the text a span can be found by for free-text
+// search and fills it from the spans already stored. Values in attributes and
+// events are joined with ingest.SearchSeparator.
+const spanSearchSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS span_search USING fts5(
+  name,
+  status_message,
+  attributes,
+  events,
+  span_id UNINDEXED
+);
+
+INSERT INTO span_search (name, status_message, attributes, events, span_id)
+SELECT s.name, s.status_message,
+  COALESCE((SELECT group_concat(a.value, ' | ') FROM span_attributes a WHERE a.span_id = s.id AND a.type = 'string'), ''),
+  COALESCE((SELECT group_concat(e.name, ' | ') FROM span_events e WHERE e.span_id = s.id), ''),
+  s.id
+FROM spans s;
+`
+
+// spanSearchExactDiacritics rebuilds the full-text index without folding
+// diacritics, so it finds the same spans as ingest.MatchText: "cafe" no
+// longer matches "café".
+const spanSearchExactDiacritics = `
+DROP TABLE span_search;
+
+CREATE VIRTUAL TABLE span_search USING fts5(
+  name,
+  status_message,
+  attributes,
+  events,
+  span_id UNINDEXED,
+  tokenize = 'unicode61 remove_diacritics 0'
+);
+
+INSERT INTO span_search (name, status_message, attributes, events, span_id)
+SELECT s.name, s.status_message,
+  COALESCE((SELECT group_concat(a.value, ' | ') FROM span_attributes a WHERE a.span_id = s.id AND a.type = 'string'), ''),
+  COALESCE((SELECT group_concat(e.name, ' | ') FROM span_events e WHERE e.span_id = s.id), ''),
+  s.id
+FROM spans s;
+`
+
+// exportOrderIndex lets ExportSpans page in export order without sorting the
+// whole table for every page.
+const exportOrderIndex = `
+CREATE INDEX IF NOT EXISTS spans_export_order_idx ON spans(start_time_unix_nano, trace_id, span_id);
+`
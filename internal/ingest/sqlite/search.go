@@ -0,0 +1,117 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"strings"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/spanstore"
+)
+
+// searchMatchColumns renders a span_search row as a TextMatch: a score where
+// higher is better, full highlights of the short fields, and snippets of the
+// long ones. Hits are marked with control characters that markHighlights
+// turns into HTML once the text is escaped.
+var searchMatchColumns = fmt.Sprintf("%s AS score, highlight(span_search, 0, '%[2]s', '%[3]s'), highlight(span_search, 1, '%[2]s', '%[3]s'), snippet(span_search, 2, '%[2]s', '%[3]s', '…', 16), snippet(span_search, 3, '%[2]s', '%[3]s', '…', 16)",
+	"-"+searchRank, matchStart, matchEnd)
+
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+var highlightMarkers = strings.NewReplacer(matchStart, ingest.HighlightStart, matchEnd, ingest.HighlightEnd)
+
+// markHighlights HTML-escapes a highlighted field and replaces the match
+// markers with ingest.HighlightStart and ingest.HighlightEnd.
+func markHighlights(field string) string {
+	return highlightMarkers.Replace(html.EscapeString(field))
+}
+
+// searchRank is bm25 with the shared field weights; lower is better.
+var searchRank = fmt.Sprintf("bm25(span_search, %g, %g, %g, %g)", ingest.SearchWeights[0], ingest.SearchWeights[1], ingest.SearchWeights[2], ingest.SearchWeights[3])
+
+// ftsQuery turns free text into an FTS5 query that requires every term,
+// each as a quoted phrase whose last token may be a prefix, the matching
+// ingest.MatchText mirrors.
+func ftsQuery(text string) string {
+	terms := ingest.SearchTerms(text)
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		parts = append(parts, `"`+strings.ReplaceAll(term, `"`, `""`)+`"*`)
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// writeSearchJoin restricts a spans query to rows matching text and exposes
+// their rank as m.search_rank. LIMIT -1 keeps SQLite from flattening the
+// subquery into an aggregate, where bm25 cannot be evaluated.
+func writeSearchJoin(builder *strings.Builder, args []interface{}, text string) []interface{} {
+	builder.WriteString("\nJOIN (SELECT span_id AS span_row_id, " + searchRank + " AS search_rank FROM span_search WHERE span_search MATCH ? LIMIT -1) m ON m.span_row_id = spans.id")
+	return append(args, ftsQuery(text))
+}
+
+func (s *Sink) loadTextMatches(ctx context.Context, conn *sql.Conn, text string, spanIDs []string) (map[string]*spanstore.TextMatch, error) {
+	result := make(map[string]*spanstore.TextMatch, len(spanIDs))
+	for _, batch := range chunkIDs(spanIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT span_id, '', "+searchMatchColumns+" FROM span_search WHERE span_search MATCH ? AND span_id IN ", batch)
+		args = append([]interface{}{ftsQuery(text)}, args...)
+		err := scanTextMatches(ctx, conn, query, args, func(spanRowID, _ string, match *spanstore.TextMatch) {
+			result[spanRowID] = match
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// loadTraceTextMatches returns the best-matching span of each trace.
+func (s *Sink) loadTraceTextMatches(ctx context.Context, conn *sql.Conn, text string, traceIDs []string) (map[string]*spanstore.TextMatch, error) {
+	result := make(map[string]*spanstore.TextMatch, len(traceIDs))
+	for _, batch := range chunkIDs(traceIDs, maxBatchSize) {
+		query, args := buildInQuery("SELECT spans.trace_id, spans.span_id, "+searchMatchColumns+" FROM span_search JOIN spans ON spans.id = span_search.span_id WHERE span_search MATCH ? AND spans.trace_id IN ", batch)
+		args = append([]interface{}{ftsQuery(text)}, args...)
+		err := scanTextMatches(ctx, conn, query+" ORDER BY score DESC", args, func(traceID, spanID string, match *spanstore.TextMatch) {
+			if _, ok := result[traceID]; !ok {
+				match.SpanID = spanID
+				result[traceID] = match
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// scanTextMatches reads rows of (id, span_id, searchMatchColumns); span_id is
+// empty for span matches.
+func scanTextMatches(ctx context.Context, conn *sql.Conn, query string, args []interface{}, add func(id, spanID string, match *spanstore.TextMatch)) error {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("load text matches: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, spanID string
+		var fields [4]string
+		match := &spanstore.TextMatch{Highlights: map[string]string{}}
+		if err := rows.Scan(&id, &spanID, &match.Score, &fields[0], &fields[1], &fields[2], &fields[3]); err != nil {
+			return fmt.Errorf("scan text match: %w", err)
+		}
+		for i, field := range fields {
+			if strings.Contains(field, matchStart) {
+				match.Highlights[ingest.SearchFields[i]] = markHighlights(field)
+			}
+		}
+		add(id, spanID, match)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate text matches: %w", err)
+	}
+	return nil
+}
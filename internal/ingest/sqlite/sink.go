@@ -3,7 +3,6 @@ package sqlite
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
@@ -12,14 +11,14 @@ import (
 	"time"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
-	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
-	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
-	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
 
 	"github.com/google/uuid"
 	sqlitedriver "modernc.org/sqlite"
 	sqlite3 "modernc.org/sqlite/lib"
 	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/migrate"
+	"smelldeadfish/internal/otlpconv"
 	"smelldeadfish/internal/spanstore"
 )
 
@@ -39,20 +38,37 @@ const (
 	maxBatchSize        = 200
 )
 
+type Options struct {
+	Metrics *metrics.Registry
+}
+
 type Sink struct {
-	db *sql.DB
+	db       *sql.DB
+	metrics  ingest.WriteMetrics
+	stmts    *stmtCache
+	path     string
+	readOnly bool
+	console  readOnlyDB
 }
 
 func New(path string) (*Sink, error) {
+	return NewWithOptions(path, Options{})
+}
+
+func NewWithOptions(path string, opts Options) (*Sink, error) {
 	db, err := sql.Open("sqlite", path)
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
 	}
-	if _, err := db.Exec(schema); err != nil {
+	if _, err := db.Exec(pragmas); err != nil {
 		_ = db.Close()
 		return nil, fmt.Errorf("init schema: %w", err)
 	}
-	return &Sink{db: db}, nil
+	if _, err := migrate.Apply(context.Background(), db, migrations); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate schema: %w", err)
+	}
+	return &Sink{db: db, metrics: ingest.NewWriteMetrics(opts.Metrics, "sqlite"), stmts: newStmtCache(db), path: path}, nil
 }
 
 func (s *Sink) withConn(ctx context.Context, fn func(*sql.Conn) error) error {
@@ -126,7 +142,21 @@ func (s *Sink) Close() error {
 	if s == nil || s.db == nil {
 		return nil
 	}
-	return s.db.Close()
+	s.stmts.Close()
+	return errors.Join(s.console.Close(), s.db.Close())
+}
+
+// Ping runs a trivial read against the spans table so a locked or missing
+// database is reported rather than just an open handle.
+func (s *Sink) Ping(ctx context.Context) error {
+	return s.withConn(ctx, func(conn *sql.Conn) error {
+		var one int
+		err := conn.QueryRowContext(ctx, "SELECT 1 FROM spans LIMIT 1").Scan(&one)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("ping: %w", err)
+		}
+		return nil
+	})
 }
 
 func (s *Sink) DB() *sql.DB {
@@ -140,7 +170,11 @@ func (s *Sink) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRe
 	if s == nil || s.db == nil || req == nil {
 		return nil
 	}
-	return withRetry(ctx, defaultRetryTimeout, func(ctx context.Context) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	start := time.Now()
+	err := withRetry(ctx, defaultRetryTimeout, func(ctx context.Context) error {
 		return s.withConn(ctx, func(conn *sql.Conn) error {
 			tx, err := conn.BeginTx(ctx, nil)
 			if err != nil {
@@ -156,34 +190,15 @@ func (s *Sink) Consume(ctx context.Context, req *coltracepb.ExportTraceServiceRe
 			return nil
 		})
 	})
-}
-
-func (s *Sink) consumeTx(ctx context.Context, tx *sql.Tx, req *coltracepb.ExportTraceServiceRequest) error {
-	for _, resourceSpans := range req.GetResourceSpans() {
-		serviceName := ingest.ResourceServiceName(resourceSpans.GetResource())
-		resourceID, err := s.insertResource(ctx, tx, resourceSpans.GetResource(), resourceSpans.GetSchemaUrl())
-		if err != nil {
-			return err
-		}
-		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
-			scopeID, err := s.insertScope(ctx, tx, scopeSpans.GetScope(), scopeSpans.GetSchemaUrl())
-			if err != nil {
-				return err
-			}
-			for _, span := range scopeSpans.GetSpans() {
-				if err := s.insertSpan(ctx, tx, span, serviceName, resourceID, scopeID); err != nil {
-					return err
-				}
-			}
-		}
-	}
-	return nil
+	s.metrics.Observe(req, start, err)
+	return err
 }
 
 func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]spanstore.Span, error) {
 	if params.Limit <= 0 {
 		params.Limit = 100
 	}
+	params.Text = strings.TrimSpace(params.Text)
 	query, args := buildSpanQuery(params)
 	var spans []spanstore.Span
 	err := withRetry(ctx, defaultRetryTimeout, func(ctx context.Context) error {
@@ -252,6 +267,13 @@ func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]
 			if err != nil {
 				return err
 			}
+			var matches map[string]*spanstore.TextMatch
+			if params.Text != "" {
+				matches, err = s.loadTextMatches(ctx, conn, params.Text, spanIDs)
+				if err != nil {
+					return err
+				}
+			}
 			for i, span := range spans {
 				spanID := spanIDs[i]
 				resourceID := resourceIDs[i]
@@ -261,6 +283,7 @@ func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]
 				span.Scope = scopes[scopeID]
 				span.Events = events[spanID]
 				span.Links = links[spanID]
+				span.Match = matches[spanID]
 				spans[i] = span
 			}
 			return nil
@@ -273,45 +296,85 @@ func (s *Sink) QuerySpans(ctx context.Context, params spanstore.QueryParams) ([]
 }
 
 func (s *Sink) QueryTraces(ctx context.Context, params spanstore.TraceQueryParams) ([]spanstore.TraceSummary, error) {
-	if params.Limit <= 0 {
-		params.Limit = 100
-	}
-	if params.Order == "" {
-		params.Order = spanstore.TraceOrderStartDesc
-	}
-	query, args := buildTraceSummaryQuery(params)
+	return s.queryTraces(ctx, normalizeTraceParams(params), nil)
+}
+
+// traceCandidates summarizes the traces matching params within one partition
+// of a partitioned store. A trace whose spans may reach past the partition
+// is summarized from its local spans only, so the query fetches
+// traceOverfetch times the limit and does not hold such traces to the
+// minimum duration.
+func (s *Sink) traceCandidates(ctx context.Context, params spanstore.TraceQueryParams, bounds fragmentBounds) ([]spanstore.TraceSummary, error) {
+	params = normalizeTraceParams(params)
+	params.Limit *= traceOverfetch
+	return s.queryTraces(ctx, params, &bounds)
+}
+
+// fragmentBounds describes the partition a trace query runs in: a trace with
+// a span starting before from, or with one at or after to, may have spans in
+// another partition.
+type fragmentBounds struct {
+	from int64
+	to   int64
+}
+
+func (s *Sink) queryTraces(ctx context.Context, params spanstore.TraceQueryParams, bounds *fragmentBounds) ([]spanstore.TraceSummary, error) {
+	query, args := buildTraceSummaryQuery(params, bounds)
 	var summaries []spanstore.TraceSummary
 	err := withRetry(ctx, defaultRetryTimeout, func(ctx context.Context) error {
 		return s.withConn(ctx, func(conn *sql.Conn) error {
-			summaries = nil
-			rows, err := conn.QueryContext(ctx, query, args...)
+			var err error
+			summaries, err = scanTraceSummaries(ctx, conn, query, args, nil)
 			if err != nil {
-				return fmt.Errorf("query traces: %w", err)
+				return err
 			}
-			defer rows.Close()
+			if params.Text == "" || len(summaries) == 0 {
+				return nil
+			}
+			traceIDs := make([]string, len(summaries))
+			for i, summary := range summaries {
+				traceIDs[i] = summary.TraceID
+			}
+			matches, err := s.loadTraceTextMatches(ctx, conn, params.Text, traceIDs)
+			if err != nil {
+				return err
+			}
+			for i := range summaries {
+				summaries[i].Match = matches[summaries[i].TraceID]
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
 
-			for rows.Next() {
-				var rootName sql.NullString
-				summary := spanstore.TraceSummary{}
-				if err := rows.Scan(
-					&summary.TraceID,
-					&rootName,
-					&summary.StartTimeUnixNano,
-					&summary.EndTimeUnixNano,
-					&summary.DurationUnixNano,
-					&summary.SpanCount,
-					&summary.ErrorCount,
-					&summary.ServiceName,
-				); err != nil {
-					return fmt.Errorf("scan traces: %w", err)
-				}
-				if rootName.Valid {
-					summary.RootName = rootName.String
+// summarizeTraces summarizes every span stored for traceIDs, with no
+// filters.
+func (s *Sink) summarizeTraces(ctx context.Context, traceIDs []string) ([]spanstore.TraceSummary, error) {
+	var summaries []spanstore.TraceSummary
+	err := withRetry(ctx, defaultRetryTimeout, func(ctx context.Context) error {
+		return s.withConn(ctx, func(conn *sql.Conn) error {
+			summaries = nil
+			for _, batch := range chunkIDs(traceIDs, maxBatchSize) {
+				query, args := buildInQuery(`SELECT s.trace_id,
+  (SELECT name FROM spans root WHERE root.trace_id = s.trace_id AND root.parent_span_id = ? ORDER BY root.start_time_unix_nano ASC LIMIT 1) AS root_name,
+  MIN(s.start_time_unix_nano),
+  MAX(s.end_time_unix_nano),
+  MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano),
+  COUNT(*),
+  SUM(CASE WHEN s.status_code = 2 THEN 1 ELSE 0 END),
+  COALESCE((SELECT service_name FROM spans root WHERE root.trace_id = s.trace_id AND root.parent_span_id = ? ORDER BY root.start_time_unix_nano ASC LIMIT 1), MIN(s.service_name))
+FROM spans s
+WHERE s.trace_id IN `, batch)
+				args = append([]interface{}{rootSpanParentID, rootSpanParentID}, args...)
+				found, err := scanTraceSummaries(ctx, conn, query+" GROUP BY s.trace_id", args, summaries)
+				if err != nil {
+					return err
 				}
-				summaries = append(summaries, summary)
-			}
-			if err := rows.Err(); err != nil {
-				return fmt.Errorf("iterate traces: %w", err)
+				summaries = found
 			}
 			return nil
 		})
@@ -322,6 +385,40 @@ func (s *Sink) QueryTraces(ctx context.Context, params spanstore.TraceQueryParam
 	return summaries, nil
 }
 
+// scanTraceSummaries runs a trace summary query and appends its rows to
+// summaries.
+func scanTraceSummaries(ctx context.Context, conn *sql.Conn, query string, args []interface{}, summaries []spanstore.TraceSummary) ([]spanstore.TraceSummary, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query traces: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rootName sql.NullString
+		summary := spanstore.TraceSummary{}
+		if err := rows.Scan(
+			&summary.TraceID,
+			&rootName,
+			&summary.StartTimeUnixNano,
+			&summary.EndTimeUnixNano,
+			&summary.DurationUnixNano,
+			&summary.SpanCount,
+			&summary.ErrorCount,
+			&summary.ServiceName,
+		); err != nil {
+			return nil, fmt.Errorf("scan traces: %w", err)
+		}
+		if rootName.Valid {
+			summary.RootName = rootName.String
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate traces: %w", err)
+	}
+	return summaries, nil
+}
+
 func (s *Sink) QueryTraceSpans(ctx context.Context, params spanstore.TraceSpansQueryParams) ([]spanstore.Span, error) {
 	traceID := strings.TrimSpace(params.TraceID)
 	if traceID == "" {
@@ -416,15 +513,19 @@ func (s *Sink) QueryTraceSpans(ctx context.Context, params spanstore.TraceSpansQ
 }
 
 func buildSpanQuery(params spanstore.QueryParams) (string, []interface{}) {
-	args := []interface{}{params.Service, params.Start, params.End}
+	args := make([]interface{}, 0, 8)
 	builder := strings.Builder{}
 	builder.WriteString(`SELECT id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id
-FROM spans
+FROM spans`)
+	if params.Text != "" {
+		args = writeSearchJoin(&builder, args, params.Text)
+	}
+	builder.WriteString(`
 WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
+	args = append(args, params.Service, params.Start, params.End)
 
 	for _, filter := range params.AttrFilters {
-		builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND sa.value = ?)`)
-		args = append(args, filter.Key, filter.Value)
+		args = writeAttrFilter(&builder, args, filter)
 	}
 
 	if params.StatusCode != nil {
@@ -432,34 +533,44 @@ WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano <=
 		args = append(args, int32(*params.StatusCode))
 	}
 
-	builder.WriteString(` ORDER BY start_time_unix_nano DESC LIMIT ?`)
+	if params.Text != "" {
+		builder.WriteString(` ORDER BY m.search_rank, start_time_unix_nano DESC LIMIT ?`)
+	} else {
+		builder.WriteString(` ORDER BY start_time_unix_nano DESC LIMIT ?`)
+	}
 	args = append(args, params.Limit)
 
 	return builder.String(), args
 }
 
-func buildTraceSummaryQuery(params spanstore.TraceQueryParams) (string, []interface{}) {
-	args := []interface{}{params.Service, params.Start, params.End}
-	builder := strings.Builder{}
-	builder.WriteString(`WITH candidate_traces AS (
-SELECT DISTINCT trace_id
-FROM spans
-WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
-
-	for _, filter := range params.AttrFilters {
-		builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND sa.value = ?)`)
-		args = append(args, filter.Key, filter.Value)
+// writeAttrFilter appends an EXISTS clause for one attribute filter. Numeric
+// operators use the typed columns; a value that is not a number binds NULL
+// and matches nothing.
+func writeAttrFilter(builder *strings.Builder, args []interface{}, filter spanstore.AttrFilter) []interface{} {
+	if filter.Op.Numeric() {
+		var number interface{}
+		if parsed, err := strconv.ParseFloat(filter.Value, 64); err == nil {
+			number = parsed
+		}
+		builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND COALESCE(sa.int_value, sa.double_value) ` + string(filter.Op) + ` ?)`)
+		return append(args, filter.Key, number)
 	}
-
-	if params.StatusCode != nil {
-		builder.WriteString(` AND status_code = ?`)
-		args = append(args, int32(*params.StatusCode))
-	}
-	if params.HasError {
-		builder.WriteString(` AND status_code = 2`)
+	op := "="
+	if filter.Op == spanstore.AttrOpNotEqual {
+		op = "!="
 	}
+	builder.WriteString(` AND EXISTS (SELECT 1 FROM span_attributes sa WHERE sa.span_id = spans.id AND sa.key = ? AND sa.value ` + op + ` ?)`)
+	return append(args, filter.Key, filter.Value)
+}
 
-	builder.WriteString(`)
+// buildTraceSummaryQuery summarizes, orders, and limits the traces matching
+// params. With bounds, traces that may continue in another partition are
+// kept even when their local spans fall short of MinDuration.
+func buildTraceSummaryQuery(params spanstore.TraceQueryParams, bounds *fragmentBounds) (string, []interface{}) {
+	builder := strings.Builder{}
+	args := writeTraceCandidates(&builder, make([]interface{}, 0, 8), params)
+
+	builder.WriteString(`
 SELECT s.trace_id,
   (SELECT name FROM spans root WHERE root.trace_id = s.trace_id AND root.parent_span_id = ? ORDER BY root.start_time_unix_nano ASC LIMIT 1) AS root_name,
   MIN(s.start_time_unix_nano) AS start_time_unix_nano,
@@ -467,20 +578,87 @@ SELECT s.trace_id,
   MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano) AS duration_unix_nano,
   COUNT(*) AS span_count,
   SUM(CASE WHEN s.status_code = 2 THEN 1 ELSE 0 END) AS error_count,
-  ? AS service_name
+`)
+	args = append(args, rootSpanParentID)
+	if params.Service != "" {
+		builder.WriteString(`  ? AS service_name`)
+		args = append(args, params.Service)
+	} else {
+		builder.WriteString(`  COALESCE((SELECT service_name FROM spans root WHERE root.trace_id = s.trace_id AND root.parent_span_id = ? ORDER BY root.start_time_unix_nano ASC LIMIT 1), MIN(s.service_name)) AS service_name`)
+		args = append(args, rootSpanParentID)
+	}
+	builder.WriteString(`
 FROM spans s
 JOIN candidate_traces ct ON ct.trace_id = s.trace_id
 GROUP BY s.trace_id
 `)
 
+	if params.MinDuration > 0 || params.MaxDuration > 0 {
+		builder.WriteString(`HAVING 1 = 1`)
+		if params.MinDuration > 0 && bounds != nil {
+			builder.WriteString(` AND (MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano) >= ? OR MAX(s.start_time_unix_nano) < ? OR MIN(s.start_time_unix_nano) >= ?)`)
+			args = append(args, params.MinDuration, bounds.from, bounds.to)
+		} else if params.MinDuration > 0 {
+			builder.WriteString(` AND MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano) >= ?`)
+			args = append(args, params.MinDuration)
+		}
+		if params.MaxDuration > 0 {
+			builder.WriteString(` AND MAX(s.end_time_unix_nano) - MIN(s.start_time_unix_nano) <= ?`)
+			args = append(args, params.MaxDuration)
+		}
+		builder.WriteString("\n")
+	}
+
 	builder.WriteString(traceSummaryOrderClause(params.Order))
 	builder.WriteString(` LIMIT ?`)
 
-	args = append(args, rootSpanParentID, params.Service, params.Limit)
+	args = append(args, params.Limit)
 
 	return builder.String(), args
 }
 
+// writeTraceCandidates writes the candidate_traces CTE: the traces with a
+// span matching params, with their best search rank for text queries.
+func writeTraceCandidates(builder *strings.Builder, args []interface{}, params spanstore.TraceQueryParams) []interface{} {
+	if params.Text != "" {
+		builder.WriteString(`WITH candidate_traces AS (
+SELECT trace_id, MIN(m.search_rank) AS search_rank
+FROM spans`)
+		args = writeSearchJoin(builder, args, params.Text)
+		builder.WriteString(`
+WHERE `)
+	} else {
+		builder.WriteString(`WITH candidate_traces AS (
+SELECT DISTINCT trace_id
+FROM spans
+WHERE `)
+	}
+	if params.Service != "" {
+		builder.WriteString(`service_name = ? AND `)
+		args = append(args, params.Service)
+	}
+	builder.WriteString(`start_time_unix_nano >= ? AND start_time_unix_nano <= ?`)
+	args = append(args, params.Start, params.End)
+
+	for _, filter := range params.AttrFilters {
+		args = writeAttrFilter(builder, args, filter)
+	}
+
+	if params.StatusCode != nil {
+		builder.WriteString(` AND status_code = ?`)
+		args = append(args, int32(*params.StatusCode))
+	}
+	if params.HasError {
+		builder.WriteString(` AND status_code = 2`)
+	}
+	if params.Text != "" {
+		builder.WriteString(`
+GROUP BY trace_id`)
+	}
+	builder.WriteString(`)`)
+	return args
+}
+
 func traceSummaryOrderClause(order spanstore.TraceOrder) string {
 	switch order {
 	case spanstore.TraceOrderStartAsc:
@@ -489,11 +667,29 @@ func traceSummaryOrderClause(order spanstore.TraceOrder) string {
 		return ` ORDER BY duration_unix_nano DESC, start_time_unix_nano DESC, s.trace_id DESC`
 	case spanstore.TraceOrderDurationAsc:
 		return ` ORDER BY duration_unix_nano ASC, start_time_unix_nano DESC, s.trace_id DESC`
+	case spanstore.TraceOrderRelevance:
+		return ` ORDER BY MIN(ct.search_rank), start_time_unix_nano DESC, s.trace_id DESC`
 	default:
 		return ` ORDER BY start_time_unix_nano DESC, s.trace_id DESC`
 	}
 }
 
+// normalizeTraceParams applies the default limit and order. Text searches
+// default to relevance; relevance without text falls back to newest first.
+func normalizeTraceParams(params spanstore.TraceQueryParams) spanstore.TraceQueryParams {
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	params.Text = strings.TrimSpace(params.Text)
+	if params.Order == "" && params.Text != "" {
+		params.Order = spanstore.TraceOrderRelevance
+	}
+	if params.Order == "" || (params.Order == spanstore.TraceOrderRelevance && params.Text == "") {
+		params.Order = spanstore.TraceOrderStartDesc
+	}
+	return params
+}
+
 func buildTraceSpansQuery(traceID string, service string, status *spanstore.StatusCode) (string, []interface{}) {
 	args := []interface{}{traceID}
 	builder := strings.Builder{}
@@ -512,156 +708,6 @@ WHERE trace_id = ?`)
 	return builder.String(), args
 }
 
-func (s *Sink) insertResource(ctx context.Context, tx *sql.Tx, resource *resourcepb.Resource, schemaURL string) (string, error) {
-	resourceID, err := newUUIDv7()
-	if err != nil {
-		return "", err
-	}
-	_, err = tx.ExecContext(ctx, "INSERT INTO resources (id, schema_url) VALUES (?, ?)", resourceID, schemaURL)
-	if err != nil {
-		return "", fmt.Errorf("insert resource: %w", err)
-	}
-	if err := s.insertAttributes(ctx, tx, "resource_attributes", "resource_id", resourceID, resource.GetAttributes()); err != nil {
-		return "", err
-	}
-	return resourceID, nil
-}
-
-func (s *Sink) insertScope(ctx context.Context, tx *sql.Tx, scope *commonpb.InstrumentationScope, schemaURL string) (string, error) {
-	if scope == nil {
-		scope = &commonpb.InstrumentationScope{}
-	}
-	scopeID, err := newUUIDv7()
-	if err != nil {
-		return "", err
-	}
-	_, err = tx.ExecContext(ctx, "INSERT INTO scopes (id, name, version, schema_url) VALUES (?, ?, ?, ?)", scopeID, scope.GetName(), scope.GetVersion(), schemaURL)
-	if err != nil {
-		return "", fmt.Errorf("insert scope: %w", err)
-	}
-	if err := s.insertAttributes(ctx, tx, "scope_attributes", "scope_id", scopeID, scope.GetAttributes()); err != nil {
-		return "", err
-	}
-	return scopeID, nil
-}
-
-func (s *Sink) insertSpan(ctx context.Context, tx *sql.Tx, span *tracepb.Span, service string, resourceID, scopeID string) error {
-	if span == nil {
-		return nil
-	}
-	traceID := ingest.FormatTraceID(span.GetTraceId())
-	spanID := ingest.FormatSpanID(span.GetSpanId())
-	parentSpanID := ingest.FormatSpanID(span.GetParentSpanId())
-	existingID, err := s.loadSpanRowID(ctx, tx, traceID, spanID)
-	if err != nil {
-		return err
-	}
-	if existingID != "" {
-		return nil
-	}
-	spanRowID, err := newUUIDv7()
-	if err != nil {
-		return err
-	}
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO spans (id, trace_id, span_id, parent_span_id, name, kind, start_time_unix_nano, end_time_unix_nano, status_code, status_message, service_name, flags, resource_id, scope_id)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		spanRowID,
-		traceID,
-		spanID,
-		parentSpanID,
-		span.GetName(),
-		ingest.SpanKind(span.GetKind()),
-		int64(span.GetStartTimeUnixNano()),
-		int64(span.GetEndTimeUnixNano()),
-		int32(span.GetStatus().GetCode()),
-		span.GetStatus().GetMessage(),
-		service,
-		span.GetFlags(),
-		resourceID,
-		scopeID,
-	)
-	if err != nil {
-		return fmt.Errorf("insert span: %w", err)
-	}
-	if err := s.insertAttributes(ctx, tx, "span_attributes", "span_id", spanRowID, span.GetAttributes()); err != nil {
-		return err
-	}
-	if err := s.insertEvents(ctx, tx, spanRowID, span.GetEvents()); err != nil {
-		return err
-	}
-	if err := s.insertLinks(ctx, tx, spanRowID, span.GetLinks()); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *Sink) loadSpanRowID(ctx context.Context, tx *sql.Tx, traceID, spanID string) (string, error) {
-	row := tx.QueryRowContext(ctx, "SELECT id FROM spans WHERE trace_id = ? AND span_id = ?", traceID, spanID)
-	var id string
-	switch err := row.Scan(&id); err {
-	case sql.ErrNoRows:
-		return "", nil
-	case nil:
-		return id, nil
-	default:
-		return "", fmt.Errorf("lookup span: %w", err)
-	}
-}
-
-func (s *Sink) insertEvents(ctx context.Context, tx *sql.Tx, spanID string, events []*tracepb.Span_Event) error {
-	for _, event := range events {
-		eventID, err := newUUIDv7()
-		if err != nil {
-			return err
-		}
-		_, err = tx.ExecContext(
-			ctx,
-			`INSERT INTO span_events (id, span_id, name, time_unix_nano, dropped_attributes_count) VALUES (?, ?, ?, ?, ?)`,
-			eventID,
-			spanID,
-			event.GetName(),
-			int64(event.GetTimeUnixNano()),
-			event.GetDroppedAttributesCount(),
-		)
-		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
-		}
-		if err := s.insertAttributes(ctx, tx, "span_event_attributes", "event_id", eventID, event.GetAttributes()); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (s *Sink) insertLinks(ctx context.Context, tx *sql.Tx, spanID string, links []*tracepb.Span_Link) error {
-	for _, link := range links {
-		linkID, err := newUUIDv7()
-		if err != nil {
-			return err
-		}
-		_, err = tx.ExecContext(
-			ctx,
-			`INSERT INTO span_links (id, span_id, trace_id, linked_span_id, trace_state, dropped_attributes_count, flags) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-			linkID,
-			spanID,
-			ingest.FormatTraceID(link.GetTraceId()),
-			ingest.FormatSpanID(link.GetSpanId()),
-			link.GetTraceState(),
-			link.GetDroppedAttributesCount(),
-			link.GetFlags(),
-		)
-		if err != nil {
-			return fmt.Errorf("insert link: %w", err)
-		}
-		if err := s.insertAttributes(ctx, tx, "span_link_attributes", "link_id", linkID, link.GetAttributes()); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func buildInQuery(prefix string, ids []string) (string, []interface{}) {
 	builder := strings.Builder{}
 	builder.WriteString(prefix)
@@ -717,34 +763,13 @@ func sortLinks(links []spanstore.Link) {
 	})
 }
 
-func (s *Sink) insertAttributes(ctx context.Context, tx *sql.Tx, table, idColumn, id string, attrs []*commonpb.KeyValue) error {
-	for _, attr := range attrs {
-		attrType, attrValue, err := formatAttributeValue(attr.GetValue())
-		if err != nil {
-			return err
-		}
-		_, err = tx.ExecContext(
-			ctx,
-			fmt.Sprintf("INSERT INTO %s (%s, key, type, value) VALUES (?, ?, ?, ?)", table, idColumn),
-			id,
-			attr.GetKey(),
-			attrType,
-			attrValue,
-		)
-		if err != nil {
-			return fmt.Errorf("insert attribute: %w", err)
-		}
-	}
-	return nil
-}
-
 func (s *Sink) loadSpanAttributesBatch(ctx context.Context, conn *sql.Conn, spanIDs []string) (map[string]map[string]interface{}, error) {
 	result := make(map[string]map[string]interface{}, len(spanIDs))
 	if len(spanIDs) == 0 {
 		return result, nil
 	}
 	for _, batch := range chunkIDs(spanIDs, maxBatchSize) {
-		query, args := buildInQuery("SELECT span_id, key, type, value FROM span_attributes WHERE span_id IN ", batch)
+		query, args := buildInQuery("SELECT span_id, key, type, value, int_value, double_value, bool_value FROM span_attributes WHERE span_id IN ", batch)
 		rows, err := conn.QueryContext(ctx, query, args...)
 		if err != nil {
 			return nil, fmt.Errorf("load span attributes: %w", err)
@@ -754,7 +779,8 @@ func (s *Sink) loadSpanAttributesBatch(ctx context.Context, conn *sql.Conn, span
 			var key string
 			var attrType string
 			var value string
-			if err := rows.Scan(&spanID, &key, &attrType, &value); err != nil {
+			var typed typedValues
+			if err := rows.Scan(&spanID, &key, &attrType, &value, &typed.intValue, &typed.doubleValue, &typed.boolValue); err != nil {
 				_ = rows.Close()
 				return nil, fmt.Errorf("scan span attribute: %w", err)
 			}
@@ -763,7 +789,7 @@ func (s *Sink) loadSpanAttributesBatch(ctx context.Context, conn *sql.Conn, span
 				attrs = map[string]interface{}{}
 				result[spanID] = attrs
 			}
-			attrs[key] = parseAttributeValue(attrType, value)
+			attrs[key] = parseAttributeValue(attrType, value, typed)
 		}
 		if err := rows.Err(); err != nil {
 			_ = rows.Close()
@@ -858,7 +884,7 @@ func (s *Sink) loadAttributesBatch(ctx context.Context, conn *sql.Conn, table, i
 		return result, nil
 	}
 	for _, batch := range chunkIDs(ids, maxBatchSize) {
-		query, args := buildInQuery(fmt.Sprintf("SELECT %s, key, type, value FROM %s WHERE %s IN ", idColumn, table, idColumn), batch)
+		query, args := buildInQuery(fmt.Sprintf("SELECT %s, key, type, value, int_value, double_value, bool_value FROM %s WHERE %s IN ", idColumn, table, idColumn), batch)
 		rows, err := conn.QueryContext(ctx, query, args...)
 		if err != nil {
 			return nil, fmt.Errorf("load attributes: %w", err)
@@ -868,7 +894,8 @@ func (s *Sink) loadAttributesBatch(ctx context.Context, conn *sql.Conn, table, i
 			var key string
 			var attrType string
 			var value string
-			if err := rows.Scan(&id, &key, &attrType, &value); err != nil {
+			var typed typedValues
+			if err := rows.Scan(&id, &key, &attrType, &value, &typed.intValue, &typed.doubleValue, &typed.boolValue); err != nil {
 				_ = rows.Close()
 				return nil, fmt.Errorf("scan attributes: %w", err)
 			}
@@ -877,7 +904,7 @@ func (s *Sink) loadAttributesBatch(ctx context.Context, conn *sql.Conn, table, i
 				attrs = map[string]interface{}{}
 				result[id] = attrs
 			}
-			attrs[key] = parseAttributeValue(attrType, value)
+			attrs[key] = parseAttributeValue(attrType, value, typed)
 		}
 		if err := rows.Err(); err != nil {
 			_ = rows.Close()
@@ -988,38 +1015,6 @@ func (s *Sink) loadLinksBatch(ctx context.Context, conn *sql.Conn, spanIDs []str
 	return result, nil
 }
 
-func formatAttributeValue(value *commonpb.AnyValue) (string, string, error) {
-	if value == nil {
-		return attrTypeString, "", nil
-	}
-	switch v := value.Value.(type) {
-	case *commonpb.AnyValue_StringValue:
-		return attrTypeString, v.StringValue, nil
-	case *commonpb.AnyValue_IntValue:
-		return attrTypeInt, fmt.Sprintf("%d", v.IntValue), nil
-	case *commonpb.AnyValue_DoubleValue:
-		return attrTypeDouble, fmt.Sprintf("%g", v.DoubleValue), nil
-	case *commonpb.AnyValue_BoolValue:
-		return attrTypeBool, fmt.Sprintf("%t", v.BoolValue), nil
-	case *commonpb.AnyValue_BytesValue:
-		return attrTypeBytes, fmt.Sprintf("%x", v.BytesValue), nil
-	case *commonpb.AnyValue_ArrayValue:
-		payload, err := json.Marshal(anyValueArray(v.ArrayValue))
-		if err != nil {
-			return "", "", fmt.Errorf("marshal array attribute: %w", err)
-		}
-		return attrTypeArray, string(payload), nil
-	case *commonpb.AnyValue_KvlistValue:
-		payload, err := json.Marshal(keyValueListToMap(v.KvlistValue))
-		if err != nil {
-			return "", "", fmt.Errorf("marshal kvlist attribute: %w", err)
-		}
-		return attrTypeKVList, string(payload), nil
-	default:
-		return attrTypeString, "", nil
-	}
-}
-
 type attributeRows interface {
 	Next() bool
 	Scan(dest ...interface{}) error
@@ -1032,10 +1027,11 @@ func readAttributes(rows attributeRows) (map[string]interface{}, error) {
 		var key string
 		var attrType string
 		var value string
-		if err := rows.Scan(&key, &attrType, &value); err != nil {
+		var typed typedValues
+		if err := rows.Scan(&key, &attrType, &value, &typed.intValue, &typed.doubleValue, &typed.boolValue); err != nil {
 			return nil, fmt.Errorf("scan attribute: %w", err)
 		}
-		attrs[key] = parseAttributeValue(attrType, value)
+		attrs[key] = parseAttributeValue(attrType, value, typed)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("iterate attributes: %w", err)
@@ -1043,21 +1039,37 @@ func readAttributes(rows attributeRows) (map[string]interface{}, error) {
 	return attrs, nil
 }
 
-func parseAttributeValue(attrType, value string) interface{} {
+// typedValues holds the typed columns read next to an attribute's string form.
+type typedValues struct {
+	intValue    sql.NullInt64
+	doubleValue sql.NullFloat64
+	boolValue   sql.NullBool
+}
+
+func parseAttributeValue(attrType, value string, typed typedValues) interface{} {
 	switch attrType {
 	case attrTypeInt:
+		if typed.intValue.Valid {
+			return typed.intValue.Int64
+		}
 		parsed, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
 			return value
 		}
 		return parsed
 	case attrTypeDouble:
+		if typed.doubleValue.Valid {
+			return typed.doubleValue.Float64
+		}
 		parsed, err := strconv.ParseFloat(value, 64)
 		if err != nil {
 			return value
 		}
 		return parsed
 	case attrTypeBool:
+		if typed.boolValue.Valid {
+			return typed.boolValue.Bool
+		}
 		parsed, err := strconv.ParseBool(value)
 		if err != nil {
 			return value
@@ -1065,69 +1077,13 @@ func parseAttributeValue(attrType, value string) interface{} {
 		return parsed
 	case attrTypeBytes:
 		return value
-	case attrTypeArray:
-		var decoded []interface{}
-		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
-			return []interface{}{value}
-		}
-		return decoded
-	case attrTypeKVList:
-		var decoded map[string]interface{}
-		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
-			return map[string]interface{}{"value": value}
-		}
-		return decoded
+	case attrTypeArray, attrTypeKVList:
+		return otlpconv.StoredInterface(attrType, value)
 	default:
 		return value
 	}
 }
 
-func anyValueArray(arr *commonpb.ArrayValue) []interface{} {
-	if arr == nil {
-		return nil
-	}
-	result := make([]interface{}, 0, len(arr.Values))
-	for _, value := range arr.Values {
-		result = append(result, anyValueToInterface(value))
-	}
-	return result
-}
-
-func anyValueToInterface(value *commonpb.AnyValue) interface{} {
-	if value == nil {
-		return nil
-	}
-	switch v := value.Value.(type) {
-	case *commonpb.AnyValue_StringValue:
-		return v.StringValue
-	case *commonpb.AnyValue_IntValue:
-		return v.IntValue
-	case *commonpb.AnyValue_DoubleValue:
-		return v.DoubleValue
-	case *commonpb.AnyValue_BoolValue:
-		return v.BoolValue
-	case *commonpb.AnyValue_BytesValue:
-		return fmt.Sprintf("%x", v.BytesValue)
-	case *commonpb.AnyValue_ArrayValue:
-		return anyValueArray(v.ArrayValue)
-	case *commonpb.AnyValue_KvlistValue:
-		return keyValueListToMap(v.KvlistValue)
-	default:
-		return nil
-	}
-}
-
-func keyValueListToMap(list *commonpb.KeyValueList) map[string]interface{} {
-	if list == nil {
-		return map[string]interface{}{}
-	}
-	result := make(map[string]interface{}, len(list.Values))
-	for _, kv := range list.Values {
-		result[kv.GetKey()] = anyValueToInterface(kv.GetValue())
-	}
-	return result
-}
-
 func newUUIDv7() (string, error) {
 	value, err := uuid.NewV7()
 	if err != nil {
@@ -0,0 +1,70 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"smelldeadfish/internal/spanstore"
+	"smelldeadfish/internal/sqlconsole"
+)
+
+// readOnlyDB is a second handle on the database file opened with mode=ro and
+// query_only, so console queries cannot write whatever they contain.
+type readOnlyDB struct {
+	mu sync.Mutex
+	db *sql.DB
+}
+
+func (r *readOnlyDB) get(path string) (*sql.DB, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.db != nil {
+		return r.db, nil
+	}
+	dsn, err := readOnlyDSN(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open read-only sqlite: %w", err)
+	}
+	r.db = db
+	return db, nil
+}
+
+func (r *readOnlyDB) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.db == nil {
+		return nil
+	}
+	err := r.db.Close()
+	r.db = nil
+	return err
+}
+
+// QuerySQL runs a single SELECT on a read-only handle.
+func (s *Sink) QuerySQL(ctx context.Context, query spanstore.SQLQuery) (spanstore.SQLResult, error) {
+	if s == nil || s.db == nil {
+		return spanstore.SQLResult{}, fmt.Errorf("sqlite connection unavailable")
+	}
+	statement, err := sqlconsole.Check(query.Query)
+	if err != nil {
+		return spanstore.SQLResult{}, err
+	}
+	db := s.db
+	if !s.readOnly {
+		if db, err = s.console.get(s.path); err != nil {
+			return spanstore.SQLResult{}, err
+		}
+	}
+	rows, err := db.QueryContext(ctx, statement)
+	if err != nil {
+		return spanstore.SQLResult{}, fmt.Errorf("run query: %w", err)
+	}
+	defer rows.Close()
+	return sqlconsole.Scan(rows, query.MaxRows)
+}
@@ -0,0 +1,77 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestSQLiteSinkQuerySQL(t *testing.T) {
+	sink, err := New(filepath.Join(t.TempDir(), "spans.sqlite"))
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	defer sink.Close()
+	ctx := context.Background()
+	if err := sink.Consume(ctx, benchmarkRequest(1, 5)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	result, err := sink.QuerySQL(ctx, spanstore.SQLQuery{Query: "SELECT span_id, name FROM spans ORDER BY span_id;", MaxRows: 3})
+	if err != nil {
+		t.Fatalf("query sql: %v", err)
+	}
+	if len(result.Columns) != 2 || result.Columns[0] != "span_id" || result.Columns[1] != "name" {
+		t.Fatalf("unexpected columns: %v", result.Columns)
+	}
+	if len(result.Rows) != 3 || !result.Truncated {
+		t.Fatalf("expected 3 truncated rows, got %d truncated=%v", len(result.Rows), result.Truncated)
+	}
+	if _, ok := result.Rows[0][0].(string); !ok {
+		t.Fatalf("expected text span id, got %T", result.Rows[0][0])
+	}
+
+	result, err = sink.QuerySQL(ctx, spanstore.SQLQuery{Query: "SELECT COUNT(*) AS spans FROM spans", MaxRows: 3})
+	if err != nil {
+		t.Fatalf("query count: %v", err)
+	}
+	if result.Truncated || len(result.Rows) != 1 || result.Rows[0][0] != int64(5) {
+		t.Fatalf("unexpected count result: %+v", result)
+	}
+}
+
+func TestSQLiteSinkQuerySQLIsReadOnly(t *testing.T) {
+	sink, err := New(filepath.Join(t.TempDir(), "spans.sqlite"))
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	defer sink.Close()
+	ctx := context.Background()
+	if err := sink.Consume(ctx, benchmarkRequest(1, 2)); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	for _, query := range []string{
+		"DELETE FROM spans",
+		"SELECT 1; DELETE FROM spans",
+		"PRAGMA query_only = 0",
+	} {
+		if _, err := sink.QuerySQL(ctx, spanstore.SQLQuery{Query: query}); !errors.Is(err, spanstore.ErrSQLNotAllowed) {
+			t.Fatalf("expected %q to be rejected, got %v", query, err)
+		}
+	}
+	// A write hidden in a CTE passes the keyword check but not the handle.
+	if _, err := sink.QuerySQL(ctx, spanstore.SQLQuery{Query: "WITH gone AS (SELECT 1) DELETE FROM spans"}); err == nil {
+		t.Fatal("expected write through WITH to fail")
+	}
+	var count int
+	if err := sink.DB().QueryRowContext(ctx, "SELECT COUNT(*) FROM spans").Scan(&count); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected spans to be untouched, got %d", count)
+	}
+}
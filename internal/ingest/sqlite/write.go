@@ -0,0 +1,374 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/otlpconv"
+)
+
+// maxInsertRows caps the rows in one multi-row INSERT. Batches are split into
+// power-of-two chunks so each table only ever needs a handful of distinct
+// prepared statements.
+const maxInsertRows = 32
+
+var (
+	resourceColumns  = []string{"id", "schema_url"}
+	scopeColumns     = []string{"id", "name", "version", "schema_url"}
+	spanColumns      = []string{"id", "trace_id", "span_id", "parent_span_id", "name", "kind", "start_time_unix_nano", "end_time_unix_nano", "status_code", "status_message", "service_name", "flags", "resource_id", "scope_id"}
+	eventColumns     = []string{"id", "span_id", "name", "time_unix_nano", "dropped_attributes_count"}
+	linkColumns      = []string{"id", "span_id", "trace_id", "linked_span_id", "trace_state", "dropped_attributes_count", "flags"}
+	searchColumns    = []string{"span_id", "name", "status_message", "attributes", "events"}
+	spanConflict     = " ON CONFLICT(trace_id, span_id) DO NOTHING RETURNING id"
+	idConflict       = " ON CONFLICT(id) DO NOTHING RETURNING id"
+	attributeColumns = map[string][]string{
+		"resource_attributes":   {"resource_id", "key", "type", "value", "int_value", "double_value", "bool_value"},
+		"scope_attributes":      {"scope_id", "key", "type", "value", "int_value", "double_value", "bool_value"},
+		"span_attributes":       {"span_id", "key", "type", "value", "int_value", "double_value", "bool_value"},
+		"span_event_attributes": {"event_id", "key", "type", "value", "int_value", "double_value", "bool_value"},
+		"span_link_attributes":  {"link_id", "key", "type", "value", "int_value", "double_value", "bool_value"},
+	}
+)
+
+// writeBatch accumulates the rows of one request so each table is written
+// with a few multi-row statements instead of one INSERT per row.
+type writeBatch struct {
+	resources     [][]interface{}
+	resourceAttrs map[string][]ingest.StoredAttribute
+	scopes        [][]interface{}
+	scopeAttrs    map[string][]ingest.StoredAttribute
+	spans         [][]interface{}
+	pending       map[string]*tracepb.Span
+	attributes    map[string][][]interface{}
+	events        [][]interface{}
+	links         [][]interface{}
+	search        [][]interface{}
+}
+
+func newWriteBatch() *writeBatch {
+	return &writeBatch{
+		resourceAttrs: map[string][]ingest.StoredAttribute{},
+		scopeAttrs:    map[string][]ingest.StoredAttribute{},
+		pending:       map[string]*tracepb.Span{},
+		attributes:    map[string][][]interface{}{},
+	}
+}
+
+func (s *Sink) consumeTx(ctx context.Context, tx *sql.Tx, req *coltracepb.ExportTraceServiceRequest) error {
+	batch := newWriteBatch()
+	for _, resourceSpans := range req.GetResourceSpans() {
+		serviceName := ingest.ResourceServiceName(resourceSpans.GetResource())
+		resourceID, err := batch.addResource(resourceSpans.GetResource().GetAttributes(), resourceSpans.GetSchemaUrl())
+		if err != nil {
+			return err
+		}
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			scopeID, err := batch.addScope(scopeSpans.GetScope(), scopeSpans.GetSchemaUrl())
+			if err != nil {
+				return err
+			}
+			for _, span := range scopeSpans.GetSpans() {
+				if span == nil {
+					continue
+				}
+				if err := batch.addSpan(span, serviceName, resourceID, scopeID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Resources and scopes are content-addressed, so most of them already
+	// exist; attributes are only written for the rows RETURNING reports new.
+	inserted, err := s.insertReturning(ctx, tx, "resources", resourceColumns, idConflict, batch.resources)
+	if err != nil {
+		return fmt.Errorf("insert resource: %w", err)
+	}
+	for _, resourceID := range inserted {
+		batch.addStoredAttributes("resource_attributes", resourceID, batch.resourceAttrs[resourceID])
+	}
+	inserted, err = s.insertReturning(ctx, tx, "scopes", scopeColumns, idConflict, batch.scopes)
+	if err != nil {
+		return fmt.Errorf("insert scope: %w", err)
+	}
+	for _, scopeID := range inserted {
+		batch.addStoredAttributes("scope_attributes", scopeID, batch.scopeAttrs[scopeID])
+	}
+	inserted, err = s.insertReturning(ctx, tx, "spans", spanColumns, spanConflict, batch.spans)
+	if err != nil {
+		return fmt.Errorf("insert span: %w", err)
+	}
+	// Spans that already existed are skipped by ON CONFLICT and are absent
+	// from RETURNING, so only new spans get their children written.
+	for _, spanRowID := range inserted {
+		if err := batch.addSpanChildren(spanRowID, batch.pending[spanRowID]); err != nil {
+			return err
+		}
+	}
+	if err := s.insertRows(ctx, tx, "span_events", eventColumns, batch.events); err != nil {
+		return fmt.Errorf("insert event: %w", err)
+	}
+	if err := s.insertRows(ctx, tx, "span_links", linkColumns, batch.links); err != nil {
+		return fmt.Errorf("insert link: %w", err)
+	}
+	if err := s.insertRows(ctx, tx, "span_search", searchColumns, batch.search); err != nil {
+		return fmt.Errorf("index span text: %w", err)
+	}
+	for _, table := range []string{"resource_attributes", "scope_attributes", "span_attributes", "span_event_attributes", "span_link_attributes"} {
+		if err := s.insertRows(ctx, tx, table, attributeColumns[table], batch.attributes[table]); err != nil {
+			return fmt.Errorf("insert attribute: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *writeBatch) addResource(attrs []*commonpb.KeyValue, schemaURL string) (string, error) {
+	stored, err := storedAttributes(attrs)
+	if err != nil {
+		return "", err
+	}
+	resourceID := ingest.ResourceID(schemaURL, stored)
+	if _, ok := b.resourceAttrs[resourceID]; !ok {
+		b.resourceAttrs[resourceID] = stored
+		b.resources = append(b.resources, []interface{}{resourceID, schemaURL})
+	}
+	return resourceID, nil
+}
+
+func (b *writeBatch) addScope(scope *commonpb.InstrumentationScope, schemaURL string) (string, error) {
+	stored, err := storedAttributes(scope.GetAttributes())
+	if err != nil {
+		return "", err
+	}
+	scopeID := ingest.ScopeID(scope.GetName(), scope.GetVersion(), schemaURL, stored)
+	if _, ok := b.scopeAttrs[scopeID]; !ok {
+		b.scopeAttrs[scopeID] = stored
+		b.scopes = append(b.scopes, []interface{}{scopeID, scope.GetName(), scope.GetVersion(), schemaURL})
+	}
+	return scopeID, nil
+}
+
+func (b *writeBatch) addSpan(span *tracepb.Span, service, resourceID, scopeID string) error {
+	spanRowID, err := newUUIDv7()
+	if err != nil {
+		return err
+	}
+	b.pending[spanRowID] = span
+	b.spans = append(b.spans, []interface{}{
+		spanRowID,
+		ingest.FormatTraceID(span.GetTraceId()),
+		ingest.FormatSpanID(span.GetSpanId()),
+		ingest.FormatSpanID(span.GetParentSpanId()),
+		span.GetName(),
+		ingest.SpanKind(span.GetKind()),
+		int64(span.GetStartTimeUnixNano()),
+		int64(span.GetEndTimeUnixNano()),
+		int32(span.GetStatus().GetCode()),
+		span.GetStatus().GetMessage(),
+		service,
+		span.GetFlags(),
+		resourceID,
+		scopeID,
+	})
+	return nil
+}
+
+func (b *writeBatch) addSpanChildren(spanRowID string, span *tracepb.Span) error {
+	if span == nil {
+		return nil
+	}
+	if err := b.addAttributes("span_attributes", spanRowID, span.GetAttributes()); err != nil {
+		return err
+	}
+	doc := ingest.NewSearchDocument(span)
+	b.search = append(b.search, []interface{}{spanRowID, doc.Name, doc.StatusMessage, doc.Attributes, doc.Events})
+	for _, event := range span.GetEvents() {
+		eventID, err := newUUIDv7()
+		if err != nil {
+			return err
+		}
+		b.events = append(b.events, []interface{}{eventID, spanRowID, event.GetName(), int64(event.GetTimeUnixNano()), event.GetDroppedAttributesCount()})
+		if err := b.addAttributes("span_event_attributes", eventID, event.GetAttributes()); err != nil {
+			return err
+		}
+	}
+	for _, link := range span.GetLinks() {
+		linkID, err := newUUIDv7()
+		if err != nil {
+			return err
+		}
+		b.links = append(b.links, []interface{}{
+			linkID,
+			spanRowID,
+			ingest.FormatTraceID(link.GetTraceId()),
+			ingest.FormatSpanID(link.GetSpanId()),
+			link.GetTraceState(),
+			link.GetDroppedAttributesCount(),
+			link.GetFlags(),
+		})
+		if err := b.addAttributes("span_link_attributes", linkID, link.GetAttributes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *writeBatch) addAttributes(table, id string, attrs []*commonpb.KeyValue) error {
+	stored, err := storedAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	b.addStoredAttributes(table, id, stored)
+	return nil
+}
+
+func (b *writeBatch) addStoredAttributes(table, id string, attrs []ingest.StoredAttribute) {
+	for _, attr := range attrs {
+		intValue, doubleValue, boolValue := attr.Typed()
+		b.attributes[table] = append(b.attributes[table], []interface{}{id, attr.Key, attr.Type, attr.Value, intValue, doubleValue, boolValue})
+	}
+}
+
+func storedAttributes(attrs []*commonpb.KeyValue) ([]ingest.StoredAttribute, error) {
+	stored := make([]ingest.StoredAttribute, 0, len(attrs))
+	for _, attr := range attrs {
+		attrType, attrValue, err := otlpconv.StoredForm(attr.GetValue())
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, ingest.StoredAttribute{Key: attr.GetKey(), Type: attrType, Value: attrValue})
+	}
+	return stored, nil
+}
+
+func (s *Sink) insertRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	for len(rows) > 0 {
+		size := chunkSize(len(rows))
+		stmt, err := s.stmts.Get(ctx, buildInsertQuery(table, columns, size, ""))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, flattenRows(rows[:size])...); err != nil {
+			return err
+		}
+		rows = rows[size:]
+	}
+	return nil
+}
+
+// insertReturning runs a multi-row INSERT whose suffix ends in RETURNING id
+// and collects the ids of the rows that were actually inserted.
+func (s *Sink) insertReturning(ctx context.Context, tx *sql.Tx, table string, columns []string, suffix string, rows [][]interface{}) ([]string, error) {
+	inserted := make([]string, 0, len(rows))
+	for len(rows) > 0 {
+		size := chunkSize(len(rows))
+		stmt, err := s.stmts.Get(ctx, buildInsertQuery(table, columns, size, suffix))
+		if err != nil {
+			return nil, err
+		}
+		result, err := tx.StmtContext(ctx, stmt).QueryContext(ctx, flattenRows(rows[:size])...)
+		if err != nil {
+			return nil, err
+		}
+		for result.Next() {
+			var id string
+			if err := result.Scan(&id); err != nil {
+				_ = result.Close()
+				return nil, err
+			}
+			inserted = append(inserted, id)
+		}
+		if err := result.Err(); err != nil {
+			_ = result.Close()
+			return nil, err
+		}
+		_ = result.Close()
+		rows = rows[size:]
+	}
+	return inserted, nil
+}
+
+// chunkSize returns the largest power of two not above n, capped at
+// maxInsertRows.
+func chunkSize(n int) int {
+	size := maxInsertRows
+	for size > n {
+		size /= 2
+	}
+	return size
+}
+
+func buildInsertQuery(table string, columns []string, rows int, suffix string) string {
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	builder := strings.Builder{}
+	builder.WriteString("INSERT INTO ")
+	builder.WriteString(table)
+	builder.WriteString(" (")
+	builder.WriteString(strings.Join(columns, ", "))
+	builder.WriteString(") VALUES ")
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		builder.WriteString(placeholder)
+	}
+	builder.WriteString(suffix)
+	return builder.String()
+}
+
+func flattenRows(rows [][]interface{}) []interface{} {
+	if len(rows) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(rows)*len(rows[0]))
+	for _, row := range rows {
+		args = append(args, row...)
+	}
+	return args
+}
+
+// stmtCache keeps prepared statements for the lifetime of the sink.
+// database/sql re-prepares them transparently on each pooled connection.
+type stmtCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+func (c *stmtCache) Get(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("prepare statement: %w", err)
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (c *stmtCache) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query, stmt := range c.stmts {
+		_ = stmt.Close()
+		delete(c.stmts, query)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// InstrumentHandler counts requests by status code and records latency under
+// the given handler label. It returns next unchanged when registry is nil.
+func InstrumentHandler(registry *Registry, handler string, next http.Handler) http.Handler {
+	if registry == nil {
+		return next
+	}
+	requests := registry.Counter("smelldeadfish_http_requests_total", "HTTP requests served, by handler and status code.", "handler", "code")
+	duration := registry.Histogram("smelldeadfish_http_request_duration_seconds", "HTTP request latency, by handler.", nil, "handler")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requests.Inc(handler, strconv.Itoa(status))
+		duration.Observe(time.Since(start).Seconds(), handler)
+	})
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWritesTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.Counter("test_requests_total", "Requests.", "code")
+	requests.Inc("200")
+	requests.Add(2, "200")
+	requests.Inc("500")
+	registry.Gauge("test_depth", "Depth.").Set(7)
+	registry.GaugeFunc("test_capacity", "Capacity.", func() float64 { return 10 })
+	latency := registry.Histogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var buffer bytes.Buffer
+	if err := registry.WriteText(&buffer); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	body := buffer.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{code="200"} 3` + "\n",
+		`test_requests_total{code="500"} 1` + "\n",
+		"test_depth 7\n",
+		"test_capacity 10\n",
+		"# TYPE test_latency_seconds histogram\n",
+		`test_latency_seconds_bucket{le="0.1"} 1` + "\n",
+		`test_latency_seconds_bucket{le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{le="+Inf"} 3` + "\n",
+		"test_latency_seconds_sum 5.55\n",
+		"test_latency_seconds_count 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in\n%s", want, body)
+		}
+	}
+	if strings.Index(body, "test_capacity") > strings.Index(body, "test_depth") {
+		t.Fatalf("expected families sorted by name")
+	}
+}
+
+func TestRegistrySharesFamilies(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("shared_total", "Shared.", "handler").Inc("a")
+	registry.Counter("shared_total", "Shared.", "handler").Inc("a")
+
+	var buffer bytes.Buffer
+	_ = registry.WriteText(&buffer)
+	if !strings.Contains(buffer.String(), `shared_total{handler="a"} 2`) {
+		t.Fatalf("expected shared counter, got\n%s", buffer.String())
+	}
+}
+
+func TestNilRegistryIsNoop(t *testing.T) {
+	var registry *Registry
+	registry.Counter("x", "x").Inc()
+	registry.Histogram("y", "y", nil).Observe(1)
+	registry.Gauge("z", "z").Set(1)
+	registry.GaugeFunc("w", "w", func() float64 { return 1 })
+	handler := http.NotFoundHandler()
+	if InstrumentHandler(registry, "h", handler) == nil {
+		t.Fatalf("expected handler")
+	}
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("escaped_total", "Escaped.", "service").Inc("a\"b\\c\nd")
+
+	var buffer bytes.Buffer
+	_ = registry.WriteText(&buffer)
+	if !strings.Contains(buffer.String(), `escaped_total{service="a\"b\\c\nd"} 1`) {
+		t.Fatalf("unexpected escaping:\n%s", buffer.String())
+	}
+}
+
+func TestInstrumentHandlerRecordsStatus(t *testing.T) {
+	registry := NewRegistry()
+	handler := InstrumentHandler(registry, "test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	resp := httptest.NewRecorder()
+	registry.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := resp.Body.String()
+	if !strings.Contains(body, `smelldeadfish_http_requests_total{handler="test",code="400"} 1`) {
+		t.Fatalf("expected request counter, got\n%s", body)
+	}
+	if !strings.Contains(body, `smelldeadfish_http_request_duration_seconds_count{handler="test"} 1`) {
+		t.Fatalf("expected duration histogram, got\n%s", body)
+	}
+	if !strings.HasPrefix(resp.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected content type %q", resp.Header().Get("Content-Type"))
+	}
+}
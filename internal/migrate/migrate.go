@@ -0,0 +1,153 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const versionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at_unix_nano BIGINT NOT NULL
+)`
+
+// ErrNewerSchema is returned when a database was migrated by a newer build
+// than the running one.
+var ErrNewerSchema = errors.New("database schema is newer than this build supports")
+
+// ErrOlderSchema is returned by RequireCurrent when migrations are pending.
+var ErrOlderSchema = errors.New("database schema is older than this build needs")
+
+// Migration is one forward step of a store's schema. Versions start at 1
+// and must be contiguous.
+type Migration struct {
+	Version int
+	Name    string
+	// SQL is executed as a single multi-statement Exec.
+	SQL string
+	// Func runs after SQL, in the same transaction, for changes that need Go
+	// code such as rewriting rows.
+	Func func(ctx context.Context, tx *sql.Tx) error
+}
+
+type Plan struct {
+	Current int
+	Latest  int
+	Pending []Migration
+}
+
+// Latest returns the version a database is at once every migration ran.
+func Latest(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// PlanFor lists the migrations a database at version current still needs.
+func PlanFor(current int, migrations []Migration) (Plan, error) {
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return Plan{}, fmt.Errorf("migration %q has version %d, expected %d", migration.Name, migration.Version, i+1)
+		}
+	}
+	plan := Plan{Current: current, Latest: Latest(migrations)}
+	if current > plan.Latest {
+		return plan, fmt.Errorf("%w: database is at version %d, latest known is %d", ErrNewerSchema, current, plan.Latest)
+	}
+	plan.Pending = migrations[current:]
+	return plan, nil
+}
+
+// CurrentVersion reads the schema version without creating anything, so it
+// is safe for dry runs. Databases that predate versioning report 0.
+func CurrentVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var tables int
+	// DuckDB provides sqlite_master as a compatibility view, so the same
+	// lookup works for both stores.
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&tables); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	var version sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// Inspect reports the pending migrations without applying them.
+func Inspect(ctx context.Context, db *sql.DB, migrations []Migration) (Plan, error) {
+	current, err := CurrentVersion(ctx, db)
+	if err != nil {
+		return Plan{}, err
+	}
+	return PlanFor(current, migrations)
+}
+
+// RequireCurrent fails unless the database is already at the latest
+// version, for callers that open it read-only and cannot migrate.
+func RequireCurrent(ctx context.Context, db *sql.DB, migrations []Migration) error {
+	plan, err := Inspect(ctx, db, migrations)
+	if err != nil {
+		return err
+	}
+	if len(plan.Pending) > 0 {
+		return fmt.Errorf("%w: database is at version %d, latest is %d", ErrOlderSchema, plan.Current, plan.Latest)
+	}
+	return nil
+}
+
+// Apply runs every pending migration, each in its own transaction, and
+// returns the plan it executed. It refuses to touch a database from a newer
+// build.
+func Apply(ctx context.Context, db *sql.DB, migrations []Migration) (Plan, error) {
+	if _, err := db.ExecContext(ctx, versionTable); err != nil {
+		return Plan{}, fmt.Errorf("create schema_version: %w", err)
+	}
+	plan, err := Inspect(ctx, db, migrations)
+	if err != nil {
+		return plan, err
+	}
+	for _, migration := range plan.Pending {
+		if err := applyOne(ctx, db, migration); err != nil {
+			return plan, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+	}
+	return plan, nil
+}
+
+func applyOne(ctx context.Context, db *sql.DB, migration Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	if err := runMigration(ctx, tx, migration); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+func runMigration(ctx context.Context, tx *sql.Tx, migration Migration) error {
+	if migration.SQL != "" {
+		if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+			return err
+		}
+	}
+	if migration.Func != nil {
+		if err := migration.Func(ctx, tx); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO schema_version (version, name, applied_at_unix_nano) VALUES (?, ?, ?)", migration.Version, migration.Name, time.Now().UnixNano())
+	return err
+}
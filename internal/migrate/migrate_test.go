@@ -0,0 +1,128 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "migrate.sqlite"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func testMigrations(calls *int) []Migration {
+	return []Migration{
+		{Version: 1, Name: "create items", SQL: "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT); CREATE INDEX items_name_idx ON items(name)"},
+		{Version: 2, Name: "seed items", Func: func(ctx context.Context, tx *sql.Tx) error {
+			*calls++
+			_, err := tx.ExecContext(ctx, "INSERT INTO items (name) VALUES ('a'), ('b')")
+			return err
+		}},
+	}
+}
+
+func TestApplyRunsPendingMigrationsOnce(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	calls := 0
+	migrations := testMigrations(&calls)
+
+	plan, err := Inspect(ctx, db, migrations)
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if plan.Current != 0 || plan.Latest != 2 || len(plan.Pending) != 2 {
+		t.Fatalf("unexpected plan before apply: %+v", plan)
+	}
+	if _, err := Apply(ctx, db, migrations); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	plan, err = Apply(ctx, db, migrations)
+	if err != nil {
+		t.Fatalf("second apply: %v", err)
+	}
+	if plan.Current != 2 || len(plan.Pending) != 0 {
+		t.Fatalf("unexpected plan after apply: %+v", plan)
+	}
+	if calls != 1 {
+		t.Fatalf("expected Func migration to run once, ran %d times", calls)
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM items").Scan(&count); err != nil || count != 2 {
+		t.Fatalf("expected 2 seeded items, got %d (%v)", count, err)
+	}
+}
+
+func TestApplyRollsBackFailedMigration(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	migrations := []Migration{
+		{Version: 1, Name: "create items", SQL: "CREATE TABLE items (id INTEGER PRIMARY KEY)"},
+		{Version: 2, Name: "broken", SQL: "CREATE TABLE other (id INTEGER); SELECT * FROM missing_table"},
+	}
+	if _, err := Apply(ctx, db, migrations); err == nil {
+		t.Fatalf("expected broken migration to fail")
+	}
+	current, err := CurrentVersion(ctx, db)
+	if err != nil {
+		t.Fatalf("current version: %v", err)
+	}
+	if current != 1 {
+		t.Fatalf("expected version 1 after failed migration, got %d", current)
+	}
+	var tables int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE name = 'other'").Scan(&tables); err != nil || tables != 0 {
+		t.Fatalf("expected failed migration to roll back, found %d tables (%v)", tables, err)
+	}
+}
+
+func TestApplyRefusesNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	calls := 0
+	if _, err := Apply(ctx, db, testMigrations(&calls)); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	_, err := Apply(ctx, db, testMigrations(&calls)[:1])
+	if !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("expected ErrNewerSchema, got %v", err)
+	}
+}
+
+func TestPlanForRejectsGaps(t *testing.T) {
+	_, err := PlanFor(0, []Migration{{Version: 1, Name: "a"}, {Version: 3, Name: "c"}})
+	if err == nil {
+		t.Fatalf("expected non-contiguous versions to be rejected")
+	}
+}
+
+func TestRequireCurrent(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	calls := 0
+	if err := RequireCurrent(ctx, db, testMigrations(&calls)); !errors.Is(err, ErrOlderSchema) {
+		t.Fatalf("expected ErrOlderSchema for empty database, got %v", err)
+	}
+	if _, err := Apply(ctx, db, testMigrations(&calls)[:1]); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := RequireCurrent(ctx, db, testMigrations(&calls)); !errors.Is(err, ErrOlderSchema) {
+		t.Fatalf("expected ErrOlderSchema with a pending migration, got %v", err)
+	}
+	if _, err := Apply(ctx, db, testMigrations(&calls)); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := RequireCurrent(ctx, db, testMigrations(&calls)); err != nil {
+		t.Fatalf("require current: %v", err)
+	}
+}
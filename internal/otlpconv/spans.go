@@ -0,0 +1,201 @@
+package otlpconv
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+const rootSpanParentID = "0000000000000000"
+
+// FromSpans rebuilds an OTLP request from stored spans, grouping spans that
+// share an identical resource and scope. Attribute types are inferred from the
+// decoded Go values, so bytes values come back as their hex string form.
+func FromSpans(spans []spanstore.Span) *coltracepb.ExportTraceServiceRequest {
+	req := &coltracepb.ExportTraceServiceRequest{}
+	resourceIndex := map[string]*tracepb.ResourceSpans{}
+	scopeIndex := map[string]*tracepb.ScopeSpans{}
+	for _, span := range spans {
+		resourceKey := resourceGroupKey(span.Resource)
+		resourceSpans, ok := resourceIndex[resourceKey]
+		if !ok {
+			resourceSpans = &tracepb.ResourceSpans{
+				Resource:  &resourcepb.Resource{Attributes: KeyValues(span.Resource.Attributes)},
+				SchemaUrl: span.Resource.SchemaURL,
+			}
+			resourceIndex[resourceKey] = resourceSpans
+			req.ResourceSpans = append(req.ResourceSpans, resourceSpans)
+		}
+		scopeKey := resourceKey + "\x00" + scopeGroupKey(span.Scope)
+		scopeSpans, ok := scopeIndex[scopeKey]
+		if !ok {
+			scopeSpans = &tracepb.ScopeSpans{
+				Scope: &commonpb.InstrumentationScope{
+					Name:       span.Scope.Name,
+					Version:    span.Scope.Version,
+					Attributes: KeyValues(span.Scope.Attributes),
+				},
+				SchemaUrl: span.Scope.SchemaURL,
+			}
+			scopeIndex[scopeKey] = scopeSpans
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, scopeSpans)
+		}
+		scopeSpans.Spans = append(scopeSpans.Spans, Span(span))
+	}
+	return req
+}
+
+func Span(span spanstore.Span) *tracepb.Span {
+	out := &tracepb.Span{
+		TraceId:           DecodeID(span.TraceID),
+		SpanId:            DecodeID(span.SpanID),
+		ParentSpanId:      DecodeParentID(span.ParentSpanID),
+		Name:              span.Name,
+		Kind:              SpanKind(span.Kind),
+		StartTimeUnixNano: uint64(span.StartTimeUnixNano),
+		EndTimeUnixNano:   uint64(span.EndTimeUnixNano),
+		Attributes:        KeyValues(span.Attributes),
+		Flags:             span.Flags,
+	}
+	if span.StatusCode != 0 || span.StatusMessage != "" {
+		out.Status = &tracepb.Status{
+			Code:    tracepb.Status_StatusCode(span.StatusCode),
+			Message: span.StatusMessage,
+		}
+	}
+	for _, event := range span.Events {
+		out.Events = append(out.Events, &tracepb.Span_Event{
+			Name:                   event.Name,
+			TimeUnixNano:           uint64(event.TimeUnixNano),
+			Attributes:             KeyValues(event.Attributes),
+			DroppedAttributesCount: event.DroppedAttributesCount,
+		})
+	}
+	for _, link := range span.Links {
+		out.Links = append(out.Links, &tracepb.Span_Link{
+			TraceId:                DecodeID(link.TraceID),
+			SpanId:                 DecodeID(link.SpanID),
+			TraceState:             link.TraceState,
+			Attributes:             KeyValues(link.Attributes),
+			DroppedAttributesCount: link.DroppedAttributesCount,
+			Flags:                  link.Flags,
+		})
+	}
+	return out
+}
+
+// DecodeID turns a stored hex identifier back into bytes. Invalid input
+// yields nil rather than an error so a single bad row cannot break a trace.
+func DecodeID(raw string) []byte {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	decoded, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil
+	}
+	return decoded
+}
+
+func DecodeParentID(raw string) []byte {
+	if raw == rootSpanParentID {
+		return nil
+	}
+	return DecodeID(raw)
+}
+
+func SpanKind(kind string) tracepb.Span_SpanKind {
+	if value, ok := tracepb.Span_SpanKind_value[kind]; ok {
+		return tracepb.Span_SpanKind(value)
+	}
+	return tracepb.Span_SPAN_KIND_UNSPECIFIED
+}
+
+// KeyValues converts a decoded attribute map into OTLP key values sorted by
+// key, so the output is stable across calls.
+func KeyValues(attrs map[string]any) []*commonpb.KeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, &commonpb.KeyValue{Key: key, Value: AnyValue(attrs[key])})
+	}
+	return result
+}
+
+func AnyValue(value any) *commonpb.AnyValue {
+	switch v := value.(type) {
+	case nil:
+		return &commonpb.AnyValue{}
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case int:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case int32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}
+	case uint32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case float32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: float64(v)}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}
+	case json.Number:
+		if parsed, err := v.Int64(); err == nil {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: parsed}}
+		}
+		parsed, _ := v.Float64()
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: parsed}}
+	case []byte:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: v}}
+	case []any:
+		values := make([]*commonpb.AnyValue, 0, len(v))
+		for _, item := range v {
+			values = append(values, AnyValue(item))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	case map[string]any:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: KeyValues(v)}}}
+	default:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(v)}}
+	}
+}
+
+func resourceGroupKey(resource spanstore.Resource) string {
+	return resource.SchemaURL + "\x00" + attributesKey(resource.Attributes)
+}
+
+func scopeGroupKey(scope spanstore.Scope) string {
+	return scope.Name + "\x00" + scope.Version + "\x00" + scope.SchemaURL + "\x00" + attributesKey(scope.Attributes)
+}
+
+func attributesKey(attrs map[string]any) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	// encoding/json sorts map keys, which makes the encoding a stable key.
+	payload, err := json.Marshal(attrs)
+	if err != nil {
+		return fmt.Sprint(attrs)
+	}
+	return string(payload)
+}
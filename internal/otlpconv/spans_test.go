@@ -0,0 +1,55 @@
+package otlpconv
+
+import (
+	"testing"
+
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestFromSpansGroupsByResourceAndScope(t *testing.T) {
+	resourceA := spanstore.Resource{Attributes: map[string]any{"service.name": "a"}}
+	resourceB := spanstore.Resource{Attributes: map[string]any{"service.name": "b"}}
+	scope := spanstore.Scope{Name: "scope", Version: "v1"}
+	spans := []spanstore.Span{
+		{TraceID: "01", SpanID: "0a", ParentSpanID: rootSpanParentID, Name: "root", Kind: "SPAN_KIND_SERVER", Resource: resourceA, Scope: scope},
+		{TraceID: "01", SpanID: "0b", ParentSpanID: "0a", Name: "child", Kind: "SPAN_KIND_CLIENT", Resource: resourceA, Scope: scope},
+		{TraceID: "01", SpanID: "0c", ParentSpanID: "0b", Name: "remote", Kind: "UNSPECIFIED", Resource: resourceB, Scope: scope},
+	}
+
+	req := FromSpans(spans)
+
+	if len(req.GetResourceSpans()) != 2 {
+		t.Fatalf("expected two resource groups, got %d", len(req.GetResourceSpans()))
+	}
+	first := req.GetResourceSpans()[0]
+	if len(first.GetScopeSpans()) != 1 || len(first.GetScopeSpans()[0].GetSpans()) != 2 {
+		t.Fatalf("expected two spans in first scope, got %v", first)
+	}
+	root := first.GetScopeSpans()[0].GetSpans()[0]
+	if root.GetParentSpanId() != nil {
+		t.Fatalf("expected root parent to be empty, got %x", root.GetParentSpanId())
+	}
+	if root.GetKind() != tracepb.Span_SPAN_KIND_SERVER {
+		t.Fatalf("unexpected kind: %v", root.GetKind())
+	}
+	if req.GetResourceSpans()[1].GetScopeSpans()[0].GetSpans()[0].GetKind() != tracepb.Span_SPAN_KIND_UNSPECIFIED {
+		t.Fatalf("expected unspecified kind")
+	}
+}
+
+func TestAnyValueConvertsNestedValues(t *testing.T) {
+	value := AnyValue(map[string]any{
+		"list":  []any{"a", int64(1), 2.5, true},
+		"inner": map[string]any{"k": "v"},
+	})
+	kvs := value.GetKvlistValue().GetValues()
+	if len(kvs) != 2 || kvs[0].GetKey() != "inner" {
+		t.Fatalf("expected sorted kvlist, got %v", kvs)
+	}
+	list := kvs[1].GetValue().GetArrayValue().GetValues()
+	if len(list) != 4 || list[1].GetIntValue() != 1 || list[2].GetDoubleValue() != 2.5 || !list[3].GetBoolValue() {
+		t.Fatalf("unexpected array: %v", list)
+	}
+}
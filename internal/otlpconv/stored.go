@@ -0,0 +1,313 @@
+package otlpconv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	attrTypeString = "string"
+	attrTypeInt    = "int"
+	attrTypeDouble = "double"
+	attrTypeBool   = "bool"
+	attrTypeBytes  = "bytes"
+	attrTypeArray  = "array"
+	attrTypeKVList = "kvlist"
+)
+
+// StoredValue restores an attribute from the (type, value) pair the SQL stores
+// persist. Arrays and kvlists are kept as OTLP/JSON AnyValues, so they restore
+// exactly. Older rows hold them as plain JSON, where integers come back as
+// ints, every other number as a double, and bytes as their hex string.
+func StoredValue(attrType, value string) *commonpb.AnyValue {
+	switch attrType {
+	case attrTypeString:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+	case attrTypeInt:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			break
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: parsed}}
+	case attrTypeDouble:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			break
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: parsed}}
+	case attrTypeBool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			break
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: parsed}}
+	case attrTypeBytes:
+		parsed, err := hex.DecodeString(value)
+		if err != nil {
+			break
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: parsed}}
+	case attrTypeArray:
+		if typed := typedValue(value); typed.GetArrayValue() != nil {
+			return typed
+		}
+		var decoded []any
+		if err := decodeJSONNumbers(value, &decoded); err != nil {
+			break
+		}
+		return AnyValue(decoded)
+	case attrTypeKVList:
+		if typed := typedValue(value); typed.GetKvlistValue() != nil {
+			return typed
+		}
+		var decoded map[string]any
+		if err := decodeJSONNumbers(value, &decoded); err != nil {
+			break
+		}
+		return AnyValue(decoded)
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+}
+
+// typedValue decodes an OTLP/JSON AnyValue, returning nil when value is not
+// one, as with rows stored before arrays and kvlists were typed.
+func typedValue(value string) *commonpb.AnyValue {
+	var decoded commonpb.AnyValue
+	if err := protojson.Unmarshal([]byte(value), &decoded); err != nil {
+		return nil
+	}
+	return &decoded
+}
+
+// StoredInterface decodes a stored (type, value) pair into the value the SQL
+// stores put in span views: bytes stay hex encoded and arrays and kvlists
+// become slices and maps.
+func StoredInterface(attrType, value string) any {
+	switch attrType {
+	case attrTypeInt:
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parsed
+		}
+	case attrTypeDouble:
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	case attrTypeBool:
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	case attrTypeArray:
+		restored := StoredValue(attrType, value)
+		if restored.GetArrayValue() == nil {
+			return []any{value}
+		}
+		return viewValue(restored)
+	case attrTypeKVList:
+		restored := StoredValue(attrType, value)
+		if restored.GetKvlistValue() == nil {
+			return map[string]any{"value": value}
+		}
+		return viewValue(restored)
+	}
+	return value
+}
+
+// viewValue converts an array or kvlist into the value span views have always
+// shown for it: numbers inside are float64 and bytes their hex string, as if
+// decoded from plain JSON.
+func viewValue(value *commonpb.AnyValue) any {
+	switch v := jsonValue(value).(type) {
+	case int64:
+		return float64(v)
+	case []any:
+		for i, item := range value.GetArrayValue().GetValues() {
+			v[i] = viewValue(item)
+		}
+		return v
+	case map[string]any:
+		for _, kv := range value.GetKvlistValue().GetValues() {
+			v[kv.GetKey()] = viewValue(kv.GetValue())
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// StoredForm returns the (type, value) pair the SQL stores persist for an
+// attribute, the inverse of StoredValue.
+func StoredForm(value *commonpb.AnyValue) (string, string, error) {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return attrTypeString, v.StringValue, nil
+	case *commonpb.AnyValue_IntValue:
+		return attrTypeInt, strconv.FormatInt(v.IntValue, 10), nil
+	case *commonpb.AnyValue_DoubleValue:
+		return attrTypeDouble, fmt.Sprintf("%g", v.DoubleValue), nil
+	case *commonpb.AnyValue_BoolValue:
+		return attrTypeBool, strconv.FormatBool(v.BoolValue), nil
+	case *commonpb.AnyValue_BytesValue:
+		return attrTypeBytes, hex.EncodeToString(v.BytesValue), nil
+	case *commonpb.AnyValue_ArrayValue:
+		payload, err := json.Marshal(otlpJSON(value))
+		if err != nil {
+			return "", "", fmt.Errorf("marshal array attribute: %w", err)
+		}
+		return attrTypeArray, string(payload), nil
+	case *commonpb.AnyValue_KvlistValue:
+		payload, err := json.Marshal(otlpJSON(value))
+		if err != nil {
+			return "", "", fmt.Errorf("marshal kvlist attribute: %w", err)
+		}
+		return attrTypeKVList, string(payload), nil
+	default:
+		return attrTypeString, "", nil
+	}
+}
+
+// otlpJSON converts value into its OTLP/JSON form for encoding/json, which
+// unlike protojson always produces the same bytes, keeping the content IDs
+// computed from stored attributes stable.
+func otlpJSON(value *commonpb.AnyValue) any {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return map[string]any{"stringValue": v.StringValue}
+	case *commonpb.AnyValue_IntValue:
+		return map[string]any{"intValue": strconv.FormatInt(v.IntValue, 10)}
+	case *commonpb.AnyValue_DoubleValue:
+		switch {
+		case math.IsNaN(v.DoubleValue):
+			return map[string]any{"doubleValue": "NaN"}
+		case math.IsInf(v.DoubleValue, 1):
+			return map[string]any{"doubleValue": "Infinity"}
+		case math.IsInf(v.DoubleValue, -1):
+			return map[string]any{"doubleValue": "-Infinity"}
+		}
+		return map[string]any{"doubleValue": v.DoubleValue}
+	case *commonpb.AnyValue_BoolValue:
+		return map[string]any{"boolValue": v.BoolValue}
+	case *commonpb.AnyValue_BytesValue:
+		return map[string]any{"bytesValue": base64.StdEncoding.EncodeToString(v.BytesValue)}
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]any, 0, len(v.ArrayValue.GetValues()))
+		for _, item := range v.ArrayValue.GetValues() {
+			values = append(values, otlpJSON(item))
+		}
+		return map[string]any{"arrayValue": map[string]any{"values": values}}
+	case *commonpb.AnyValue_KvlistValue:
+		values := make([]any, 0, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			values = append(values, map[string]any{"key": kv.GetKey(), "value": otlpJSON(kv.GetValue())})
+		}
+		return map[string]any{"kvlistValue": map[string]any{"values": values}}
+	default:
+		return map[string]any{}
+	}
+}
+
+// jsonValue converts an array or kvlist member into a plain Go value; bytes
+// become their hex string.
+func jsonValue(value *commonpb.AnyValue) any {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_BytesValue:
+		return hex.EncodeToString(v.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		result := make([]any, 0, len(v.ArrayValue.GetValues()))
+		for _, item := range v.ArrayValue.GetValues() {
+			result = append(result, jsonValue(item))
+		}
+		return result
+	case *commonpb.AnyValue_KvlistValue:
+		result := make(map[string]any, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			result[kv.GetKey()] = jsonValue(kv.GetValue())
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+func decodeJSONNumbers(value string, dest any) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.UseNumber()
+	return decoder.Decode(dest)
+}
+
+// Builder regroups spans under the stored resource and scope rows they were
+// ingested with, preserving the order in which each group is first seen.
+type Builder struct {
+	req       *coltracepb.ExportTraceServiceRequest
+	resources map[string]*tracepb.ResourceSpans
+	scopes    map[string]*tracepb.ScopeSpans
+}
+
+type StoredResource struct {
+	SchemaURL  string
+	Attributes []*commonpb.KeyValue
+}
+
+type StoredScope struct {
+	Name       string
+	Version    string
+	SchemaURL  string
+	Attributes []*commonpb.KeyValue
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		req:       &coltracepb.ExportTraceServiceRequest{},
+		resources: map[string]*tracepb.ResourceSpans{},
+		scopes:    map[string]*tracepb.ScopeSpans{},
+	}
+}
+
+func (b *Builder) Add(resourceID string, resource StoredResource, scopeID string, scope StoredScope, span *tracepb.Span) {
+	resourceSpans, ok := b.resources[resourceID]
+	if !ok {
+		resourceSpans = &tracepb.ResourceSpans{
+			Resource:  &resourcepb.Resource{Attributes: resource.Attributes},
+			SchemaUrl: resource.SchemaURL,
+		}
+		b.resources[resourceID] = resourceSpans
+		b.req.ResourceSpans = append(b.req.ResourceSpans, resourceSpans)
+	}
+	scopeKey := resourceID + "\x00" + scopeID
+	scopeSpans, ok := b.scopes[scopeKey]
+	if !ok {
+		scopeSpans = &tracepb.ScopeSpans{SchemaUrl: scope.SchemaURL}
+		if scope.Name != "" || scope.Version != "" || len(scope.Attributes) > 0 {
+			scopeSpans.Scope = &commonpb.InstrumentationScope{
+				Name:       scope.Name,
+				Version:    scope.Version,
+				Attributes: scope.Attributes,
+			}
+		}
+		b.scopes[scopeKey] = scopeSpans
+		resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, scopeSpans)
+	}
+	scopeSpans.Spans = append(scopeSpans.Spans, span)
+}
+
+func (b *Builder) Request() *coltracepb.ExportTraceServiceRequest {
+	return b.req
+}
@@ -0,0 +1,111 @@
+package otlpconv
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStoredFormRoundTrips(t *testing.T) {
+	values := []*commonpb.AnyValue{
+		AnyValue("text"),
+		AnyValue(int64(-42)),
+		AnyValue(0.5),
+		AnyValue(true),
+		AnyValue([]byte{0xde, 0xad}),
+		AnyValue([]any{"a", int64(7), 1.5, false}),
+		AnyValue(map[string]any{"name": "x", "nested": []any{int64(1)}}),
+	}
+	wantTypes := []string{"string", "int", "double", "bool", "bytes", "array", "kvlist"}
+	for i, value := range values {
+		attrType, stored, err := StoredForm(value)
+		if err != nil {
+			t.Fatalf("stored form of %v: %v", value, err)
+		}
+		if attrType != wantTypes[i] {
+			t.Fatalf("expected type %s for %v, got %s", wantTypes[i], value, attrType)
+		}
+		if got := StoredValue(attrType, stored); !proto.Equal(got, value) {
+			t.Fatalf("expected %v to round trip, got %v from %q", value, got, stored)
+		}
+	}
+	if _, stored, _ := StoredForm(AnyValue([]any{int64(1), "x"})); stored != `{"arrayValue":{"values":[{"intValue":"1"},{"stringValue":"x"}]}}` {
+		t.Fatalf("expected an OTLP/JSON array, got %s", stored)
+	}
+}
+
+func TestStoredFormKeepsNestedTypes(t *testing.T) {
+	kv := func(key string, value *commonpb.AnyValue) *commonpb.KeyValue {
+		return &commonpb.KeyValue{Key: key, Value: value}
+	}
+	kvlist := func(values ...*commonpb.KeyValue) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: values}}}
+	}
+	array := func(values ...*commonpb.AnyValue) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	}
+	values := []*commonpb.AnyValue{
+		array(AnyValue(1.0), AnyValue(int64(1)), AnyValue([]byte("raw")), AnyValue(math.Inf(-1)), &commonpb.AnyValue{}),
+		// Keys stay in their original order, repeated keys included.
+		kvlist(
+			kv("z", AnyValue(2.0)),
+			kv("a", kvlist(kv("bytes", AnyValue([]byte{0, 1})), kv("list", array(AnyValue(3.0), AnyValue(false))))),
+			kv("z", AnyValue("again")),
+		),
+		kvlist(),
+		array(),
+	}
+	for _, value := range values {
+		attrType, stored, err := StoredForm(value)
+		if err != nil {
+			t.Fatalf("stored form of %v: %v", value, err)
+		}
+		if got := StoredValue(attrType, stored); !proto.Equal(got, value) {
+			t.Fatalf("expected %v to round trip, got %v from %s", value, got, stored)
+		}
+	}
+}
+
+func TestStoredValueReadsPlainJSON(t *testing.T) {
+	got := StoredValue("array", `[1,1.5,"a",null]`)
+	want := AnyValue([]any{int64(1), 1.5, "a", nil})
+	if !proto.Equal(got, want) {
+		t.Fatalf("expected %v from a plain JSON array, got %v", want, got)
+	}
+	got = StoredValue("kvlist", `{"name":"x","nested":{"n":2}}`)
+	want = AnyValue(map[string]any{"name": "x", "nested": map[string]any{"n": int64(2)}})
+	if !proto.Equal(got, want) {
+		t.Fatalf("expected %v from a plain JSON object, got %v", want, got)
+	}
+	if view := StoredInterface("kvlist", `{"name":"x"}`); !reflect.DeepEqual(view, map[string]any{"name": "x"}) {
+		t.Fatalf("unexpected view of a plain JSON object: %#v", view)
+	}
+}
+
+func TestStoredInterfaceMatchesSpanViews(t *testing.T) {
+	cases := []struct {
+		value *commonpb.AnyValue
+		want  any
+	}{
+		{AnyValue("text"), "text"},
+		{AnyValue(int64(-42)), int64(-42)},
+		{AnyValue(0.5), 0.5},
+		{AnyValue(true), true},
+		{AnyValue([]byte{0xde, 0xad}), "dead"},
+		{AnyValue([]any{"a", int64(7)}), []any{"a", float64(7)}},
+		{AnyValue(map[string]any{"n": int64(1)}), map[string]any{"n": float64(1)}},
+		{nil, ""},
+	}
+	for _, tc := range cases {
+		attrType, stored, err := StoredForm(tc.value)
+		if err != nil {
+			t.Fatalf("stored form of %v: %v", tc.value, err)
+		}
+		if got := StoredInterface(attrType, stored); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("expected %#v for %v, got %#v", tc.want, tc.value, got)
+		}
+	}
+}
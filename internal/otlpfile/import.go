@@ -0,0 +1,153 @@
+package otlpfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+)
+
+// ErrSink marks failures returned by the sink rather than by decoding input.
+var ErrSink = errors.New("sink rejected request")
+
+type ImportOptions struct {
+	Format Format
+	// Rebase shifts every timestamp by the same offset so the latest span end
+	// lands on Now. Relative timing inside and across traces is preserved.
+	Rebase   bool
+	Now      time.Time
+	Progress func(Progress)
+}
+
+type Progress struct {
+	Requests  int
+	Spans     int
+	BytesRead int64
+}
+
+// Opener returns a fresh reader over the input. Import calls it twice when
+// rebasing: once to find the latest timestamp and once to ingest.
+type Opener func() (io.ReadCloser, error)
+
+func Import(ctx context.Context, sink ingest.TraceSink, open Opener, opts ImportOptions) (Progress, error) {
+	if sink == nil {
+		return Progress{}, errors.New("sink is required")
+	}
+	var offset int64
+	if opts.Rebase {
+		latest, err := latestTimestamp(ctx, open, opts.Format)
+		if err != nil {
+			return Progress{}, err
+		}
+		if latest > 0 {
+			now := opts.Now
+			if now.IsZero() {
+				now = time.Now()
+			}
+			offset = now.UnixNano() - int64(latest)
+		}
+	}
+
+	var progress Progress
+	err := scan(ctx, open, opts.Format, func(req *coltracepb.ExportTraceServiceRequest, bytesRead int64) error {
+		if offset != 0 {
+			shiftTimestamps(req, offset)
+		}
+		if err := sink.Consume(ctx, req); err != nil {
+			return fmt.Errorf("%w: request %d: %w", ErrSink, progress.Requests+1, err)
+		}
+		progress.Requests++
+		progress.Spans += ingest.CountSpans(req.GetResourceSpans()...)
+		progress.BytesRead = bytesRead
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		return nil
+	})
+	return progress, err
+}
+
+func scan(ctx context.Context, open Opener, format Format, fn func(*coltracepb.ExportTraceServiceRequest, int64) error) error {
+	input, err := open()
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer input.Close()
+	counter := &countingReader{r: input}
+	reader, err := NewReader(counter, format)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		req, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(req, counter.n); err != nil {
+			return err
+		}
+	}
+}
+
+func latestTimestamp(ctx context.Context, open Opener, format Format) (uint64, error) {
+	var latest uint64
+	err := scan(ctx, open, format, func(req *coltracepb.ExportTraceServiceRequest, _ int64) error {
+		for _, resourceSpans := range req.GetResourceSpans() {
+			for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+				for _, span := range scopeSpans.GetSpans() {
+					latest = max(latest, span.GetStartTimeUnixNano(), span.GetEndTimeUnixNano())
+				}
+			}
+		}
+		return nil
+	})
+	return latest, err
+}
+
+func shiftTimestamps(req *coltracepb.ExportTraceServiceRequest, offset int64) {
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			for _, span := range scopeSpans.GetSpans() {
+				span.StartTimeUnixNano = shift(span.StartTimeUnixNano, offset)
+				span.EndTimeUnixNano = shift(span.EndTimeUnixNano, offset)
+				for _, event := range span.Events {
+					event.TimeUnixNano = shift(event.TimeUnixNano, offset)
+				}
+			}
+		}
+	}
+}
+
+func shift(value uint64, offset int64) uint64 {
+	if value == 0 {
+		return 0
+	}
+	shifted := int64(value) + offset
+	if shifted < 0 {
+		return 0
+	}
+	return uint64(shifted)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,88 @@
+package otlpfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+)
+
+type collectSink struct {
+	reqs []*coltracepb.ExportTraceServiceRequest
+	fail bool
+}
+
+func (c *collectSink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	if c.fail {
+		return errors.New("fail")
+	}
+	c.reqs = append(c.reqs, req)
+	return nil
+}
+
+func bytesOpener(data []byte) Opener {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func TestImportReportsProgress(t *testing.T) {
+	data := encodeJSONLines(t, testRequest("a", 1, 2), testRequest("b", 3, 4))
+	sink := &collectSink{}
+	var updates []Progress
+
+	progress, err := Import(context.Background(), sink, bytesOpener(data), ImportOptions{
+		Progress: func(p Progress) { updates = append(updates, p) },
+	})
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if progress.Requests != 2 || progress.Spans != 2 {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+	if progress.BytesRead != int64(len(data)) {
+		t.Fatalf("expected %d bytes read got %d", len(data), progress.BytesRead)
+	}
+	if len(updates) != 2 || updates[0].Requests != 1 {
+		t.Fatalf("unexpected updates: %+v", updates)
+	}
+	if len(sink.reqs) != 2 {
+		t.Fatalf("expected 2 requests consumed got %d", len(sink.reqs))
+	}
+}
+
+func TestImportRebasesTimestamps(t *testing.T) {
+	data := encodeFixedProto(t, testRequest("a", 1_000, 2_000), testRequest("b", 5_000, 9_000))
+	now := time.Unix(1_700_000_000, 0)
+	sink := &collectSink{}
+
+	if _, err := Import(context.Background(), sink, bytesOpener(data), ImportOptions{Rebase: true, Now: now}); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	last := sink.reqs[1].GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0]
+	if last.GetEndTimeUnixNano() != uint64(now.UnixNano()) {
+		t.Fatalf("expected latest end at now, got %d", last.GetEndTimeUnixNano())
+	}
+	first := sink.reqs[0].GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0]
+	if got := last.GetEndTimeUnixNano() - first.GetStartTimeUnixNano(); got != 8_000 {
+		t.Fatalf("expected relative timing preserved, got %d", got)
+	}
+	if first.GetEvents()[0].GetTimeUnixNano() != first.GetStartTimeUnixNano()+1 {
+		t.Fatalf("expected event time shifted with span")
+	}
+}
+
+func TestImportStopsOnSinkError(t *testing.T) {
+	data := encodeJSONLines(t, testRequest("a", 1, 2))
+	progress, err := Import(context.Background(), &collectSink{fail: true}, bytesOpener(data), ImportOptions{})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if progress.Requests != 0 {
+		t.Fatalf("expected no requests counted, got %d", progress.Requests)
+	}
+}
@@ -0,0 +1,213 @@
+package otlpfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/otlpjson"
+)
+
+type Format string
+
+const (
+	FormatAuto        Format = "auto"
+	FormatJSON        Format = "json"
+	FormatProto       Format = "proto"
+	FormatProtoVarint Format = "proto-varint"
+
+	maxMessageSize = 64 << 20
+	maxLineSize    = 64 << 20
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func ParseFormat(raw string) (Format, error) {
+	switch format := Format(strings.ToLower(strings.TrimSpace(raw))); format {
+	case "", FormatAuto:
+		return FormatAuto, nil
+	case FormatJSON, FormatProto, FormatProtoVarint:
+		return format, nil
+	default:
+		return "", fmt.Errorf("format must be auto, json, proto, or proto-varint")
+	}
+}
+
+// Reader decodes a stream of OTLP trace requests as written by the
+// collector's file exporter: one OTLP/JSON document per line, or protobuf
+// messages each prefixed by a 4-byte big-endian length. Varint-delimited
+// protobuf is also accepted. gzip and zstd input is detected by magic bytes.
+type Reader struct {
+	format Format
+	buf    *bufio.Reader
+	closer func()
+	line   int
+}
+
+func NewReader(r io.Reader, format Format) (*Reader, error) {
+	buf := bufio.NewReader(r)
+	closer := func() {}
+	magic, _ := buf.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("open gzip: %w", err)
+		}
+		buf = bufio.NewReader(gz)
+		closer = func() { _ = gz.Close() }
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("open zstd: %w", err)
+		}
+		buf = bufio.NewReader(zr)
+		closer = zr.Close
+	}
+	if format == "" || format == FormatAuto {
+		detected, err := detectFormat(buf)
+		if err != nil {
+			closer()
+			return nil, err
+		}
+		format = detected
+	}
+	return &Reader{format: format, buf: buf, closer: closer}, nil
+}
+
+func detectFormat(buf *bufio.Reader) (Format, error) {
+	for {
+		b, err := buf.Peek(1)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return FormatJSON, nil
+			}
+			return "", fmt.Errorf("detect format: %w", err)
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = buf.ReadByte()
+			continue
+		case '{':
+			return FormatJSON, nil
+		case 0x00:
+			// A 4-byte big-endian length starts with a zero byte for any
+			// message under 16MiB, while a varint length never does.
+			return FormatProto, nil
+		default:
+			return FormatProtoVarint, nil
+		}
+	}
+}
+
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+func (r *Reader) Close() error {
+	if r.closer != nil {
+		r.closer()
+	}
+	return nil
+}
+
+// Next returns the next request in the stream, or io.EOF once it is drained.
+func (r *Reader) Next() (*coltracepb.ExportTraceServiceRequest, error) {
+	switch r.format {
+	case FormatJSON:
+		return r.nextJSON()
+	case FormatProto:
+		return r.nextProto()
+	case FormatProtoVarint:
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := (protodelim.UnmarshalOptions{MaxSize: maxMessageSize}).UnmarshalFrom(r.buf, req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("decode protobuf message: %w", err)
+		}
+		return req, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", r.format)
+	}
+}
+
+func (r *Reader) nextJSON() (*coltracepb.ExportTraceServiceRequest, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		r.line++
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := otlpjson.Unmarshal(line, req); err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return req, nil
+	}
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.buf.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineSize {
+			return nil, fmt.Errorf("line %d exceeds %d bytes", r.line+1, maxLineSize)
+		}
+		switch {
+		case err == nil:
+			return line, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF):
+			if len(line) == 0 {
+				return nil, io.EOF
+			}
+			return line, nil
+		default:
+			return nil, fmt.Errorf("read line: %w", err)
+		}
+	}
+}
+
+func (r *Reader) nextProto() (*coltracepb.ExportTraceServiceRequest, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.buf, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("read message length: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message length %d exceeds %d bytes", size, maxMessageSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.buf, payload); err != nil {
+		return nil, fmt.Errorf("read message: %w", err)
+	}
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(payload, req); err != nil {
+		return nil, fmt.Errorf("decode protobuf message: %w", err)
+	}
+	return req, nil
+}
@@ -0,0 +1,194 @@
+package otlpfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/otlpjson"
+)
+
+func testRequest(name string, start, end uint64) *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{{
+					TraceId:           bytes.Repeat([]byte{0x01}, 16),
+					SpanId:            bytes.Repeat([]byte{0x02}, 8),
+					Name:              name,
+					StartTimeUnixNano: start,
+					EndTimeUnixNano:   end,
+					Events:            []*tracepb.Span_Event{{Name: "event", TimeUnixNano: start + 1}},
+				}},
+			}},
+		}},
+	}
+}
+
+func encodeJSONLines(t *testing.T, reqs ...*coltracepb.ExportTraceServiceRequest) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	for _, req := range reqs {
+		payload, err := otlpjson.Marshal(req)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		buffer.Write(payload)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+func encodeFixedProto(t *testing.T, reqs ...*coltracepb.ExportTraceServiceRequest) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	for _, req := range reqs {
+		payload, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+		buffer.Write(header[:])
+		buffer.Write(payload)
+	}
+	return buffer.Bytes()
+}
+
+func encodeVarintProto(t *testing.T, reqs ...*coltracepb.ExportTraceServiceRequest) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	for _, req := range reqs {
+		if _, err := protodelim.MarshalTo(&buffer, req); err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer, err := zstd.NewWriter(&buffer)
+	if err != nil {
+		t.Fatalf("zstd: %v", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("zstd write: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("zstd close: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func readAll(t *testing.T, data []byte, format Format) (Format, []*coltracepb.ExportTraceServiceRequest) {
+	t.Helper()
+	reader, err := NewReader(bytes.NewReader(data), format)
+	if err != nil {
+		t.Fatalf("new reader: %v", err)
+	}
+	defer reader.Close()
+	var reqs []*coltracepb.ExportTraceServiceRequest
+	for {
+		req, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return reader.Format(), reqs
+		}
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+func TestReaderDetectsFormats(t *testing.T) {
+	first := testRequest("first", 100, 200)
+	second := testRequest("second", 300, 400)
+	jsonLines := encodeJSONLines(t, first, second)
+	fixed := encodeFixedProto(t, first, second)
+
+	cases := []struct {
+		name   string
+		data   []byte
+		format Format
+	}{
+		{name: "json", data: jsonLines, format: FormatJSON},
+		{name: "proto", data: fixed, format: FormatProto},
+		{name: "proto-varint", data: encodeVarintProto(t, first, second), format: FormatProtoVarint},
+		{name: "gzip json", data: gzipBytes(t, jsonLines), format: FormatJSON},
+		{name: "zstd proto", data: zstdBytes(t, fixed), format: FormatProto},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			format, reqs := readAll(t, tc.data, FormatAuto)
+			if format != tc.format {
+				t.Fatalf("expected format %s got %s", tc.format, format)
+			}
+			if len(reqs) != 2 {
+				t.Fatalf("expected 2 requests got %d", len(reqs))
+			}
+			if !proto.Equal(reqs[0], first) || !proto.Equal(reqs[1], second) {
+				t.Fatalf("decoded requests mismatch: %v", reqs)
+			}
+		})
+	}
+}
+
+func TestReaderSkipsBlankLines(t *testing.T) {
+	data := append([]byte("\n\n"), encodeJSONLines(t, testRequest("only", 1, 2))...)
+	data = append(data, '\n')
+	_, reqs := readAll(t, data, FormatJSON)
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request got %d", len(reqs))
+	}
+}
+
+func TestReaderReportsBadLine(t *testing.T) {
+	data := append(encodeJSONLines(t, testRequest("ok", 1, 2)), []byte("{not json\n")...)
+	reader, err := NewReader(bytes.NewReader(data), FormatAuto)
+	if err != nil {
+		t.Fatalf("new reader: %v", err)
+	}
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("first line: %v", err)
+	}
+	if _, err := reader.Next(); err == nil || !bytes.Contains([]byte(err.Error()), []byte("line 2")) {
+		t.Fatalf("expected line 2 error, got %v", err)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if format, err := ParseFormat(""); err != nil || format != FormatAuto {
+		t.Fatalf("expected auto, got %s %v", format, err)
+	}
+	if format, err := ParseFormat("JSON"); err != nil || format != FormatJSON {
+		t.Fatalf("expected json, got %s %v", format, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 
 	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
 )
 
 const (
@@ -29,12 +30,14 @@ var errBodyTooLarge = errors.New("request body too large")
 type Options struct {
 	MaxBodyBytes int64
 	Logger       *log.Logger
+	Metrics      *metrics.Registry
 }
 
 type Handler struct {
-	sink         ingest.TraceSink
-	maxBodyBytes int64
-	logger       *log.Logger
+	sink          ingest.TraceSink
+	maxBodyBytes  int64
+	logger        *log.Logger
+	receivedSpans *metrics.Counter
 }
 
 func NewHandler(sink ingest.TraceSink, opts Options) http.Handler {
@@ -42,7 +45,12 @@ func NewHandler(sink ingest.TraceSink, opts Options) http.Handler {
 	if maxBody <= 0 {
 		maxBody = maxBodySize
 	}
-	return &Handler{sink: sink, maxBodyBytes: maxBody, logger: opts.Logger}
+	return metrics.InstrumentHandler(opts.Metrics, "otlp", &Handler{
+		sink:          sink,
+		maxBodyBytes:  maxBody,
+		logger:        opts.Logger,
+		receivedSpans: opts.Metrics.Counter("smelldeadfish_received_spans_total", "Spans accepted by the OTLP receiver, by service.", "service"),
+	})
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -87,6 +95,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	h.countSpans(&req)
 	resp := &coltracepb.ExportTraceServiceResponse{}
 	payload, err := proto.Marshal(resp)
 	if err != nil {
@@ -99,6 +108,17 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(payload)
 }
 
+func (h *Handler) countSpans(req *coltracepb.ExportTraceServiceRequest) {
+	if h.receivedSpans == nil {
+		return
+	}
+	for _, resourceSpans := range req.GetResourceSpans() {
+		if count := ingest.CountSpans(resourceSpans); count > 0 {
+			h.receivedSpans.Add(float64(count), ingest.ResourceServiceName(resourceSpans.GetResource()))
+		}
+	}
+}
+
 func (h *Handler) logError(r *http.Request, status int, err error, start time.Time, bodyBytes int64) {
 	if h == nil || h.logger == nil {
 		return
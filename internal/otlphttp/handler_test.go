@@ -12,6 +12,11 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/metrics"
 )
 
 type captureSink struct {
@@ -92,3 +97,34 @@ func TestHandlerLogsErrors(t *testing.T) {
 		t.Fatalf("expected log line for error, got: %s", logged)
 	}
 }
+
+func TestHandlerRecordsMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := NewHandler(&captureSink{}, Options{Metrics: registry})
+	payload, err := proto.Marshal(&coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "svc"}}},
+			}},
+			ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{Name: "a"}, {Name: "b"}}}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, tracesPath, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", protobufMime)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	resp := httptest.NewRecorder()
+	registry.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := resp.Body.String()
+	for _, want := range []string{
+		`smelldeadfish_http_requests_total{handler="otlp",code="200"} 1`,
+		`smelldeadfish_received_spans_total{service="svc"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in\n%s", want, body)
+		}
+	}
+}
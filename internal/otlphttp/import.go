@@ -0,0 +1,171 @@
+package otlphttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/otlpfile"
+)
+
+const (
+	importPath        = "/api/import"
+	maxImportBodySize = 1 << 30
+)
+
+type ImportOptions struct {
+	MaxBodyBytes int64
+	Logger       *log.Logger
+	Metrics      *metrics.Registry
+}
+
+type ImportHandler struct {
+	sink         ingest.TraceSink
+	maxBodyBytes int64
+	logger       *log.Logger
+}
+
+type ImportResponse struct {
+	Requests  int   `json:"requests"`
+	Spans     int   `json:"spans"`
+	BytesRead int64 `json:"bytes_read"`
+}
+
+// NewImportHandler accepts an uploaded OTLP file (JSON lines or
+// length-delimited protobuf, optionally gzip/zstd) and replays it into sink.
+func NewImportHandler(sink ingest.TraceSink, opts ImportOptions) http.Handler {
+	maxBody := opts.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = maxImportBodySize
+	}
+	return metrics.InstrumentHandler(opts.Metrics, "import", &ImportHandler{sink: sink, maxBodyBytes: maxBody, logger: opts.Logger})
+}
+
+func (h *ImportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.URL.Path != importPath {
+		h.logError(r, http.StatusNotFound, errors.New("not found"), start)
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.logError(r, http.StatusMethodNotAllowed, errors.New("method not allowed"), start)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	format, err := otlpfile.ParseFormat(query.Get("format"))
+	if err != nil {
+		h.logError(r, http.StatusBadRequest, err, start)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rebase := false
+	if raw := strings.TrimSpace(query.Get("rebase")); raw != "" {
+		rebase, err = strconv.ParseBool(raw)
+		if err != nil {
+			h.logError(r, http.StatusBadRequest, err, start)
+			http.Error(w, "rebase must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+	open := func() (io.ReadCloser, error) { return io.NopCloser(body), nil }
+	if rebase {
+		// Rebasing reads the input twice, so spool the upload to disk first.
+		path, err := spool(body)
+		if err != nil {
+			status := http.StatusBadRequest
+			if isBodyTooLarge(err) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			h.logError(r, status, err, start)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		defer os.Remove(path)
+		open = func() (io.ReadCloser, error) { return os.Open(path) }
+	}
+
+	progress, err := otlpfile.Import(r.Context(), h.sink, open, otlpfile.ImportOptions{Format: format, Rebase: rebase})
+	if err != nil {
+		status := http.StatusBadRequest
+		message := err.Error()
+		switch {
+		case isBodyTooLarge(err):
+			status = http.StatusRequestEntityTooLarge
+			message = errBodyTooLarge.Error()
+		case errors.Is(err, otlpfile.ErrSink):
+			status = http.StatusInternalServerError
+			message = "failed to consume trace"
+		}
+		h.logError(r, status, err, start)
+		http.Error(w, fmt.Sprintf("%s (imported %d requests)", message, progress.Requests), status)
+		return
+	}
+	if h.logger != nil {
+		h.logger.Printf("msg=import_complete requests=%d spans=%d bytes_read=%d duration_ms=%d", progress.Requests, progress.Spans, progress.BytesRead, time.Since(start).Milliseconds())
+	}
+
+	payload, err := json.Marshal(ImportResponse{Requests: progress.Requests, Spans: progress.Spans, BytesRead: progress.BytesRead})
+	if err != nil {
+		h.logError(r, http.StatusInternalServerError, err, start)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(payload)
+}
+
+func spool(body io.Reader) (string, error) {
+	file, err := os.CreateTemp("", "smelldeadfish-import-*")
+	if err != nil {
+		return "", fmt.Errorf("create spool file: %w", err)
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("close spool file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+func (h *ImportHandler) logError(r *http.Request, status int, err error, start time.Time) {
+	if h == nil || h.logger == nil {
+		return
+	}
+	errMessage := ""
+	if err != nil {
+		errMessage = err.Error()
+	}
+	h.logger.Printf(
+		"msg=request_error handler=import method=%s path=%s status=%d duration_ms=%d error=%q content_length=%d",
+		r.Method,
+		r.URL.Path,
+		status,
+		time.Since(start).Milliseconds(),
+		errMessage,
+		r.ContentLength,
+	)
+}
@@ -0,0 +1,128 @@
+package otlphttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/otlpjson"
+)
+
+type importSink struct {
+	reqs []*coltracepb.ExportTraceServiceRequest
+}
+
+func (s *importSink) Consume(_ context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	s.reqs = append(s.reqs, req)
+	return nil
+}
+
+func importBody(t *testing.T, count int) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	for i := 0; i < count; i++ {
+		payload, err := otlpjson.Marshal(&coltracepb.ExportTraceServiceRequest{
+			ResourceSpans: []*tracepb.ResourceSpans{{
+				ScopeSpans: []*tracepb.ScopeSpans{{
+					Spans: []*tracepb.Span{{
+						TraceId:           bytes.Repeat([]byte{0x01}, 16),
+						SpanId:            []byte{0, 0, 0, 0, 0, 0, 0, byte(i + 1)},
+						Name:              "op",
+						StartTimeUnixNano: 1_000,
+						EndTimeUnixNano:   2_000,
+					}},
+				}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		buffer.Write(payload)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+func TestImportHandlerImportsJSONLines(t *testing.T) {
+	sink := &importSink{}
+	h := NewImportHandler(sink, ImportOptions{})
+	req := httptest.NewRequest(http.MethodPost, importPath, bytes.NewReader(importBody(t, 3)))
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	var decoded ImportResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if decoded.Requests != 3 || decoded.Spans != 3 || len(sink.reqs) != 3 {
+		t.Fatalf("unexpected import result: %+v consumed=%d", decoded, len(sink.reqs))
+	}
+}
+
+func TestImportHandlerRebases(t *testing.T) {
+	sink := &importSink{}
+	h := NewImportHandler(sink, ImportOptions{})
+	req := httptest.NewRequest(http.MethodPost, importPath+"?rebase=true", bytes.NewReader(importBody(t, 1)))
+	resp := httptest.NewRecorder()
+
+	before := time.Now().UnixNano()
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	span := sink.reqs[0].GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0]
+	if int64(span.GetEndTimeUnixNano()) < before {
+		t.Fatalf("expected end time rebased to now, got %d", span.GetEndTimeUnixNano())
+	}
+	if span.GetEndTimeUnixNano()-span.GetStartTimeUnixNano() != 1_000 {
+		t.Fatalf("expected duration preserved")
+	}
+}
+
+func TestImportHandlerRejectsInvalidInput(t *testing.T) {
+	h := NewImportHandler(&importSink{}, ImportOptions{})
+	req := httptest.NewRequest(http.MethodPost, importPath, bytes.NewReader([]byte("{broken\n")))
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d got %d", http.StatusBadRequest, resp.Code)
+	}
+}
+
+func TestImportHandlerRejectsLargeBody(t *testing.T) {
+	h := NewImportHandler(&importSink{}, ImportOptions{MaxBodyBytes: 16})
+	req := httptest.NewRequest(http.MethodPost, importPath, bytes.NewReader(importBody(t, 2)))
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d got %d", http.StatusRequestEntityTooLarge, resp.Code)
+	}
+}
+
+func TestImportHandlerRejectsWrongMethod(t *testing.T) {
+	h := NewImportHandler(&importSink{}, ImportOptions{})
+	req := httptest.NewRequest(http.MethodGet, importPath, nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected %d got %d", http.StatusMethodNotAllowed, resp.Code)
+	}
+}
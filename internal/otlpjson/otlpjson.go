@@ -0,0 +1,96 @@
+package otlpjson
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+)
+
+// OTLP/JSON differs from the canonical protobuf JSON mapping in that trace and
+// span identifiers are hex strings rather than base64 and enums are numbers.
+// These helpers bridge the two so the rest of the code can stay on protojson.
+
+var idFields = map[string]bool{
+	"traceId":        true,
+	"spanId":         true,
+	"parentSpanId":   true,
+	"trace_id":       true,
+	"span_id":        true,
+	"parent_span_id": true,
+}
+
+func Marshal(req *coltracepb.ExportTraceServiceRequest) ([]byte, error) {
+	payload, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal otlp json: %w", err)
+	}
+	return rewriteIDs(payload, base64ToHex)
+}
+
+func Unmarshal(data []byte, req *coltracepb.ExportTraceServiceRequest) error {
+	payload, err := rewriteIDs(data, hexToBase64)
+	if err != nil {
+		return err
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(payload, req); err != nil {
+		return fmt.Errorf("unmarshal otlp json: %w", err)
+	}
+	return nil
+}
+
+func rewriteIDs(data []byte, convert func(string) string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode otlp json: %w", err)
+	}
+	rewriteValue(doc, convert)
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("encode otlp json: %w", err)
+	}
+	return payload, nil
+}
+
+func rewriteValue(value any, convert func(string) string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if raw, ok := item.(string); ok && idFields[key] {
+				v[key] = convert(raw)
+				continue
+			}
+			rewriteValue(item, convert)
+		}
+	case []any:
+		for _, item := range v {
+			rewriteValue(item, convert)
+		}
+	}
+}
+
+func base64ToHex(raw string) string {
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return raw
+	}
+	return hex.EncodeToString(decoded)
+}
+
+func hexToBase64(raw string) string {
+	if len(raw)%2 != 0 {
+		return raw
+	}
+	decoded, err := hex.DecodeString(raw)
+	if err != nil {
+		return raw
+	}
+	return base64.StdEncoding.EncodeToString(decoded)
+}
@@ -0,0 +1,69 @@
+package otlpjson
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+func TestMarshalUsesHexIDs(t *testing.T) {
+	req := &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{{
+					TraceId:      []byte{0x4b, 0xf9, 0x2f, 0x35},
+					SpanId:       []byte{0x00, 0xf0, 0x67, 0xaa},
+					ParentSpanId: []byte{0x01, 0x02},
+					Kind:         tracepb.Span_SPAN_KIND_SERVER,
+					Attributes: []*commonpb.KeyValue{
+						{Key: "traceId", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: []byte{0xff}}}},
+					},
+					Links: []*tracepb.Span_Link{{TraceId: []byte{0xab}, SpanId: []byte{0xcd}}},
+				}},
+			}},
+		}},
+	}
+
+	payload, err := Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	body := string(payload)
+	for _, want := range []string{`"traceId":"4bf92f35"`, `"spanId":"00f067aa"`, `"parentSpanId":"0102"`, `"traceId":"ab"`, `"kind":2`, `"bytesValue":"/w=="`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %s in %s", want, body)
+		}
+	}
+
+	var decoded coltracepb.ExportTraceServiceRequest
+	if err := Unmarshal(payload, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !proto.Equal(req, &decoded) {
+		t.Fatalf("round trip mismatch: %v", &decoded)
+	}
+}
+
+func TestUnmarshalAcceptsCollectorFileExporterLine(t *testing.T) {
+	line := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"svc"}}]},"scopeSpans":[{"scope":{"name":"s"},"spans":[{"traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174","parentSpanId":"","name":"op","kind":2,"startTimeUnixNano":"1544712660000000000","endTimeUnixNano":"1544712661000000000","attributes":[{"key":"n","value":{"intValue":"3"}}],"status":{}}]}]}]}`
+
+	var req coltracepb.ExportTraceServiceRequest
+	if err := Unmarshal([]byte(line), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	span := req.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0]
+	if len(span.GetTraceId()) != 16 || span.GetTraceId()[0] != 0x5b {
+		t.Fatalf("unexpected trace id: %x", span.GetTraceId())
+	}
+	if len(span.GetParentSpanId()) != 0 {
+		t.Fatalf("expected empty parent id, got %x", span.GetParentSpanId())
+	}
+	if span.GetKind() != tracepb.Span_SPAN_KIND_SERVER || span.GetAttributes()[0].GetValue().GetIntValue() != 3 {
+		t.Fatalf("unexpected span: %v", span)
+	}
+}
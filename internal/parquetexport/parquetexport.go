@@ -0,0 +1,199 @@
+// Package parquetexport writes stored spans to Parquet files, one row per
+// span with resource, scope and span attributes as string maps.
+package parquetexport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/otlpconv"
+	"smelldeadfish/internal/spanstore"
+)
+
+const (
+	pageSize     = 1000
+	rowGroupSize = 122880
+)
+
+var attributeMap = arrow.MapOf(arrow.BinaryTypes.String, arrow.BinaryTypes.String)
+
+// Schema is the layout of an exported file. Stores that write Parquet
+// themselves must produce the same columns. Attribute values use the string
+// form the stores persist; parent_span_id is null for root spans and the
+// attribute maps are null when empty.
+var Schema = arrow.NewSchema([]arrow.Field{
+	{Name: "trace_id", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "span_id", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "parent_span_id", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "name", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "kind", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "start_time_unix_nano", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+	{Name: "end_time_unix_nano", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+	{Name: "duration_nano", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+	{Name: "status_code", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+	{Name: "status_message", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "service_name", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "resource_attributes", Type: attributeMap, Nullable: true},
+	{Name: "scope_name", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "scope_version", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "scope_attributes", Type: attributeMap, Nullable: true},
+	{Name: "attributes", Type: attributeMap, Nullable: true},
+}, nil)
+
+// WriteFile writes the spans matching params to a Parquet file at path, in
+// export order. Stores implementing spanstore.ParquetStore write the file
+// themselves; others are read page by page and encoded here. After and Limit
+// are ignored. A partial file is removed on error.
+func WriteFile(ctx context.Context, store spanstore.ExportStore, path string, params spanstore.ExportParams) (int64, error) {
+	if native, ok := store.(spanstore.ParquetStore); ok {
+		return native.WriteParquet(ctx, params, path)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("create parquet file: %w", err)
+	}
+	spans, err := Write(ctx, store, file, params)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("close parquet file: %w", closeErr)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return 0, err
+	}
+	return spans, nil
+}
+
+// Write encodes the spans matching params as Parquet to w, in export order.
+// After and Limit are ignored.
+func Write(ctx context.Context, store spanstore.ExportStore, w io.Writer, params spanstore.ExportParams) (int64, error) {
+	if store == nil {
+		return 0, errors.New("store is required")
+	}
+	props := parquet.NewWriterProperties(
+		parquet.WithCompression(compress.Codecs.Zstd),
+		parquet.WithMaxRowGroupLength(rowGroupSize),
+	)
+	// The parquet writer closes writers it is given; the caller owns w.
+	writer, err := pqarrow.NewFileWriter(Schema, struct{ io.Writer }{w}, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return 0, fmt.Errorf("create parquet writer: %w", err)
+	}
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, Schema)
+	defer builder.Release()
+
+	var spans int64
+	params.After, params.Limit = nil, pageSize
+	for {
+		if err := ctx.Err(); err != nil {
+			_ = writer.Close()
+			return spans, err
+		}
+		page, err := store.ExportSpans(ctx, params)
+		if err != nil {
+			_ = writer.Close()
+			return spans, fmt.Errorf("read spans: %w", err)
+		}
+		if page.Spans == 0 {
+			break
+		}
+		if err := appendRequest(builder, page.Request); err != nil {
+			_ = writer.Close()
+			return spans, err
+		}
+		record := builder.NewRecordBatch()
+		err = writer.WriteBuffered(record)
+		record.Release()
+		if err != nil {
+			return spans, fmt.Errorf("write parquet: %w", err)
+		}
+		spans += int64(page.Spans)
+		if page.Spans < pageSize {
+			break
+		}
+		params.After = page.Next
+	}
+	if err := writer.Close(); err != nil {
+		return spans, fmt.Errorf("write parquet: %w", err)
+	}
+	return spans, nil
+}
+
+func appendRequest(builder *array.RecordBuilder, req *coltracepb.ExportTraceServiceRequest) error {
+	fields := builder.Fields()
+	for _, resourceSpans := range req.GetResourceSpans() {
+		resource := resourceSpans.GetResource()
+		service := ingest.ResourceServiceName(resource)
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			scope := scopeSpans.GetScope()
+			for _, span := range scopeSpans.GetSpans() {
+				start, end := int64(span.GetStartTimeUnixNano()), int64(span.GetEndTimeUnixNano())
+				fields[0].(*array.StringBuilder).Append(ingest.FormatTraceID(span.GetTraceId()))
+				fields[1].(*array.StringBuilder).Append(ingest.FormatSpanID(span.GetSpanId()))
+				if parent := span.GetParentSpanId(); len(parent) > 0 {
+					fields[2].(*array.StringBuilder).Append(ingest.FormatSpanID(parent))
+				} else {
+					fields[2].AppendNull()
+				}
+				fields[3].(*array.StringBuilder).Append(span.GetName())
+				fields[4].(*array.StringBuilder).Append(ingest.SpanKind(span.GetKind()))
+				fields[5].(*array.Int64Builder).Append(start)
+				fields[6].(*array.Int64Builder).Append(end)
+				fields[7].(*array.Int64Builder).Append(end - start)
+				fields[8].(*array.Int32Builder).Append(int32(span.GetStatus().GetCode()))
+				fields[9].(*array.StringBuilder).Append(span.GetStatus().GetMessage())
+				fields[10].(*array.StringBuilder).Append(service)
+				if err := appendAttributes(fields[11].(*array.MapBuilder), resource.GetAttributes()); err != nil {
+					return err
+				}
+				fields[12].(*array.StringBuilder).Append(scope.GetName())
+				fields[13].(*array.StringBuilder).Append(scope.GetVersion())
+				if err := appendAttributes(fields[14].(*array.MapBuilder), scope.GetAttributes()); err != nil {
+					return err
+				}
+				if err := appendAttributes(fields[15].(*array.MapBuilder), span.GetAttributes()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// appendAttributes adds attrs as one map sorted by key, or null when empty.
+func appendAttributes(builder *array.MapBuilder, attrs []*commonpb.KeyValue) error {
+	if len(attrs) == 0 {
+		builder.AppendNull()
+		return nil
+	}
+	sorted := append([]*commonpb.KeyValue(nil), attrs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetKey() < sorted[j].GetKey() })
+	keys := builder.KeyBuilder().(*array.StringBuilder)
+	values := builder.ItemBuilder().(*array.StringBuilder)
+	builder.Append(true)
+	for i, attr := range sorted {
+		if i > 0 && attr.GetKey() == sorted[i-1].GetKey() {
+			continue
+		}
+		_, value, err := otlpconv.StoredForm(attr.GetValue())
+		if err != nil {
+			return err
+		}
+		keys.Append(attr.GetKey())
+		values.Append(value)
+	}
+	return nil
+}
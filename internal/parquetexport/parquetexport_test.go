@@ -0,0 +1,279 @@
+package parquetexport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	ingestduckdb "smelldeadfish/internal/ingest/duckdb"
+	ingestsqlite "smelldeadfish/internal/ingest/sqlite"
+	"smelldeadfish/internal/otlpconv"
+	"smelldeadfish/internal/spanstore"
+)
+
+func testRequest() *coltracepb.ExportTraceServiceRequest {
+	resource := func(service string) *resourcepb.Resource {
+		return &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			{Key: "service.name", Value: otlpconv.AnyValue(service)},
+			{Key: "host.cores", Value: otlpconv.AnyValue(int64(8))},
+		}}
+	}
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{
+			{
+				Resource: resource("api"),
+				ScopeSpans: []*tracepb.ScopeSpans{{
+					Scope: &commonpb.InstrumentationScope{
+						Name: "http", Version: "1.2",
+						Attributes: []*commonpb.KeyValue{{Key: "scope.attr", Value: otlpconv.AnyValue("s")}},
+					},
+					Spans: []*tracepb.Span{
+						{
+							TraceId: []byte{1}, SpanId: []byte{1}, Name: "GET /", Kind: tracepb.Span_SPAN_KIND_SERVER,
+							StartTimeUnixNano: 1_000, EndTimeUnixNano: 1_500,
+							Attributes: []*commonpb.KeyValue{
+								{Key: "http.status_code", Value: otlpconv.AnyValue(int64(500))},
+								{Key: "http.method", Value: otlpconv.AnyValue("GET")},
+								{Key: "tags", Value: otlpconv.AnyValue([]any{"a", int64(1)})},
+							},
+							Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "boom"},
+						},
+						{
+							TraceId: []byte{1}, SpanId: []byte{2}, ParentSpanId: []byte{1}, Name: "query",
+							StartTimeUnixNano: 1_100, EndTimeUnixNano: 1_200,
+						},
+					},
+				}},
+			},
+			{
+				Resource: resource("worker"),
+				ScopeSpans: []*tracepb.ScopeSpans{{
+					Spans: []*tracepb.Span{{
+						TraceId: []byte{2}, SpanId: []byte{3}, Name: "job",
+						StartTimeUnixNano: 2_000, EndTimeUnixNano: 2_600,
+					}},
+				}},
+			},
+		},
+	}
+}
+
+func newSQLite(t *testing.T) *ingestsqlite.Sink {
+	t.Helper()
+	sink, err := ingestsqlite.New(filepath.Join(t.TempDir(), "spans.sqlite"))
+	if err != nil {
+		t.Fatalf("new sqlite sink: %v", err)
+	}
+	t.Cleanup(func() { _ = sink.Close() })
+	if err := sink.Consume(context.Background(), testRequest()); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	return sink
+}
+
+// readRows decodes a Parquet file into one JSON object per row.
+func readRows(t *testing.T, data []byte) []string {
+	t.Helper()
+	reader, err := file.NewParquetReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("open parquet: %v", err)
+	}
+	defer reader.Close()
+	arrowReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatalf("open arrow reader: %v", err)
+	}
+	table, err := arrowReader.ReadTable(context.Background())
+	if err != nil {
+		t.Fatalf("read table: %v", err)
+	}
+	defer table.Release()
+	names := make([]string, 0, table.NumCols())
+	for _, field := range table.Schema().Fields() {
+		names = append(names, field.Name)
+	}
+	if want := Schema.Fields(); len(names) != len(want) {
+		t.Fatalf("expected %d columns, got %v", len(want), names)
+	}
+	for i, field := range Schema.Fields() {
+		if names[i] != field.Name {
+			t.Fatalf("expected column %d to be %s, got %s", i, field.Name, names[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	tableReader := array.NewTableReader(table, -1)
+	defer tableReader.Release()
+	for tableReader.Next() {
+		if err := array.RecordToJSON(tableReader.RecordBatch(), &buf); err != nil {
+			t.Fatalf("encode rows: %v", err)
+		}
+	}
+	var rows []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line != "" {
+			rows = append(rows, line)
+		}
+	}
+	return rows
+}
+
+func decodeRow(t *testing.T, row string) map[string]any {
+	t.Helper()
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(row), &decoded); err != nil {
+		t.Fatalf("decode row %s: %v", row, err)
+	}
+	return decoded
+}
+
+func TestWriteFlattensSpans(t *testing.T) {
+	var buf bytes.Buffer
+	spans, err := Write(context.Background(), newSQLite(t), &buf, spanstore.ExportParams{})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if spans != 3 {
+		t.Fatalf("expected 3 spans written, got %d", spans)
+	}
+	rows := readRows(t, buf.Bytes())
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %v", rows)
+	}
+
+	root := decodeRow(t, rows[0])
+	want := map[string]any{
+		"trace_id":             "01",
+		"span_id":              "01",
+		"name":                 "GET /",
+		"kind":                 "SPAN_KIND_SERVER",
+		"start_time_unix_nano": float64(1_000),
+		"duration_nano":        float64(500),
+		"status_code":          float64(2),
+		"status_message":       "boom",
+		"service_name":         "api",
+		"scope_name":           "http",
+		"scope_version":        "1.2",
+	}
+	for key, value := range want {
+		if root[key] != value {
+			t.Fatalf("expected %s=%v, got %v in %s", key, value, root[key], rows[0])
+		}
+	}
+	if root["parent_span_id"] != nil {
+		t.Fatalf("expected null parent for root span, got %v", root["parent_span_id"])
+	}
+	if !strings.Contains(rows[0], `"attributes":[{"key":"http.method","value":"GET"},{"key":"http.status_code","value":"500"},{"key":"tags","value":"{\"arrayValue\":{\"values\":[{\"stringValue\":\"a\"},{\"intValue\":\"1\"}]}}"}]`) {
+		t.Fatalf("expected sorted span attribute map, got %s", rows[0])
+	}
+	if !strings.Contains(rows[0], `"resource_attributes":[{"key":"host.cores","value":"8"},{"key":"service.name","value":"api"}]`) {
+		t.Fatalf("expected resource attribute map, got %s", rows[0])
+	}
+	if child := decodeRow(t, rows[1]); child["parent_span_id"] != "01" || child["attributes"] != nil {
+		t.Fatalf("unexpected child row: %s", rows[1])
+	}
+}
+
+func TestWriteFiltersByServiceAndTime(t *testing.T) {
+	store := newSQLite(t)
+	cases := []struct {
+		name   string
+		params spanstore.ExportParams
+		want   []string
+	}{
+		{name: "service", params: spanstore.ExportParams{Service: "worker"}, want: []string{"03"}},
+		{name: "window", params: spanstore.ExportParams{Start: 1_050, End: 2_000}, want: []string{"02", "03"}},
+		{name: "empty", params: spanstore.ExportParams{Service: "missing"}, want: nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if _, err := Write(context.Background(), store, &buf, tc.params); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			var got []string
+			for _, row := range readRows(t, buf.Bytes()) {
+				got = append(got, decodeRow(t, row)["span_id"].(string))
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("expected spans %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWriteFileRemovesPartialFile(t *testing.T) {
+	store := newSQLite(t)
+	path := filepath.Join(t.TempDir(), "spans.parquet")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := WriteFile(ctx, store, path, spanstore.ExportParams{}); err == nil {
+		t.Fatal("expected error for canceled context")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected partial file to be removed, got %v", err)
+	}
+}
+
+// goWriter hides a store's native Parquet support.
+type goWriter struct {
+	spanstore.ExportStore
+}
+
+func TestDuckDBWriteMatchesGoWriter(t *testing.T) {
+	if !ingestduckdb.Available() {
+		t.Skip("duckdb support unavailable")
+	}
+	dir := t.TempDir()
+	sink, err := ingestduckdb.New(filepath.Join(dir, "spans.duckdb"))
+	if err != nil {
+		t.Fatalf("new duckdb sink: %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Consume(context.Background(), testRequest()); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	for _, params := range []spanstore.ExportParams{{}, {Service: "api", Start: 1_050}} {
+		nativePath := filepath.Join(dir, "native.parquet")
+		goPath := filepath.Join(dir, "go.parquet")
+		nativeSpans, err := WriteFile(context.Background(), sink, nativePath, params)
+		if err != nil {
+			t.Fatalf("native write: %v", err)
+		}
+		goSpans, err := WriteFile(context.Background(), goWriter{sink}, goPath, params)
+		if err != nil {
+			t.Fatalf("go write: %v", err)
+		}
+		if nativeSpans != goSpans {
+			t.Fatalf("expected %d spans from duckdb, got %d", goSpans, nativeSpans)
+		}
+		nativeRows := readRows(t, readFile(t, nativePath))
+		goRows := readRows(t, readFile(t, goPath))
+		if strings.Join(nativeRows, "\n") != strings.Join(goRows, "\n") {
+			t.Fatalf("duckdb rows differ from go rows:\nduckdb=%v\ngo=%v", nativeRows, goRows)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return data
+}
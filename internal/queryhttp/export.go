@@ -0,0 +1,121 @@
+package queryhttp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/parquetexport"
+	"smelldeadfish/internal/spanstore"
+)
+
+const (
+	exportPath       = "/api/export"
+	parquetMediaType = "application/vnd.apache.parquet"
+)
+
+type ExportHandler struct {
+	store  spanstore.Store
+	logger *log.Logger
+}
+
+func NewExportHandler(store spanstore.Store) http.Handler {
+	return NewExportHandlerWithOptions(store, Options{})
+}
+
+func NewExportHandlerWithOptions(store spanstore.Store, opts Options) http.Handler {
+	return metrics.InstrumentHandler(opts.Metrics, "export_spans", &ExportHandler{store: store, logger: loggerFromOptions(opts)})
+}
+
+// ServeHTTP writes the requested spans to a temporary Parquet file and
+// serves it, so errors are reported before any of the body is sent.
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	service := strings.TrimSpace(r.URL.Query().Get("service"))
+	if r.URL.Path != exportPath {
+		logRequestError(h.logger, "export_spans", r, http.StatusNotFound, start, errors.New("not found"), service)
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		logRequestError(h.logger, "export_spans", r, http.StatusMethodNotAllowed, start, errors.New("method not allowed"), service)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	exporter, ok := h.store.(spanstore.ExportStore)
+	if !ok {
+		logRequestError(h.logger, "export_spans", r, http.StatusNotImplemented, start, errors.New("store does not support export"), service)
+		http.Error(w, "export is not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	params, err := parseExportParams(r)
+	if err != nil {
+		logRequestError(h.logger, "export_spans", r, http.StatusBadRequest, start, err, service)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "smelldeadfish-export-*")
+	if err != nil {
+		logRequestError(h.logger, "export_spans", r, http.StatusInternalServerError, start, err, service)
+		http.Error(w, "failed to export spans", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.parquet")
+	if _, err := parquetexport.WriteFile(r.Context(), exporter, path, params); err != nil {
+		logRequestError(h.logger, "export_spans", r, http.StatusInternalServerError, start, err, service)
+		http.Error(w, "failed to export spans", http.StatusInternalServerError)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		logRequestError(h.logger, "export_spans", r, http.StatusInternalServerError, start, err, service)
+		http.Error(w, "failed to export spans", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", parquetMediaType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(params)))
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+func parseExportParams(r *http.Request) (spanstore.ExportParams, error) {
+	values := r.URL.Query()
+	start, err := parseInt64(values.Get("start"), "start")
+	if err != nil {
+		return spanstore.ExportParams{}, err
+	}
+	end, err := parseInt64(values.Get("end"), "end")
+	if err != nil {
+		return spanstore.ExportParams{}, err
+	}
+	if end < start {
+		return spanstore.ExportParams{}, fmt.Errorf("end must not be before start")
+	}
+	return spanstore.ExportParams{
+		Service: strings.TrimSpace(values.Get("service")),
+		Start:   start,
+		End:     end,
+	}, nil
+}
+
+func exportFileName(params spanstore.ExportParams) string {
+	name := "spans"
+	if params.Service != "" {
+		name += "-" + strings.Map(func(r rune) rune {
+			if r == '"' || r == '/' || r == '\\' || r < ' ' {
+				return '_'
+			}
+			return r
+		}, params.Service)
+	}
+	return fmt.Sprintf("%s-%d-%d.parquet", name, params.Start, params.End)
+}
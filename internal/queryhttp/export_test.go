@@ -0,0 +1,75 @@
+package queryhttp
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+type exportStore struct {
+	traceStore
+	params spanstore.ExportParams
+}
+
+func (e *exportStore) ExportSpans(_ context.Context, params spanstore.ExportParams) (spanstore.ExportPage, error) {
+	if params.After != nil {
+		return spanstore.ExportPage{Request: &coltracepb.ExportTraceServiceRequest{}}, nil
+	}
+	e.params = params
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{TraceId: []byte{1}, SpanId: []byte{2}, Name: "op", StartTimeUnixNano: 5}}}},
+	}}}
+	return spanstore.ExportPage{Request: req, Spans: 1, Next: &spanstore.ExportCursor{StartTimeUnixNano: 5, TraceID: "01", SpanID: "02"}}, nil
+}
+
+func TestExportHandlerServesParquet(t *testing.T) {
+	store := &exportStore{}
+	h := NewExportHandler(store)
+	req := httptest.NewRequest(http.MethodGet, exportPath+"?service=svc&start=1&end=10", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if got := resp.Header().Get("Content-Type"); got != parquetMediaType {
+		t.Fatalf("unexpected content type: %s", got)
+	}
+	if got := resp.Header().Get("Content-Disposition"); got != `attachment; filename="spans-svc-1-10.parquet"` {
+		t.Fatalf("unexpected content disposition: %s", got)
+	}
+	body := resp.Body.Bytes()
+	if !bytes.HasPrefix(body, []byte("PAR1")) || !bytes.HasSuffix(body, []byte("PAR1")) {
+		t.Fatalf("expected a parquet file, got %d bytes", len(body))
+	}
+	if store.params.Service != "svc" || store.params.Start != 1 || store.params.End != 10 {
+		t.Fatalf("unexpected export params: %+v", store.params)
+	}
+}
+
+func TestExportHandlerValidatesParams(t *testing.T) {
+	cases := []string{"?service=svc&end=10", "?start=1", "?start=10&end=1"}
+	for _, query := range cases {
+		resp := httptest.NewRecorder()
+		NewExportHandler(&exportStore{}).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, exportPath+query, nil))
+		if resp.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d got %d", query, http.StatusBadRequest, resp.Code)
+		}
+	}
+}
+
+func TestExportHandlerRequiresExportStore(t *testing.T) {
+	resp := httptest.NewRecorder()
+	NewExportHandler(&traceStore{}).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, exportPath+"?start=1&end=10", nil))
+	if resp.Code != http.StatusNotImplemented {
+		t.Fatalf("expected %d got %d", http.StatusNotImplemented, resp.Code)
+	}
+}
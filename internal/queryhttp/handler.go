@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"smelldeadfish/internal/metrics"
 	"smelldeadfish/internal/spanstore"
 )
 
@@ -31,7 +32,7 @@ func NewHandler(store spanstore.Store) http.Handler {
 }
 
 func NewHandlerWithOptions(store spanstore.Store, opts Options) http.Handler {
-	return &Handler{store: store, logger: loggerFromOptions(opts)}
+	return metrics.InstrumentHandler(opts.Metrics, "query_spans", &Handler{store: store, logger: loggerFromOptions(opts)})
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -109,6 +110,7 @@ func parseQueryParams(r *http.Request) (spanstore.QueryParams, error) {
 		Limit:       limit,
 		AttrFilters: filters,
 		StatusCode:  status,
+		Text:        strings.TrimSpace(values.Get("text")),
 	}, nil
 }
 
@@ -138,16 +140,24 @@ func parseInt(raw, field string) (int, error) {
 func parseAttrFilters(rawFilters []string) ([]spanstore.AttrFilter, error) {
 	filters := make([]spanstore.AttrFilter, 0, len(rawFilters))
 	for _, raw := range rawFilters {
-		parts := strings.SplitN(raw, "=", 2)
-		if len(parts) != 2 {
+		idx := strings.IndexAny(raw, "=!<>")
+		if idx < 0 {
 			return nil, fmt.Errorf("attr must be key=value")
 		}
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+		op := spanstore.AttrOp(raw[idx : idx+1])
+		if op != spanstore.AttrOpEqual && strings.HasPrefix(raw[idx+1:], "=") {
+			op += "="
+		}
+		key := strings.TrimSpace(raw[:idx])
+		value := strings.TrimSpace(raw[idx+len(op):])
 		if key == "" || value == "" {
 			return nil, fmt.Errorf("attr must be key=value")
 		}
-		filters = append(filters, spanstore.AttrFilter{Key: key, Value: value})
+		filter := spanstore.AttrFilter{Key: key, Op: op, Value: value}
+		if err := filter.Validate(); err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
 	}
 	return filters, nil
 }
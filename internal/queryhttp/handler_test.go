@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -88,6 +90,67 @@ func TestHandlerAcceptsMissingAttrFilters(t *testing.T) {
 	}
 }
 
+func TestHandlerParsesAttrOperators(t *testing.T) {
+	store := &fakeStore{}
+	h := NewHandler(store)
+	query := url.Values{}
+	query.Set("service", "svc")
+	query.Set("start", "1")
+	query.Set("end", "2")
+	query.Add("attr", "http.status_code>=500")
+	query.Add("attr", "http.method!=GET")
+	query.Add("attr", "retries<3")
+	req := httptest.NewRequest(http.MethodGet, spansPath+"?"+query.Encode(), nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	want := []spanstore.AttrFilter{
+		{Key: "http.status_code", Op: spanstore.AttrOpGreaterEqual, Value: "500"},
+		{Key: "http.method", Op: spanstore.AttrOpNotEqual, Value: "GET"},
+		{Key: "retries", Op: spanstore.AttrOpLess, Value: "3"},
+	}
+	if !reflect.DeepEqual(store.params.AttrFilters, want) {
+		t.Fatalf("unexpected attr filters: %+v", store.params.AttrFilters)
+	}
+}
+
+func TestHandlerRejectsNonNumericComparison(t *testing.T) {
+	h := NewHandler(&fakeStore{})
+	query := url.Values{}
+	query.Set("service", "svc")
+	query.Set("start", "1")
+	query.Set("end", "2")
+	query.Set("attr", "http.method>GET")
+	req := httptest.NewRequest(http.MethodGet, spansPath+"?"+query.Encode(), nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d got %d", http.StatusBadRequest, resp.Code)
+	}
+}
+
+func TestHandlerParsesText(t *testing.T) {
+	store := &fakeStore{}
+	h := NewHandler(store)
+	req := httptest.NewRequest(http.MethodGet, spansPath+"?service=svc&start=1&end=2&text=payment+declined", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	if store.params.Text != "payment declined" {
+		t.Fatalf("unexpected text: %q", store.params.Text)
+	}
+}
+
 func TestHandlerParsesStatus(t *testing.T) {
 	store := &fakeStore{}
 	h := NewHandler(store)
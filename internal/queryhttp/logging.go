@@ -4,10 +4,13 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"smelldeadfish/internal/metrics"
 )
 
 type Options struct {
-	Logger *log.Logger
+	Logger  *log.Logger
+	Metrics *metrics.Registry
 }
 
 func loggerFromOptions(opts Options) *log.Logger {
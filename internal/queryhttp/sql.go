@@ -0,0 +1,187 @@
+package queryhttp
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/spanstore"
+	"smelldeadfish/internal/sqlconsole"
+)
+
+const (
+	sqlPath           = "/api/sql"
+	sqlDefaultTimeout = 10 * time.Second
+	maxSQLBodySize    = 64 << 10
+)
+
+type SQLOptions struct {
+	// Timeout bounds each statement. MaxRows caps the rows returned; the
+	// limit parameter can only lower it.
+	Timeout time.Duration
+	MaxRows int
+	Logger  *log.Logger
+	Metrics *metrics.Registry
+}
+
+type SQLHandler struct {
+	store   spanstore.Store
+	timeout time.Duration
+	maxRows int
+	logger  *log.Logger
+}
+
+func NewSQLHandler(store spanstore.Store) http.Handler {
+	return NewSQLHandlerWithOptions(store, SQLOptions{})
+}
+
+func NewSQLHandlerWithOptions(store spanstore.Store, opts SQLOptions) http.Handler {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = sqlDefaultTimeout
+	}
+	maxRows := opts.MaxRows
+	if maxRows <= 0 {
+		maxRows = sqlconsole.DefaultMaxRows
+	}
+	return metrics.InstrumentHandler(opts.Metrics, "sql", &SQLHandler{store: store, timeout: timeout, maxRows: maxRows, logger: opts.Logger})
+}
+
+// ServeHTTP runs the statement in q (query string, form, or raw POST body)
+// and encodes the result as JSON, or CSV with format=csv.
+func (h *SQLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.URL.Path != sqlPath {
+		logRequestError(h.logger, "sql", r, http.StatusNotFound, start, errors.New("not found"), "")
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		logRequestError(h.logger, "sql", r, http.StatusMethodNotAllowed, start, errors.New("method not allowed"), "")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store, ok := h.store.(spanstore.SQLStore)
+	if !ok {
+		logRequestError(h.logger, "sql", r, http.StatusNotImplemented, start, errors.New("store does not support sql"), "")
+		http.Error(w, "sql is not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	query, format, err := h.parseSQLRequest(w, r)
+	if err != nil {
+		logRequestError(h.logger, "sql", r, http.StatusBadRequest, start, err, "")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	result, err := store.QuerySQL(ctx, query)
+	if err != nil {
+		status := http.StatusBadRequest
+		message := err.Error()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+			message = fmt.Sprintf("query exceeded %s timeout", h.timeout)
+		}
+		logRequestError(h.logger, "sql", r, status, start, err, "")
+		http.Error(w, message, status)
+		return
+	}
+	if result.Truncated {
+		w.Header().Set("X-Result-Truncated", "true")
+	}
+	if format == "csv" {
+		writeSQLCSV(w, result)
+		return
+	}
+	writeJSON(w, r, h.logger, "sql", start, "", result)
+}
+
+func (h *SQLHandler) parseSQLRequest(w http.ResponseWriter, r *http.Request) (spanstore.SQLQuery, string, error) {
+	values := r.URL.Query()
+	query := values.Get("q")
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSQLBodySize))
+		if err != nil {
+			return spanstore.SQLQuery{}, "", fmt.Errorf("read body: %w", err)
+		}
+		query = string(body)
+		// curl -d sends raw statements as forms too, so only a body with a
+		// q field is read as one.
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/x-www-form-urlencoded" {
+			if form, err := url.ParseQuery(query); err == nil && form.Has("q") {
+				query = form.Get("q")
+			}
+		}
+	}
+	if strings.TrimSpace(query) == "" {
+		return spanstore.SQLQuery{}, "", errors.New("q is required")
+	}
+
+	maxRows := h.maxRows
+	if raw := strings.TrimSpace(values.Get("limit")); raw != "" {
+		limit, err := parseInt(raw, "limit")
+		if err != nil {
+			return spanstore.SQLQuery{}, "", err
+		}
+		maxRows = min(limit, maxRows)
+	}
+
+	format := strings.ToLower(strings.TrimSpace(values.Get("format")))
+	if format == "" {
+		format = "json"
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Accept")); mediaType == "text/csv" {
+			format = "csv"
+		}
+	}
+	if format != "json" && format != "csv" {
+		return spanstore.SQLQuery{}, "", fmt.Errorf("format must be json or csv")
+	}
+	return spanstore.SQLQuery{Query: query, MaxRows: maxRows}, format, nil
+}
+
+// writeSQLCSV writes a header row then the rows, with nested values as JSON.
+func writeSQLCSV(w http.ResponseWriter, result spanstore.SQLResult) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(w)
+	_ = writer.Write(result.Columns)
+	record := make([]string, len(result.Columns))
+	for _, row := range result.Rows {
+		for i, value := range row {
+			record[i] = csvField(value)
+		}
+		_ = writer.Write(record)
+	}
+	writer.Flush()
+}
+
+func csvField(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []any, map[string]any:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,135 @@
+package queryhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+type sqlStore struct {
+	traceStore
+	query spanstore.SQLQuery
+	err   error
+	block bool
+}
+
+func (s *sqlStore) QuerySQL(ctx context.Context, query spanstore.SQLQuery) (spanstore.SQLResult, error) {
+	s.query = query
+	if s.block {
+		<-ctx.Done()
+		return spanstore.SQLResult{}, ctx.Err()
+	}
+	if s.err != nil {
+		return spanstore.SQLResult{}, s.err
+	}
+	return spanstore.SQLResult{
+		Columns:   []string{"name", "tags"},
+		Rows:      [][]any{{"GET /", []any{"a", 1}}, {"a,b", nil}},
+		Truncated: true,
+	}, nil
+}
+
+func TestSQLHandlerServesJSON(t *testing.T) {
+	store := &sqlStore{}
+	h := NewSQLHandlerWithOptions(store, SQLOptions{MaxRows: 50})
+	req := httptest.NewRequest(http.MethodGet, sqlPath+"?q=SELECT+name+FROM+spans&limit=10", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if store.query.Query != "SELECT name FROM spans" || store.query.MaxRows != 10 {
+		t.Fatalf("unexpected query: %+v", store.query)
+	}
+	if resp.Header().Get("X-Result-Truncated") != "true" {
+		t.Fatalf("expected truncated header, got %v", resp.Header())
+	}
+	var result spanstore.SQLResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(result.Rows) != 2 || result.Columns[1] != "tags" || !result.Truncated {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestSQLHandlerServesCSV(t *testing.T) {
+	store := &sqlStore{}
+	h := NewSQLHandlerWithOptions(store, SQLOptions{MaxRows: 5})
+	req := httptest.NewRequest(http.MethodPost, sqlPath+"?format=csv&limit=100", strings.NewReader("SELECT name, tags FROM spans"))
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if store.query.Query != "SELECT name, tags FROM spans" || store.query.MaxRows != 5 {
+		t.Fatalf("unexpected query: %+v", store.query)
+	}
+	if want := "name,tags\nGET /,\"[\"\"a\"\",1]\"\n\"a,b\",\n"; resp.Body.String() != want {
+		t.Fatalf("expected csv %q, got %q", want, resp.Body.String())
+	}
+}
+
+func TestSQLHandlerReadsForm(t *testing.T) {
+	store := &sqlStore{}
+	h := NewSQLHandler(store)
+	req := httptest.NewRequest(http.MethodPost, sqlPath, strings.NewReader("q=SELECT+1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/csv")
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK || store.query.Query != "SELECT 1" {
+		t.Fatalf("unexpected response %d for %+v", resp.Code, store.query)
+	}
+	if !strings.HasPrefix(resp.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected csv from Accept header, got %s", resp.Header().Get("Content-Type"))
+	}
+
+	// curl -d labels a raw statement as a form.
+	req = httptest.NewRequest(http.MethodPost, sqlPath, strings.NewReader("SELECT 'a=b' AS pair"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if store.query.Query != "SELECT 'a=b' AS pair" {
+		t.Fatalf("expected raw statement, got %q", store.query.Query)
+	}
+}
+
+func TestSQLHandlerErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		store  spanstore.Store
+		method string
+		target string
+		want   int
+	}{
+		{name: "unsupported store", store: &traceStore{}, method: http.MethodGet, target: sqlPath + "?q=SELECT+1", want: http.StatusNotImplemented},
+		{name: "missing query", store: &sqlStore{}, method: http.MethodGet, target: sqlPath, want: http.StatusBadRequest},
+		{name: "bad format", store: &sqlStore{}, method: http.MethodGet, target: sqlPath + "?q=SELECT+1&format=xml", want: http.StatusBadRequest},
+		{name: "bad limit", store: &sqlStore{}, method: http.MethodGet, target: sqlPath + "?q=SELECT+1&limit=0", want: http.StatusBadRequest},
+		{name: "rejected", store: &sqlStore{err: spanstore.ErrSQLNotAllowed}, method: http.MethodGet, target: sqlPath + "?q=DELETE", want: http.StatusBadRequest},
+		{name: "timeout", store: &sqlStore{block: true}, method: http.MethodGet, target: sqlPath + "?q=SELECT+1", want: http.StatusGatewayTimeout},
+		{name: "method", store: &sqlStore{}, method: http.MethodDelete, target: sqlPath, want: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewSQLHandlerWithOptions(tc.store, SQLOptions{Timeout: 10 * time.Millisecond})
+			resp := httptest.NewRecorder()
+			h.ServeHTTP(resp, httptest.NewRequest(tc.method, tc.target, nil))
+			if resp.Code != tc.want {
+				t.Fatalf("expected %d got %d: %s", tc.want, resp.Code, resp.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,594 @@
+package queryhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/spanstore"
+)
+
+const (
+	tempoEchoPath        = "/api/echo"
+	tempoSearchPath      = "/api/search"
+	tempoTagsPath        = "/api/search/tags"
+	tempoTagValuesPrefix = "/api/search/tag/"
+	tempoTagValuesSuffix = "/values"
+	tempoTracePrefix     = "/api/traces/"
+	tempoDefaultLimit    = 20
+	tempoProtobufMime    = "application/protobuf"
+	tempoServiceTag      = "service.name"
+	tempoStatusTag       = "status.code"
+)
+
+// TempoHandler serves the subset of the Grafana Tempo HTTP API that the Tempo
+// datasource needs. It expects paths relative to its mount point, so callers
+// mounting it under a prefix should wrap it in http.StripPrefix.
+type TempoHandler struct {
+	store  spanstore.Store
+	logger *log.Logger
+}
+
+type TempoSearchResponse struct {
+	Traces  []TempoTraceMetadata `json:"traces"`
+	Metrics TempoSearchMetrics   `json:"metrics"`
+}
+
+type TempoTraceMetadata struct {
+	TraceID           string `json:"traceID"`
+	RootServiceName   string `json:"rootServiceName"`
+	RootTraceName     string `json:"rootTraceName"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	DurationMs        int64  `json:"durationMs"`
+}
+
+type TempoSearchMetrics struct {
+	InspectedTraces int `json:"inspectedTraces"`
+}
+
+type TempoTagsResponse struct {
+	TagNames []string `json:"tagNames"`
+}
+
+type TempoTagValuesResponse struct {
+	TagValues []string `json:"tagValues"`
+}
+
+func NewTempoHandler(store spanstore.Store) http.Handler {
+	return NewTempoHandlerWithOptions(store, Options{})
+}
+
+func NewTempoHandlerWithOptions(store spanstore.Store, opts Options) http.Handler {
+	return metrics.InstrumentHandler(opts.Metrics, "tempo", &TempoHandler{store: store, logger: loggerFromOptions(opts)})
+}
+
+func (h *TempoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		logRequestError(h.logger, "tempo", r, http.StatusMethodNotAllowed, start, errors.New("method not allowed"), "")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Path
+	switch {
+	case path == tempoEchoPath:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("echo"))
+	case path == tempoSearchPath:
+		h.serveSearch(w, r, start)
+	case path == tempoTagsPath:
+		h.serveTags(w, r, start)
+	case strings.HasPrefix(path, tempoTagValuesPrefix) && strings.HasSuffix(path, tempoTagValuesSuffix):
+		tag := strings.TrimSuffix(strings.TrimPrefix(path, tempoTagValuesPrefix), tempoTagValuesSuffix)
+		h.serveTagValues(w, r, start, tag)
+	case strings.HasPrefix(path, tempoTracePrefix):
+		h.serveTrace(w, r, start, strings.TrimPrefix(path, tempoTracePrefix))
+	default:
+		logRequestError(h.logger, "tempo", r, http.StatusNotFound, start, errors.New("not found"), "")
+		http.NotFound(w, r)
+	}
+}
+
+func (h *TempoHandler) serveSearch(w http.ResponseWriter, r *http.Request, start time.Time) {
+	params, err := parseTempoSearchParams(r)
+	if err != nil {
+		logRequestError(h.logger, "tempo_search", r, http.StatusBadRequest, start, err, "")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	traces, err := h.store.QueryTraces(r.Context(), params)
+	if err != nil {
+		logRequestError(h.logger, "tempo_search", r, http.StatusInternalServerError, start, err, params.Service)
+		http.Error(w, "failed to search traces", http.StatusInternalServerError)
+		return
+	}
+	resp := TempoSearchResponse{
+		Traces:  make([]TempoTraceMetadata, 0, len(traces)),
+		Metrics: TempoSearchMetrics{InspectedTraces: len(traces)},
+	}
+	for _, trace := range traces {
+		resp.Traces = append(resp.Traces, TempoTraceMetadata{
+			TraceID:           trace.TraceID,
+			RootServiceName:   trace.ServiceName,
+			RootTraceName:     trace.RootName,
+			StartTimeUnixNano: strconv.FormatInt(trace.StartTimeUnixNano, 10),
+			DurationMs:        time.Duration(trace.DurationUnixNano).Milliseconds(),
+		})
+	}
+	writeJSON(w, r, h.logger, "tempo_search", start, params.Service, resp)
+}
+
+func (h *TempoHandler) serveTags(w http.ResponseWriter, r *http.Request, start time.Time) {
+	params, err := parseTempoTagParams(r)
+	if err != nil {
+		logRequestError(h.logger, "tempo_tags", r, http.StatusBadRequest, start, err, "")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := []string{}
+	if tagStore, ok := h.store.(spanstore.TagStore); ok {
+		names, err = tagStore.QueryTagNames(r.Context(), params)
+		if err != nil {
+			logRequestError(h.logger, "tempo_tags", r, http.StatusInternalServerError, start, err, "")
+			http.Error(w, "failed to query tags", http.StatusInternalServerError)
+			return
+		}
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, r, h.logger, "tempo_tags", start, "", TempoTagsResponse{TagNames: names})
+}
+
+func (h *TempoHandler) serveTagValues(w http.ResponseWriter, r *http.Request, start time.Time, tag string) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" || strings.Contains(tag, "/") {
+		logRequestError(h.logger, "tempo_tag_values", r, http.StatusBadRequest, start, errors.New("tag is required"), "")
+		http.Error(w, "tag is required", http.StatusBadRequest)
+		return
+	}
+	params, err := parseTempoTagParams(r)
+	if err != nil {
+		logRequestError(h.logger, "tempo_tag_values", r, http.StatusBadRequest, start, err, "")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := []string{}
+	if tagStore, ok := h.store.(spanstore.TagStore); ok {
+		values, err = tagStore.QueryTagValues(r.Context(), tag, params)
+		if err != nil {
+			logRequestError(h.logger, "tempo_tag_values", r, http.StatusInternalServerError, start, err, "")
+			http.Error(w, "failed to query tag values", http.StatusInternalServerError)
+			return
+		}
+	}
+	if values == nil {
+		values = []string{}
+	}
+	writeJSON(w, r, h.logger, "tempo_tag_values", start, "", TempoTagValuesResponse{TagValues: values})
+}
+
+func (h *TempoHandler) serveTrace(w http.ResponseWriter, r *http.Request, start time.Time, traceID string) {
+	traceID = strings.ToLower(strings.TrimSpace(traceID))
+	if traceID == "" || strings.Contains(traceID, "/") {
+		logRequestError(h.logger, "tempo_trace", r, http.StatusBadRequest, start, errors.New("trace_id is required"), "")
+		http.Error(w, "trace_id is required", http.StatusBadRequest)
+		return
+	}
+	req, err := queryTraceOTLP(r.Context(), h.store, spanstore.TraceSpansQueryParams{TraceID: traceID})
+	if err != nil {
+		logRequestError(h.logger, "tempo_trace", r, http.StatusInternalServerError, start, err, "")
+		http.Error(w, "failed to query trace", http.StatusInternalServerError)
+		return
+	}
+	if len(req.GetResourceSpans()) == 0 {
+		logRequestError(h.logger, "tempo_trace", r, http.StatusNotFound, start, errors.New("trace not found"), "")
+		http.Error(w, "trace not found", http.StatusNotFound)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), tempoProtobufMime) {
+		// tempopb.Trace stores its batches in field 1, exactly like
+		// ExportTraceServiceRequest.resource_spans, so the wire format matches.
+		payload, err := proto.Marshal(req)
+		if err != nil {
+			logRequestError(h.logger, "tempo_trace", r, http.StatusInternalServerError, start, err, "")
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", tempoProtobufMime)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(payload)
+		return
+	}
+	batches := make([]json.RawMessage, 0, len(req.GetResourceSpans()))
+	for _, resourceSpans := range req.GetResourceSpans() {
+		payload, err := protojson.Marshal(resourceSpans)
+		if err != nil {
+			logRequestError(h.logger, "tempo_trace", r, http.StatusInternalServerError, start, err, "")
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+		batches = append(batches, payload)
+	}
+	writeJSON(w, r, h.logger, "tempo_trace", start, "", map[string][]json.RawMessage{"batches": batches})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, logger *log.Logger, handler string, start time.Time, service string, resp any) {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		logRequestError(logger, handler, r, http.StatusInternalServerError, start, err, service)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(payload)
+}
+
+func parseTempoSearchParams(r *http.Request) (spanstore.TraceQueryParams, error) {
+	values := r.URL.Query()
+	params := spanstore.TraceQueryParams{
+		Limit: tempoDefaultLimit,
+		Order: spanstore.TraceOrderStartDesc,
+	}
+	start, end, err := parseTempoTimeRange(values.Get("start"), values.Get("end"))
+	if err != nil {
+		return spanstore.TraceQueryParams{}, err
+	}
+	params.Start = start
+	params.End = end
+	if rawLimit := strings.TrimSpace(values.Get("limit")); rawLimit != "" {
+		limit, err := parseInt(rawLimit, "limit")
+		if err != nil {
+			return spanstore.TraceQueryParams{}, err
+		}
+		params.Limit = limit
+	}
+	if raw := strings.TrimSpace(values.Get("minDuration")); raw != "" {
+		value, err := parseTempoDuration(raw, "minDuration")
+		if err != nil {
+			return spanstore.TraceQueryParams{}, err
+		}
+		params.MinDuration = value
+	}
+	if raw := strings.TrimSpace(values.Get("maxDuration")); raw != "" {
+		value, err := parseTempoDuration(raw, "maxDuration")
+		if err != nil {
+			return spanstore.TraceQueryParams{}, err
+		}
+		params.MaxDuration = value
+	}
+	if raw := strings.TrimSpace(values.Get("tags")); raw != "" {
+		tags, err := parseLogfmt(raw)
+		if err != nil {
+			return spanstore.TraceQueryParams{}, err
+		}
+		for _, tag := range tags {
+			if err := applyTempoTag(&params, tag.Key, tag.Value); err != nil {
+				return spanstore.TraceQueryParams{}, err
+			}
+		}
+	}
+	if raw := strings.TrimSpace(values.Get("q")); raw != "" {
+		if err := applyTraceQL(&params, raw); err != nil {
+			return spanstore.TraceQueryParams{}, err
+		}
+	}
+	if params.MaxDuration > 0 && params.MinDuration > params.MaxDuration {
+		return spanstore.TraceQueryParams{}, fmt.Errorf("minDuration must be <= maxDuration")
+	}
+	return params, nil
+}
+
+func parseTempoTagParams(r *http.Request) (spanstore.TagQueryParams, error) {
+	values := r.URL.Query()
+	params := spanstore.TagQueryParams{}
+	if strings.TrimSpace(values.Get("start")) != "" || strings.TrimSpace(values.Get("end")) != "" {
+		start, end, err := parseTempoTimeRange(values.Get("start"), values.Get("end"))
+		if err != nil {
+			return spanstore.TagQueryParams{}, err
+		}
+		params.Start = start
+		params.End = end
+	}
+	if rawLimit := strings.TrimSpace(values.Get("limit")); rawLimit != "" {
+		limit, err := parseInt(rawLimit, "limit")
+		if err != nil {
+			return spanstore.TagQueryParams{}, err
+		}
+		params.Limit = limit
+	}
+	return params, nil
+}
+
+func parseTempoTimeRange(rawStart, rawEnd string) (int64, int64, error) {
+	start := int64(0)
+	end := int64(math.MaxInt64)
+	if raw := strings.TrimSpace(rawStart); raw != "" {
+		seconds, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, 0, fmt.Errorf("start must be unix seconds")
+		}
+		start = seconds * int64(time.Second)
+	}
+	if raw := strings.TrimSpace(rawEnd); raw != "" {
+		seconds, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, 0, fmt.Errorf("end must be unix seconds")
+		}
+		end = seconds * int64(time.Second)
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("end must be >= start")
+	}
+	return start, end, nil
+}
+
+func parseTempoDuration(raw, field string) (int64, error) {
+	value, err := time.ParseDuration(raw)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a duration like 100ms", field)
+	}
+	return int64(value), nil
+}
+
+func applyTempoTag(params *spanstore.TraceQueryParams, key, value string) error {
+	switch key {
+	case tempoServiceTag:
+		params.Service = value
+	case tempoStatusTag, "status":
+		status, err := parseStatusFilter(value)
+		if err != nil {
+			return err
+		}
+		params.StatusCode = status
+	case "error":
+		hasError, err := parseBoolParam(value, "error")
+		if err != nil {
+			return err
+		}
+		params.HasError = hasError
+	default:
+		params.AttrFilters = append(params.AttrFilters, spanstore.AttrFilter{Key: key, Value: value})
+	}
+	return nil
+}
+
+type logfmtPair struct {
+	Key   string
+	Value string
+}
+
+func parseLogfmt(raw string) ([]logfmtPair, error) {
+	pairs := []logfmtPair{}
+	i := 0
+	for i < len(raw) {
+		for i < len(raw) && raw[i] == ' ' {
+			i++
+		}
+		if i >= len(raw) {
+			break
+		}
+		keyStart := i
+		for i < len(raw) && raw[i] != '=' && raw[i] != ' ' {
+			i++
+		}
+		key := raw[keyStart:i]
+		if i >= len(raw) || raw[i] != '=' || key == "" {
+			return nil, fmt.Errorf("tags must be logfmt key=value pairs")
+		}
+		i++
+		value := ""
+		if i < len(raw) && raw[i] == '"' {
+			end := i + 1
+			for end < len(raw) && !(raw[end] == '"' && raw[end-1] != '\\') {
+				end++
+			}
+			if end >= len(raw) {
+				return nil, fmt.Errorf("tags contain an unterminated quote")
+			}
+			unquoted, err := strconv.Unquote(raw[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("tags contain an invalid quoted value")
+			}
+			value = unquoted
+			i = end + 1
+		} else {
+			valueStart := i
+			for i < len(raw) && raw[i] != ' ' {
+				i++
+			}
+			value = raw[valueStart:i]
+		}
+		if value == "" {
+			return nil, fmt.Errorf("tags must be logfmt key=value pairs")
+		}
+		pairs = append(pairs, logfmtPair{Key: key, Value: value})
+	}
+	return pairs, nil
+}
+
+// applyTraceQL understands the small TraceQL subset the Grafana search editor
+// generates: a single spanset of conditions joined with &&.
+func applyTraceQL(params *spanstore.TraceQueryParams, raw string) error {
+	tokens, err := tokenizeTraceQL(raw)
+	if err != nil {
+		return err
+	}
+	if len(tokens) < 2 || !tokens[0].is("{") || !tokens[len(tokens)-1].is("}") {
+		return fmt.Errorf("q must be a single TraceQL spanset like {span.http.method=\"GET\"}")
+	}
+	body := tokens[1 : len(tokens)-1]
+	for len(body) > 0 {
+		if len(body) < 3 || body[0].kind != traceQLWord || body[1].kind != traceQLSymbol || body[2].kind == traceQLSymbol {
+			return fmt.Errorf("unsupported TraceQL condition: %s", raw[body[0].start:body[len(body)-1].end])
+		}
+		field, op, value := body[0], body[1], body[2]
+		if err := applyTraceQLCondition(params, field.text, op.text, value.text, raw[field.start:value.end]); err != nil {
+			return err
+		}
+		body = body[3:]
+		if len(body) > 0 {
+			if !body[0].is("&&") || len(body) == 1 {
+				return fmt.Errorf("unsupported TraceQL condition: %s", raw[field.start:body[len(body)-1].end])
+			}
+			body = body[1:]
+		}
+	}
+	return nil
+}
+
+func applyTraceQLCondition(params *spanstore.TraceQueryParams, field, op, value, condition string) error {
+	switch op {
+	case ">=", "<=", "!=", "=", ">", "<":
+	default:
+		return fmt.Errorf("unsupported TraceQL operator for %s: %s", field, op)
+	}
+	if value == "" {
+		return fmt.Errorf("unsupported TraceQL condition: %s", condition)
+	}
+	switch field {
+	case "duration", "traceDuration":
+		parsed, err := parseTempoDuration(value, field)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case ">", ">=":
+			params.MinDuration = parsed
+		case "<", "<=":
+			params.MaxDuration = parsed
+		default:
+			return fmt.Errorf("unsupported TraceQL operator for %s: %s", field, op)
+		}
+		return nil
+	}
+	if key, ok := traceQLAttribute(field); ok {
+		filter := spanstore.AttrFilter{Key: key, Op: spanstore.AttrOp(op), Value: value}
+		if err := filter.Validate(); err != nil {
+			return err
+		}
+		params.AttrFilters = append(params.AttrFilters, filter)
+		return nil
+	}
+	if op != "=" {
+		return fmt.Errorf("unsupported TraceQL operator for %s: %s", field, op)
+	}
+	switch {
+	case field == "status":
+		status, err := parseStatusFilter(value)
+		if err != nil {
+			return err
+		}
+		params.StatusCode = status
+	case field == "resource."+tempoServiceTag || field == "."+tempoServiceTag:
+		params.Service = value
+	default:
+		return fmt.Errorf("unsupported TraceQL field: %s", field)
+	}
+	return nil
+}
+
+type traceQLTokenKind int
+
+const (
+	traceQLWord traceQLTokenKind = iota
+	traceQLString
+	traceQLSymbol
+)
+
+// traceQLToken is a word, an unquoted string, or a symbol, with its byte
+// offsets in the query for error messages.
+type traceQLToken struct {
+	kind       traceQLTokenKind
+	text       string
+	start, end int
+}
+
+func (t traceQLToken) is(symbol string) bool {
+	return t.kind == traceQLSymbol && t.text == symbol
+}
+
+// traceQLSymbols are the characters that end a word.
+const traceQLSymbols = "{}()&|!=<>~\"`"
+
+// tokenizeTraceQL splits a query into words such as span.http.method, 500,
+// or 50ms, double-quoted or backtick strings, and the symbols { } && and the
+// comparison operators. Anything else, such as pipelines or ||, is rejected.
+func tokenizeTraceQL(query string) ([]traceQLToken, error) {
+	var tokens []traceQLToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '{' || c == '}':
+			tokens = append(tokens, traceQLToken{kind: traceQLSymbol, text: query[i : i+1], start: i, end: i + 1})
+			i++
+		case strings.HasPrefix(query[i:], "&&"):
+			tokens = append(tokens, traceQLToken{kind: traceQLSymbol, text: "&&", start: i, end: i + 2})
+			i += 2
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			end := i + 1
+			if end < len(query) && (query[end] == '=' || query[end] == '~') {
+				end++
+			}
+			tokens = append(tokens, traceQLToken{kind: traceQLSymbol, text: query[i:end], start: i, end: end})
+			i = end
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if c == '"' && query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				return nil, fmt.Errorf("q contains an unterminated quote")
+			}
+			value, err := strconv.Unquote(query[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("q contains an invalid quoted value: %s", query[i:end+1])
+			}
+			tokens = append(tokens, traceQLToken{kind: traceQLString, text: value, start: i, end: end + 1})
+			i = end + 1
+		default:
+			end := i
+			for end < len(query) && !strings.ContainsRune(" \t\n\r"+traceQLSymbols, rune(query[end])) {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("unsupported TraceQL syntax: %s", query[i:])
+			}
+			tokens = append(tokens, traceQLToken{kind: traceQLWord, text: query[i:end], start: i, end: end})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// traceQLAttribute maps span.key and .key to a span attribute key. The
+// service name is handled separately because it lives on the span row.
+func traceQLAttribute(field string) (string, bool) {
+	if field == "."+tempoServiceTag {
+		return "", false
+	}
+	for _, prefix := range []string{"span.", "."} {
+		if strings.HasPrefix(field, prefix) {
+			return strings.TrimPrefix(field, prefix), true
+		}
+	}
+	return "", false
+}
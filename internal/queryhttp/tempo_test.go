@@ -0,0 +1,291 @@
+package queryhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+type tempoStore struct {
+	params    spanstore.TraceQueryParams
+	traces    []spanstore.TraceSummary
+	spans     []spanstore.Span
+	tagNames  []string
+	tagValues map[string][]string
+}
+
+func (t *tempoStore) QuerySpans(_ context.Context, _ spanstore.QueryParams) ([]spanstore.Span, error) {
+	return []spanstore.Span{}, nil
+}
+
+func (t *tempoStore) QueryTraces(_ context.Context, params spanstore.TraceQueryParams) ([]spanstore.TraceSummary, error) {
+	t.params = params
+	return t.traces, nil
+}
+
+func (t *tempoStore) QueryTraceSpans(_ context.Context, _ spanstore.TraceSpansQueryParams) ([]spanstore.Span, error) {
+	return t.spans, nil
+}
+
+func (t *tempoStore) QueryTagNames(_ context.Context, _ spanstore.TagQueryParams) ([]string, error) {
+	return t.tagNames, nil
+}
+
+func (t *tempoStore) QueryTagValues(_ context.Context, tag string, _ spanstore.TagQueryParams) ([]string, error) {
+	return t.tagValues[tag], nil
+}
+
+func TestTempoSearchParsesTagsAndDurations(t *testing.T) {
+	store := &tempoStore{traces: []spanstore.TraceSummary{{
+		TraceID:           "0102",
+		RootName:          "GET /",
+		StartTimeUnixNano: 1_700_000_000_000_000_000,
+		DurationUnixNano:  int64(1500 * time.Millisecond),
+		ServiceName:       "svc",
+	}}}
+	h := NewTempoHandler(store)
+	query := url.Values{}
+	query.Set("tags", `service.name=svc http.route="/a b" status.code=error`)
+	query.Set("minDuration", "100ms")
+	query.Set("maxDuration", "2s")
+	query.Set("start", "10")
+	query.Set("end", "20")
+	query.Set("limit", "7")
+	req := httptest.NewRequest(http.MethodGet, tempoSearchPath+"?"+query.Encode(), nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	params := store.params
+	if params.Service != "svc" || params.Limit != 7 {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+	if params.Start != 10*int64(time.Second) || params.End != 20*int64(time.Second) {
+		t.Fatalf("unexpected range: %d-%d", params.Start, params.End)
+	}
+	if params.MinDuration != int64(100*time.Millisecond) || params.MaxDuration != int64(2*time.Second) {
+		t.Fatalf("unexpected durations: %d-%d", params.MinDuration, params.MaxDuration)
+	}
+	if len(params.AttrFilters) != 1 || params.AttrFilters[0].Key != "http.route" || params.AttrFilters[0].Value != "/a b" {
+		t.Fatalf("unexpected attr filters: %+v", params.AttrFilters)
+	}
+	if params.StatusCode == nil || *params.StatusCode != spanstore.StatusError {
+		t.Fatalf("expected error status filter")
+	}
+	var decoded TempoSearchResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(decoded.Traces) != 1 || decoded.Traces[0].DurationMs != 1500 || decoded.Traces[0].RootServiceName != "svc" {
+		t.Fatalf("unexpected response: %+v", decoded)
+	}
+	if decoded.Traces[0].StartTimeUnixNano != "1700000000000000000" {
+		t.Fatalf("unexpected start: %s", decoded.Traces[0].StartTimeUnixNano)
+	}
+}
+
+func TestTempoSearchParsesTraceQL(t *testing.T) {
+	store := &tempoStore{}
+	h := NewTempoHandler(store)
+	query := url.Values{}
+	query.Set("q", `{resource.service.name="svc" && span.http.method="GET" && duration>50ms && status=error}`)
+	req := httptest.NewRequest(http.MethodGet, tempoSearchPath+"?"+query.Encode(), nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	params := store.params
+	if params.Service != "svc" || params.MinDuration != int64(50*time.Millisecond) {
+		t.Fatalf("unexpected params: %+v", params)
+	}
+	if len(params.AttrFilters) != 1 || params.AttrFilters[0].Key != "http.method" {
+		t.Fatalf("unexpected attr filters: %+v", params.AttrFilters)
+	}
+	if params.StatusCode == nil || *params.StatusCode != spanstore.StatusError {
+		t.Fatalf("expected error status filter")
+	}
+}
+
+func TestTempoSearchParsesNumericTraceQL(t *testing.T) {
+	store := &tempoStore{}
+	h := NewTempoHandler(store)
+	query := url.Values{}
+	query.Set("q", `{span.http.status_code >= 500 && .retries < 3}`)
+	req := httptest.NewRequest(http.MethodGet, tempoSearchPath+"?"+query.Encode(), nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	want := []spanstore.AttrFilter{
+		{Key: "http.status_code", Op: spanstore.AttrOpGreaterEqual, Value: "500"},
+		{Key: "retries", Op: spanstore.AttrOpLess, Value: "3"},
+	}
+	if !reflect.DeepEqual(store.params.AttrFilters, want) {
+		t.Fatalf("unexpected attr filters: %+v", store.params.AttrFilters)
+	}
+}
+
+func TestTempoSearchParsesQuotedTraceQLValues(t *testing.T) {
+	store := &tempoStore{}
+	h := NewTempoHandler(store)
+	query := url.Values{}
+	query.Set("q", `{ span.http.url = "a?x=1&&y=2" && span.note!="x >= y" && .path = `+"`a}b`"+` && span.msg = "say \"hi\" && go" }`)
+	req := httptest.NewRequest(http.MethodGet, tempoSearchPath+"?"+query.Encode(), nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	want := []spanstore.AttrFilter{
+		{Key: "http.url", Op: spanstore.AttrOpEqual, Value: "a?x=1&&y=2"},
+		{Key: "note", Op: spanstore.AttrOpNotEqual, Value: "x >= y"},
+		{Key: "path", Op: spanstore.AttrOpEqual, Value: "a}b"},
+		{Key: "msg", Op: spanstore.AttrOpEqual, Value: `say "hi" && go`},
+	}
+	if !reflect.DeepEqual(store.params.AttrFilters, want) {
+		t.Fatalf("unexpected attr filters: %+v", store.params.AttrFilters)
+	}
+}
+
+func TestTempoSearchRejectsUnsupportedTraceQL(t *testing.T) {
+	h := NewTempoHandler(&tempoStore{})
+	for _, q := range []string{
+		`{span.a="b"} | count() > 2`,
+		`{span.a="b"} && {span.c="d"}`,
+		`{span.a="b" || span.c="d"}`,
+		`{span.a="b" &&}`,
+		`{span.a}`,
+		`{span.a=~"b.*"}`,
+		`{span.a="b}`,
+		`{span.a=""}`,
+		`span.a="b"`,
+	} {
+		query := url.Values{}
+		query.Set("q", q)
+		req := httptest.NewRequest(http.MethodGet, tempoSearchPath+"?"+query.Encode(), nil)
+		resp := httptest.NewRecorder()
+
+		h.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusBadRequest {
+			t.Fatalf("expected %d for %s, got %d", http.StatusBadRequest, q, resp.Code)
+		}
+	}
+}
+
+func TestTempoTagEndpoints(t *testing.T) {
+	store := &tempoStore{
+		tagNames:  []string{"http.method", "service.name"},
+		tagValues: map[string][]string{"http.method": {"GET", "POST"}},
+	}
+	h := NewTempoHandler(store)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tempoTagsPath, nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	var tags TempoTagsResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &tags); err != nil {
+		t.Fatalf("decode tags: %v", err)
+	}
+	if len(tags.TagNames) != 2 {
+		t.Fatalf("unexpected tags: %+v", tags)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/search/tag/http.method/values", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	var values TempoTagValuesResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &values); err != nil {
+		t.Fatalf("decode values: %v", err)
+	}
+	if len(values.TagValues) != 2 || values.TagValues[0] != "GET" {
+		t.Fatalf("unexpected values: %+v", values)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/search/tag/missing/values", nil))
+	if resp.Body.String() != `{"tagValues":[]}` {
+		t.Fatalf("expected empty values, got %s", resp.Body.String())
+	}
+}
+
+func TestTempoTraceByIDEncodings(t *testing.T) {
+	store := &tempoStore{spans: []spanstore.Span{{
+		TraceID:      "0102",
+		SpanID:       "0a0b",
+		ParentSpanID: "0000000000000000",
+		Name:         "root",
+		Kind:         "SPAN_KIND_SERVER",
+		ServiceName:  "svc",
+		Resource:     spanstore.Resource{Attributes: map[string]any{"service.name": "svc"}},
+		Attributes:   map[string]any{"http.status_code": int64(200)},
+	}}}
+	h := NewTempoHandler(store)
+
+	req := httptest.NewRequest(http.MethodGet, tempoTracePrefix+"0102", nil)
+	req.Header.Set("Accept", tempoProtobufMime)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	var decoded coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(resp.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("unmarshal protobuf: %v", err)
+	}
+	if len(decoded.GetResourceSpans()) != 1 || decoded.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0].GetName() != "root" {
+		t.Fatalf("unexpected trace: %v", &decoded)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tempoTracePrefix+"0102", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	var body struct {
+		Batches []json.RawMessage `json:"batches"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode json: %v", err)
+	}
+	if len(body.Batches) != 1 {
+		t.Fatalf("expected one batch, got %s", resp.Body.String())
+	}
+}
+
+func TestTempoTraceByIDNotFound(t *testing.T) {
+	h := NewTempoHandler(&tempoStore{})
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tempoTracePrefix+"ffff", nil))
+
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("expected %d got %d", http.StatusNotFound, resp.Code)
+	}
+}
@@ -1,6 +1,7 @@
 package queryhttp
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,12 +11,22 @@ import (
 	"strings"
 	"time"
 
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"smelldeadfish/internal/metrics"
+	"smelldeadfish/internal/otlpconv"
+	"smelldeadfish/internal/otlpjson"
 	"smelldeadfish/internal/spanstore"
 )
 
 const (
-	tracesPath        = "/api/traces"
-	traceDetailPrefix = "/api/traces/"
+	tracesPath           = "/api/traces"
+	traceDetailPrefix    = "/api/traces/"
+	traceFormatJSON      = "json"
+	traceFormatOTLPJSON  = "otlp-json"
+	traceFormatOTLPProto = "otlp-proto"
 )
 
 type TracesHandler struct {
@@ -46,11 +57,11 @@ func NewTraceDetailHandler(store spanstore.Store) http.Handler {
 }
 
 func NewTracesHandlerWithOptions(store spanstore.Store, opts Options) http.Handler {
-	return &TracesHandler{store: store, logger: loggerFromOptions(opts)}
+	return metrics.InstrumentHandler(opts.Metrics, "query_traces", &TracesHandler{store: store, logger: loggerFromOptions(opts)})
 }
 
 func NewTraceDetailHandlerWithOptions(store spanstore.Store, opts Options) http.Handler {
-	return &TraceDetailHandler{store: store, logger: loggerFromOptions(opts)}
+	return metrics.InstrumentHandler(opts.Metrics, "trace_detail", &TraceDetailHandler{store: store, logger: loggerFromOptions(opts)})
 }
 
 func (h *TracesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -118,11 +129,22 @@ func (h *TraceDetailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	spans, err := h.store.QueryTraceSpans(r.Context(), spanstore.TraceSpansQueryParams{
+	format, err := parseTraceFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		logRequestError(h.logger, "trace_detail", r, http.StatusBadRequest, start, err, service)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := spanstore.TraceSpansQueryParams{
 		TraceID:    traceID,
 		Service:    service,
 		StatusCode: status,
-	})
+	}
+	if format != traceFormatJSON {
+		h.serveOTLP(w, r, start, params, format)
+		return
+	}
+	spans, err := h.store.QueryTraceSpans(r.Context(), params)
 	if err != nil {
 		logRequestError(h.logger, "trace_detail", r, http.StatusInternalServerError, start, err, service)
 		http.Error(w, "failed to query trace", http.StatusInternalServerError)
@@ -140,6 +162,53 @@ func (h *TraceDetailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(payload)
 }
 
+func (h *TraceDetailHandler) serveOTLP(w http.ResponseWriter, r *http.Request, start time.Time, params spanstore.TraceSpansQueryParams, format string) {
+	req, err := queryTraceOTLP(r.Context(), h.store, params)
+	if err != nil {
+		logRequestError(h.logger, "trace_detail", r, http.StatusInternalServerError, start, err, params.Service)
+		http.Error(w, "failed to query trace", http.StatusInternalServerError)
+		return
+	}
+	var payload []byte
+	contentType := "application/json"
+	if format == traceFormatOTLPProto {
+		payload, err = proto.Marshal(req)
+		contentType = "application/x-protobuf"
+	} else {
+		payload, err = otlpjson.Marshal(req)
+	}
+	if err != nil {
+		logRequestError(h.logger, "trace_detail", r, http.StatusInternalServerError, start, err, params.Service)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(payload)
+}
+
+func queryTraceOTLP(ctx context.Context, store spanstore.Store, params spanstore.TraceSpansQueryParams) (*coltracepb.ExportTraceServiceRequest, error) {
+	if otlpStore, ok := store.(spanstore.OTLPStore); ok {
+		return otlpStore.QueryTraceOTLP(ctx, params)
+	}
+	spans, err := store.QueryTraceSpans(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return otlpconv.FromSpans(spans), nil
+}
+
+func parseTraceFormat(raw string) (string, error) {
+	switch trimmed := strings.ToLower(strings.TrimSpace(raw)); trimmed {
+	case "", traceFormatJSON:
+		return traceFormatJSON, nil
+	case traceFormatOTLPJSON, traceFormatOTLPProto:
+		return trimmed, nil
+	default:
+		return "", fmt.Errorf("format must be json, otlp-json, or otlp-proto")
+	}
+}
+
 func parseTraceQueryParams(r *http.Request) (spanstore.TraceQueryParams, error) {
 	values := r.URL.Query()
 	service := strings.TrimSpace(values.Get("service"))
@@ -177,7 +246,11 @@ func parseTraceQueryParams(r *http.Request) (spanstore.TraceQueryParams, error)
 	if hasError && status != nil && *status != spanstore.StatusError {
 		return spanstore.TraceQueryParams{}, fmt.Errorf("has_error cannot be combined with status=unset or status=ok")
 	}
+	text := strings.TrimSpace(values.Get("text"))
 	order := spanstore.TraceOrderStartDesc
+	if text != "" {
+		order = spanstore.TraceOrderRelevance
+	}
 	if rawOrder := strings.TrimSpace(values.Get("order")); rawOrder != "" {
 		parsed, err := parseTraceOrder(rawOrder)
 		if err != nil {
@@ -185,6 +258,9 @@ func parseTraceQueryParams(r *http.Request) (spanstore.TraceQueryParams, error)
 		}
 		order = parsed
 	}
+	if order == spanstore.TraceOrderRelevance && text == "" {
+		return spanstore.TraceQueryParams{}, fmt.Errorf("order=relevance requires text")
+	}
 	return spanstore.TraceQueryParams{
 		Service:     service,
 		Start:       start,
@@ -194,6 +270,7 @@ func parseTraceQueryParams(r *http.Request) (spanstore.TraceQueryParams, error)
 		AttrFilters: filters,
 		StatusCode:  status,
 		HasError:    hasError,
+		Text:        text,
 	}, nil
 }
 
@@ -202,10 +279,11 @@ func parseTraceOrder(raw string) (spanstore.TraceOrder, error) {
 	case spanstore.TraceOrderStartDesc,
 		spanstore.TraceOrderStartAsc,
 		spanstore.TraceOrderDurationDesc,
-		spanstore.TraceOrderDurationAsc:
+		spanstore.TraceOrderDurationAsc,
+		spanstore.TraceOrderRelevance:
 		return spanstore.TraceOrder(raw), nil
 	default:
-		return "", fmt.Errorf("order must be start_desc, start_asc, duration_desc, or duration_asc")
+		return "", fmt.Errorf("order must be start_desc, start_asc, duration_desc, duration_asc, or relevance")
 	}
 }
 
@@ -9,6 +9,11 @@ import (
 	"strings"
 	"testing"
 
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
 	"smelldeadfish/internal/spanstore"
 )
 
@@ -74,6 +79,34 @@ func TestTracesHandlerRejectsInvalidOrder(t *testing.T) {
 	}
 }
 
+func TestTracesHandlerRanksTextSearchByRelevance(t *testing.T) {
+	store := &traceStore{}
+	h := NewTracesHandler(store)
+	req := httptest.NewRequest(http.MethodGet, tracesPath+"?service=svc&start=1&end=2&text=+ORD-42+", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	if store.params.Text != "ORD-42" || store.params.Order != spanstore.TraceOrderRelevance {
+		t.Fatalf("unexpected params: %+v", store.params)
+	}
+}
+
+func TestTracesHandlerRejectsRelevanceWithoutText(t *testing.T) {
+	h := NewTracesHandler(&traceStore{})
+	req := httptest.NewRequest(http.MethodGet, tracesPath+"?service=svc&start=1&end=2&order=relevance", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d got %d", http.StatusBadRequest, resp.Code)
+	}
+}
+
 func TestTracesHandlerParsesStatus(t *testing.T) {
 	store := &traceStore{}
 	h := NewTracesHandler(store)
@@ -162,3 +195,84 @@ func TestTracesHandlerLogsErrors(t *testing.T) {
 		t.Fatalf("expected log line for error, got: %s", logged)
 	}
 }
+
+type otlpTraceStore struct {
+	traceStore
+	params spanstore.TraceSpansQueryParams
+}
+
+func (o *otlpTraceStore) QueryTraceOTLP(_ context.Context, params spanstore.TraceSpansQueryParams) (*coltracepb.ExportTraceServiceRequest, error) {
+	o.params = params
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{{TraceId: []byte{0xab, 0xcd}, SpanId: []byte{0x01}, Name: "root"}},
+			}},
+		}},
+	}, nil
+}
+
+func TestTraceDetailHandlerExportsOTLPProto(t *testing.T) {
+	store := &otlpTraceStore{}
+	h := NewTraceDetailHandler(store)
+	req := httptest.NewRequest(http.MethodGet, traceDetailPrefix+"abcd?format=otlp-proto&status=error", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	if resp.Header().Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("unexpected content type: %s", resp.Header().Get("Content-Type"))
+	}
+	var decoded coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(resp.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if decoded.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0].GetName() != "root" {
+		t.Fatalf("unexpected payload: %v", &decoded)
+	}
+	if store.params.TraceID != "abcd" || store.params.StatusCode == nil {
+		t.Fatalf("unexpected params: %+v", store.params)
+	}
+}
+
+func TestTraceDetailHandlerExportsOTLPJSON(t *testing.T) {
+	h := NewTraceDetailHandler(&otlpTraceStore{})
+	req := httptest.NewRequest(http.MethodGet, traceDetailPrefix+"abcd?format=otlp-json", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+	if !strings.Contains(resp.Body.String(), `"traceId":"abcd"`) {
+		t.Fatalf("expected hex trace id, got %s", resp.Body.String())
+	}
+}
+
+func TestTraceDetailHandlerFallsBackToStoredSpans(t *testing.T) {
+	h := NewTraceDetailHandler(&fakeStore{})
+	req := httptest.NewRequest(http.MethodGet, traceDetailPrefix+"abcd?format=otlp-json", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, resp.Code)
+	}
+}
+
+func TestTraceDetailHandlerRejectsInvalidFormat(t *testing.T) {
+	h := NewTraceDetailHandler(&otlpTraceStore{})
+	req := httptest.NewRequest(http.MethodGet, traceDetailPrefix+"abcd?format=xml", nil)
+	resp := httptest.NewRecorder()
+
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d got %d", http.StatusBadRequest, resp.Code)
+	}
+}
@@ -0,0 +1,396 @@
+package spanstoretest
+
+import (
+	"fmt"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// base anchors every fixture timestamp. All spans fall within one second of
+// it, so time-partitioned stores keep the fixture in a single partition.
+var base = time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+
+func at(ms int) uint64 {
+	return uint64(base.Add(time.Duration(ms) * time.Millisecond).UnixNano())
+}
+
+func ns(ms int) int64 {
+	return int64(at(ms))
+}
+
+func traceID(n byte) []byte {
+	id := make([]byte, 16)
+	id[15] = n
+	return id
+}
+
+func spanID(n byte) []byte {
+	id := make([]byte, 8)
+	id[7] = n
+	return id
+}
+
+func traceHex(n byte) string {
+	return fmt.Sprintf("%x", traceID(n))
+}
+
+func spanHex(n byte) string {
+	return fmt.Sprintf("%x", spanID(n))
+}
+
+const (
+	rootParent  = "0000000000000000"
+	frontendURL = "https://opentelemetry.io/schemas/1.21.0"
+	scopeURL    = "https://example.com/scope"
+)
+
+func str(value string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+}
+
+func integer(value int64) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}
+}
+
+func double(value float64) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: value}}
+}
+
+func boolean(value bool) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: value}}
+}
+
+func attr(key string, value *commonpb.AnyValue) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: value}
+}
+
+// The fixture holds six traces across a frontend and a backend service:
+//
+//	trace 1: GET /checkout (frontend, error) -> charge card (backend, error) -> SELECT orders (backend, ok)
+//	trace 2: GET /browse (frontend, ok) -> list items (backend)
+//	trace 3: GET /search (frontend, 404)
+//	trace 4: process job (backend) whose parent was never received
+//	trace 5: schedule (frontend) and reconcile (backend), both without a parent
+//	trace 6: GET /search (frontend, 200), starting and ending with trace 3
+//
+// The backend spans arrive in a request before their frontend parents.
+func fixtureRequests() []*coltracepb.ExportTraceServiceRequest {
+	return []*coltracepb.ExportTraceServiceRequest{backendRequest(), frontendRequest()}
+}
+
+func backendRequest() *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				attr("service.name", str("backend")),
+				attr("deployment.environment", str("staging")),
+			}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: "rpc"},
+				Spans: []*tracepb.Span{
+					{
+						TraceId: traceID(1), SpanId: spanID(2), ParentSpanId: spanID(1),
+						Name: "charge card", Kind: tracepb.Span_SPAN_KIND_CLIENT,
+						StartTimeUnixNano: at(10), EndTimeUnixNano: at(90),
+						Attributes: []*commonpb.KeyValue{
+							attr("http.status_code", integer(503)),
+							attr("ratio", double(0.75)),
+							attr("cached", boolean(false)),
+						},
+						Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "card declined"},
+					},
+					{
+						TraceId: traceID(1), SpanId: spanID(3), ParentSpanId: spanID(2),
+						Name: "SELECT orders", Kind: tracepb.Span_SPAN_KIND_CLIENT,
+						StartTimeUnixNano: at(20), EndTimeUnixNano: at(30),
+						Attributes: []*commonpb.KeyValue{attr("db.system", str("postgres"))},
+						Status:     &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
+					},
+					{
+						TraceId: traceID(2), SpanId: spanID(5), ParentSpanId: spanID(4),
+						Name: "list items", Kind: tracepb.Span_SPAN_KIND_SERVER,
+						StartTimeUnixNano: at(205), EndTimeUnixNano: at(215),
+						Attributes: []*commonpb.KeyValue{
+							attr("http.status_code", integer(200)),
+							attr("ratio", double(1.5)),
+							attr("cached", boolean(true)),
+						},
+					},
+					{
+						TraceId: traceID(4), SpanId: spanID(8), ParentSpanId: spanID(99),
+						Name:              "process job",
+						StartTimeUnixNano: at(400), EndTimeUnixNano: at(450),
+					},
+					{
+						TraceId: traceID(5), SpanId: spanID(10),
+						Name: "reconcile", Kind: tracepb.Span_SPAN_KIND_INTERNAL,
+						StartTimeUnixNano: at(510), EndTimeUnixNano: at(530),
+					},
+				},
+			}},
+		}},
+	}
+}
+
+func frontendRequest() *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				attr("service.name", str("frontend")),
+				attr("deployment.environment", str("prod")),
+			}},
+			SchemaUrl: frontendURL,
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{
+					Name: "http", Version: "1.0",
+					Attributes: []*commonpb.KeyValue{attr("scope.attr", str("s"))},
+				},
+				SchemaUrl: scopeURL,
+				Spans: []*tracepb.Span{
+					checkoutSpan(),
+					{
+						TraceId: traceID(2), SpanId: spanID(4),
+						Name: "GET /browse", Kind: tracepb.Span_SPAN_KIND_SERVER,
+						StartTimeUnixNano: at(200), EndTimeUnixNano: at(220),
+						Attributes: []*commonpb.KeyValue{
+							attr("http.method", str("GET")),
+							attr("http.status_code", integer(200)),
+						},
+						Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
+					},
+					{
+						TraceId: traceID(3), SpanId: spanID(6),
+						Name: "GET /search", Kind: tracepb.Span_SPAN_KIND_SERVER,
+						StartTimeUnixNano: at(300), EndTimeUnixNano: at(305),
+						Attributes: []*commonpb.KeyValue{
+							attr("http.method", str("POST")),
+							attr("http.status_code", integer(404)),
+						},
+					},
+					{
+						TraceId: traceID(6), SpanId: spanID(7),
+						Name: "GET /search", Kind: tracepb.Span_SPAN_KIND_SERVER,
+						StartTimeUnixNano: at(300), EndTimeUnixNano: at(305),
+						Attributes: []*commonpb.KeyValue{
+							attr("http.method", str("GET")),
+							attr("http.status_code", integer(200)),
+						},
+					},
+					{
+						TraceId: traceID(5), SpanId: spanID(9),
+						Name: "schedule", Kind: tracepb.Span_SPAN_KIND_INTERNAL,
+						StartTimeUnixNano: at(500), EndTimeUnixNano: at(510),
+					},
+				},
+			}},
+		}},
+	}
+}
+
+// checkoutSpan carries events and links out of their stored order.
+func checkoutSpan() *tracepb.Span {
+	return &tracepb.Span{
+		TraceId: traceID(1), SpanId: spanID(1),
+		Name: "GET /checkout", Kind: tracepb.Span_SPAN_KIND_SERVER,
+		StartTimeUnixNano: at(0), EndTimeUnixNano: at(100),
+		Flags: 1,
+		Attributes: []*commonpb.KeyValue{
+			attr("http.method", str("GET")),
+			attr("http.status_code", integer(500)),
+		},
+		Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "upstream failed"},
+		Events: []*tracepb.Span_Event{
+			{Name: "retry", TimeUnixNano: at(60), DroppedAttributesCount: 1, Attributes: []*commonpb.KeyValue{attr("attempt", integer(2))}},
+			{Name: "retry", TimeUnixNano: at(20), Attributes: []*commonpb.KeyValue{attr("attempt", integer(1))}},
+			{Name: "cache miss", TimeUnixNano: at(20)},
+		},
+		Links: []*tracepb.Span_Link{
+			{TraceId: traceID(3), SpanId: spanID(6)},
+			{
+				TraceId: traceID(2), SpanId: spanID(4), TraceState: "k=v", DroppedAttributesCount: 2, Flags: 1,
+				Attributes: []*commonpb.KeyValue{attr("link.kind", str("follows"))},
+			},
+		},
+	}
+}
+
+// typedRequest holds one span carrying every OTLP attribute value type.
+func typedRequest() *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				attr("service.name", str("typed")),
+				attr("host.cores", integer(8)),
+			}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{{
+					TraceId: traceID(7), SpanId: spanID(11),
+					Name:              "typed",
+					StartTimeUnixNano: at(0), EndTimeUnixNano: at(1),
+					Attributes: []*commonpb.KeyValue{
+						attr("string", str("value")),
+						attr("int", integer(-42)),
+						attr("double", double(0.5)),
+						attr("bool", boolean(true)),
+						attr("bytes", &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: []byte{0xde, 0xad}}}),
+						attr("array", &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{
+							str("a"), integer(7), double(1.5), boolean(false),
+						}}}}),
+						attr("kvlist", &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: []*commonpb.KeyValue{
+							attr("name", str("x")),
+							attr("count", integer(3)),
+							attr("nested", &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{integer(1)}}}}),
+						}}}}),
+						{Key: "empty"},
+					},
+				}},
+			}},
+		}},
+	}
+}
+
+// bulkRequest holds n single-span traces for the "bulk" service.
+func bulkRequest(n int) *coltracepb.ExportTraceServiceRequest {
+	spans := make([]*tracepb.Span, n)
+	for i := range spans {
+		spans[i] = &tracepb.Span{
+			TraceId:           []byte{0xb0, byte(i >> 8), byte(i)},
+			SpanId:            []byte{0xb0, byte(i >> 8), byte(i)},
+			Name:              "bulk",
+			StartTimeUnixNano: at(i),
+			EndTimeUnixNano:   at(i + 1),
+		}
+	}
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource:   &resourcepb.Resource{Attributes: []*commonpb.KeyValue{attr("service.name", str("bulk"))}},
+			ScopeSpans: []*tracepb.ScopeSpans{{Spans: spans}},
+		}},
+	}
+}
+
+// searchRequest holds the "shop" spans the text search tests look for.
+func searchRequest() *coltracepb.ExportTraceServiceRequest {
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{attr("service.name", str("shop"))}},
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{
+					{
+						TraceId: traceID(9), SpanId: spanID(20),
+						Name:              "POST /checkout",
+						StartTimeUnixNano: at(600), EndTimeUnixNano: at(700),
+						Attributes: []*commonpb.KeyValue{
+							attr("order.id", str("ORD-12345")),
+							attr("customer", str("refund desk")),
+						},
+						Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "payment declined by issuer"},
+					},
+					{
+						TraceId: traceID(9), SpanId: spanID(21), ParentSpanId: spanID(20),
+						Name:              "charge card",
+						StartTimeUnixNano: at(610), EndTimeUnixNano: at(690),
+						Events: []*tracepb.Span_Event{{Name: "retrying charge", TimeUnixNano: at(620)}},
+					},
+					{
+						TraceId: traceID(10), SpanId: spanID(22),
+						Name:              "POST /refund",
+						StartTimeUnixNano: at(800), EndTimeUnixNano: at(900),
+						Attributes: []*commonpb.KeyValue{attr("order.id", str("ORD-99999"))},
+					},
+					{
+						TraceId: traceID(11), SpanId: spanID(23),
+						Name:              `render <b onclick="x()">widget</b> & co`,
+						StartTimeUnixNano: at(950), EndTimeUnixNano: at(960),
+					},
+				},
+			}},
+		}},
+	}
+}
+
+// roundTripRequest exercises every field QueryTraceOTLP has to restore:
+// schema URLs, scope attributes, events and links out of time order, and
+// arrays and kvlists holding every value type.
+func roundTripRequest() *coltracepb.ExportTraceServiceRequest {
+	bytesValue := func(value ...byte) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: value}}
+	}
+	kvlist := func(values ...*commonpb.KeyValue) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: values}}}
+	}
+	return &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{
+			{
+				Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+					attr("service.name", str("roundtrip")),
+					attr("host.name", str("box")),
+				}},
+				SchemaUrl: frontendURL,
+				ScopeSpans: []*tracepb.ScopeSpans{
+					{
+						Scope: &commonpb.InstrumentationScope{
+							Name: "http", Version: "1.0",
+							Attributes: []*commonpb.KeyValue{attr("scope.attr", str("s"))},
+						},
+						SchemaUrl: scopeURL,
+						Spans: []*tracepb.Span{{
+							TraceId: traceID(8), SpanId: spanID(12),
+							Name: "GET /", Kind: tracepb.Span_SPAN_KIND_SERVER,
+							StartTimeUnixNano: at(0), EndTimeUnixNano: at(50),
+							Flags: 1,
+							Attributes: []*commonpb.KeyValue{
+								attr("str", str("value")),
+								attr("int", integer(-42)),
+								attr("double", double(0.1)),
+								attr("bool", boolean(true)),
+								attr("bytes", bytesValue(0xde, 0xad)),
+								attr("array", &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{
+									str("a"), integer(7), double(1.5), double(2), bytesValue(0xbe, 0xef),
+								}}}}),
+								attr("kvlist", kvlist(
+									attr("b", boolean(false)),
+									attr("a", str("x")),
+									attr("nested", kvlist(attr("z", double(3)), attr("y", bytesValue(0x01)))),
+								)),
+							},
+							Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: "boom"},
+							Events: []*tracepb.Span_Event{
+								{Name: "second-by-order", TimeUnixNano: at(2), DroppedAttributesCount: 3, Attributes: []*commonpb.KeyValue{attr("e", str("1"))}},
+								{Name: "first-by-order", TimeUnixNano: at(1)},
+							},
+							Links: []*tracepb.Span_Link{{
+								TraceId: traceID(9), SpanId: spanID(20), TraceState: "k=v", DroppedAttributesCount: 1, Flags: 1,
+								Attributes: []*commonpb.KeyValue{attr("l", integer(9))},
+							}},
+						}},
+					},
+					{
+						Scope: &commonpb.InstrumentationScope{Name: "db"},
+						Spans: []*tracepb.Span{{
+							TraceId: traceID(8), SpanId: spanID(13), ParentSpanId: spanID(12),
+							Name: "SELECT", Kind: tracepb.Span_SPAN_KIND_CLIENT,
+							StartTimeUnixNano: at(10), EndTimeUnixNano: at(20),
+						}},
+					},
+				},
+			},
+			{
+				Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{attr("service.name", str("roundtrip-backend"))}},
+				ScopeSpans: []*tracepb.ScopeSpans{{
+					Scope: &commonpb.InstrumentationScope{Name: "rpc"},
+					Spans: []*tracepb.Span{{
+						TraceId: traceID(8), SpanId: spanID(14), ParentSpanId: spanID(12),
+						Name: "handle", Kind: tracepb.Span_SPAN_KIND_SERVER,
+						StartTimeUnixNano: at(30), EndTimeUnixNano: at(40),
+						Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
+					}},
+				}},
+			},
+		},
+	}
+}
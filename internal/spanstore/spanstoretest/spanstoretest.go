@@ -0,0 +1,895 @@
+// Package spanstoretest is a conformance suite for span stores. A backend
+// runs it from its own tests so every store answers queries the same way:
+//
+//	spanstoretest.Run(t, func(t *testing.T) spanstoretest.Store {
+//		sink, err := New(filepath.Join(t.TempDir(), "spans.db"))
+//		...
+//		t.Cleanup(func() { sink.Close() })
+//		return sink
+//	})
+package spanstoretest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"smelldeadfish/internal/ingest"
+	"smelldeadfish/internal/spanstore"
+)
+
+// Store is what the suite exercises. Stores that also implement
+// spanstore.TagStore, spanstore.OTLPStore or spanstore.ExportStore are
+// checked against those too.
+type Store interface {
+	ingest.TraceSink
+	spanstore.Store
+}
+
+// Run runs the suite. open must return an empty store and release it with
+// t.Cleanup; it is called once per subtest.
+func Run(t *testing.T, open func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store Store)
+	}{
+		{"SpanFilters", testSpanFilters},
+		{"SpanOrderAndLimit", testSpanOrderAndLimit},
+		{"SpanDetails", testSpanDetails},
+		{"AttributeTypes", testAttributeTypes},
+		{"Dedup", testDedup},
+		{"TraceSummaries", testTraceSummaries},
+		{"TraceFilters", testTraceFilters},
+		{"TraceOrder", testTraceOrder},
+		{"TraceSpans", testTraceSpans},
+		{"TextSearch", testTextSearch},
+		{"DefaultLimit", testDefaultLimit},
+		{"Tags", testTags},
+		{"OTLP", testOTLP},
+		{"OTLPRoundTrip", func(t *testing.T, store Store) { testOTLPRoundTrip(t, store, open(t)) }},
+		{"Export", testExport},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, open(t))
+		})
+	}
+}
+
+func consume(t *testing.T, store Store, reqs ...*coltracepb.ExportTraceServiceRequest) {
+	t.Helper()
+	for i, req := range reqs {
+		if err := store.Consume(context.Background(), req); err != nil {
+			t.Fatalf("consume request %d: %v", i, err)
+		}
+	}
+}
+
+func statusPtr(code spanstore.StatusCode) *spanstore.StatusCode {
+	return &code
+}
+
+func spanIDs(spans []spanstore.Span) []string {
+	ids := make([]string, len(spans))
+	for i, span := range spans {
+		ids[i] = span.SpanID
+	}
+	return ids
+}
+
+func sortedSpanIDs(spans []spanstore.Span) []string {
+	ids := spanIDs(spans)
+	sort.Strings(ids)
+	return ids
+}
+
+func spanHexes(ids ...byte) []string {
+	result := make([]string, len(ids))
+	for i, id := range ids {
+		result[i] = spanHex(id)
+	}
+	return result
+}
+
+func traceIDs(summaries []spanstore.TraceSummary) []string {
+	ids := make([]string, len(summaries))
+	for i, summary := range summaries {
+		ids[i] = summary.TraceID
+	}
+	return ids
+}
+
+func traceHexes(ids ...byte) []string {
+	result := make([]string, len(ids))
+	for i, id := range ids {
+		result[i] = traceHex(id)
+	}
+	return result
+}
+
+func testSpanFilters(t *testing.T, store Store) {
+	consume(t, store, fixtureRequests()...)
+	cases := []struct {
+		name    string
+		service string
+		start   int64
+		end     int64
+		filters []spanstore.AttrFilter
+		status  *spanstore.StatusCode
+		text    string
+		want    []string
+	}{
+		{name: "frontend", service: "frontend", want: spanHexes(1, 4, 6, 7, 9)},
+		{name: "backend", service: "backend", want: spanHexes(2, 3, 5, 8, 10)},
+		{name: "unknown service", service: "missing", want: spanHexes()},
+		{name: "inclusive window", service: "frontend", start: ns(200), end: ns(300), want: spanHexes(4, 6, 7)},
+		{name: "status error", service: "backend", status: statusPtr(spanstore.StatusError), want: spanHexes(2)},
+		{name: "status ok", service: "backend", status: statusPtr(spanstore.StatusOk), want: spanHexes(3)},
+		{name: "status unset", service: "frontend", status: statusPtr(spanstore.StatusUnset), want: spanHexes(6, 7, 9)},
+		{name: "string equal", service: "frontend", filters: []spanstore.AttrFilter{{Key: "http.method", Value: "GET"}}, want: spanHexes(1, 4, 7)},
+		{name: "explicit equal", service: "frontend", filters: []spanstore.AttrFilter{{Key: "http.method", Op: spanstore.AttrOpEqual, Value: "POST"}}, want: spanHexes(6)},
+		{name: "not equal skips missing keys", service: "frontend", filters: []spanstore.AttrFilter{{Key: "http.method", Op: spanstore.AttrOpNotEqual, Value: "GET"}}, want: spanHexes(6)},
+		{name: "int equal", service: "frontend", filters: []spanstore.AttrFilter{{Key: "http.status_code", Value: "500"}}, want: spanHexes(1)},
+		{name: "int greater equal", service: "frontend", filters: []spanstore.AttrFilter{{Key: "http.status_code", Op: spanstore.AttrOpGreaterEqual, Value: "404"}}, want: spanHexes(1, 6)},
+		{name: "int less", service: "frontend", filters: []spanstore.AttrFilter{{Key: "http.status_code", Op: spanstore.AttrOpLess, Value: "300"}}, want: spanHexes(4, 7)},
+		{name: "double greater", service: "backend", filters: []spanstore.AttrFilter{{Key: "ratio", Op: spanstore.AttrOpGreater, Value: "1"}}, want: spanHexes(5)},
+		{name: "double less equal", service: "backend", filters: []spanstore.AttrFilter{{Key: "ratio", Op: spanstore.AttrOpLessEqual, Value: "0.75"}}, want: spanHexes(2)},
+		{name: "bool equal", service: "backend", filters: []spanstore.AttrFilter{{Key: "cached", Value: "true"}}, want: spanHexes(5)},
+		{name: "bool is not numeric", service: "backend", filters: []spanstore.AttrFilter{{Key: "cached", Op: spanstore.AttrOpGreater, Value: "0"}}, want: spanHexes()},
+		{name: "string is not numeric", service: "frontend", filters: []spanstore.AttrFilter{{Key: "http.method", Op: spanstore.AttrOpGreater, Value: "0"}}, want: spanHexes()},
+		{name: "missing key", service: "backend", filters: []spanstore.AttrFilter{{Key: "db.system", Value: "mysql"}}, want: spanHexes()},
+		{name: "filters combine", service: "frontend", filters: []spanstore.AttrFilter{
+			{Key: "http.method", Value: "GET"},
+			{Key: "http.status_code", Op: spanstore.AttrOpGreaterEqual, Value: "400"},
+		}, want: spanHexes(1)},
+		{name: "filters and status", service: "backend", status: statusPtr(spanstore.StatusUnset), filters: []spanstore.AttrFilter{
+			{Key: "http.status_code", Value: "200"},
+		}, want: spanHexes(5)},
+		{name: "text in name", service: "frontend", text: "checkout", want: spanHexes(1)},
+		{name: "text in status message", service: "backend", text: "declined", want: spanHexes(2)},
+		{name: "text in attribute", service: "backend", text: "postgres", want: spanHexes(3)},
+		{name: "text in event name", service: "frontend", text: "miss", want: spanHexes(1)},
+		{name: "text needs every term", service: "backend", text: "charge orders", want: spanHexes()},
+		{name: "text ignores case", service: "backend", text: "DECLINED", want: spanHexes(2)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := spanstore.QueryParams{
+				Service:     tc.service,
+				Start:       tc.start,
+				End:         tc.end,
+				Limit:       20,
+				AttrFilters: tc.filters,
+				StatusCode:  tc.status,
+				Text:        tc.text,
+			}
+			if params.Start == 0 && params.End == 0 {
+				params.Start, params.End = ns(0), ns(1000)
+			}
+			spans, err := store.QuerySpans(context.Background(), params)
+			if err != nil {
+				t.Fatalf("query spans: %v", err)
+			}
+			if got := sortedSpanIDs(spans); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected spans %v, got %v", tc.want, got)
+			}
+			if tc.text != "" {
+				for _, span := range spans {
+					if span.Match == nil || len(span.Match.Highlights) == 0 {
+						t.Fatalf("expected a text match on span %s, got %+v", span.SpanID, span.Match)
+					}
+				}
+			}
+		})
+	}
+}
+
+func testSpanOrderAndLimit(t *testing.T, store Store) {
+	consume(t, store, fixtureRequests()...)
+	ctx := context.Background()
+	spans, err := store.QuerySpans(ctx, spanstore.QueryParams{Service: "backend", Start: ns(0), End: ns(1000), Limit: 10})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if got, want := spanIDs(spans), spanHexes(10, 8, 5, 3, 2); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected newest spans first %v, got %v", want, got)
+	}
+	spans, err = store.QuerySpans(ctx, spanstore.QueryParams{Service: "backend", Start: ns(0), End: ns(1000), Limit: 2})
+	if err != nil {
+		t.Fatalf("query spans with limit: %v", err)
+	}
+	if got, want := spanIDs(spans), spanHexes(10, 8); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected limited spans %v, got %v", want, got)
+	}
+}
+
+func testSpanDetails(t *testing.T, store Store) {
+	consume(t, store, fixtureRequests()...)
+	spans, err := store.QuerySpans(context.Background(), spanstore.QueryParams{
+		Service:     "frontend",
+		Start:       ns(0),
+		End:         ns(1000),
+		AttrFilters: []spanstore.AttrFilter{{Key: "http.status_code", Value: "500"}},
+	})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	want := checkoutView()
+	if !reflect.DeepEqual(spans[0], want) {
+		t.Fatalf("unexpected span:\n got %#v\nwant %#v", spans[0], want)
+	}
+
+	spans, err = store.QueryTraceSpans(context.Background(), spanstore.TraceSpansQueryParams{TraceID: traceHex(4)})
+	if err != nil {
+		t.Fatalf("query trace spans: %v", err)
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	bare := spans[0]
+	if bare.Kind != "UNSPECIFIED" || bare.ParentSpanID != spanHex(99) || bare.ServiceName != "backend" {
+		t.Fatalf("unexpected span without extras: %+v", bare)
+	}
+	if bare.Attributes != nil || bare.Events != nil || bare.Links != nil {
+		t.Fatalf("expected no attributes, events or links, got %+v", bare)
+	}
+	wantScope := spanstore.Scope{Name: "rpc", Attributes: map[string]any{}}
+	if !reflect.DeepEqual(bare.Scope, wantScope) {
+		t.Fatalf("expected scope %+v, got %+v", wantScope, bare.Scope)
+	}
+}
+
+// checkoutView is checkoutSpan as the stores read it back.
+func checkoutView() spanstore.Span {
+	return spanstore.Span{
+		TraceID:           traceHex(1),
+		SpanID:            spanHex(1),
+		ParentSpanID:      rootParent,
+		Name:              "GET /checkout",
+		Kind:              "SPAN_KIND_SERVER",
+		StartTimeUnixNano: ns(0),
+		EndTimeUnixNano:   ns(100),
+		StatusCode:        int32(spanstore.StatusError),
+		StatusMessage:     "upstream failed",
+		ServiceName:       "frontend",
+		Flags:             1,
+		Resource: spanstore.Resource{
+			SchemaURL:  frontendURL,
+			Attributes: map[string]any{"service.name": "frontend", "deployment.environment": "prod"},
+		},
+		Scope: spanstore.Scope{
+			Name:       "http",
+			Version:    "1.0",
+			SchemaURL:  scopeURL,
+			Attributes: map[string]any{"scope.attr": "s"},
+		},
+		Attributes: map[string]any{"http.method": "GET", "http.status_code": int64(500)},
+		Events: []spanstore.Event{
+			{Name: "cache miss", TimeUnixNano: ns(20), Attributes: map[string]any{}},
+			{Name: "retry", TimeUnixNano: ns(20), Attributes: map[string]any{"attempt": int64(1)}},
+			{Name: "retry", TimeUnixNano: ns(60), DroppedAttributesCount: 1, Attributes: map[string]any{"attempt": int64(2)}},
+		},
+		Links: []spanstore.Link{
+			{TraceID: traceHex(2), SpanID: spanHex(4), TraceState: "k=v", DroppedAttributesCount: 2, Flags: 1, Attributes: map[string]any{"link.kind": "follows"}},
+			{TraceID: traceHex(3), SpanID: spanHex(6), Attributes: map[string]any{}},
+		},
+	}
+}
+
+func testAttributeTypes(t *testing.T, store Store) {
+	consume(t, store, typedRequest())
+	spans, err := store.QuerySpans(context.Background(), spanstore.QueryParams{Service: "typed", Start: ns(0), End: ns(1000)})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	// Values nested in arrays and key-value lists decode as JSON, so their
+	// numbers read back as float64.
+	want := map[string]any{
+		"string": "value",
+		"int":    int64(-42),
+		"double": 0.5,
+		"bool":   true,
+		"bytes":  "dead",
+		"array":  []any{"a", float64(7), 1.5, false},
+		"kvlist": map[string]any{"name": "x", "count": float64(3), "nested": []any{float64(1)}},
+		"empty":  "",
+	}
+	if got := spans[0].Attributes; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected attributes:\n got %#v\nwant %#v", got, want)
+	}
+	wantResource := map[string]any{"service.name": "typed", "host.cores": int64(8)}
+	if got := spans[0].Resource.Attributes; !reflect.DeepEqual(got, wantResource) {
+		t.Fatalf("unexpected resource attributes: %#v", got)
+	}
+
+	cases := []struct {
+		filter spanstore.AttrFilter
+		match  bool
+	}{
+		{spanstore.AttrFilter{Key: "int", Value: "-42"}, true},
+		{spanstore.AttrFilter{Key: "int", Op: spanstore.AttrOpLess, Value: "0"}, true},
+		{spanstore.AttrFilter{Key: "double", Value: "0.5"}, true},
+		{spanstore.AttrFilter{Key: "double", Op: spanstore.AttrOpGreaterEqual, Value: "0.5"}, true},
+		{spanstore.AttrFilter{Key: "bool", Value: "true"}, true},
+		{spanstore.AttrFilter{Key: "bytes", Value: "dead"}, true},
+		{spanstore.AttrFilter{Key: "empty", Value: ""}, true},
+		{spanstore.AttrFilter{Key: "array", Op: spanstore.AttrOpGreater, Value: "0"}, false},
+		{spanstore.AttrFilter{Key: "kvlist", Op: spanstore.AttrOpNotEqual, Value: "x"}, true},
+	}
+	for _, tc := range cases {
+		spans, err := store.QuerySpans(context.Background(), spanstore.QueryParams{
+			Service: "typed", Start: ns(0), End: ns(1000), AttrFilters: []spanstore.AttrFilter{tc.filter},
+		})
+		if err != nil {
+			t.Fatalf("query %+v: %v", tc.filter, err)
+		}
+		if got := len(spans) == 1; got != tc.match {
+			t.Fatalf("filter %+v: expected match=%t, got %d spans", tc.filter, tc.match, len(spans))
+		}
+	}
+}
+
+func testDedup(t *testing.T, store Store) {
+	duplicated := frontendRequest()
+	scopeSpans := duplicated.ResourceSpans[0].ScopeSpans[0]
+	scopeSpans.Spans = append(scopeSpans.Spans, checkoutSpan())
+	consume(t, store, backendRequest(), duplicated, frontendRequest(), backendRequest())
+
+	ctx := context.Background()
+	spans, err := store.QueryTraceSpans(ctx, spanstore.TraceSpansQueryParams{TraceID: traceHex(1)})
+	if err != nil {
+		t.Fatalf("query trace spans: %v", err)
+	}
+	if got, want := spanIDs(spans), spanHexes(1, 2, 3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected each span once %v, got %v", want, got)
+	}
+	if want := checkoutView(); !reflect.DeepEqual(spans[0], want) {
+		t.Fatalf("expected duplicates to keep one copy of events and links:\n got %#v\nwant %#v", spans[0], want)
+	}
+	summaries, err := store.QueryTraces(ctx, spanstore.TraceQueryParams{Start: ns(0), End: ns(1000)})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(summaries) != 6 {
+		t.Fatalf("expected 6 traces, got %d", len(summaries))
+	}
+	for _, summary := range summaries {
+		if summary.TraceID == traceHex(1) && (summary.SpanCount != 3 || summary.ErrorCount != 2) {
+			t.Fatalf("expected duplicates to be counted once, got %+v", summary)
+		}
+	}
+}
+
+func fixtureSummaries() map[byte]spanstore.TraceSummary {
+	return map[byte]spanstore.TraceSummary{
+		1: {TraceID: traceHex(1), RootName: "GET /checkout", StartTimeUnixNano: ns(0), EndTimeUnixNano: ns(100), DurationUnixNano: ns(100) - ns(0), SpanCount: 3, ErrorCount: 2, ServiceName: "frontend"},
+		2: {TraceID: traceHex(2), RootName: "GET /browse", StartTimeUnixNano: ns(200), EndTimeUnixNano: ns(220), DurationUnixNano: ns(220) - ns(200), SpanCount: 2, ServiceName: "frontend"},
+		3: {TraceID: traceHex(3), RootName: "GET /search", StartTimeUnixNano: ns(300), EndTimeUnixNano: ns(305), DurationUnixNano: ns(305) - ns(300), SpanCount: 1, ServiceName: "frontend"},
+		4: {TraceID: traceHex(4), StartTimeUnixNano: ns(400), EndTimeUnixNano: ns(450), DurationUnixNano: ns(450) - ns(400), SpanCount: 1, ServiceName: "backend"},
+		5: {TraceID: traceHex(5), RootName: "schedule", StartTimeUnixNano: ns(500), EndTimeUnixNano: ns(530), DurationUnixNano: ns(530) - ns(500), SpanCount: 2, ServiceName: "frontend"},
+		6: {TraceID: traceHex(6), RootName: "GET /search", StartTimeUnixNano: ns(300), EndTimeUnixNano: ns(305), DurationUnixNano: ns(305) - ns(300), SpanCount: 1, ServiceName: "frontend"},
+	}
+}
+
+func testTraceSummaries(t *testing.T, store Store) {
+	consume(t, store, fixtureRequests()...)
+	ctx := context.Background()
+	summaries, err := store.QueryTraces(ctx, spanstore.TraceQueryParams{Start: ns(0), End: ns(1000), Order: spanstore.TraceOrderStartAsc})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	// Trace 1 names its root and service after the frontend span although
+	// the backend spans arrived first and sort first by service name. Trace
+	// 4 has no root; trace 5 has two and takes the earlier one.
+	expected := fixtureSummaries()
+	want := []spanstore.TraceSummary{expected[1], expected[2], expected[6], expected[3], expected[4], expected[5]}
+	if !reflect.DeepEqual(summaries, want) {
+		t.Fatalf("unexpected summaries:\n got %+v\nwant %+v", summaries, want)
+	}
+
+	// A service filter selects traces with any span in that service and
+	// reports the service asked for, while still summarizing every span.
+	summaries, err = store.QueryTraces(ctx, spanstore.TraceQueryParams{Service: "backend", Start: ns(0), End: ns(1000), Order: spanstore.TraceOrderStartAsc})
+	if err != nil {
+		t.Fatalf("query backend traces: %v", err)
+	}
+	want = nil
+	for _, id := range []byte{1, 2, 4, 5} {
+		summary := expected[id]
+		summary.ServiceName = "backend"
+		want = append(want, summary)
+	}
+	if !reflect.DeepEqual(summaries, want) {
+		t.Fatalf("unexpected backend summaries:\n got %+v\nwant %+v", summaries, want)
+	}
+
+	// The window selects traces by their spans' start times but the
+	// summary still covers the whole trace.
+	summaries, err = store.QueryTraces(ctx, spanstore.TraceQueryParams{Start: ns(15), End: ns(25)})
+	if err != nil {
+		t.Fatalf("query traces in window: %v", err)
+	}
+	if want := []spanstore.TraceSummary{expected[1]}; !reflect.DeepEqual(summaries, want) {
+		t.Fatalf("unexpected windowed summaries:\n got %+v\nwant %+v", summaries, want)
+	}
+}
+
+func testTraceFilters(t *testing.T, store Store) {
+	consume(t, store, fixtureRequests()...)
+	cases := []struct {
+		name   string
+		params spanstore.TraceQueryParams
+		want   []string
+	}{
+		{name: "all", want: traceHexes(1, 2, 6, 3, 4, 5)},
+		{name: "service", params: spanstore.TraceQueryParams{Service: "frontend"}, want: traceHexes(1, 2, 6, 3, 5)},
+		{name: "unknown service", params: spanstore.TraceQueryParams{Service: "missing"}, want: traceHexes()},
+		{name: "window", params: spanstore.TraceQueryParams{Start: ns(300), End: ns(510)}, want: traceHexes(6, 3, 4, 5)},
+		{name: "attr on any span", params: spanstore.TraceQueryParams{AttrFilters: []spanstore.AttrFilter{
+			{Key: "http.status_code", Op: spanstore.AttrOpGreaterEqual, Value: "500"},
+		}}, want: traceHexes(1)},
+		{name: "attrs on one span", params: spanstore.TraceQueryParams{AttrFilters: []spanstore.AttrFilter{
+			{Key: "cached", Value: "true"},
+			{Key: "http.status_code", Value: "200"},
+		}}, want: traceHexes(2)},
+		{name: "attrs on different spans", params: spanstore.TraceQueryParams{AttrFilters: []spanstore.AttrFilter{
+			{Key: "cached", Value: "true"},
+			{Key: "http.method", Value: "GET"},
+		}}, want: traceHexes()},
+		{name: "service and attr", params: spanstore.TraceQueryParams{Service: "backend", AttrFilters: []spanstore.AttrFilter{
+			{Key: "http.method", Value: "GET"},
+		}}, want: traceHexes()},
+		{name: "status error", params: spanstore.TraceQueryParams{StatusCode: statusPtr(spanstore.StatusError)}, want: traceHexes(1)},
+		{name: "status ok", params: spanstore.TraceQueryParams{StatusCode: statusPtr(spanstore.StatusOk)}, want: traceHexes(1, 2)},
+		{name: "has error", params: spanstore.TraceQueryParams{HasError: true}, want: traceHexes(1)},
+		{name: "has error in service", params: spanstore.TraceQueryParams{Service: "backend", HasError: true}, want: traceHexes(1)},
+		{name: "min duration", params: spanstore.TraceQueryParams{MinDuration: ns(30) - ns(0)}, want: traceHexes(1, 4, 5)},
+		{name: "max duration", params: spanstore.TraceQueryParams{MaxDuration: ns(20) - ns(0)}, want: traceHexes(2, 6, 3)},
+		{name: "duration range", params: spanstore.TraceQueryParams{MinDuration: ns(20) - ns(0), MaxDuration: ns(50) - ns(0)}, want: traceHexes(2, 4, 5)},
+		{name: "text", params: spanstore.TraceQueryParams{Text: "declined"}, want: traceHexes(1)},
+		{name: "text and service", params: spanstore.TraceQueryParams{Service: "frontend", Text: "declined"}, want: traceHexes()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := tc.params
+			if params.Start == 0 && params.End == 0 {
+				params.Start, params.End = ns(0), ns(1000)
+			}
+			params.Order = spanstore.TraceOrderStartAsc
+			summaries, err := store.QueryTraces(context.Background(), params)
+			if err != nil {
+				t.Fatalf("query traces: %v", err)
+			}
+			if got := traceIDs(summaries); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected traces %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	summaries, err := store.QueryTraces(context.Background(), spanstore.TraceQueryParams{Start: ns(0), End: ns(1000), Text: "declined"})
+	if err != nil {
+		t.Fatalf("query traces by text: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].Match == nil || summaries[0].Match.SpanID != spanHex(2) {
+		t.Fatalf("expected the trace to point at its matching span, got %+v", summaries)
+	}
+}
+
+func testTraceOrder(t *testing.T, store Store) {
+	consume(t, store, fixtureRequests()...)
+	// Traces 3 and 6 tie on start and duration; the trace ID breaks the
+	// tie, highest first, whatever the order.
+	cases := []struct {
+		order spanstore.TraceOrder
+		limit int
+		want  []string
+	}{
+		{order: "", want: traceHexes(5, 4, 6, 3, 2, 1)},
+		{order: spanstore.TraceOrderStartDesc, want: traceHexes(5, 4, 6, 3, 2, 1)},
+		{order: spanstore.TraceOrderStartAsc, want: traceHexes(1, 2, 6, 3, 4, 5)},
+		{order: spanstore.TraceOrderDurationDesc, want: traceHexes(1, 4, 5, 2, 6, 3)},
+		{order: spanstore.TraceOrderDurationAsc, want: traceHexes(6, 3, 2, 5, 4, 1)},
+		{order: spanstore.TraceOrderRelevance, want: traceHexes(5, 4, 6, 3, 2, 1)},
+		{order: spanstore.TraceOrderStartDesc, limit: 3, want: traceHexes(5, 4, 6)},
+		{order: spanstore.TraceOrderDurationAsc, limit: 1, want: traceHexes(6)},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s/%d", tc.order, tc.limit), func(t *testing.T) {
+			summaries, err := store.QueryTraces(context.Background(), spanstore.TraceQueryParams{
+				Start: ns(0), End: ns(1000), Order: tc.order, Limit: tc.limit,
+			})
+			if err != nil {
+				t.Fatalf("query traces: %v", err)
+			}
+			if got := traceIDs(summaries); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected traces %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func testTraceSpans(t *testing.T, store Store) {
+	consume(t, store, fixtureRequests()...)
+	cases := []struct {
+		name   string
+		params spanstore.TraceSpansQueryParams
+		want   []string
+	}{
+		{name: "start order", params: spanstore.TraceSpansQueryParams{TraceID: traceHex(1)}, want: spanHexes(1, 2, 3)},
+		{name: "service", params: spanstore.TraceSpansQueryParams{TraceID: traceHex(1), Service: "backend"}, want: spanHexes(2, 3)},
+		{name: "status", params: spanstore.TraceSpansQueryParams{TraceID: traceHex(1), StatusCode: statusPtr(spanstore.StatusError)}, want: spanHexes(1, 2)},
+		{name: "service and status", params: spanstore.TraceSpansQueryParams{TraceID: traceHex(1), Service: "backend", StatusCode: statusPtr(spanstore.StatusOk)}, want: spanHexes(3)},
+		{name: "parentless spans", params: spanstore.TraceSpansQueryParams{TraceID: traceHex(5)}, want: spanHexes(9, 10)},
+		{name: "unknown trace", params: spanstore.TraceSpansQueryParams{TraceID: traceHex(42)}, want: spanHexes()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			spans, err := store.QueryTraceSpans(context.Background(), tc.params)
+			if err != nil {
+				t.Fatalf("query trace spans: %v", err)
+			}
+			if got := spanIDs(spans); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected spans %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func testTextSearch(t *testing.T, store Store) {
+	consume(t, store, searchRequest())
+	ctx := context.Background()
+	search := func(text string) []spanstore.Span {
+		t.Helper()
+		spans, err := store.QuerySpans(ctx, spanstore.QueryParams{Service: "shop", Start: ns(0), End: ns(1000), Limit: 10, Text: text})
+		if err != nil {
+			t.Fatalf("search %q: %v", text, err)
+		}
+		return spans
+	}
+
+	spans := search("ord-12345")
+	if len(spans) != 1 || spans[0].Name != "POST /checkout" || spans[0].Match == nil {
+		t.Fatalf("unexpected order ID matches: %+v", spans)
+	}
+	if got := spans[0].Match.Highlights["attributes"]; got != "<mark>ORD-12345</mark> | refund desk" {
+		t.Fatalf("expected highlighted order ID, got %q", got)
+	}
+	// Terms match whole tokens, the last of them by prefix, and highlight
+	// the whole tokens they matched.
+	if spans := search("DECLINED pay"); len(spans) != 1 || spans[0].Match.Highlights["status_message"] != "<mark>payment</mark> <mark>declined</mark> by issuer" {
+		t.Fatalf("unexpected status message matches: %+v", spans)
+	}
+	for _, text := range []string{"ment", "ord-2345", "12345-ord"} {
+		if spans := search(text); len(spans) != 0 {
+			t.Fatalf("expected %q to match no token, got %+v", text, spans)
+		}
+	}
+	// Highlights are HTML, so the text around the marks is escaped.
+	if spans := search("widget"); len(spans) != 1 || spans[0].Match.Highlights["name"] != `render &lt;b onclick=&#34;x()&#34;&gt;<mark>widget</mark>&lt;/b&gt; &amp; co` {
+		t.Fatalf("expected an escaped highlight, got %+v", spans)
+	}
+	if spans := search("retrying"); len(spans) != 1 || spans[0].Name != "charge card" {
+		t.Fatalf("expected event name match, got %+v", spans)
+	}
+	// Query syntax characters are searched for, not interpreted.
+	for _, text := range []string{`"`, "-", "*", "AND", "name:x"} {
+		search(text)
+	}
+	// A hit in the span name outranks the same word in an attribute value.
+	spans = search("refund")
+	if len(spans) != 2 || spans[0].Name != "POST /refund" || spans[0].Match.Score <= spans[1].Match.Score {
+		t.Fatalf("unexpected ranking: %+v", spans)
+	}
+
+	traces, err := store.QueryTraces(ctx, spanstore.TraceQueryParams{Service: "shop", Start: ns(0), End: ns(1000), Limit: 10, Text: "charge"})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(traces) != 1 || traces[0].SpanCount != 2 || traces[0].Match == nil || traces[0].Match.SpanID != spanHex(21) {
+		t.Fatalf("unexpected trace matches: %+v", traces)
+	}
+}
+
+func testDefaultLimit(t *testing.T, store Store) {
+	consume(t, store, bulkRequest(120))
+	ctx := context.Background()
+	spans, err := store.QuerySpans(ctx, spanstore.QueryParams{Service: "bulk", Start: ns(0), End: ns(1000)})
+	if err != nil {
+		t.Fatalf("query spans: %v", err)
+	}
+	if len(spans) != 100 || spans[0].StartTimeUnixNano != ns(119) {
+		t.Fatalf("expected the newest 100 spans, got %d starting at %d", len(spans), spans[0].StartTimeUnixNano)
+	}
+	summaries, err := store.QueryTraces(ctx, spanstore.TraceQueryParams{Start: ns(0), End: ns(1000)})
+	if err != nil {
+		t.Fatalf("query traces: %v", err)
+	}
+	if len(summaries) != 100 || summaries[0].StartTimeUnixNano != ns(119) {
+		t.Fatalf("expected the newest 100 traces, got %d", len(summaries))
+	}
+}
+
+func testTags(t *testing.T, store Store) {
+	tags, ok := store.(spanstore.TagStore)
+	if !ok {
+		t.Skip("store does not implement spanstore.TagStore")
+	}
+	ctx := context.Background()
+	names, err := tags.QueryTagNames(ctx, spanstore.TagQueryParams{})
+	if err != nil {
+		t.Fatalf("query tag names on empty store: %v", err)
+	}
+	if want := []string{"service.name"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected %v on an empty store, got %v", want, names)
+	}
+
+	consume(t, store, fixtureRequests()...)
+	nameCases := []struct {
+		name   string
+		params spanstore.TagQueryParams
+		want   []string
+	}{
+		{name: "all", want: []string{"cached", "db.system", "deployment.environment", "http.method", "http.status_code", "ratio", "service.name"}},
+		{name: "window", params: spanstore.TagQueryParams{Start: ns(300), End: ns(305)}, want: []string{"deployment.environment", "http.method", "http.status_code", "service.name"}},
+		{name: "open end", params: spanstore.TagQueryParams{Start: ns(400)}, want: []string{"deployment.environment", "service.name"}},
+		{name: "limit", params: spanstore.TagQueryParams{Limit: 2}, want: []string{"cached", "db.system"}},
+	}
+	for _, tc := range nameCases {
+		t.Run("names/"+tc.name, func(t *testing.T) {
+			names, err := tags.QueryTagNames(ctx, tc.params)
+			if err != nil {
+				t.Fatalf("query tag names: %v", err)
+			}
+			if !reflect.DeepEqual(names, tc.want) {
+				t.Fatalf("expected tag names %v, got %v", tc.want, names)
+			}
+		})
+	}
+
+	valueCases := []struct {
+		name   string
+		tag    string
+		params spanstore.TagQueryParams
+		want   []string
+	}{
+		{name: "services", tag: "service.name", want: []string{"backend", "frontend"}},
+		{name: "services in window", tag: "service.name", params: spanstore.TagQueryParams{Start: ns(400), End: ns(450)}, want: []string{"backend"}},
+		{name: "resource attribute", tag: "deployment.environment", want: []string{"prod", "staging"}},
+		{name: "span attribute", tag: "http.method", want: []string{"GET", "POST"}},
+		{name: "typed attribute", tag: "http.status_code", want: []string{"200", "404", "500", "503"}},
+		{name: "limit", tag: "http.status_code", params: spanstore.TagQueryParams{Limit: 1}, want: []string{"200"}},
+		{name: "unknown tag", tag: "missing", want: nil},
+	}
+	for _, tc := range valueCases {
+		t.Run("values/"+tc.name, func(t *testing.T) {
+			values, err := tags.QueryTagValues(ctx, tc.tag, tc.params)
+			if err != nil {
+				t.Fatalf("query tag values: %v", err)
+			}
+			if len(values) != len(tc.want) || (len(values) > 0 && !reflect.DeepEqual(values, tc.want)) {
+				t.Fatalf("expected tag values %v, got %v", tc.want, values)
+			}
+		})
+	}
+	if _, err := tags.QueryTagValues(ctx, " ", spanstore.TagQueryParams{}); err == nil {
+		t.Fatalf("expected an empty tag to be rejected")
+	}
+}
+
+func testOTLP(t *testing.T, store Store) {
+	otlp, ok := store.(spanstore.OTLPStore)
+	if !ok {
+		t.Skip("store does not implement spanstore.OTLPStore")
+	}
+	consume(t, store, fixtureRequests()...)
+	ctx := context.Background()
+	req, err := otlp.QueryTraceOTLP(ctx, spanstore.TraceSpansQueryParams{TraceID: traceHex(1)})
+	if err != nil {
+		t.Fatalf("query trace otlp: %v", err)
+	}
+	if got, want := checkExported(t, req), spanHexes(1, 2, 3); !reflect.DeepEqual(sortedStrings(got), want) {
+		t.Fatalf("expected spans %v, got %v", want, got)
+	}
+
+	req, err = otlp.QueryTraceOTLP(ctx, spanstore.TraceSpansQueryParams{TraceID: traceHex(42)})
+	if err != nil {
+		t.Fatalf("query unknown trace: %v", err)
+	}
+	if len(req.GetResourceSpans()) != 0 {
+		t.Fatalf("expected no spans for an unknown trace, got %v", req)
+	}
+}
+
+// testOTLPRoundTrip exports a trace, imports the export into a second store,
+// and exports it again, expecting the original request both times.
+func testOTLPRoundTrip(t *testing.T, store, second Store) {
+	otlp, ok := store.(spanstore.OTLPStore)
+	if !ok {
+		t.Skip("store does not implement spanstore.OTLPStore")
+	}
+	original := roundTripRequest()
+	consume(t, store, original)
+	ctx := context.Background()
+	params := spanstore.TraceSpansQueryParams{TraceID: traceHex(8)}
+	exported, err := otlp.QueryTraceOTLP(ctx, params)
+	if err != nil {
+		t.Fatalf("query trace otlp: %v", err)
+	}
+	if !proto.Equal(roundTripRequest(), exported) {
+		t.Fatalf("exported trace differs from original:\noriginal=%v\nexported=%v", roundTripRequest(), exported)
+	}
+
+	consume(t, second, exported)
+	reexported, err := second.(spanstore.OTLPStore).QueryTraceOTLP(ctx, params)
+	if err != nil {
+		t.Fatalf("query second trace otlp: %v", err)
+	}
+	if !proto.Equal(exported, reexported) {
+		t.Fatalf("re-exported trace differs:\nfirst=%v\nsecond=%v", exported, reexported)
+	}
+}
+
+func testExport(t *testing.T, store Store) {
+	exporter, ok := store.(spanstore.ExportStore)
+	if !ok {
+		t.Skip("store does not implement spanstore.ExportStore")
+	}
+	consume(t, store, fixtureRequests()...)
+	ctx := context.Background()
+
+	var exported []string
+	var after *spanstore.ExportCursor
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("export did not finish, got %v", exported)
+		}
+		page, err := exporter.ExportSpans(ctx, spanstore.ExportParams{After: after, Limit: 4})
+		if err != nil {
+			t.Fatalf("export page %d: %v", pages, err)
+		}
+		ids := checkExported(t, page.Request)
+		if page.Spans != len(ids) || page.Spans > 4 {
+			t.Fatalf("page %d: expected Spans to count %d exported spans, got %d", pages, len(ids), page.Spans)
+		}
+		if page.Spans == 0 {
+			if page.Next != nil {
+				t.Fatalf("expected no cursor on an empty page, got %+v", page.Next)
+			}
+			break
+		}
+		if page.Next == nil || page.Next.SpanID != ids[len(ids)-1] {
+			t.Fatalf("page %d: expected a cursor at the last span, got %+v", pages, page.Next)
+		}
+		exported = append(exported, ids...)
+		after = page.Next
+	}
+	// Export order is start time, then trace ID: traces 3 and 6 tie on start.
+	if want := spanHexes(1, 2, 3, 4, 5, 6, 7, 8, 9, 10); !reflect.DeepEqual(exported, want) {
+		t.Fatalf("expected every span once in export order %v, got %v", want, exported)
+	}
+
+	cases := []struct {
+		name   string
+		params spanstore.ExportParams
+		want   []string
+	}{
+		{name: "window", params: spanstore.ExportParams{Start: ns(200), End: ns(300)}, want: spanHexes(4, 5, 6, 7)},
+		{name: "after tie", params: spanstore.ExportParams{After: &spanstore.ExportCursor{StartTimeUnixNano: ns(300), TraceID: traceHex(3), SpanID: spanHex(6)}}, want: spanHexes(7, 8, 9, 10)},
+		{name: "after window", params: spanstore.ExportParams{Start: ns(0), End: ns(400), After: &spanstore.ExportCursor{StartTimeUnixNano: ns(205), TraceID: traceHex(2), SpanID: spanHex(5)}}, want: spanHexes(6, 7, 8)},
+		{name: "service", params: spanstore.ExportParams{Service: "backend"}, want: spanHexes(2, 3, 5, 8, 10)},
+		{name: "service window", params: spanstore.ExportParams{Service: "frontend", Start: ns(200), End: ns(500)}, want: spanHexes(4, 6, 7, 9)},
+		{name: "after everything", params: spanstore.ExportParams{After: &spanstore.ExportCursor{StartTimeUnixNano: ns(1000)}}, want: spanHexes()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			page, err := exporter.ExportSpans(ctx, tc.params)
+			if err != nil {
+				t.Fatalf("export: %v", err)
+			}
+			if got := exportOrder(page.Request); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected spans %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// checkExported compares every span in req with the fixture span it came
+// from, including its resource, and returns the span IDs in export order.
+func checkExported(t *testing.T, req *coltracepb.ExportTraceServiceRequest) []string {
+	t.Helper()
+	want := map[string]*tracepb.Span{}
+	for _, original := range fixtureRequests() {
+		for _, resourceSpans := range original.GetResourceSpans() {
+			for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+				for _, span := range scopeSpans.GetSpans() {
+					want[fmt.Sprintf("%x", span.GetSpanId())] = span
+				}
+			}
+		}
+	}
+	services := map[string]string{}
+	for _, id := range spanHexes(1, 4, 6, 7, 9) {
+		services[id] = "frontend"
+	}
+	for _, id := range spanHexes(2, 3, 5, 8, 10) {
+		services[id] = "backend"
+	}
+	for _, resourceSpans := range req.GetResourceSpans() {
+		service := ""
+		for _, kv := range resourceSpans.GetResource().GetAttributes() {
+			if kv.GetKey() == "service.name" {
+				service = kv.GetValue().GetStringValue()
+			}
+		}
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			for _, span := range scopeSpans.GetSpans() {
+				id := fmt.Sprintf("%x", span.GetSpanId())
+				if services[id] != service {
+					t.Fatalf("expected span %s under service %q, got %q", id, services[id], service)
+				}
+				// Events and links come back in their stored order.
+				expected := proto.Clone(want[id]).(*tracepb.Span)
+				actual := proto.Clone(span).(*tracepb.Span)
+				sortProtoEvents(expected)
+				sortProtoEvents(actual)
+				if !proto.Equal(expected, actual) {
+					t.Fatalf("span %s differs:\n got %v\nwant %v", id, span, expected)
+				}
+			}
+		}
+	}
+	return exportOrder(req)
+}
+
+// exportOrder lists the span IDs of req sorted into export order.
+func exportOrder(req *coltracepb.ExportTraceServiceRequest) []string {
+	var spans []*tracepb.Span
+	for _, resourceSpans := range req.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			spans = append(spans, scopeSpans.GetSpans()...)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		left := spanstore.ExportCursor{StartTimeUnixNano: int64(spans[i].GetStartTimeUnixNano()), TraceID: fmt.Sprintf("%x", spans[i].GetTraceId()), SpanID: fmt.Sprintf("%x", spans[i].GetSpanId())}
+		right := spanstore.ExportCursor{StartTimeUnixNano: int64(spans[j].GetStartTimeUnixNano()), TraceID: fmt.Sprintf("%x", spans[j].GetTraceId()), SpanID: fmt.Sprintf("%x", spans[j].GetSpanId())}
+		return left.Before(right)
+	})
+	ids := make([]string, len(spans))
+	for i, span := range spans {
+		ids[i] = fmt.Sprintf("%x", span.GetSpanId())
+	}
+	return ids
+}
+
+func sortedStrings(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func sortProtoEvents(span *tracepb.Span) {
+	sort.SliceStable(span.Events, func(i, j int) bool {
+		if span.Events[i].GetTimeUnixNano() == span.Events[j].GetTimeUnixNano() {
+			return span.Events[i].GetName() < span.Events[j].GetName()
+		}
+		return span.Events[i].GetTimeUnixNano() < span.Events[j].GetTimeUnixNano()
+	})
+	sort.SliceStable(span.Links, func(i, j int) bool {
+		left := fmt.Sprintf("%x%x", span.Links[i].GetTraceId(), span.Links[i].GetSpanId())
+		right := fmt.Sprintf("%x%x", span.Links[j].GetTraceId(), span.Links[j].GetSpanId())
+		return left < right
+	})
+}
@@ -1,12 +1,59 @@
 package spanstore
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
 
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+)
+
+// AttrFilter matches spans that carry attribute Key. Equality operators
+// compare the attribute's string form; ordering operators compare int and
+// double attributes numerically and never match other types.
 type AttrFilter struct {
 	Key   string
+	Op    AttrOp
 	Value string
 }
 
+type AttrOp string
+
+const (
+	AttrOpEqual        AttrOp = "="
+	AttrOpNotEqual     AttrOp = "!="
+	AttrOpGreater      AttrOp = ">"
+	AttrOpGreaterEqual AttrOp = ">="
+	AttrOpLess         AttrOp = "<"
+	AttrOpLessEqual    AttrOp = "<="
+)
+
+// Numeric reports whether the operator compares numbers.
+func (op AttrOp) Numeric() bool {
+	switch op {
+	case AttrOpGreater, AttrOpGreaterEqual, AttrOpLess, AttrOpLessEqual:
+		return true
+	}
+	return false
+}
+
+// Validate checks the operator and, for numeric operators, the value. An
+// empty Op means equality.
+func (f AttrFilter) Validate() error {
+	switch f.Op {
+	case "", AttrOpEqual, AttrOpNotEqual:
+		return nil
+	case AttrOpGreater, AttrOpGreaterEqual, AttrOpLess, AttrOpLessEqual:
+		if _, err := strconv.ParseFloat(f.Value, 64); err != nil {
+			return fmt.Errorf("attr %s%s%s: value must be a number", f.Key, f.Op, f.Value)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported attr operator %q", f.Op)
+	}
+}
+
 type TraceOrder string
 
 const (
@@ -14,6 +61,9 @@ const (
 	TraceOrderStartAsc     TraceOrder = "start_asc"
 	TraceOrderDurationDesc TraceOrder = "duration_desc"
 	TraceOrderDurationAsc  TraceOrder = "duration_asc"
+	// TraceOrderRelevance ranks traces by their best free-text match and
+	// requires Text.
+	TraceOrderRelevance TraceOrder = "relevance"
 )
 
 type StatusCode int32
@@ -31,6 +81,10 @@ type QueryParams struct {
 	Limit       int
 	AttrFilters []AttrFilter
 	StatusCode  *StatusCode
+	// Text restricts results to spans whose name, status message, string
+	// attribute values, or event names contain every whitespace-separated
+	// term. Matches are ordered by relevance.
+	Text string
 }
 
 type TraceQueryParams struct {
@@ -42,6 +96,11 @@ type TraceQueryParams struct {
 	AttrFilters []AttrFilter
 	StatusCode  *StatusCode
 	HasError    bool
+	MinDuration int64
+	MaxDuration int64
+	// Text restricts results to traces with a span matching every term, as
+	// in QueryParams.
+	Text string
 }
 
 type TraceSpansQueryParams struct {
@@ -50,6 +109,12 @@ type TraceSpansQueryParams struct {
 	StatusCode *StatusCode
 }
 
+type TagQueryParams struct {
+	Start int64
+	End   int64
+	Limit int
+}
+
 type TraceSummary struct {
 	TraceID           string `json:"trace_id"`
 	RootName          string `json:"root_name"`
@@ -59,6 +124,18 @@ type TraceSummary struct {
 	SpanCount         int64  `json:"span_count"`
 	ErrorCount        int64  `json:"error_count"`
 	ServiceName       string `json:"service_name"`
+	// Match is the trace's best-matching span for a free-text search.
+	Match *TextMatch `json:"match,omitempty"`
+}
+
+// TextMatch explains a free-text search hit. Score is higher for better
+// matches and only comparable within one store. Highlights holds the matched
+// fields (name, status_message, attributes, events) as HTML, escaped, with
+// each hit wrapped in <mark></mark>.
+type TextMatch struct {
+	Score      float64           `json:"score"`
+	SpanID     string            `json:"span_id,omitempty"`
+	Highlights map[string]string `json:"highlights"`
 }
 
 type Span struct {
@@ -78,6 +155,7 @@ type Span struct {
 	Attributes        map[string]any `json:"attributes"`
 	Events            []Event        `json:"events"`
 	Links             []Link         `json:"links"`
+	Match             *TextMatch     `json:"match,omitempty"`
 }
 
 type Resource struct {
@@ -113,3 +191,84 @@ type Store interface {
 	QueryTraces(ctx context.Context, params TraceQueryParams) ([]TraceSummary, error)
 	QueryTraceSpans(ctx context.Context, params TraceSpansQueryParams) ([]Span, error)
 }
+
+type TagStore interface {
+	QueryTagNames(ctx context.Context, params TagQueryParams) ([]string, error)
+	QueryTagValues(ctx context.Context, tag string, params TagQueryParams) ([]string, error)
+}
+
+type OTLPStore interface {
+	QueryTraceOTLP(ctx context.Context, params TraceSpansQueryParams) (*coltracepb.ExportTraceServiceRequest, error)
+}
+
+// ExportParams pages through the spans starting in [Start, End] in export
+// order: start time, then trace ID, then span ID. A non-positive End is
+// unbounded. A non-empty Service keeps only that service's spans. After
+// continues behind the last span of a previous page.
+type ExportParams struct {
+	Service string
+	Start   int64
+	End     int64
+	After   *ExportCursor
+	Limit   int
+}
+
+// ExportCursor is a span's position in export order.
+type ExportCursor struct {
+	StartTimeUnixNano int64  `json:"start_time_unix_nano"`
+	TraceID           string `json:"trace_id"`
+	SpanID            string `json:"span_id"`
+}
+
+// Before reports whether c sorts before other in export order.
+func (c ExportCursor) Before(other ExportCursor) bool {
+	if c.StartTimeUnixNano != other.StartTimeUnixNano {
+		return c.StartTimeUnixNano < other.StartTimeUnixNano
+	}
+	if c.TraceID != other.TraceID {
+		return c.TraceID < other.TraceID
+	}
+	return c.SpanID < other.SpanID
+}
+
+// ExportPage holds up to Limit spans grouped under their resources and
+// scopes. Next is the cursor of the page's last span; an empty page has none
+// and ends the export.
+type ExportPage struct {
+	Request *coltracepb.ExportTraceServiceRequest
+	Spans   int
+	Next    *ExportCursor
+}
+
+// ExportStore streams stored spans back in OTLP form, for copying a store.
+type ExportStore interface {
+	ExportSpans(ctx context.Context, params ExportParams) (ExportPage, error)
+}
+
+// ParquetStore writes the spans matching params, ignoring After and Limit, to
+// a Parquet file at path and returns the number of spans written.
+type ParquetStore interface {
+	WriteParquet(ctx context.Context, params ExportParams, path string) (int64, error)
+}
+
+// ErrSQLNotAllowed rejects statements other than a single read-only SELECT.
+var ErrSQLNotAllowed = errors.New("only a single read-only SELECT statement is allowed")
+
+// SQLQuery is one ad-hoc SELECT. At most MaxRows rows are returned.
+type SQLQuery struct {
+	Query   string
+	MaxRows int
+}
+
+// SQLResult holds a query's columns and rows. Truncated is set when the
+// query produced more than MaxRows rows.
+type SQLResult struct {
+	Columns   []string `json:"columns"`
+	Rows      [][]any  `json:"rows"`
+	Truncated bool     `json:"truncated"`
+}
+
+// SQLStore runs ad-hoc read-only SQL against the store's own tables.
+type SQLStore interface {
+	QuerySQL(ctx context.Context, query SQLQuery) (SQLResult, error)
+}
@@ -0,0 +1,192 @@
+// Package sqlconsole holds the store-independent parts of the read-only SQL
+// console: statement checks and result scanning.
+package sqlconsole
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+const DefaultMaxRows = 1000
+
+// Check returns query without trailing semicolons. It rejects anything but a
+// single statement starting with SELECT, WITH, or VALUES. Stores still run
+// the statement read-only; this only gives early, uniform errors.
+func Check(query string) (string, error) {
+	statement, rest := splitStatement(query)
+	if strings.TrimSpace(stripComments(rest)) != "" {
+		return "", fmt.Errorf("%w: found more than one statement", spanstore.ErrSQLNotAllowed)
+	}
+	keyword := firstKeyword(statement)
+	if keyword == "" {
+		return "", fmt.Errorf("%w: query is empty", spanstore.ErrSQLNotAllowed)
+	}
+	switch keyword {
+	case "SELECT", "WITH", "VALUES":
+		return strings.TrimSpace(statement), nil
+	default:
+		return "", fmt.Errorf("%w: got %s", spanstore.ErrSQLNotAllowed, keyword)
+	}
+}
+
+// splitStatement returns the text before the first semicolon outside quotes
+// and comments, and everything after it with further semicolons removed.
+func splitStatement(query string) (string, string) {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(query, i, c)
+		case c == '[':
+			i = skipQuoted(query, i, ']')
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			i = skipLineComment(query, i)
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			i = skipBlockComment(query, i)
+		case c == ';':
+			return query[:i], strings.ReplaceAll(query[i+1:], ";", "")
+		}
+	}
+	return query, ""
+}
+
+func skipQuoted(query string, start int, closing byte) int {
+	for i := start + 1; i < len(query); i++ {
+		if query[i] == closing {
+			// A doubled quote is an escaped quote, not the end.
+			if i+1 < len(query) && query[i+1] == closing && closing != ']' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(query)
+}
+
+func skipLineComment(query string, start int) int {
+	if end := strings.IndexByte(query[start:], '\n'); end >= 0 {
+		return start + end
+	}
+	return len(query)
+}
+
+func skipBlockComment(query string, start int) int {
+	if end := strings.Index(query[start+2:], "*/"); end >= 0 {
+		return start + 2 + end + 1
+	}
+	return len(query)
+}
+
+func stripComments(text string) string {
+	var builder strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case strings.HasPrefix(text[i:], "--"):
+			i = skipLineComment(text, i)
+		case strings.HasPrefix(text[i:], "/*"):
+			i = skipBlockComment(text, i)
+		default:
+			builder.WriteByte(text[i])
+		}
+	}
+	return builder.String()
+}
+
+func firstKeyword(statement string) string {
+	trimmed := strings.TrimLeft(stripComments(statement), " \t\r\n(")
+	end := strings.IndexFunc(trimmed, func(r rune) bool {
+		return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if end < 0 {
+		end = len(trimmed)
+	}
+	return strings.ToUpper(trimmed[:end])
+}
+
+// Scan reads up to maxRows rows, converting values so they encode as JSON
+// and CSV. The result is truncated when rows has more.
+func Scan(rows *sql.Rows, maxRows int) (spanstore.SQLResult, error) {
+	if maxRows <= 0 {
+		maxRows = DefaultMaxRows
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return spanstore.SQLResult{}, fmt.Errorf("read columns: %w", err)
+	}
+	result := spanstore.SQLResult{Columns: columns, Rows: [][]any{}}
+	for rows.Next() {
+		if len(result.Rows) == maxRows {
+			result.Truncated = true
+			break
+		}
+		values := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return spanstore.SQLResult{}, fmt.Errorf("scan row: %w", err)
+		}
+		for i, value := range values {
+			values[i] = Normalize(value)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return spanstore.SQLResult{}, err
+	}
+	return result, nil
+}
+
+// Normalize converts a driver value into one encoding/json accepts: bytes
+// become text (hex when not UTF-8), map keys become strings, and non-finite
+// floats and other driver types become their string form.
+func Normalize(value any) any {
+	switch v := value.(type) {
+	case nil, bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return v
+	case float32:
+		return Normalize(float64(v))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprint(v)
+		}
+		return v
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return hex.EncodeToString(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []any:
+		result := make([]any, len(v))
+		for i, item := range v {
+			result[i] = Normalize(item)
+		}
+		return result
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			result[key] = Normalize(item)
+		}
+		return result
+	case map[any]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = Normalize(item)
+		}
+		return result
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
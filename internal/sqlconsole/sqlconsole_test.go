@@ -0,0 +1,67 @@
+package sqlconsole
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"smelldeadfish/internal/spanstore"
+)
+
+func TestCheckAcceptsSingleSelect(t *testing.T) {
+	cases := map[string]string{
+		"SELECT 1":                                        "SELECT 1",
+		"  select * from spans;  ":                        "select * from spans",
+		"-- count\nSELECT COUNT(*) FROM spans;;":          "-- count\nSELECT COUNT(*) FROM spans",
+		"/* lead */ WITH x AS (SELECT 1) SELECT * FROM x": "/* lead */ WITH x AS (SELECT 1) SELECT * FROM x",
+		"(SELECT 1) UNION (SELECT 2)":                     "(SELECT 1) UNION (SELECT 2)",
+		"VALUES (1, 'a;b')":                               "VALUES (1, 'a;b')",
+		"SELECT 'it''s; fine', \"a;b\" FROM spans -- ;":   "SELECT 'it''s; fine', \"a;b\" FROM spans -- ;",
+		"SELECT 1; -- trailing comment":                   "SELECT 1",
+	}
+	for query, want := range cases {
+		got, err := Check(query)
+		if err != nil {
+			t.Fatalf("check %q: %v", query, err)
+		}
+		if got != want {
+			t.Fatalf("check %q: expected %q, got %q", query, want, got)
+		}
+	}
+}
+
+func TestCheckRejectsOtherStatements(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"  ;",
+		"-- only a comment",
+		"DELETE FROM spans",
+		"PRAGMA query_only = 0",
+		"ATTACH 'other.db' AS other",
+		"SELECT 1; DROP TABLE spans",
+		"SELECT 1 /* ; */; SELECT 2",
+		"selectx 1",
+	} {
+		if _, err := Check(query); !errors.Is(err, spanstore.ErrSQLNotAllowed) {
+			t.Fatalf("expected %q to be rejected, got %v", query, err)
+		}
+	}
+}
+
+func TestNormalizeProducesJSON(t *testing.T) {
+	value := Normalize([]any{
+		[]byte("text"),
+		[]byte{0xff, 0x00},
+		math.NaN(),
+		float32(1.5),
+		map[any]any{1: []byte("one")},
+	})
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if want := `["text","ff00","NaN",1.5,{"1":"one"}]`; string(encoded) != want {
+		t.Fatalf("expected %s, got %s", want, encoded)
+	}
+}